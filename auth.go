@@ -0,0 +1,217 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linksmart/go-sec/auth/obtainer"
+	"github.com/linksmart/go-sec/auth/validator"
+	"github.com/linksmart/go-sec/authz"
+	"github.com/linksmart/service-catalog/v3/catalog"
+)
+
+const (
+	// basicClientTTL is the time after which the client of Basic auth credentials is created again
+	basicClientTTL = 10 * time.Minute
+	// maxBasicClients is the number of clients of Basic auth credentials which are cached
+	maxBasicClients = 1000
+)
+
+// authHandler authenticates and authorizes each request, and passes the authenticated user to the catalog
+// It replaces the handler of the validator, which does not pass on the user profile, so that each token is
+// validated once per request.
+type authHandler struct {
+	conf      ValidatorConf
+	validator *validator.Validator
+	// authz is the optional authorization
+	authz *authz.Conf
+
+	sync.Mutex
+	// cached clients for Basic auth by the hash of the credentials
+	clients map[[sha256.Size]byte]*basicClient
+}
+
+// basicClient obtains the tokens of Basic auth credentials until it expires
+type basicClient struct {
+	client  *obtainer.Client
+	expires time.Time
+}
+
+func newAuthHandler(conf ValidatorConf, v *validator.Validator, authzConf *authz.Conf) *authHandler {
+	return &authHandler{
+		conf:      conf,
+		validator: v,
+		authz:     authzConf,
+		clients:   make(map[[sha256.Size]byte]*basicClient),
+	}
+}
+
+func (h *authHandler) Handler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		profile, statuscode, err := h.authenticate(r)
+		if err != nil {
+			authErrorResponse(w, statuscode, err.Error())
+			return
+		}
+
+		if profile == nil {
+			if h.authz == nil || !h.authz.Authorized(r.URL.Path, r.Method, "", []string{"anonymous"}) {
+				authErrorResponse(w, http.StatusUnauthorized, "Unauthorized request.")
+				return
+			}
+			// Anonymous access, proceed to the next handler
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if h.authz != nil && !h.authz.Authorized(r.URL.Path, r.Method, profile.Username, profile.Groups) {
+			authErrorResponse(w, http.StatusForbidden,
+				fmt.Sprintf("Access denied for user `%s` member of %s", profile.Username, profile.Groups))
+			return
+		}
+		r = catalog.WithPrincipal(r, &catalog.Principal{User: profile.Username, Groups: profile.Groups})
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// authenticate returns the profile of the user of the request, or nil for anonymous requests
+func (h *authHandler) authenticate(r *http.Request) (*validator.UserProfile, int, error) {
+	// DEPRECATED: Use Authorization field instead.
+	if token := r.Header.Get("X-Auth-Token"); token != "" {
+		return h.validate(token)
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return nil, http.StatusOK, nil
+	}
+	parts := strings.SplitN(authorization, " ", 2)
+	if len(parts) != 2 {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid format for Authorization header field.")
+	}
+	switch {
+	case parts[0] == "Bearer":
+		return h.validate(parts[1])
+	case parts[0] == "Basic" && h.conf.BasicEnabled:
+		return h.basicAuth(parts[1])
+	}
+	return nil, http.StatusUnauthorized, fmt.Errorf("Unsupported Authorization method: %s", parts[0])
+}
+
+// validate returns the profile of the user of a valid token
+func (h *authHandler) validate(token string) (*validator.UserProfile, int, error) {
+	valid, profile, err := h.validator.Validate(token)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Authentication server error: %s", err)
+	}
+	if !valid {
+		if profile != nil && profile.Status != "" {
+			return nil, http.StatusUnauthorized, fmt.Errorf("Unauthorized request: %s", profile.Status)
+		}
+		return nil, http.StatusUnauthorized, fmt.Errorf("Unauthorized request")
+	}
+	return profile, http.StatusOK, nil
+}
+
+// basicAuth returns the profile of the user of Basic auth credentials
+// The token of the credentials is cached by their client and is only renewed if it is no longer valid.
+func (h *authHandler) basicAuth(credentials string) (*validator.UserProfile, int, error) {
+	client, statuscode, err := h.basicClient(credentials)
+	if err != nil {
+		return nil, statuscode, err
+	}
+
+	token, err := client.Obtain()
+	if err != nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("Basic Auth: Unable to obtain ticket: %s", err)
+	}
+	valid, profile, err := h.validator.Validate(token)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Basic Auth: Validation error: %s", err)
+	}
+	if valid {
+		return profile, http.StatusOK, nil
+	}
+
+	token, err = client.Renew()
+	if err != nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("Basic Auth: Unable to renew ticket: %s", err)
+	}
+	return h.validate(token)
+}
+
+// basicClient returns the cached client of Basic auth credentials, or creates one
+func (h *authHandler) basicClient(credentials string) (*obtainer.Client, int, error) {
+	key := sha256.Sum256([]byte(credentials))
+	now := time.Now()
+
+	h.Lock()
+	defer h.Unlock()
+
+	if c, found := h.clients[key]; found && now.Before(c.expires) {
+		return c.client, http.StatusOK, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Basic Auth: Invalid value: %s", err)
+	}
+	pair := strings.SplitN(string(b), ":", 2)
+	if len(pair) != 2 {
+		return nil, http.StatusBadRequest, fmt.Errorf("Basic Auth: Invalid value")
+	}
+	client, err := obtainer.NewClient(h.conf.Provider, h.conf.ProviderURL, pair[0], pair[1], h.conf.ServiceID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Basic Auth: Unable to create client for token generation: %s", err)
+	}
+
+	if len(h.clients) >= maxBasicClients {
+		h.evictClients(now)
+	}
+	h.clients[key] = &basicClient{client: client, expires: now.Add(basicClientTTL)}
+	return client, http.StatusOK, nil
+}
+
+// evictClients removes the expired clients, or the one which expires first if none has expired
+// The caller must hold the lock.
+func (h *authHandler) evictClients(now time.Time) {
+	var first [sha256.Size]byte
+	var firstExpires time.Time
+	for key, c := range h.clients {
+		if !now.Before(c.expires) {
+			delete(h.clients, key)
+			continue
+		}
+		if firstExpires.IsZero() || c.expires.Before(firstExpires) {
+			first, firstExpires = key, c.expires
+		}
+	}
+	if len(h.clients) >= maxBasicClients {
+		delete(h.clients, first)
+	}
+}
+
+// authErrorResponse writes an error in the format of the validator
+func authErrorResponse(w http.ResponseWriter, code int, msg string) {
+	if code >= 500 {
+		logger.Printf("ERROR %s: %s", http.StatusText(code), msg)
+	} else {
+		logger.Printf("%s: %s", http.StatusText(code), msg)
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"code":    code,
+		"message": msg,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
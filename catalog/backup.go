@@ -0,0 +1,323 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Restore modes
+const (
+	RestoreModeMerge   = "merge"   // add or overwrite the services in the backup and keep the others
+	RestoreModeReplace = "replace" // make the catalog identical to the backup
+
+	backupFilePrefix   = "backup-"
+	backupFileSuffix   = ".ndjson"
+	backupFileTimeForm = "20060102T150405Z"
+	backupContentType  = "application/x-ndjson"
+)
+
+// BackupConf is the configuration of periodic backups
+type BackupConf struct {
+	// Dir is the directory of backup files. Periodic backups are disabled if empty.
+	Dir string `json:"dir"`
+	// Interval is the time between backups in seconds
+	Interval uint `json:"interval"`
+	// Retain is the number of backup files to keep. All files are kept if zero.
+	Retain int `json:"retain"`
+}
+
+func (c BackupConf) Validate() error {
+	if c.Dir == "" {
+		return nil
+	}
+	if c.Interval == 0 {
+		return fmt.Errorf("backup: interval not defined")
+	}
+	if c.Retain < 0 {
+		return fmt.Errorf("backup: retain must not be negative")
+	}
+	return nil
+}
+
+// ForNamespace returns the configuration of the backups of a namespace, which are written to namespaces/<namespace> in the directory
+func (c BackupConf) ForNamespace(namespace string) BackupConf {
+	if c.Dir != "" {
+		c.Dir = filepath.Join(c.Dir, "namespaces", namespace)
+	}
+	return c
+}
+
+// snapshot takes a consistent snapshot of the catalog
+// The lock is only held while the storage creates the snapshot.
+func (c *Controller) snapshot() (snapshot, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.storage.snapshot()
+}
+
+// backup takes a consistent snapshot of the catalog for a backup requested by the actor
+// The backup has the services of all owners and is limited to the admins, and to the admin token if tokens are enabled.
+func (c *Controller) backup(by actor) (snapshot, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if err := c.authorizeAdmin(by); err != nil {
+		return nil, err
+	}
+	if err := c.checkAdminToken(by); err != nil {
+		return nil, err
+	}
+	return c.storage.snapshot()
+}
+
+// restore adds or overwrites the given services, keeping their timestamps and owners.
+// In replace mode, the services which are not given are removed. Either the whole backup is restored or nothing.
+// Restoring affects the services of all owners and is limited to the admins, and to the admin token if tokens are enabled.
+func (c *Controller) restore(services []Service, mode string, by actor) (*ImportResult, error) {
+	if mode != RestoreModeMerge && mode != RestoreModeReplace {
+		return nil, &BadRequestError{fmt.Sprintf("unknown restore mode: %s", mode)}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err := c.authorizeAdmin(by); err != nil {
+		return nil, err
+	}
+	if err := c.checkAdminToken(by); err != nil {
+		return nil, err
+	}
+
+	var removed []Service
+	if mode == RestoreModeReplace {
+		restored := make(map[string]bool, len(services))
+		for i := range services {
+			restored[services[i].ID] = true
+		}
+		for s := range c.storage.iterator() {
+			if !restored[s.ID] {
+				removed = append(removed, *s)
+			}
+		}
+	}
+
+	// the backup is restored in a single transaction, so that a failure leaves the catalog unchanged
+	var result ImportResult
+	err := c.transact(func(tx *txn) error {
+		result = ImportResult{}
+		for i := range removed {
+			err := tx.delete(removed[i].ID)
+			if err != nil {
+				return err
+			}
+			err = c.notifyDeleted(tx, removed[i], actor{origin: OriginRestore})
+			if err != nil {
+				return err
+			}
+			result.Deleted++
+		}
+
+		for i := range services {
+			s := services[i]
+			err := tx.add(&s)
+			if err == nil {
+				err = c.notifyAdded(tx, s, actor{origin: OriginRestore})
+				if err != nil {
+					return err
+				}
+				result.Added++
+				continue
+			} else if _, conflict := err.(*ConflictError); !conflict {
+				return err
+			}
+
+			err = tx.update(&s)
+			if err != nil {
+				return err
+			}
+			err = c.notifyUpdated(tx, s, actor{origin: OriginRestore})
+			if err != nil {
+				return err
+			}
+			result.Overwritten++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Backup streams a snapshot of the catalog as newline-delimited JSON (NDJSON)
+func (a *HttpAPI) Backup(w http.ResponseWriter, req *http.Request) {
+	snapshot, err := a.controller.backup(requestActor(req))
+	if err != nil {
+		switch err.(type) {
+		case *ForbiddenError:
+			a.ErrorResponse(w, http.StatusForbidden, err.Error())
+		case *UnauthorizedError:
+			a.ErrorResponse(w, http.StatusUnauthorized, err.Error())
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error creating the snapshot:", err.Error())
+		}
+		return
+	}
+	defer snapshot.release()
+
+	w.Header().Set("Content-Type", backupContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", backupFileName(time.Now())))
+	n, err := writeSnapshot(snapshot, w)
+	if err != nil {
+		// the status is already sent
+		logger.Printf("Backup: Error writing the snapshot after %d services: %s", n, err)
+	}
+}
+
+// Restore loads a backup into the catalog
+// The mode query parameter is either merge (default) or replace.
+func (a *HttpAPI) Restore(w http.ResponseWriter, req *http.Request) {
+	mode := req.URL.Query().Get("mode")
+	if mode == "" {
+		mode = RestoreModeMerge
+	}
+
+	services, err := readDump(req.Body, true)
+	if err != nil {
+		switch err.(type) {
+		case *BadRequestError:
+			a.ErrorResponse(w, http.StatusBadRequest, "Invalid backup:", err.Error())
+		default:
+			a.ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
+		}
+		return
+	}
+
+	result, err := a.controller.restore(services, mode, requestActor(req))
+	if err != nil {
+		switch err.(type) {
+		case *BadRequestError:
+			a.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		case *ForbiddenError:
+			a.ErrorResponse(w, http.StatusForbidden, err.Error())
+		case *UnauthorizedError:
+			a.ErrorResponse(w, http.StatusUnauthorized, err.Error())
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error restoring the backup:", err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(result)
+}
+
+// StartBackups periodically writes the catalog to backup files in the configured directory
+func StartBackups(controller *Controller, conf BackupConf) {
+	if conf.Dir == "" {
+		return
+	}
+
+	err := os.MkdirAll(conf.Dir, 0755)
+	if err != nil {
+		logger.Printf("Backup: Error creating the directory: %s", err)
+		return
+	}
+	logger.Printf("Backup: Writing backups to %s every %ds", conf.Dir, conf.Interval)
+
+	for t := range time.Tick(time.Duration(conf.Interval) * time.Second) {
+		path, n, err := controller.writeBackupFile(conf.Dir, t)
+		if err != nil {
+			logger.Printf("Backup: Error writing %s: %s", path, err)
+			continue
+		}
+		logger.Printf("Backup: Wrote %d services to %s", n, path)
+
+		err = removeOldBackups(conf.Dir, conf.Retain)
+		if err != nil {
+			logger.Printf("Backup: Error removing old backups: %s", err)
+		}
+	}
+}
+
+// writeBackupFile writes a snapshot to a new file in dir
+// The file is written under a temporary name and renamed once complete.
+func (c *Controller) writeBackupFile(dir string, t time.Time) (string, int, error) {
+	path := filepath.Join(dir, backupFileName(t))
+
+	snapshot, err := c.snapshot()
+	if err != nil {
+		return path, 0, err
+	}
+	defer snapshot.release()
+
+	f, err := ioutil.TempFile(dir, ".tmp-"+backupFilePrefix)
+	if err != nil {
+		return path, 0, err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	n, err := writeSnapshot(snapshot, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return path, n, err
+	}
+
+	return path, n, os.Rename(f.Name(), path)
+}
+
+// removeOldBackups removes the oldest backup files in dir and keeps the given number of files
+func removeOldBackups(dir string, retain int) error {
+	if retain == 0 {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), backupFilePrefix) && strings.HasSuffix(f.Name(), backupFileSuffix) {
+			backups = append(backups, f.Name())
+		}
+	}
+	if len(backups) <= retain {
+		return nil
+	}
+
+	// the names are ordered by time
+	sort.Strings(backups)
+	for _, name := range backups[:len(backups)-retain] {
+		err = os.Remove(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		logger.Printf("Backup: Removed %s", name)
+	}
+	return nil
+}
+
+func backupFileName(t time.Time) string {
+	return backupFilePrefix + t.UTC().Format(backupFileTimeForm) + backupFileSuffix
+}
@@ -0,0 +1,311 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Operations of a batch
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// Modes of a batch
+const (
+	// BatchAtomic applies either all operations or none of them
+	BatchAtomic = "atomic"
+	// BatchBestEffort applies each operation independently of the others
+	BatchBestEffort = "bestEffort"
+)
+
+// MaxBatchSize is the maximum number of operations in a batch
+const MaxBatchSize = 1000
+
+// Batch is a list of operations applied in order
+type Batch struct {
+	// Mode is either atomic or bestEffort. Defaults to atomic.
+	Mode       string           `json:"mode"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation creates, updates, or deletes a service
+type BatchOperation struct {
+	Op string `json:"op"`
+	// ID is the id of the service. It is optional for create, which otherwise takes the id of the service or generates one.
+	ID string `json:"id,omitempty"`
+	// IfMatch is the entity tag the service must match for update and delete, as in the If-Match header
+	IfMatch string `json:"ifMatch,omitempty"`
+	// Token is the registration token of the service for update and delete, instead of the one in the header of the request
+	Token string `json:"token,omitempty"`
+	// Service is the registration for create and update
+	Service *Service `json:"service,omitempty"`
+}
+
+// BatchResult is the result of a batch with the results of its operations in order
+type BatchResult struct {
+	Mode      string            `json:"mode"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+// BatchItemResult is the result of an operation
+// The status is the code of the response to the equivalent request, e.g. 201 for a created service.
+type BatchItemResult struct {
+	Op      string   `json:"op"`
+	ID      string   `json:"id,omitempty"`
+	Status  int      `json:"status"`
+	Error   string   `json:"error,omitempty"`
+	Service *Service `json:"service,omitempty"`
+}
+
+func (b Batch) validate() error {
+	switch b.Mode {
+	case "", BatchAtomic, BatchBestEffort:
+	default:
+		return fmt.Errorf("unknown mode: %s", b.Mode)
+	}
+	if len(b.Operations) == 0 {
+		return fmt.Errorf("no operations")
+	}
+	if len(b.Operations) > MaxBatchSize {
+		return fmt.Errorf("more than %d operations", MaxBatchSize)
+	}
+	return nil
+}
+
+// batchChange is an applied operation of a batch
+type batchChange struct {
+	status  int
+	service *Service
+}
+
+// batch applies the operations of a batch in order while holding the lock
+// In atomic mode, all operations are committed in one transaction, which is dropped after a failed operation, and the
+// listeners are only notified if all operations succeed. In best-effort mode, each operation is committed on its own.
+func (c *Controller) batch(b Batch, by actor) BatchResult {
+	if b.Mode == "" {
+		b.Mode = BatchAtomic
+	}
+	result := BatchResult{Mode: b.Mode, Results: make([]BatchItemResult, len(b.Operations))}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if b.Mode == BatchBestEffort {
+		for i, op := range b.Operations {
+			r := &result.Results[i]
+			r.Op, r.ID = op.Op, op.ID
+
+			var change *batchChange
+			err := c.transact(func(tx *txn) error {
+				var err error
+				change, err = c.applyBatchOperation(tx, op, by)
+				return err
+			})
+			if err != nil {
+				r.Status, r.Error = batchErrorResponse(err)
+				result.Failed++
+				continue
+			}
+			r.setChange(change)
+			result.Succeeded++
+		}
+		return result
+	}
+
+	failed := -1
+	err := c.transact(func(tx *txn) error {
+		failed = -1
+		result.Results = make([]BatchItemResult, len(b.Operations))
+		for i, op := range b.Operations {
+			r := &result.Results[i]
+			r.Op, r.ID = op.Op, op.ID
+
+			change, err := c.applyBatchOperation(tx, op, by)
+			if err != nil {
+				failed = i
+				return err
+			}
+			r.setChange(change)
+		}
+		return nil
+	})
+	if err == nil {
+		result.Succeeded = len(result.Results)
+		return result
+	}
+
+	if failed == -1 {
+		// none of the operations is applied
+		status, message := batchErrorResponse(err)
+		for i := range result.Results {
+			r := &result.Results[i]
+			r.Status, r.Error, r.Service = status, message, nil
+		}
+	} else {
+		for i := range result.Results {
+			r := &result.Results[i]
+			if i == failed {
+				r.Status, r.Error = batchErrorResponse(err)
+				r.Service = nil
+				continue
+			}
+			r.Status = http.StatusFailedDependency
+			r.Error = fmt.Sprintf("Not applied due to the failure of operation %d", failed)
+			r.Service = nil
+		}
+	}
+	result.Failed = len(result.Results)
+	return result
+}
+
+// setChange sets the result of an applied operation
+func (r *BatchItemResult) setChange(change *batchChange) {
+	r.Status, r.Service = change.status, change.service
+	if change.service != nil {
+		r.ID = change.service.ID
+	}
+}
+
+// applyBatchOperation applies an operation in the transaction
+// The caller must hold the lock.
+func (c *Controller) applyBatchOperation(tx *txn, op BatchOperation, by actor) (*batchChange, error) {
+	if op.Token != "" {
+		by.token = op.Token
+	}
+	switch op.Op {
+	case BatchCreate:
+		if op.Service == nil {
+			return nil, &BadRequestError{"Missing service"}
+		}
+		s := *op.Service
+		if op.ID != "" {
+			if s.ID != "" && s.ID != op.ID {
+				return nil, &ConflictError{"Mismatching IDs in the operation and the service"}
+			}
+			s.ID = op.ID
+		}
+		return c.createBatchService(tx, s, by)
+
+	case BatchUpdate:
+		if op.Service == nil {
+			return nil, &BadRequestError{"Missing service"}
+		}
+		s := *op.Service
+		id := op.ID
+		if id == "" {
+			id = s.ID
+		}
+		if id == "" {
+			return nil, &BadRequestError{"Missing id"}
+		}
+		if s.ID != "" && s.ID != id {
+			return nil, &ConflictError{"Mismatching IDs in the operation and the service"}
+		}
+		if err := validateRegistration(&s); err != nil {
+			return nil, err
+		}
+		ss, err := c.getModifiable(tx, id, op.IfMatch, by)
+		if _, notFound := err.(*NotFoundError); notFound {
+			// Create a new service with the given id, as with PUT
+			s.ID = id
+			return c.createBatchService(tx, s, by)
+		} else if err != nil {
+			return nil, err
+		}
+		updated, err := c.replace(tx, ss, s, by)
+		if err != nil {
+			return nil, err
+		}
+		return &batchChange{status: http.StatusOK, service: updated}, nil
+
+	case BatchDelete:
+		if op.ID == "" {
+			return nil, &BadRequestError{"Missing id"}
+		}
+		old, err := c.getModifiable(tx, op.ID, op.IfMatch, by)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.delete(op.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.notifyDeleted(tx, *old, by); err != nil {
+			return nil, err
+		}
+		return &batchChange{status: http.StatusOK}, nil
+
+	default:
+		return nil, &BadRequestError{fmt.Sprintf("Unknown operation: %s", op.Op)}
+	}
+}
+
+// createBatchService creates a service for a create or update operation
+// The caller must hold the lock.
+func (c *Controller) createBatchService(tx *txn, s Service, by actor) (*batchChange, error) {
+	if err := validateRegistration(&s); err != nil {
+		return nil, err
+	}
+	added, token, err := c.create(tx, s, by)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.notifyAdded(tx, *added, by); err != nil {
+		return nil, err
+	}
+
+	// the token is returned only to the creator
+	created := *added
+	created.Token = token
+	return &batchChange{status: http.StatusCreated, service: &created}, nil
+}
+
+// batchErrorResponse returns the status code and message of a failed operation, as in the response to the equivalent request
+func batchErrorResponse(err error) (int, string) {
+	switch err.(type) {
+	case *NotFoundError:
+		return http.StatusNotFound, err.Error()
+	case *ConflictError:
+		return http.StatusConflict, "Error applying the operation: " + err.Error()
+	case *PreconditionFailedError:
+		return http.StatusPreconditionFailed, "Error applying the operation: " + err.Error()
+	case *ForbiddenError:
+		return http.StatusForbidden, "Error applying the operation: " + err.Error()
+	case *BadRequestError:
+		return http.StatusBadRequest, "Invalid service registration: " + err.Error()
+	default:
+		return http.StatusInternalServerError, "Error applying the operation: " + err.Error()
+	}
+}
+
+// Batch applies a list of create, update, and delete operations
+// The response is 200 OK if the batch is valid, with the status of each operation in the results.
+func (a *HttpAPI) Batch(w http.ResponseWriter, req *http.Request) {
+	var b Batch
+	err := json.NewDecoder(req.Body).Decode(&b)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
+		return
+	}
+	if err := b.validate(); err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Invalid batch:", err.Error())
+		return
+	}
+
+	result := a.controller.batch(b, requestActor(req))
+	for _, r := range result.Results {
+		if r.Status == http.StatusInternalServerError {
+			logger.Println("ERROR:", r.Error)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,134 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	events := make(eventListener, 10)
+	controller.AddListener(events)
+
+	existing, err := controller.add(Service{ID: "existing", Type: "_test._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	<-events
+
+	expectStatuses := func(result BatchResult, statuses ...int) {
+		if len(result.Results) != len(statuses) {
+			t.Fatalf("Expected %d results, got: %+v", len(statuses), result)
+		}
+		for i, status := range statuses {
+			if result.Results[i].Status != status {
+				t.Fatalf("Expected status %d for operation %d, got: %+v", status, i, result.Results[i])
+			}
+		}
+	}
+
+	// atomic: a failed operation reverts the applied ones
+	result := controller.batch(Batch{Operations: []BatchOperation{
+		{Op: BatchCreate, Service: &Service{ID: "created", Type: "_test._tcp", TTL: 30}},
+		{Op: BatchUpdate, ID: existing.ID, Service: &Service{Type: "_updated._tcp", TTL: 30}},
+		{Op: BatchDelete, ID: existing.ID},
+		{Op: BatchCreate, Service: &Service{ID: existing.ID, Type: "_test._tcp", TTL: 30}},
+		{Op: BatchDelete, ID: "missing"},
+	}}, actor{})
+	expectStatuses(result, http.StatusFailedDependency, http.StatusFailedDependency, http.StatusFailedDependency,
+		http.StatusFailedDependency, http.StatusNotFound)
+	if result.Mode != BatchAtomic || result.Succeeded != 0 || result.Failed != 5 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	if _, err := controller.get("created"); err == nil {
+		t.Fatal("Created service was not reverted")
+	}
+	s, err := controller.get(existing.ID)
+	if err != nil {
+		t.Fatalf("Deleted service was not reverted: %s", err)
+	}
+	if s.Type != existing.Type || s.Revision != existing.Revision {
+		t.Fatalf("Updated service was not reverted: %+v", s)
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("Unexpected event of a reverted batch: %s", e)
+	default:
+	}
+
+	// atomic success
+	result = controller.batch(Batch{Mode: BatchAtomic, Operations: []BatchOperation{
+		{Op: BatchCreate, Service: &Service{Type: "_test._tcp", TTL: 30}},
+		{Op: BatchUpdate, ID: existing.ID, IfMatch: existing.ETag(), Service: &Service{Type: "_updated._tcp", TTL: 30}},
+		{Op: BatchUpdate, ID: "upserted", Service: &Service{Type: "_test._tcp", TTL: 30}},
+	}}, actor{})
+	expectStatuses(result, http.StatusCreated, http.StatusOK, http.StatusCreated)
+	if result.Results[0].ID == "" || result.Results[1].Service.Revision != 2 || result.Results[2].ID != "upserted" {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	for _, e := range []string{"added " + result.Results[0].ID, "updated " + existing.ID, "added upserted"} {
+		if received := <-events; received != e {
+			t.Fatalf("Expected event %s, got %s", e, received)
+		}
+	}
+
+	// best effort: the failed operations do not affect the others
+	result = controller.batch(Batch{Mode: BatchBestEffort, Operations: []BatchOperation{
+		{Op: BatchUpdate, ID: existing.ID, IfMatch: existing.ETag(), Service: &Service{Type: "_test._tcp", TTL: 30}},
+		{Op: BatchCreate, Service: &Service{Type: "_test._tcp"}},
+		{Op: BatchCreate, ID: "a", Service: &Service{ID: "b", Type: "_test._tcp", TTL: 30}},
+		{Op: "replace", ID: existing.ID},
+		{Op: BatchDelete, ID: existing.ID},
+	}}, actor{})
+	expectStatuses(result, http.StatusPreconditionFailed, http.StatusBadRequest, http.StatusConflict,
+		http.StatusBadRequest, http.StatusOK)
+	if result.Succeeded != 1 || result.Failed != 4 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	if received := <-events; received != "deleted "+existing.ID {
+		t.Fatalf("Expected event deleted %s, got %s", existing.ID, received)
+	}
+}
+
+func TestBatchHTTP(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	api := NewHTTPAPI(controller, "test", "Test catalog", "MAJOR.MINOR.PATCH")
+
+	for body, code := range map[string]int{
+		`{"operations":[{"op":"create","service":{"type":"_test._tcp","ttl":30}}]}`:                    http.StatusOK,
+		`{"mode":"bestEffort","operations":[{"op":"delete","id":"missing"}]}`:                          http.StatusOK,
+		`{"mode":"sometimes","operations":[{"op":"create","service":{"type":"_test._tcp","ttl":30}}]}`: http.StatusBadRequest,
+		`{"operations":[]}`: http.StatusBadRequest,
+		`[]`:                http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		api.Batch(w, httptest.NewRequest("POST", "/batch", bytes.NewBufferString(body)))
+		if w.Code != code {
+			t.Fatalf("Expected %d for %s, got %d: %s", code, body, w.Code, w.Body.String())
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		var result BatchResult
+		err = json.NewDecoder(w.Body).Decode(&result)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(result.Results) != 1 || result.Succeeded+result.Failed != 1 {
+			t.Fatalf("Unexpected result for %s: %+v", body, result)
+		}
+	}
+}
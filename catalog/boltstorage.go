@@ -0,0 +1,580 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/linksmart/service-catalog/v3/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltOpenTimeout   = 5 * time.Second
+	boltIteratorBatch = 100
+)
+
+var (
+	boltServicesBucket = []byte("services")
+	boltIndexBucket    = []byte("index")
+	boltMetaBucket     = []byte("meta")
+	boltRecordsBucket  = []byte("records")
+	boltTotalKey       = []byte("total")
+	boltIndexesKey     = []byte("indexes")
+)
+
+// Bolt storage
+// All services are kept in a single file. Every mutation is performed in one transaction.
+type BoltStorage struct {
+	db      *bolt.DB
+	indexes []string
+}
+
+// NewBoltStorage opens or creates a Bolt storage
+// indexes are the paths to be indexed in addition to the DefaultIndexes
+func NewBoltStorage(dsn string, opts *bolt.Options, indexes ...string) (Storage, error) {
+	url, err := url.Parse(dsn)
+	if err != nil {
+		return &BoltStorage{}, err
+	}
+
+	if opts == nil {
+		opts = &bolt.Options{Timeout: boltOpenTimeout}
+	}
+
+	// Bolt creates the database file but not its parent directories
+	err = os.MkdirAll(filepath.Dir(url.Path), 0755)
+	if err != nil {
+		return &BoltStorage{}, err
+	}
+
+	// Open the database file
+	db, err := bolt.Open(url.Path, 0600, opts)
+	if err != nil {
+		return &BoltStorage{}, err
+	}
+
+	bs := &BoltStorage{db: db, indexes: indexPaths(indexes)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		services, err := tx.CreateBucketIfNotExists(boltServicesBucket)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltRecordsBucket)
+		if err != nil {
+			return err
+		}
+		// initialize the counter for databases created without it
+		if meta.Get(boltTotalKey) == nil {
+			err = meta.Put(boltTotalKey, boltEncodeCount(services.Stats().KeyN))
+			if err != nil {
+				return err
+			}
+		}
+		return bs.ensureIndexes(tx)
+	})
+	if err != nil {
+		db.Close()
+		return &BoltStorage{}, err
+	}
+
+	return bs, nil
+}
+
+// CRUD
+func (bs *BoltStorage) add(s *Service) error {
+	return bs.commit([]write{{Op: writeAdd, ID: s.ID, Service: s}})
+}
+
+// addTx adds a service in a transaction
+func (bs *BoltStorage) addTx(tx *bolt.Tx, s *Service) error {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket(boltServicesBucket)
+	if b.Get([]byte(s.ID)) != nil {
+		return &ConflictError{"Service id is not unique."}
+	}
+
+	err = b.Put([]byte(s.ID), bytes)
+	if err != nil {
+		return err
+	}
+	err = bs.putIndexEntries(tx, s)
+	if err != nil {
+		return err
+	}
+	return boltAddCount(tx, 1)
+}
+
+func (bs *BoltStorage) get(id string) (*Service, error) {
+
+	var s *Service
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		s, err = boltGet(tx.Bucket(boltServicesBucket), id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (bs *BoltStorage) update(id string, s *Service) error {
+	return bs.commit([]write{{Op: writeUpdate, ID: id, Service: s}})
+}
+
+// updateTx replaces a service in a transaction
+func (bs *BoltStorage) updateTx(tx *bolt.Tx, id string, s *Service) error {
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket(boltServicesBucket)
+	old, err := boltGet(b, id)
+	if err != nil {
+		return err
+	}
+
+	err = bs.deleteIndexEntries(tx, old)
+	if err != nil {
+		return err
+	}
+	err = b.Put([]byte(id), bytes)
+	if err != nil {
+		return err
+	}
+	return bs.putIndexEntries(tx, s)
+}
+
+func (bs *BoltStorage) delete(id string) error {
+	return bs.commit([]write{{Op: writeDelete, ID: id}})
+}
+
+// deleteTx removes a service in a transaction
+func (bs *BoltStorage) deleteTx(tx *bolt.Tx, id string) error {
+	b := tx.Bucket(boltServicesBucket)
+	old, err := boltGet(b, id)
+	if err != nil {
+		return err
+	}
+
+	err = b.Delete([]byte(id))
+	if err != nil {
+		return err
+	}
+	err = bs.deleteIndexEntries(tx, old)
+	if err != nil {
+		return err
+	}
+	return boltAddCount(tx, -1)
+}
+
+// commit applies the writes in one transaction, which is rolled back if a write fails
+func (bs *BoltStorage) commit(writes []write) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, w := range writes {
+			var err error
+			switch w.Op {
+			case writeAdd:
+				err = bs.addTx(tx, w.Service)
+			case writeUpdate:
+				err = bs.updateTx(tx, w.ID, w.Service)
+			case writeDelete:
+				err = bs.deleteTx(tx, w.ID)
+			case writePutRecord:
+				err = putRecordTx(tx, w.Record)
+			case writeDeleteRecord:
+				err = tx.Bucket(boltRecordsBucket).Delete([]byte(recordKey(w.Kind, w.ID)))
+			default:
+				err = fmt.Errorf("unknown write operation: %s", w.Op)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *BoltStorage) putRecord(r *record) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return putRecordTx(tx, r)
+	})
+}
+
+// putRecordTx adds or replaces a record in a transaction
+func putRecordTx(tx *bolt.Tx, r *record) error {
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltRecordsBucket).Put([]byte(recordKey(r.Kind, r.ID)), bytes)
+}
+
+func (bs *BoltStorage) deleteRecord(kind, id string) error {
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket)
+		key := []byte(recordKey(kind, id))
+		if b.Get(key) == nil {
+			return &NotFoundError{fmt.Sprintf("Record %s with id %s is not found", kind, id)}
+		}
+		return b.Delete(key)
+	})
+}
+
+func (bs *BoltStorage) getRecord(kind, id string) (*record, error) {
+	var r *record
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltRecordsBucket).Get([]byte(recordKey(kind, id)))
+		if v == nil {
+			return &NotFoundError{fmt.Sprintf("Record %s with id %s is not found", kind, id)}
+		}
+		return json.Unmarshal(v, &r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (bs *BoltStorage) listRecords(kind string) ([]record, error) {
+	var prefix []byte
+	if kind != "" {
+		prefix = []byte(recordKey(kind, ""))
+	}
+
+	records := make([]record, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltRecordsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var r record
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (bs *BoltStorage) listRecordsAfter(kind, after string, limit int) ([]record, error) {
+	prefix := []byte(recordKey(kind, ""))
+	key := []byte(recordKey(kind, after))
+
+	records := make([]record, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltRecordsBucket).Cursor()
+		k, v := c.Seek(key)
+		if k != nil && bytes.Equal(k, key) {
+			k, v = c.Next()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix) && len(records) < limit; k, v = c.Next() {
+			var r record
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Utilities
+
+func (bs *BoltStorage) list(page int, perPage int) ([]Service, int, error) {
+
+	var (
+		services []Service
+		total    int
+	)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		total = boltCount(tx)
+		offset, limit, err := utils.GetPagingAttr(total, page, perPage, MaxPerPage)
+		if err != nil {
+			return &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
+		}
+
+		services = make([]Service, 0, limit)
+		c := tx.Bucket(boltServicesBucket).Cursor()
+		k, v := c.First()
+		// skip to the offset without decoding the values
+		for i := 0; i < offset && k != nil; i++ {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(services) < limit; k, v = c.Next() {
+			var s Service
+			err := json.Unmarshal(v, &s)
+			if err != nil {
+				return err
+			}
+			services = append(services, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return services, total, nil
+}
+
+func (bs *BoltStorage) listAfter(after string, limit int) ([]Service, error) {
+
+	services := make([]Service, 0, limit)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltServicesBucket).Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(services) < limit; k, v = c.Next() {
+			var s Service
+			err := json.Unmarshal(v, &s)
+			if err != nil {
+				return err
+			}
+			services = append(services, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+func (bs *BoltStorage) total() (int, error) {
+	var c int
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c = boltCount(tx)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return c, nil
+}
+
+func (bs *BoltStorage) lookup(path, op, value string) ([]string, bool, error) {
+	if !containsString(bs.indexes, path) {
+		return nil, false, nil
+	}
+	if err := utils.ValidateFilterOp(op); err != nil {
+		return nil, true, err
+	}
+
+	ids := []string{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltIndexBucket).Bucket([]byte(path))
+		if b == nil {
+			return nil
+		}
+
+		prefix := indexScanPrefix(op, value)
+		c := b.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			v, id := splitIndexKey(k)
+			matched, err := utils.MatchValue(v, op, value)
+			if err != nil {
+				return err
+			}
+			if matched {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	sort.Strings(ids)
+
+	return ids, true, nil
+}
+
+func (bs *BoltStorage) iterator() <-chan *Service {
+	serviceIter := make(chan *Service)
+
+	go func() {
+		defer close(serviceIter)
+
+		// Read in batches to avoid holding a transaction while the receiver is busy.
+		// A long-running read transaction would block writers which need to remap the file.
+		var last string
+		for {
+			batch, err := bs.listAfter(last, boltIteratorBatch)
+			if err != nil {
+				logger.Printf("Bolt Error: %s", err)
+				return
+			}
+
+			for i := range batch {
+				serviceIter <- &batch[i]
+			}
+			if len(batch) < boltIteratorBatch {
+				return
+			}
+			last = batch[len(batch)-1].ID
+		}
+	}()
+
+	return serviceIter
+}
+
+func (bs *BoltStorage) snapshot() (snapshot, error) {
+	// Copy the services instead of keeping the read transaction open. See iterator().
+	var services memSnapshot
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		services = make(memSnapshot, 0, boltCount(tx))
+		return tx.Bucket(boltServicesBucket).ForEach(func(k, v []byte) error {
+			var s Service
+			err := json.Unmarshal(v, &s)
+			if err != nil {
+				return err
+			}
+			services = append(services, s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
+
+// Indexing
+
+func (bs *BoltStorage) putIndexEntries(tx *bolt.Tx, s *Service) error {
+	for path, value := range indexValues(s, bs.indexes) {
+		b, err := tx.Bucket(boltIndexBucket).CreateBucketIfNotExists([]byte(path))
+		if err != nil {
+			return err
+		}
+		err = b.Put(indexKey(value, s.ID), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bs *BoltStorage) deleteIndexEntries(tx *bolt.Tx, s *Service) error {
+	for path, value := range indexValues(s, bs.indexes) {
+		b := tx.Bucket(boltIndexBucket).Bucket([]byte(path))
+		if b == nil {
+			continue
+		}
+		err := b.Delete(indexKey(value, s.ID))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureIndexes rebuilds the indexes if the indexed paths differ from the ones stored in the database
+func (bs *BoltStorage) ensureIndexes(tx *bolt.Tx) error {
+	indexes, err := json.Marshal(bs.indexes)
+	if err != nil {
+		return err
+	}
+
+	meta := tx.Bucket(boltMetaBucket)
+	if string(meta.Get(boltIndexesKey)) == string(indexes) && tx.Bucket(boltIndexBucket) != nil {
+		return nil
+	}
+	logger.Printf("Bolt: Building indexes for %s", indexes)
+
+	if tx.Bucket(boltIndexBucket) != nil {
+		err = tx.DeleteBucket(boltIndexBucket)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.CreateBucket(boltIndexBucket)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(boltServicesBucket).ForEach(func(k, v []byte) error {
+		var s Service
+		err := json.Unmarshal(v, &s)
+		if err != nil {
+			return err
+		}
+		return bs.putIndexEntries(tx, &s)
+	})
+	if err != nil {
+		return err
+	}
+
+	return meta.Put(boltIndexesKey, indexes)
+}
+
+func boltGet(b *bolt.Bucket, id string) (*Service, error) {
+	bytes := b.Get([]byte(id))
+	if bytes == nil {
+		return nil, &NotFoundError{fmt.Sprintf("Service with id %s is not found", id)}
+	}
+
+	var s Service
+	err := json.Unmarshal(bytes, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func boltCount(tx *bolt.Tx) int {
+	v := tx.Bucket(boltMetaBucket).Get(boltTotalKey)
+	if v == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+func boltAddCount(tx *bolt.Tx, delta int) error {
+	return tx.Bucket(boltMetaBucket).Put(boltTotalKey, boltEncodeCount(boltCount(tx)+delta))
+}
+
+func boltEncodeCount(c int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(c))
+	return b
+}
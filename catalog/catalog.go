@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"strings"
 	"time"
+	"unicode"
 )
 
 // Structs
@@ -24,7 +25,50 @@ type Service struct {
 	TTL         uint32                 `json:"ttl"`
 	CreatedAt   time.Time              `json:"createdAt"`
 	UpdatedAt   time.Time              `json:"updatedAt"`
-	ExpiresAt   time.Time              `json:"expiresAt"` // the time when service will be removed from the system (unless updated within TTL)
+	ExpiresAt   time.Time              `json:"expiresAt"`        // the time when the service expires (unless renewed or updated within TTL)
+	Revision    uint64                 `json:"revision"`         // incremented on every update of the registration
+	State       string                 `json:"state"`            // active, or expired until the service is removed after the grace period
+	Health      *Health                `json:"health,omitempty"` // the result of the latest health check, if enabled
+	Owner       *Owner                 `json:"owner,omitempty"`  // the authenticated user who created the service, if any
+	Token       string                 `json:"token,omitempty"`  // the registration token, only returned when the service is created
+}
+
+// ETag returns the entity tag of the service's revision and of its latest health check
+// The health checks do not change the revision, which is the part of the tag compared by matchRevision.
+func (s Service) ETag() string {
+	if s.Health == nil {
+		return fmt.Sprintf(`"%d"`, s.Revision)
+	}
+	return fmt.Sprintf(`"%d-%d"`, s.Revision, s.Health.CheckedAt.UnixNano())
+}
+
+// matchETag checks whether the service matches the value of an If-None-Match header
+// The value is either * or a comma-separated list of entity tags. Weak tags are compared by their opaque value.
+func (s Service) matchETag(header string) bool {
+	etag := s.ETag()
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRevision checks whether the revision of the service matches the value of an If-Match header
+// Entity tags are compared by their revision, so that a health check does not fail a conditional update.
+func (s Service) matchRevision(header string) bool {
+	revision := fmt.Sprint(s.Revision)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+		if i := strings.Index(tag, "-"); i != -1 {
+			tag = tag[:i]
+		}
+		if tag == "*" || tag == revision {
+			return true
+		}
+	}
+	return false
 }
 
 // API - an API (e.g. REST API, MQTT API, etc.) exposed by the service
@@ -47,12 +91,37 @@ type Spec struct {
 	Schema    map[string]interface{} `json:"schema"`
 }
 
+// reservedIDPrefixes are the paths of the API endpoints which cannot be the first segment of a service id
+// The routes of these endpoints would hide the services with such ids.
+var reservedIDPrefixes = []string{"admin", "batch", "changes", "cluster", "events", "health", "ns", "subscriptions"}
+
+// reservedIDSuffixes are the sub-resources of a service which cannot be the second segment of a service id
+var reservedIDSuffixes = []string{"history", "owner", "renew"}
+
+// validateID checks that the service id does not collide with the routes of the API, or with the internal keys of the storages
+func validateID(id string) error {
+	if strings.IndexFunc(id, unicode.IsControl) != -1 {
+		return fmt.Errorf("service id must not contain control characters")
+	}
+	segments := strings.SplitN(id, "/", 2)
+	if containsString(reservedIDPrefixes, segments[0]) {
+		return fmt.Errorf("service id must not start with the reserved path %s", segments[0])
+	}
+	if len(segments) == 2 && containsString(reservedIDSuffixes, segments[1]) {
+		return fmt.Errorf("service id must not end with the reserved path %s", segments[1])
+	}
+	return nil
+}
+
 // Validates the Service configuration
 func (s Service) validate() error {
 
 	if strings.ContainsAny(s.ID, " ") {
 		return fmt.Errorf("service id must not contain spaces")
 	}
+	if err := validateID(s.ID); err != nil {
+		return err
+	}
 	_, err := url.Parse("http://example.com/" + s.ID)
 	if err != nil {
 		return fmt.Errorf("service id is invalid: %v", err)
@@ -125,15 +194,46 @@ type Storage interface {
 	update(id string, s *Service) error
 	delete(id string) error
 	list(page, perPage int) ([]Service, int, error)
+	// listAfter returns up to limit services with ids greater than after, ordered by id
+	listAfter(after string, limit int) ([]Service, error)
 	total() (int, error)
+	// lookup returns the sorted ids of services matching the filter using the index of the given path.
+	// It returns false if the path is not indexed.
+	lookup(path, op, value string) ([]string, bool, error)
 	iterator() <-chan *Service
+	// snapshot returns a consistent view of the storage which is not affected by later mutations
+	snapshot() (snapshot, error)
+	// putRecord adds or replaces an internal record
+	putRecord(r *record) error
+	deleteRecord(kind, id string) error
+	// getRecord returns the record of the given kind and id, or a NotFoundError
+	getRecord(kind, id string) (*record, error)
+	// listRecords returns the records of the given kind, or all records if kind is empty, ordered by kind and id
+	listRecords(kind string) ([]record, error)
+	// listRecordsAfter returns up to limit records of the given kind with ids greater than after, ordered by id
+	listRecordsAfter(kind, after string, limit int) ([]record, error)
+	// commit applies the writes atomically and in order, or none of them if one fails
+	commit(writes []write) error
 	Close() error
 }
 
+// snapshot is a read-only view of a storage at a point in time
+type snapshot interface {
+	// listAfter returns up to limit services with ids greater than after, ordered by id
+	listAfter(after string, limit int) ([]Service, error)
+	release()
+}
+
 // Listener interface can be used for notification of the catalog updates
 // NOTE: Implementations are expected to be thread safe
 type Listener interface {
 	added(s Service)
 	updated(s Service)
+	// renewed is called when the expiry of a service is extended without modifying it
+	renewed(s Service)
 	deleted(s Service)
+	// expired is called when a service is flagged as expired. It is called with deleted once the service is removed.
+	expired(s Service)
+	// healthChanged is called when the health status of a service changes
+	healthChanged(s Service)
 }
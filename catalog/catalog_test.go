@@ -51,6 +51,32 @@ func TestValidate(t *testing.T) {
 		t.Fatalf("Failed to invalidate a registration with ID including whitespace")
 	}
 
+	for _, id := range []string{"\x00m\x00total", "id\nwith\nnewlines"} {
+		bad = *s
+		bad.ID = id
+		err = bad.validate()
+		if err == nil {
+			t.Fatalf("Failed to invalidate a registration with the control characters in ID %q", id)
+		}
+	}
+
+	for _, id := range []string{"events", "batch", "admin/backup", "subscriptions/x", "ns/team-a", "foo/history", "x/renew", "x/owner"} {
+		bad = *s
+		bad.ID = id
+		err = bad.validate()
+		if err == nil {
+			t.Fatalf("Failed to invalidate a registration with the reserved ID %s", id)
+		}
+	}
+	for _, id := range []string{"eventsource", "history", "renew/x", "foo/admin"} {
+		ok := *s
+		ok.ID = id
+		err = ok.validate()
+		if err != nil {
+			t.Fatalf("Failed to validate a registration with the ID %s: %s", id, err)
+		}
+	}
+
 	bad = *s
 	bad.Type = ""
 	err = bad.validate()
@@ -0,0 +1,292 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/linksmart/service-catalog/v3/utils"
+)
+
+const (
+	// GetParamSince is the query parameter for the sequence number after which the changes are returned
+	GetParamSince = "since"
+
+	recordKindChange   = "change"
+	recordKindSequence = "sequence"
+	// id of the record which holds the latest sequence number
+	sequenceRecordID = "last"
+
+	defaultChangesSize = 10000
+)
+
+// ChangesConf is the configuration of the change feed
+type ChangesConf struct {
+	// Size is the number of latest changes kept. Defaults to 10000. The change feed is disabled if negative.
+	// The event streams are only resumed after a disconnection while the change feed is enabled.
+	Size int `json:"size"`
+}
+
+func (c ChangesConf) Validate() error {
+	return nil
+}
+
+// withDefaults returns the configuration with the defaults of the unset fields
+func (c ChangesConf) withDefaults() ChangesConf {
+	if c.Size == 0 {
+		c.Size = defaultChangesSize
+	}
+	return c
+}
+
+// Change is a mutation of the catalog with its sequence number
+// Deletions are tombstones which only have the id of the service.
+type Change struct {
+	Seq  uint64    `json:"seq"`
+	Type string    `json:"type"`
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Service is the document after the change, omitted for deletions
+	Service *Service `json:"service,omitempty"`
+}
+
+// ChangeList is a page of changes ordered by sequence number
+type ChangeList struct {
+	Changes []Change `json:"changes"`
+	// Since is the sequence number after which the changes are returned
+	Since uint64 `json:"since"`
+	// Last is the sequence number of the latest change in the catalog
+	Last uint64 `json:"last"`
+	// More is true if the changes after the returned ones are not included in the page
+	More bool `json:"more"`
+}
+
+// changes keeps a bounded log of the mutations in the storage
+// The sequence number is stored as a record, which persists and replicates it together with the services.
+// It is guarded by the lock of the controller.
+type changes struct {
+	conf    ChangesConf
+	storage Storage
+}
+
+// changeRecordID returns the id of the record of a change, which orders the records by sequence number
+func changeRecordID(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// recordReader reads the records of a storage or a transaction
+type recordReader interface {
+	getRecord(kind, id string) (*record, error)
+}
+
+// lastSeq returns the sequence number of the latest change
+func lastSeq(records recordReader) (uint64, error) {
+	r, err := records.getRecord(recordKindSequence, sequenceRecordID)
+	if _, notFound := err.(*NotFoundError); notFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	err = json.Unmarshal(r.Value, &seq)
+	if err != nil {
+		return 0, fmt.Errorf("error decoding the sequence number: %s", err)
+	}
+	return seq, nil
+}
+
+// append writes a change with the next sequence number in the transaction and removes the change which is no longer kept
+// The records are committed together with the mutation, so that the change feed has every committed change exactly once.
+func (ch *changes) append(tx *txn, changeType string, s Service) (*Change, error) {
+	last, err := lastSeq(tx)
+	if err != nil {
+		return nil, err
+	}
+	c := Change{
+		Seq:  last + 1,
+		Type: changeType,
+		ID:   s.ID,
+		Time: time.Now().UTC(),
+	}
+	if changeType != EventDeleted {
+		c.Service = &s
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	seq, _ := json.Marshal(c.Seq)
+	tx.putRecord(&record{Kind: recordKindSequence, ID: sequenceRecordID, Value: seq})
+	tx.putRecord(&record{Kind: recordKindChange, ID: changeRecordID(c.Seq), Value: b})
+	if c.Seq > uint64(ch.conf.Size) {
+		tx.deleteRecord(recordKindChange, changeRecordID(c.Seq-uint64(ch.conf.Size)))
+	}
+	return &c, nil
+}
+
+// prune removes the changes which are no longer kept, e.g. after the size is reduced
+func (ch *changes) prune() error {
+	records, err := ch.storage.listRecords(recordKindChange)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(records)-ch.conf.Size; i++ {
+		err = ch.storage.deleteRecord(recordKindChange, records[i].ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// after returns up to limit changes with sequence numbers greater than since
+// The changes are read from the record of since onwards, rather than decoding all kept changes.
+func (ch *changes) after(since uint64, limit int) (*ChangeList, error) {
+	last, err := lastSeq(ch.storage)
+	if err != nil {
+		return nil, err
+	}
+	if since > last {
+		return nil, &BadRequestError{fmt.Sprintf("%s is after the latest change %d", GetParamSince, last)}
+	}
+	if since < last {
+		_, err := ch.storage.getRecord(recordKindChange, changeRecordID(since+1))
+		if _, notFound := err.(*NotFoundError); notFound {
+			oldest, err := ch.storage.listRecordsAfter(recordKindChange, "", 1)
+			if err != nil {
+				return nil, err
+			}
+			var c Change
+			if len(oldest) > 0 {
+				json.Unmarshal(oldest[0].Value, &c)
+			}
+			return nil, &GoneError{fmt.Sprintf("Changes after %d are no longer kept, the oldest change is %d", since, c.Seq)}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	// fetch one more to find out if there are more changes
+	records, err := ch.storage.listRecordsAfter(recordKindChange, changeRecordID(since), limit+1)
+	if err != nil {
+		return nil, err
+	}
+	list := ChangeList{Changes: []Change{}, Since: since, Last: last}
+	if len(records) > limit {
+		records = records[:limit]
+		list.More = true
+	}
+	for _, r := range records {
+		var c Change
+		err = json.Unmarshal(r.Value, &c)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding change %s: %s", r.ID, err)
+		}
+		list.Changes = append(list.Changes, c)
+	}
+	return &list, nil
+}
+
+// EnableChanges starts keeping the change feed
+func (c *Controller) EnableChanges(conf ChangesConf) error {
+	conf = conf.withDefaults()
+	if conf.Size < 0 {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	ch := &changes{conf: conf, storage: c.storage}
+	err := ch.prune()
+	if err != nil {
+		return fmt.Errorf("error pruning the changes: %s", err)
+	}
+	c.changes = ch
+	return nil
+}
+
+// appendChange adds a mutation to the change feed if it is enabled
+// It returns the change, or nil if the change feed is disabled. The transaction must not be committed after an error,
+// which would leave a gap in the change feed.
+// The caller must hold the lock.
+func (c *Controller) appendChange(tx *txn, changeType string, s Service) (*Change, error) {
+	if c.changes == nil {
+		return nil, nil
+	}
+	change, err := c.changes.append(tx, changeType, s)
+	if err != nil {
+		return nil, fmt.Errorf("error storing the change of service %s: %s", s.ID, err)
+	}
+	return change, nil
+}
+
+// lastChange returns the sequence number of the latest change, or zero if the change feed is disabled
+func (c *Controller) lastChange() (uint64, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.changes == nil {
+		return 0, nil
+	}
+	return lastSeq(c.storage)
+}
+
+// getChanges returns the changes after the given sequence number
+func (c *Controller) getChanges(since uint64, limit int) (*ChangeList, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.changes == nil {
+		return nil, &NotFoundError{"Change feed is not enabled"}
+	}
+	return c.changes.after(since, limit)
+}
+
+// Changes returns the changes of the catalog after a sequence number
+// Clients sync incrementally by requesting the changes after the sequence number of the last change they received.
+func (a *HttpAPI) Changes(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error parsing the query:", err.Error())
+		return
+	}
+	var since uint64
+	if s := req.Form.Get(GetParamSince); s != "" {
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			a.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid value for parameter %s: %s", GetParamSince, s))
+			return
+		}
+	}
+	_, perPage, err := utils.ParsePagingParams("", req.Form.Get(utils.GetParamPerPage), MaxPerPage)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
+		return
+	}
+
+	list, err := a.controller.getChanges(since, perPage)
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			a.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		case *BadRequestError:
+			a.ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		case *GoneError:
+			a.ErrorResponse(w, http.StatusGone, err.Error())
+			return
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error retrieving the changes:", err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(list)
+}
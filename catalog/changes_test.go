@@ -0,0 +1,194 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestChanges(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+
+	_, err = controller.getChanges(0, MaxPerPage)
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError for a disabled change feed, got: %v", err)
+	}
+	err = controller.EnableChanges(ChangesConf{Size: 4})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	list, err := controller.getChanges(0, MaxPerPage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list.Changes) != 0 || list.Last != 0 {
+		t.Fatalf("Unexpected changes of an empty catalog: %+v", list)
+	}
+
+	s, err := controller.add(Service{ID: "service_1", Type: "_test._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s.Description = "updated"
+	_, err = controller.update(s.ID, *s, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// renewals are not changes
+	_, err = controller.renew(s.ID, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = controller.delete(s.ID, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	list, err = controller.getChanges(0, MaxPerPage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if list.Last != 3 || len(list.Changes) != 3 {
+		t.Fatalf("Expected 3 changes, got: %+v", list)
+	}
+	for i, expected := range []string{EventAdded, EventUpdated, EventDeleted} {
+		c := list.Changes[i]
+		if c.Seq != uint64(i+1) || c.Type != expected || c.ID != s.ID {
+			t.Fatalf("Unexpected change %d: %+v", i, c)
+		}
+	}
+	if list.Changes[1].Service == nil || list.Changes[1].Service.Description != "updated" {
+		t.Fatalf("Updates should include the service: %+v", list.Changes[1])
+	}
+	if list.Changes[2].Service != nil {
+		t.Fatalf("Deletions should be tombstones: %+v", list.Changes[2])
+	}
+
+	// paging
+	list, err = controller.getChanges(1, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list.Changes) != 1 || list.Changes[0].Seq != 2 || !list.More {
+		t.Fatalf("Unexpected page: %+v", list)
+	}
+	_, err = controller.getChanges(4, MaxPerPage)
+	if _, ok := err.(*BadRequestError); !ok {
+		t.Fatalf("Expected BadRequestError for a future sequence number, got: %v", err)
+	}
+
+	// only the latest changes are kept
+	for i := 0; i < 3; i++ {
+		_, err = controller.add(Service{ID: fmt.Sprintf("service_%d", i+2), Type: "_test._tcp", TTL: 30}, actor{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	list, err = controller.getChanges(2, MaxPerPage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list.Changes) != 4 || list.Changes[0].Seq != 3 || list.Last != 6 {
+		t.Fatalf("Unexpected changes: %+v", list)
+	}
+	_, err = controller.getChanges(1, MaxPerPage)
+	if _, ok := err.(*GoneError); !ok {
+		t.Fatalf("Expected GoneError for pruned changes, got: %v", err)
+	}
+
+	// the sequence continues after a smaller size is configured
+	err = controller.EnableChanges(ChangesConf{Size: 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = controller.add(Service{ID: "service_5", Type: "_test._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	list, err = controller.getChanges(5, MaxPerPage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(list.Changes) != 2 || list.Changes[1].Seq != 7 || list.Changes[1].ID != "service_5" {
+		t.Fatalf("Unexpected changes: %+v", list)
+	}
+
+	// the size has a default
+	err = controller.EnableChanges(ChangesConf{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if controller.changes.conf.Size != defaultChangesSize {
+		t.Fatalf("Expected the default size, got %d", controller.changes.conf.Size)
+	}
+}
+
+func TestChangesDisabled(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	err = controller.EnableChanges(ChangesConf{Size: -1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if controller.changes != nil {
+		t.Fatal("Change feed should be disabled by a negative size")
+	}
+}
+
+func TestChangesHTTP(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	err = controller.EnableChanges(ChangesConf{Size: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	api := NewHTTPAPI(controller, "test", "Test catalog", "MAJOR.MINOR.PATCH")
+
+	for i := 0; i < 2; i++ {
+		_, err = controller.add(Service{ID: fmt.Sprintf("service_%d", i), Type: "_test._tcp", TTL: 30}, actor{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	for query, code := range map[string]int{
+		"?since=1":            http.StatusOK,
+		"?since=0":            http.StatusGone,
+		"?since=3":            http.StatusBadRequest,
+		"?since=x":            http.StatusBadRequest,
+		"?per_page=1000":      http.StatusBadRequest,
+		"?since=1&per_page=1": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		api.Changes(w, httptest.NewRequest("GET", "/changes"+query, nil))
+		if w.Code != code {
+			t.Fatalf("Expected %d for %s, got %d: %s", code, query, w.Code, w.Body.String())
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		var list ChangeList
+		err = json.NewDecoder(w.Body).Decode(&list)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if list.Since != 1 || list.Last != 2 || len(list.Changes) != 1 || list.Changes[0].Service.ID != "service_1" {
+			t.Fatalf("Unexpected changes for %s: %+v", query, list)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// ClusterPath is the path of the cluster status
+	ClusterPath = "/cluster"
+	// ClusterApplyPath is the path to which the nodes forward mutations to the leader
+	ClusterApplyPath = "/cluster/apply"
+	// ClusterSecretHeader carries the shared secret of the cluster in forwarded requests
+	ClusterSecretHeader = "X-Cluster-Secret"
+)
+
+// ClusterConf is the configuration of the clustered mode
+type ClusterConf struct {
+	Enabled bool `json:"enabled"`
+	// NodeID is the id of this node in Nodes
+	NodeID string `json:"nodeID"`
+	// BindAddr is the address of the Raft transport. Defaults to the address of this node in Nodes.
+	BindAddr string `json:"bindAddr"`
+	// DataDir is the directory of the Raft log and snapshots
+	DataDir string `json:"dataDir"`
+	// Secret authenticates the mutations forwarded among the nodes
+	Secret string        `json:"secret"`
+	Nodes  []ClusterNode `json:"nodes"`
+}
+
+// ClusterNode is a member of the cluster
+type ClusterNode struct {
+	ID string `json:"id"`
+	// Address is the host:port of the Raft transport
+	Address string `json:"address"`
+	// APIURL is the base URL of the HTTP API, to which mutations are forwarded when the node is the leader
+	APIURL string `json:"apiURL"`
+}
+
+func (c ClusterConf) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.DataDir == "" {
+		return fmt.Errorf("cluster: dataDir not defined")
+	}
+	if c.Secret == "" {
+		return fmt.Errorf("cluster: secret not defined")
+	}
+	if len(c.Nodes) == 0 {
+		return fmt.Errorf("cluster: nodes not defined")
+	}
+	ids := make(map[string]bool)
+	for _, node := range c.Nodes {
+		if node.ID == "" || ids[node.ID] {
+			return fmt.Errorf("cluster: node ids must be defined and unique")
+		}
+		ids[node.ID] = true
+		_, _, err := net.SplitHostPort(node.Address)
+		if err != nil {
+			return fmt.Errorf("cluster: invalid address of node %s: %s", node.ID, err)
+		}
+		u, err := url.Parse(node.APIURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("cluster: invalid apiURL of node %s", node.ID)
+		}
+	}
+	if !ids[c.NodeID] {
+		return fmt.Errorf("cluster: nodeID %q is not one of the nodes", c.NodeID)
+	}
+	return nil
+}
+
+func (c ClusterConf) bindAddr() string {
+	if c.BindAddr != "" {
+		return c.BindAddr
+	}
+	node, _ := c.nodeByID(c.NodeID)
+	return node.Address
+}
+
+// node returns the node with the given Raft address
+func (c ClusterConf) node(address string) (ClusterNode, bool) {
+	for _, node := range c.Nodes {
+		if node.Address == address {
+			return node, true
+		}
+	}
+	return ClusterNode{}, false
+}
+
+func (c ClusterConf) nodeByID(id string) (ClusterNode, bool) {
+	for _, node := range c.Nodes {
+		if node.ID == id {
+			return node, true
+		}
+	}
+	return ClusterNode{}, false
+}
+
+// ClusterStatus describes the cluster from the view of a node
+type ClusterStatus struct {
+	NodeID string `json:"nodeID"`
+	State  string `json:"state"`
+	Leader string `json:"leader"`
+	// AppliedIndex is the index of the last mutation applied to the local storage
+	AppliedIndex uint64        `json:"appliedIndex"`
+	Nodes        []ClusterNode `json:"nodes"`
+}
+
+// ClusterStatus returns the status of the cluster
+func (a *HttpAPI) ClusterStatus(w http.ResponseWriter, req *http.Request) {
+	rs, ok := a.controller.storage.(*RaftStorage)
+	if !ok {
+		a.ErrorResponse(w, http.StatusNotFound, "Clustered mode is not enabled")
+		return
+	}
+
+	status := ClusterStatus{
+		NodeID:       rs.conf.NodeID,
+		State:        rs.raft.State().String(),
+		AppliedIndex: rs.raft.AppliedIndex(),
+		Nodes:        rs.conf.Nodes,
+	}
+	if leader, found := rs.conf.node(string(rs.raft.Leader())); found {
+		status.Leader = leader.ID
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(status)
+}
+
+// ClusterApply applies a transaction forwarded by another node to the leader
+// The request is authenticated with the shared secret of the cluster instead of the configured auth provider.
+func (a *HttpAPI) ClusterApply(w http.ResponseWriter, req *http.Request) {
+	rs, ok := a.controller.storage.(*RaftStorage)
+	if !ok {
+		a.ErrorResponse(w, http.StatusNotFound, "Clustered mode is not enabled")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get(ClusterSecretHeader)), []byte(rs.conf.Secret)) != 1 {
+		a.ErrorResponse(w, http.StatusUnauthorized, "Invalid cluster secret")
+		return
+	}
+	if !rs.isLeader() {
+		a.ErrorResponse(w, http.StatusServiceUnavailable, "Node is not the leader")
+		return
+	}
+
+	b, err := readClusterRequest(req.Body)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	index, err := rs.applyLog(b)
+	if stale, ok := err.(*staleError); ok {
+		// the node retries the transaction after it has applied the log up to the index
+		w.Header().Set("Content-Type", "application/json;version="+a.version)
+		json.NewEncoder(w).Encode(raftApplyResult{Index: index, Stale: stale.Error()})
+		return
+	}
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			a.ErrorResponse(w, http.StatusNotFound, err.Error())
+		case *ConflictError:
+			a.ErrorResponse(w, http.StatusConflict, err.Error())
+		case *BadRequestError:
+			a.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error applying the mutation:", err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(raftApplyResult{Index: index})
+}
@@ -0,0 +1,214 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestCluster(t *testing.T) {
+	if TestStorageType != CatalogBackendMemory {
+		t.Skip("The state machine is tested with the memory storage")
+	}
+	dir := fmt.Sprintf("%s/lslc/test-%s.raft", strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4().String())
+	defer os.RemoveAll(dir)
+
+	const size = 3
+	conf := ClusterConf{Enabled: true, Secret: "test"}
+	routers := make([]*mux.Router, size)
+	for i := 0; i < size; i++ {
+		i := i
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			routers[i].ServeHTTP(w, req)
+		}))
+		defer ts.Close()
+
+		// reserve a port for the Raft transport
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		l.Close()
+		conf.Nodes = append(conf.Nodes, ClusterNode{ID: fmt.Sprintf("node%d", i), Address: l.Addr().String(), APIURL: ts.URL})
+	}
+
+	controllers := make([]*Controller, size)
+	listeners := make([]eventListener, size)
+	for i := 0; i < size; i++ {
+		nodeConf := conf
+		nodeConf.NodeID = conf.Nodes[i].ID
+		nodeConf.DataDir = fmt.Sprintf("%s/%s", dir, nodeConf.NodeID)
+		if err := nodeConf.Validate(); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		storage, err := NewRaftStorage(NewMemoryStorage(), nodeConf)
+		if err != nil {
+			t.Fatal("Error starting the node:", err.Error())
+		}
+		listeners[i] = make(eventListener, 100)
+		controllers[i], err = NewController(storage, ControllerConf{}, listeners[i])
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer controllers[i].Stop()
+		err = controllers[i].EnableChanges(ChangesConf{Size: 100})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		api := NewHTTPAPI(controllers[i], nodeConf.NodeID, "Test catalog", "MAJOR.MINOR.PATCH")
+		routers[i] = mux.NewRouter()
+		routers[i].Methods("POST").Path(ClusterApplyPath).HandlerFunc(api.ClusterApply)
+	}
+
+	// Leader election
+	leader, follower := -1, -1
+	for deadline := time.Now().Add(10 * time.Second); leader == -1 && time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+		for i := range controllers {
+			if controllers[i].storage.(*RaftStorage).isLeader() {
+				leader, follower = i, (i+1)%size
+			}
+		}
+	}
+	if leader == -1 {
+		t.Fatal("No leader was elected")
+	}
+	t.Logf("Leader: node%d", leader)
+	other := (follower + 1) % size
+
+	// Writes on a follower are forwarded to the leader and replicated
+	added, err := controllers[follower].add(Service{ID: "service_1", Type: "_test._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal("Error adding a service on a follower:", err.Error())
+	}
+	if _, err := controllers[follower].get(added.ID); err != nil {
+		t.Fatal("Added service is not readable on the follower:", err.Error())
+	}
+	_, err = controllers[follower].add(Service{ID: "service_1", Type: "_test._tcp", TTL: 30}, actor{})
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("Expected a conflict error for a forwarded write, got: %v", err)
+	}
+
+	_, err = controllers[leader].add(Service{ID: "service_2", Type: "_test._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal("Error adding a service on the leader:", err.Error())
+	}
+	err = controllers[follower].delete("service_1", actor{})
+	if err != nil {
+		t.Fatal("Error deleting a service on a follower:", err.Error())
+	}
+	err = controllers[follower].storage.putRecord(&record{Kind: "test", ID: "1", Value: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal("Error putting a record on a follower:", err.Error())
+	}
+
+	for i := range controllers {
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			total, _ := controllers[i].total()
+			_, err := controllers[i].get("service_2")
+			records, _ := controllers[i].storage.listRecords("test")
+			if total == 1 && err == nil && len(records) == 1 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Mutations are not replicated to node%d: total %d, %v", i, total, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// The revision is checked against the latest state, even by a node which has not applied the previous update
+	_, err = controllers[follower].updateIf("service_2", Service{ID: "service_2", Type: "_updated._tcp", TTL: 30}, `"1"`, actor{})
+	if err != nil {
+		t.Fatal("Error updating a service on a follower:", err.Error())
+	}
+	_, err = controllers[other].updateIf("service_2", Service{ID: "service_2", Type: "_other._tcp", TTL: 30}, `"1"`, actor{})
+	if _, ok := err.(*PreconditionFailedError); !ok {
+		t.Fatalf("Expected a precondition failed error for a stale revision on node%d, got: %v", other, err)
+	}
+
+	err = controllers[other].storage.(*RaftStorage).replicate([]read{{ID: "service_2", Version: "stale"}},
+		[]write{{Op: writeDelete, ID: "service_2"}}, nil)
+	if _, ok := err.(*staleError); !ok {
+		t.Fatalf("Expected a stale error for a transaction with a stale read, got: %v", err)
+	}
+
+	// Concurrent writes on all nodes get distinct sequence numbers in the change feed
+	var wg sync.WaitGroup
+	const concurrent = 5
+	for i := range controllers {
+		for j := 0; j < concurrent; j++ {
+			wg.Add(1)
+			go func(i, j int) {
+				defer wg.Done()
+				_, err := controllers[i].add(Service{ID: fmt.Sprintf("service_%d_%d", i, j), Type: "_test._tcp", TTL: 30}, actor{})
+				if err != nil {
+					t.Errorf("Error adding a service concurrently on node%d: %s", i, err)
+				}
+			}(i, j)
+		}
+	}
+	wg.Wait()
+
+	// Every node has the same change feed and notifies its listeners about all changes in order
+	expected := []string{"added service_1", "added service_2", "deleted service_1", "updated service_2"}
+	const changes = 4 + size*concurrent
+	for i := range controllers {
+		var list *ChangeList
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			list, err = controllers[i].getChanges(0, MaxPerPage)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if list.Last == changes {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d changes on node%d, got %d", changes, i, list.Last)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if len(list.Changes) != changes {
+			t.Fatalf("Expected %d changes on node%d, got %d", changes, i, len(list.Changes))
+		}
+		for j, c := range list.Changes {
+			if c.Seq != uint64(j+1) {
+				t.Fatalf("Unexpected sequence number of change %d on node%d: %d", j, i, c.Seq)
+			}
+			if j >= len(expected) {
+				continue
+			}
+			if e := c.Type + " " + c.ID; e != expected[j] {
+				t.Fatalf("Unexpected change %d on node%d: %s", j, i, e)
+			}
+		}
+
+		for j := 0; j < changes; j++ {
+			select {
+			case e := <-listeners[i]:
+				if j < len(expected) && e != expected[j] {
+					t.Fatalf("Unexpected event %d on node%d: %s", j, i, e)
+				}
+				if j >= len(expected) && e != "added "+list.Changes[j].ID {
+					t.Fatalf("Event %d on node%d is not in the order of the changes: %s", j, i, e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Listener of node%d received %d events, expected %d", i, j, changes)
+			}
+		}
+	}
+}
@@ -9,6 +9,7 @@ const (
 
 	CatalogBackendMemory  = "memory"
 	CatalogBackendLevelDB = "leveldb"
+	CatalogBackendBolt    = "bolt"
 
 	APITypeHTTP = "HTTP"
 	APITypeMQTT = "MQTT"
@@ -19,4 +20,5 @@ const (
 var SupportedBackends = map[string]bool{
 	CatalogBackendMemory:  true,
 	CatalogBackendLevelDB: true,
+	CatalogBackendBolt:    true,
 }
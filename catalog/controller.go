@@ -4,6 +4,7 @@ package catalog
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,19 +13,41 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
-var ControllerExpiryCleanupInterval = 60 * time.Second // to be modified in unit tests
+// ControllerConf is the configuration of the controller
+type ControllerConf struct {
+	Expiry        ExpiryConf
+	ListenerQueue ListenerQueueConf
+}
 
 type Controller struct {
 	wg sync.WaitGroup
 	sync.RWMutex
 	storage   Storage
-	listeners []Listener
+	expiry    ExpiryConf
+	queueConf ListenerQueueConf
+	// queues of the listeners, modified while holding the dispatch lock and the queues lock
+	queues       []*listenerQueue
+	dispatchLock sync.Mutex
+	queuesLock   sync.Mutex
+	history      *history
+	changes      *changes
+	webhooks     *webhooks
+	health       *healthChecker
+	ownership    *OwnershipConf
+	tokens       *TokenConf
 }
 
-func NewController(storage Storage, listeners ...Listener) (*Controller, error) {
+func NewController(storage Storage, conf ControllerConf, listeners ...Listener) (*Controller, error) {
 	c := Controller{
 		storage:   storage,
-		listeners: listeners,
+		expiry:    conf.Expiry.withDefaults(),
+		queueConf: conf.ListenerQueue.withDefaults(),
+	}
+	for _, l := range listeners {
+		c.queues = append(c.queues, newListenerQueue(l, c.queueConf))
+	}
+	if r, ok := storage.(replicatedStorage); ok {
+		r.setDispatcher(c.dispatchEvents)
 	}
 
 	go c.cleanExpired()
@@ -32,55 +55,147 @@ func NewController(storage Storage, listeners ...Listener) (*Controller, error)
 	return &c, nil
 }
 
-func (c *Controller) add(s Service) (*Service, error) {
-	if err := s.validate(); err != nil {
-		return nil, &BadRequestError{err.Error()}
+func (c *Controller) add(s Service, by actor) (*Service, error) {
+	if err := validateRegistration(&s); err != nil {
+		return nil, err
 	}
 
 	c.Lock()
 	defer c.Unlock()
 
+	var added *Service
+	var token string
+	err := c.transact(func(tx *txn) error {
+		var err error
+		added, token, err = c.create(tx, s, by)
+		if err != nil {
+			return err
+		}
+		return c.notifyAdded(tx, *added, by)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the token is returned only to the creator
+	added.Token = token
+	return added, nil
+}
+
+// validateRegistration validates a service registered or updated by a client
+func validateRegistration(s *Service) error {
+	if err := s.validate(); err != nil {
+		return &BadRequestError{err.Error()}
+	}
+	if federationOrigin(s) != "" {
+		return &BadRequestError{fmt.Sprintf("meta.%s is reserved for imported services", MetaKeyFederationOrigin)}
+	}
+	return nil
+}
+
+// create stores a new validated service, which is owned by the authenticated user who created it
+// It returns the registration token of the service, if tokens are enabled.
+// The caller must hold the lock.
+func (c *Controller) create(tx *txn, s Service, by actor) (*Service, string, error) {
 	if s.ID == "" {
 		// System generated id
 		s.ID = uuid.NewV4().String()
 	}
 	s.CreatedAt = time.Now().UTC()
 	s.UpdatedAt = s.CreatedAt
+	s.Revision = 1
+	s.State = StateActive
+	s.Health = nil
+	s.Owner = by.owner()
+	s.Token = ""
 
 	s.ExpiresAt = s.CreatedAt.Add(time.Duration(s.TTL) * time.Second)
 
-	err := c.storage.add(&s)
+	err := tx.add(&s)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-
-	// notify listeners
-	for _, l := range c.listeners {
-		go l.added(s)
+	token, err := c.issueToken(tx, s.ID, by)
+	if err != nil {
+		return nil, "", err
 	}
-
-	return &s, nil
+	return &s, token, nil
 }
 
 func (c *Controller) get(id string) (*Service, error) {
 	return c.storage.get(id)
 }
 
-func (c *Controller) update(id string, s Service) (*Service, error) {
-	if err := s.validate(); err != nil {
-		return nil, &BadRequestError{err.Error()}
+func (c *Controller) update(id string, s Service, by actor) (*Service, error) {
+	return c.updateIf(id, s, "", by)
+}
+
+// updateIf updates the service if its entity tag matches the value of an If-Match header
+// The update is unconditional if ifMatch is empty.
+func (c *Controller) updateIf(id string, s Service, ifMatch string, by actor) (*Service, error) {
+	if err := validateRegistration(&s); err != nil {
+		return nil, err
 	}
 
 	c.Lock()
 	defer c.Unlock()
 
-	// Get the stored service
-	ss, err := c.storage.get(id)
+	var updated *Service
+	err := c.transact(func(tx *txn) error {
+		ss, err := c.getModifiable(tx, id, ifMatch, by)
+		if err != nil {
+			return err
+		}
+		updated, err = c.replace(tx, ss, s, by)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	return updated, nil
+}
 
-	s.ID = id
+// getModifiable returns the stored service if it can be modified by the actor with a request with the If-Match header
+// The caller must hold the lock.
+func (c *Controller) getModifiable(tx *txn, id string, ifMatch string, by actor) (*Service, error) {
+	ss, err := tx.get(id)
+	if _, notFound := err.(*NotFoundError); notFound && ifMatch != "" {
+		return nil, &PreconditionFailedError{fmt.Sprintf("Service %s does not exist", id)}
+	} else if err != nil {
+		return nil, err
+	}
+	if origin := federationOrigin(ss); origin != "" {
+		return nil, &ConflictError{fmt.Sprintf("Service is imported from catalog %s and is read-only", origin)}
+	}
+	if err := c.authorize(ss, by); err != nil {
+		return nil, err
+	}
+	if err := c.checkToken(tx, ss.ID, by); err != nil {
+		return nil, err
+	}
+	if ifMatch != "" && !ss.matchRevision(ifMatch) {
+		return nil, &PreconditionFailedError{fmt.Sprintf("Service revision %s does not match %s", ss.ETag(), ifMatch)}
+	}
+	return ss, nil
+}
+
+// replace updates the stored service ss with the modifiable attributes of the validated service s
+// The caller must hold the lock.
+func (c *Controller) replace(tx *txn, ss *Service, s Service, by actor) (*Service, error) {
+	err := c.modify(tx, ss, s)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.notifyUpdated(tx, *ss, by); err != nil {
+		return nil, err
+	}
+
+	return ss, nil
+}
+
+// modify stores the modifiable attributes of the validated service s in the stored service ss
+// The caller must hold the lock.
+func (c *Controller) modify(tx *txn, ss *Service, s Service) error {
 	ss.Title = s.Title
 	ss.Description = s.Description
 	ss.Type = s.Type
@@ -88,139 +203,263 @@ func (c *Controller) update(id string, s Service) (*Service, error) {
 	ss.Doc = s.Doc
 	ss.Meta = s.Meta
 	ss.TTL = s.TTL
+	ss.Revision++
 	ss.UpdatedAt = time.Now().UTC()
 	ss.ExpiresAt = ss.UpdatedAt.Add(time.Duration(ss.TTL) * time.Second)
+	ss.State = StateActive
+
+	return tx.update(ss)
+}
 
-	err = c.storage.update(id, ss)
+func (c *Controller) delete(id string, by actor) error {
+	return c.deleteIf(id, "", by)
+}
+
+// deleteIf deletes the service if its entity tag matches the value of an If-Match header
+// The deletion is unconditional if ifMatch is empty.
+func (c *Controller) deleteIf(id string, ifMatch string, by actor) error {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.transact(func(tx *txn) error {
+		old, err := c.getModifiable(tx, id, ifMatch, by)
+		if err != nil {
+			return err
+		}
+
+		err = tx.delete(id)
+		if err != nil {
+			return err
+		}
+		return c.notifyDeleted(tx, *old, by)
+	})
+}
+
+// selection excludes services from listing and filtering by their state
+type selection struct {
+	excludeExpired bool
+	healthyOnly    bool
+}
+
+func (c *Controller) list(page, perPage int) ([]Service, int, error) {
+	return c.storage.list(page, perPage)
+}
+
+// listAfter returns a page of services with ids greater than after, whether more services follow, and the total
+func (c *Controller) listAfter(after string, perPage int) ([]Service, bool, int, error) {
+	err := utils.ValidatePagingParams(1, perPage, MaxPerPage)
 	if err != nil {
-		return nil, err
+		return nil, false, 0, &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
 	}
 
-	// notify listeners
-	for _, l := range c.listeners {
-		go l.updated(s)
+	// fetch one more to find out if there is a next page
+	services, err := c.storage.listAfter(after, perPage+1)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	total, err := c.storage.total()
+	if err != nil {
+		return nil, false, 0, err
 	}
 
-	return ss, nil
+	if len(services) > perPage {
+		return services[:perPage], true, total, nil
+	}
+	return services, false, total, nil
 }
 
-func (c *Controller) delete(id string) error {
-	c.Lock()
-	defer c.Unlock()
+func (c *Controller) filter(path, op, value string, page, perPage int) ([]Service, int, error) {
+	c.RLock()
+	defer c.RUnlock()
 
-	old, err := c.storage.get(id)
+	ids, err := c.filterIDs(path, op, value)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
+	return c.pageIDs(ids, page, perPage)
+}
 
-	err = c.storage.delete(id)
+// filterAfter returns a page of matching services with ids greater than after, whether more services follow, and the total
+func (c *Controller) filterAfter(path, op, value, after string, perPage int) ([]Service, bool, int, error) {
+	err := utils.ValidatePagingParams(1, perPage, MaxPerPage)
 	if err != nil {
-		return err
+		return nil, false, 0, &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
 	}
 
-	// notify listeners
-	for _, l := range c.listeners {
-		go l.deleted(*old)
+	c.RLock()
+	defer c.RUnlock()
+
+	ids, err := c.filterIDs(path, op, value)
+	if err != nil {
+		return nil, false, 0, err
 	}
+	return c.pageIDsAfter(ids, after, perPage)
+}
 
-	return nil
+// pageIDs returns the services of a page of the sorted ids, and the total
+func (c *Controller) pageIDs(ids []string, page, perPage int) ([]Service, int, error) {
+	offset, limit, err := utils.GetPagingAttr(len(ids), page, perPage, MaxPerPage)
+	if err != nil {
+		return nil, 0, &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
+	}
+	services, err := c.getMany(ids[offset : offset+limit])
+	if err != nil {
+		return nil, 0, err
+	}
+	return services, len(ids), nil
 }
 
-func (c *Controller) list(page, perPage int) ([]Service, int, error) {
-	return c.storage.list(page, perPage)
+// pageIDsAfter returns the services of the sorted ids greater than after, whether more services follow, and the total
+func (c *Controller) pageIDsAfter(ids []string, after string, perPage int) ([]Service, bool, int, error) {
+	start := sort.Search(len(ids), func(i int) bool { return ids[i] > after })
+	end := start + perPage
+	if end > len(ids) {
+		end = len(ids)
+	}
+	services, err := c.getMany(ids[start:end])
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return services, end < len(ids), len(ids), nil
 }
 
-func (c *Controller) filter(path, op, value string, page, perPage int) ([]Service, int, error) {
-	c.RLock()
-	defer c.RUnlock()
+// filterIDs returns the sorted ids of the services matching the filter
+func (c *Controller) filterIDs(path, op, value string) ([]string, error) {
+	// Use the index if the path is indexed
+	ids, indexed, err := c.storage.lookup(path, op, value)
+	if err != nil {
+		return nil, err
+	}
+	if indexed {
+		return ids, nil
+	}
 
-	matches := make([]Service, 0)
-	pp := MaxPerPage
-	for p := 1; ; p++ {
-		services, t, err := c.storage.list(p, pp)
+	// Otherwise, scan the whole catalog
+	ids = []string{}
+	for after := ""; ; {
+		services, err := c.storage.listAfter(after, MaxPerPage)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 
 		for i := range services {
 			matched, err := utils.MatchObject(services[i], strings.Split(path, "."), op, value)
 			if err != nil {
-				return nil, 0, err
+				return nil, err
 			}
 			if matched {
-				matches = append(matches, services[i])
+				ids = append(ids, services[i].ID)
 			}
 		}
 
-		if p*pp >= t {
+		if len(services) < MaxPerPage {
 			break
 		}
+		after = services[len(services)-1].ID
 	}
-	// Pagination
-	offset, limit, err := utils.GetPagingAttr(len(matches), page, perPage, MaxPerPage)
-	if err != nil {
-		return nil, 0, &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
+	return ids, nil
+}
+
+func (c *Controller) getMany(ids []string) ([]Service, error) {
+	services := make([]Service, 0, len(ids))
+	for _, id := range ids {
+		s, err := c.storage.get(id)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, *s)
 	}
-	// Return the page
-	return matches[offset : offset+limit], len(matches), nil
+	return services, nil
 }
 
 func (c *Controller) total() (int, error) {
 	return c.storage.total()
 }
 
-func (c *Controller) cleanExpired() {
-	clean := func(t time.Time) {
-		c.Lock()
-		var expiredServices []*Service
+// clusterMember is implemented by storages replicated among the nodes of a cluster
+type clusterMember interface {
+	isLeader() bool
+}
 
-		for s := range c.storage.iterator() {
-			// remove if expiry is overdue by half-TTL
-			if t.After(s.ExpiresAt.Add(time.Duration(s.TTL/2) * time.Second)) {
-				expiredServices = append(expiredServices, s)
-			}
-		}
+// notifyAdded records the creation of a service and notifies the listeners after the commit
+// The caller must hold the lock.
+func (c *Controller) notifyAdded(tx *txn, s Service, by actor) error {
+	c.record(tx, HistoryCreated, s, by)
+	change, err := c.appendChange(tx, EventAdded, s)
+	if err != nil {
+		return err
+	}
+	tx.notify(EventAdded, s, change)
+	return nil
+}
 
-		for i := range expiredServices {
-			logger.Printf("cleanExpired() Removing expired registration: %s", expiredServices[i].ID)
-			err := c.storage.delete(expiredServices[i].ID)
-			if err != nil {
-				logger.Printf("cleanExpired() Error removing expired registration: %s: %s", expiredServices[i].ID, err)
-				continue
-			}
-			// notify listeners
-			for li := range c.listeners {
-				go c.listeners[li].deleted(*expiredServices[i])
-			}
-		}
-		c.Unlock()
+// notifyUpdated records the update of a service and notifies the listeners after the commit
+// The caller must hold the lock.
+func (c *Controller) notifyUpdated(tx *txn, s Service, by actor) error {
+	c.record(tx, HistoryUpdated, s, by)
+	change, err := c.appendChange(tx, EventUpdated, s)
+	if err != nil {
+		return err
 	}
+	tx.notify(EventUpdated, s, change)
+	return nil
+}
 
-	clean(time.Now())
-	for t := range time.Tick(ControllerExpiryCleanupInterval) {
-		clean(t)
+// notifyRenewed notifies the listeners about the renewal of a service after the commit
+// Renewals are not recorded in the history or the change feed as the service is not modified.
+// The caller must hold the lock.
+func (c *Controller) notifyRenewed(tx *txn, s Service) {
+	tx.notify(eventRenewed, s, nil)
+}
+
+// notifyDeleted revokes the token of a deleted service, records the deletion, and notifies the listeners after the commit
+// The caller must hold the lock.
+func (c *Controller) notifyDeleted(tx *txn, s Service, by actor) error {
+	c.revokeToken(tx, s.ID)
+	c.record(tx, HistoryDeleted, s, by)
+	change, err := c.appendChange(tx, EventDeleted, s)
+	if err != nil {
+		return err
 	}
+	tx.notify(EventDeleted, s, change)
+	return nil
 }
 
-func (c *Controller) AddListener(listener Listener) {
-	c.Lock()
-	c.listeners = append(c.listeners, listener)
-	c.Unlock()
+// notifyExpired records the expiry of a service and notifies the listeners after the commit
+// The caller must hold the lock.
+func (c *Controller) notifyExpired(tx *txn, s Service) error {
+	c.record(tx, HistoryExpired, s, actor{origin: OriginExpiry})
+	change, err := c.appendChange(tx, EventExpired, s)
+	if err != nil {
+		return err
+	}
+	tx.notify(EventExpired, s, change)
+	return nil
 }
 
-func (c *Controller) RemoveListener(listener Listener) {
-	c.Lock()
-	for i, l := range c.listeners {
-		if l == listener {
-			//delete the entry and break
-			c.listeners = append(c.listeners[:i], c.listeners[i+1:]...)
-			break
-		}
+// notifyHealthChanged notifies the listeners about a changed health status of a service after the commit
+// Health changes are not recorded in the history as the service is not modified.
+// The caller must hold the lock.
+func (c *Controller) notifyHealthChanged(tx *txn, s Service) error {
+	change, err := c.appendChange(tx, EventHealthChanged, s)
+	if err != nil {
+		return err
 	}
-	c.Unlock()
+	tx.notify(EventHealthChanged, s, change)
+	return nil
 }
 
 // Stop the controller
 func (c *Controller) Stop() error {
+	c.RLock()
+	health := c.health
+	c.RUnlock()
+	if health != nil {
+		health.stop()
+	}
+	c.drainListeners()
+	if w, err := c.getWebhooks(); err == nil {
+		w.stop()
+	}
 	return c.storage.Close()
 }
@@ -3,6 +3,7 @@
 package catalog
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -13,7 +14,18 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
+const testMetaIndex = "meta.gateway"
+
 func setup() (*Controller, func(), error) {
+	return setupWithConf(ControllerConf{})
+}
+
+func setupWithConf(conf ControllerConf) (*Controller, func(), error) {
+	return setupWrapped(conf, nil)
+}
+
+// setupWrapped sets up a controller with a wrapper of the storage, if given
+func setupWrapped(conf ControllerConf, wrap func(Storage) Storage) (*Controller, func(), error) {
 	var (
 		storage Storage
 		err     error
@@ -21,15 +33,23 @@ func setup() (*Controller, func(), error) {
 	)
 	switch TestStorageType {
 	case CatalogBackendMemory:
-		storage = NewMemoryStorage()
+		storage = NewMemoryStorage(testMetaIndex)
 	case CatalogBackendLevelDB:
-		storage, err = NewLevelDBStorage(tempDir, nil)
+		storage, err = NewLevelDBStorage(tempDir, nil, testMetaIndex)
+		if err != nil {
+			return nil, nil, err
+		}
+	case CatalogBackendBolt:
+		storage, err = NewBoltStorage(tempDir, nil, testMetaIndex)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
 
-	controller, err := NewController(storage)
+	if wrap != nil {
+		storage = wrap(storage)
+	}
+	controller, err := NewController(storage, conf)
 	if err != nil {
 		storage.Close()
 		return nil, nil, err
@@ -55,7 +75,7 @@ func TestAddService(t *testing.T) {
 	r.Type = "_test._tcp"
 	r.TTL = 30
 
-	s, err := controller.add(r)
+	s, err := controller.add(r, actor{})
 	if err != nil {
 		t.Fatalf("Unexpected error on add: %v", err.Error())
 	}
@@ -63,7 +83,7 @@ func TestAddService(t *testing.T) {
 		t.Fatalf("User defined ID is not returned. Getting %v instead of %v\n", s.ID, r.ID)
 	}
 
-	_, err = controller.add(r)
+	_, err = controller.add(r, actor{})
 	if err == nil {
 		t.Error("Didn't get any error when adding a service with non-unique id.")
 	}
@@ -72,7 +92,7 @@ func TestAddService(t *testing.T) {
 	var r2 Service
 	r2.Type = "_test._tcp"
 	r2.TTL = 30
-	s, err = controller.add(r2)
+	s, err = controller.add(r2, actor{})
 	if err != nil {
 		t.Fatalf("Unexpected error on add: %v", err.Error())
 	}
@@ -94,13 +114,13 @@ func TestUpdateService(t *testing.T) {
 	r.Type = "_test._tcp"
 	r.TTL = 30
 
-	_, err = controller.add(r)
+	_, err = controller.add(r, actor{})
 	if err != nil {
 		t.Errorf("Unexpected error on add: %v", err.Error())
 	}
 	r.Description = "new description"
 
-	_, err = controller.update(r.ID, r)
+	_, err = controller.update(r.ID, r, actor{})
 	if err != nil {
 		t.Errorf("Unexpected error on update: %v", err.Error())
 	}
@@ -115,6 +135,68 @@ func TestUpdateService(t *testing.T) {
 	}
 }
 
+// eventListener records the events of the controller
+type eventListener chan string
+
+func (l eventListener) added(s Service)         { l <- "added " + s.ID }
+func (l eventListener) updated(s Service)       { l <- "updated " + s.ID }
+func (l eventListener) renewed(s Service)       { l <- "renewed " + s.ID }
+func (l eventListener) deleted(s Service)       { l <- "deleted " + s.ID }
+func (l eventListener) expired(s Service)       { l <- "expired " + s.ID }
+func (l eventListener) healthChanged(s Service) { l <- "health " + s.ID }
+
+func TestRenewService(t *testing.T) {
+	t.Log(TestStorageType)
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+
+	var r Service
+	r.ID = "E9203BE9-D705-42A8-8B12-F28E7EA2FC99"
+	r.Type = "_test._tcp"
+	r.TTL = 30
+
+	added, err := controller.add(r, actor{})
+	if err != nil {
+		t.Errorf("Unexpected error on add: %v", err.Error())
+	}
+	events := make(eventListener, 1)
+	controller.AddListener(events)
+
+	time.Sleep(10 * time.Millisecond)
+	renewed, err := controller.renew(r.ID, actor{})
+	if err != nil {
+		t.Fatalf("Unexpected error on renew: %v", err.Error())
+	}
+	if !renewed.ExpiresAt.After(added.ExpiresAt) {
+		t.Errorf("Expiry is not extended: %v, before: %v", renewed.ExpiresAt, added.ExpiresAt)
+	}
+
+	rg, err := controller.get(r.ID)
+	if err != nil {
+		t.Errorf("Unexpected error on get: %v", err.Error())
+	}
+	if !rg.ExpiresAt.Equal(renewed.ExpiresAt) || !rg.UpdatedAt.Equal(added.UpdatedAt) || rg.Revision != added.Revision {
+		t.Errorf("Only the expiry should be modified: %+v", rg)
+	}
+
+	select {
+	case event := <-events:
+		if event != "renewed "+r.ID {
+			t.Errorf("Expected a renewed event, got: %s", event)
+		}
+	case <-time.After(time.Second):
+		t.Error("No event for the renewal")
+	}
+
+	_, err = controller.renew("missing", actor{})
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Errorf("Expected a not found error for renewing a missing service, got: %v", err)
+	}
+}
+
 func TestGetService(t *testing.T) {
 	t.Log(TestStorageType)
 	controller, shutdown, err := setup()
@@ -129,7 +211,7 @@ func TestGetService(t *testing.T) {
 	r.Type = "_test._tcp"
 	r.TTL = 30
 
-	_, err = controller.add(r)
+	_, err = controller.add(r, actor{})
 	if err != nil {
 		t.Errorf("Unexpected error on add: %v", err.Error())
 	}
@@ -157,22 +239,162 @@ func TestDeleteService(t *testing.T) {
 	r.Type = "_test._tcp"
 	r.TTL = 30
 
-	_, err = controller.add(r)
+	_, err = controller.add(r, actor{})
 	if err != nil {
 		t.Errorf("Unexpected error on add: %v", err.Error())
 	}
 
-	err = controller.delete(r.ID)
+	err = controller.delete(r.ID, actor{})
 	if err != nil {
 		t.Errorf("Unexpected error on delete: %v", err.Error())
 	}
 
-	err = controller.delete(r.ID)
+	err = controller.delete(r.ID, actor{})
 	if err == nil {
 		t.Error("Didn't get any error when deleting a deleted service.")
 	}
 }
 
+func TestHistory(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	controller.EnableHistory(HistoryConf{Size: 3, Retention: 60})
+
+	_, err = controller.getHistory("service_1")
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError for a missing history, got: %v", err)
+	}
+
+	user := actor{origin: OriginHTTP, user: "alice"}
+	s, err := controller.add(Service{ID: "service_1", Type: "_test._tcp", TTL: 30}, user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		s.Description = fmt.Sprintf("revision %d", i)
+		_, err = controller.update(s.ID, *s, actor{origin: "broker"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// renewals are not recorded
+	_, err = controller.renew(s.ID, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	h, err := controller.getHistory(s.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(h.Entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(h.Entries))
+	}
+	last := h.Entries[2]
+	if last.Operation != HistoryUpdated || last.Origin != "broker" || last.Service.Description != "revision 2" || last.Service.Revision != 4 {
+		t.Fatalf("Unexpected last entry: %+v", last)
+	}
+
+	err = controller.delete(s.ID, user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	h, err = controller.getHistory(s.ID)
+	if err != nil {
+		t.Fatalf("History should survive deletion: %s", err)
+	}
+	last = h.Entries[len(h.Entries)-1]
+	if last.Operation != HistoryDeleted || last.Origin != OriginHTTP || last.User != "alice" {
+		t.Fatalf("Unexpected last entry: %+v", last)
+	}
+
+	// the history is stored with the services
+	if _, err := controller.storage.getRecord(recordKindHistory, s.ID); err != nil {
+		t.Fatalf("History is not stored: %s", err)
+	}
+
+	// kept within the retention period
+	controller.Lock()
+	err = controller.pruneHistory(time.Now().Add(30 * time.Second))
+	controller.Unlock()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := controller.getHistory(s.ID); err != nil {
+		t.Fatalf("History should be kept within the retention period: %s", err)
+	}
+
+	// removed after the retention period
+	controller.Lock()
+	err = controller.pruneHistory(time.Now().Add(2 * time.Minute))
+	controller.Unlock()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = controller.getHistory(s.ID)
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError after the retention period, got: %v", err)
+	}
+	if _, err := controller.storage.getRecord(recordKindHistory, s.ID); err == nil {
+		t.Fatal("History record was not removed after the retention period")
+	}
+	if _, err := controller.storage.getRecord(recordKindHistoryDeleted, s.ID); err == nil {
+		t.Fatal("Deletion record was not removed after the retention period")
+	}
+
+	// the history of a service created again is not removed
+	_, err = controller.add(Service{ID: "service_2", Type: "_test._tcp", TTL: 30}, user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = controller.delete("service_2", user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = controller.add(Service{ID: "service_2", Type: "_test._tcp", TTL: 30}, user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	controller.Lock()
+	err = controller.pruneHistory(time.Now().Add(2 * time.Minute))
+	controller.Unlock()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := controller.getHistory("service_2"); err != nil {
+		t.Fatalf("History of a service created again should be kept: %s", err)
+	}
+
+	// the histories of deleted services without deletion records are indexed once
+	entries, _ := json.Marshal([]HistoryEntry{{Operation: HistoryDeleted, Time: time.Now().UTC()}})
+	err = controller.storage.putRecord(&record{Kind: recordKindHistory, ID: "service_3", Value: entries})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	controller.Lock()
+	controller.history.indexed = false
+	err = controller.pruneHistory(time.Now())
+	if err == nil {
+		err = controller.pruneHistory(time.Now().Add(2 * time.Minute))
+	}
+	controller.Unlock()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := controller.storage.getRecord(recordKindHistory, "service_3"); err == nil {
+		t.Fatal("History record without a deletion record was not removed after the retention period")
+	}
+
+	// the retention has a default
+	controller.EnableHistory(HistoryConf{Size: 3})
+	if controller.history.conf.Retention != defaultHistoryRetention {
+		t.Fatalf("Expected the default retention, got %d", controller.history.conf.Retention)
+	}
+}
+
 func TestListServices(t *testing.T) {
 	t.Log(TestStorageType)
 	controller, shutdown, err := setup()
@@ -188,7 +410,7 @@ func TestListServices(t *testing.T) {
 	for i := 0; i < 11; i++ {
 		r.ID = fmt.Sprintf("TestID_%d", i)
 		r.TTL = 30
-		_, err := controller.add(r)
+		_, err := controller.add(r, actor{})
 
 		if err != nil {
 			t.Errorf("Unexpected error on add: %v", err.Error())
@@ -233,7 +455,7 @@ func TestFilterService(t *testing.T) {
 			Description: fmt.Sprintf("boring_%d", i),
 			Type:        "_test._tcp",
 			TTL:         30,
-		})
+		}, actor{})
 		if err != nil {
 			t.Fatal("Error adding a service:", err.Error())
 		}
@@ -243,12 +465,12 @@ func TestFilterService(t *testing.T) {
 		Description: "interesting_1",
 		Type:        "_test._tcp",
 		TTL:         30,
-	})
+	}, actor{})
 	controller.add(Service{
 		Description: "interesting_2",
 		Type:        "_test._tcp",
 		TTL:         30,
-	})
+	}, actor{})
 
 	services, total, err := controller.filter("description", utils.FOpPrefix, "interesting", 1, 10)
 	if err != nil {
@@ -264,46 +486,277 @@ func TestFilterService(t *testing.T) {
 	}
 }
 
-func TestCleanExpired(t *testing.T) {
+func TestFilterIndexedService(t *testing.T) {
 	t.Log(TestStorageType)
-	ControllerExpiryCleanupInterval = 5 * time.Second
-
 	controller, shutdown, err := setup()
 	if err != nil {
 		t.Fatal(err.Error())
 	}
 	defer shutdown()
 
+	for i := 0; i < 6; i++ {
+		_, err := controller.add(Service{
+			ID:   fmt.Sprintf("service_%d", i),
+			Type: fmt.Sprintf("_test%d._tcp", i%2),
+			APIs: []API{{
+				ID:       "api",
+				Protocol: "HTTP",
+				URL:      fmt.Sprintf("http://gateway%d/api", i%3),
+			}},
+			Meta: map[string]interface{}{"gateway": fmt.Sprintf("Gateway_%d", i%3)},
+			TTL:  30,
+		}, actor{})
+		if err != nil {
+			t.Fatal("Error adding a service:", err.Error())
+		}
+	}
+
+	cases := []struct {
+		path, op, value string
+		expected        []string
+	}{
+		{"type", utils.FOpEquals, "_test1._tcp", []string{"service_1", "service_3", "service_5"}},
+		{"apis.protocol", utils.FOpEquals, "http", []string{"service_0", "service_1", "service_2", "service_3", "service_4", "service_5"}},
+		{"apis.url", utils.FOpPrefix, "http://gateway2", []string{"service_2", "service_5"}},
+		{"meta.gateway", utils.FOpSuffix, "_0", []string{"service_0", "service_3"}},
+		{"meta.gateway", utils.FOpContains, "way_1", []string{"service_1", "service_4"}},
+	}
+	for _, c := range cases {
+		services, total, err := controller.filter(c.path, c.op, c.value, 1, 10)
+		if err != nil {
+			t.Fatalf("Error filtering services by %s/%s/%s: %s", c.path, c.op, c.value, err)
+		}
+		if total != len(c.expected) || len(services) != len(c.expected) {
+			t.Fatalf("Returned %d instead of %d services when filtering %s/%s/%s: \n%v", total, len(c.expected), c.path, c.op, c.value, services)
+		}
+		for i := range services {
+			if services[i].ID != c.expected[i] {
+				t.Fatalf("Wrong results when filtering %s/%s/%s. Expected %v, got %s at %d", c.path, c.op, c.value, c.expected, services[i].ID, i)
+			}
+		}
+	}
+
+	// Pagination
+	services, total, err := controller.filter("apis.protocol", utils.FOpEquals, "http", 2, 4)
+	if err != nil {
+		t.Fatal("Error filtering services:", err.Error())
+	}
+	if total != 6 || len(services) != 2 || services[0].ID != "service_4" {
+		t.Fatalf("Wrong second page when filtering by protocol. Total: %d, services: %v", total, services)
+	}
+
+	// Updates and deletions must be reflected in the index
+	s, err := controller.get("service_0")
+	if err != nil {
+		t.Fatal("Error getting a service:", err.Error())
+	}
+	s.Type = "_test1._tcp"
+	_, err = controller.update(s.ID, *s, actor{})
+	if err != nil {
+		t.Fatal("Error updating a service:", err.Error())
+	}
+	err = controller.delete("service_5", actor{})
+	if err != nil {
+		t.Fatal("Error deleting a service:", err.Error())
+	}
+
+	services, total, err = controller.filter("type", utils.FOpEquals, "_test1._tcp", 1, 10)
+	if err != nil {
+		t.Fatal("Error filtering services:", err.Error())
+	}
+	if total != 3 || services[0].ID != "service_0" || services[1].ID != "service_1" || services[2].ID != "service_3" {
+		t.Fatalf("Index is not updated after update and delete. Got: %v", services)
+	}
+	_, total, _ = controller.filter("type", utils.FOpEquals, "_test0._tcp", 1, 10)
+	if total != 2 {
+		t.Fatalf("Index is not updated after update. Expected 2 services, got %d", total)
+	}
+
+	_, _, err = controller.filter("type", "unknown", "_test", 1, 10)
+	if err == nil {
+		t.Fatal("No error when filtering with an unknown operation")
+	}
+}
+
+func fraction(f float64) *float64 {
+	return &f
+}
+
+func TestExpiryConf(t *testing.T) {
+	s := &Service{TTL: 10}
+	if d := (ExpiryConf{}).withDefaults().gracePeriod(s); d != 5*time.Second {
+		t.Fatalf("Expected the default grace period of 5s, got %s", d)
+	}
+	// expired services may be removed right away
+	conf := ExpiryConf{GraceFraction: fraction(0)}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if d := conf.withDefaults().gracePeriod(s); d != 0 {
+		t.Fatalf("Expected no grace period, got %s", d)
+	}
+	if err := (ExpiryConf{GraceFraction: fraction(-1)}).Validate(); err == nil {
+		t.Fatal("Expected an error for a negative grace fraction")
+	}
+}
+
+func TestCleanExpired(t *testing.T) {
+	t.Log(TestStorageType)
+	controller, shutdown, err := setupWithConf(ControllerConf{Expiry: ExpiryConf{GraceFraction: fraction(2), CleanupInterval: 1}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	events := make(eventListener, 10)
+	controller.AddListener(events)
+
 	var d = Service{
 		Description: "my_service",
 		Type:        "_test._tcp",
 		TTL:         1,
 	}
 
-	s, err := controller.add(d)
+	s, err := controller.add(d, actor{})
 	if err != nil {
 		t.Fatal("Error adding a service:", err.Error())
 	}
+	if s.State != StateActive {
+		t.Fatalf("Expected state %s, got %s", StateActive, s.State)
+	}
+	if e := <-events; e != "added "+s.ID {
+		t.Fatalf("Unexpected event: %s", e)
+	}
+
+	// expired but kept for the grace period of 2 seconds
+	select {
+	case e := <-events:
+		if e != "expired "+s.ID {
+			t.Fatalf("Unexpected event: %s", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Service was not flagged as expired after 3 seconds")
+	}
+	expired, err := controller.get(s.ID)
+	if err != nil {
+		t.Fatal("Expired service should be kept during the grace period:", err.Error())
+	}
+	if expired.State != StateExpired || expired.Revision != s.Revision {
+		t.Fatalf("Unexpected expired service: %+v", expired)
+	}
+
+	// expired services may be excluded
+	services, total, err := controller.view(ViewAll, "type", utils.FOpEquals, "_test._tcp", selection{excludeExpired: true}, 1, MaxPerPage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total != 0 || len(services) != 0 {
+		t.Fatalf("Expired services should be excluded, got: %v", services)
+	}
+	_, total, _ = controller.view(ViewAll, "", "", "", selection{}, 1, MaxPerPage)
+	if total != 1 {
+		t.Fatalf("Expired services should be listed unless excluded, got %d", total)
+	}
+
+	select {
+	case e := <-events:
+		if e != "deleted "+s.ID {
+			t.Fatalf("Unexpected event: %s", e)
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("Service was not removed after the grace period")
+	}
+	_, err = controller.get(s.ID)
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError when getting a removed service, got: %v", err)
+	}
+}
+
+func TestRenewExpired(t *testing.T) {
+	controller, shutdown, err := setupWithConf(ControllerConf{Expiry: ExpiryConf{GraceFraction: fraction(10), CleanupInterval: 1}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	events := make(eventListener, 10)
+	controller.AddListener(events)
+
+	s, err := controller.add(Service{Type: "_test._tcp", TTL: 1}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	<-events
+	select {
+	case e := <-events:
+		if e != "expired "+s.ID {
+			t.Fatalf("Unexpected event: %s", e)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Service was not flagged as expired after 3 seconds")
+	}
+
+	// renewing makes the service active again
+	renewed, err := controller.renew(s.ID, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if renewed.State != StateActive {
+		t.Fatalf("Expected state %s after renewal, got %s", StateActive, renewed.State)
+	}
+	if e := <-events; e != "updated "+s.ID {
+		t.Fatalf("Reactivation should be notified as an update, got: %s", e)
+	}
+}
+
+// failingStorage fails the commits which have the given operation on the service with the given id
+type failingStorage struct {
+	Storage
+	op string
+	id string
+}
+
+func (fs *failingStorage) commit(writes []write) error {
+	for _, w := range writes {
+		if w.Op == fs.op && w.ID == fs.id {
+			return fmt.Errorf("failed to write %s", w.ID)
+		}
+	}
+	return fs.Storage.commit(writes)
+}
 
-	addingTime := time.Now()
-	time.Sleep(6 * time.Second)
+// failOn returns a wrapper of the storage which fails the commits which have the given operation on the given service
+func failOn(op, id string) func(Storage) Storage {
+	return func(s Storage) Storage {
+		return &failingStorage{Storage: s, op: op, id: id}
+	}
+}
 
-	checkingTime := time.Now()
-	dd, err := controller.get(s.ID)
+func TestRestoreAtomic(t *testing.T) {
+	controller, shutdown, err := setupWrapped(ControllerConf{}, failOn(writeAdd, "failing"))
 	if err != nil {
-		switch err.(type) {
-		case *NotFoundError:
-		// good
-		default:
-			t.Fatalf("Got an error other than NotFoundError when getting an expired service: %s\n", err)
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+
+	for i := 0; i < 3; i++ {
+		_, err := controller.add(Service{ID: fmt.Sprintf("service_%d", i), Type: "_test._tcp", TTL: 30}, actor{})
+		if err != nil {
+			t.Fatal(err.Error())
 		}
-	} else {
-		t.Fatalf("Service was not removed after 1 seconds. \nTTL: %v \nCreated: %v \nExpiry: %v \nNot deleted after: %v at %v\n",
-			dd.TTL,
-			dd.CreatedAt,
-			dd.ExpiresAt,
-			checkingTime.Sub(addingTime),
-			checkingTime.UTC(),
-		)
+	}
+
+	// a failure leaves the catalog unchanged
+	services := []Service{
+		{ID: "service_0", Type: "_test._tcp", TTL: 60},
+		{ID: "failing", Type: "_test._tcp", TTL: 30},
+	}
+	_, err = controller.restore(services, RestoreModeReplace, actor{})
+	if err == nil {
+		t.Fatal("Expected an error for a restore which cannot be stored")
+	}
+	if total, _ := controller.total(); total != 3 {
+		t.Fatalf("Failed restore changed the catalog: %d services", total)
+	}
+	if s, _ := controller.get("service_0"); s.TTL != 30 {
+		t.Fatalf("Failed restore overwrote a service: %+v", s)
 	}
 }
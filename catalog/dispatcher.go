@@ -0,0 +1,329 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Overflow policies of the listener queues
+const (
+	// OverflowBlock makes the changes wait until the listener catches up, which stalls all changes while a listener is stuck
+	OverflowBlock = "block"
+	// OverflowDropOldest discards the oldest queued event to make room for the new one
+	OverflowDropOldest = "dropOldest"
+	// OverflowDropNewest discards the new event
+	OverflowDropNewest = "dropNewest"
+)
+
+const (
+	defaultListenerQueueSize = 1000
+	// time given to each listener to process its queued events when the controller is stopped
+	listenerDrainTimeout = 10 * time.Second
+)
+
+// ListenerQueueConf is the configuration of the queues which deliver the events to each listener in order
+type ListenerQueueConf struct {
+	// Size is the number of events queued for each listener. Defaults to 1000.
+	Size int `json:"size"`
+	// Overflow is the policy when the queue of a listener is full: block, dropOldest, or dropNewest. Defaults to dropOldest.
+	Overflow string `json:"overflow"`
+}
+
+func (c ListenerQueueConf) Validate() error {
+	if c.Size < 0 {
+		return fmt.Errorf("listenerQueue: size must not be negative")
+	}
+	switch c.Overflow {
+	case "", OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+	default:
+		return fmt.Errorf("listenerQueue: unknown overflow policy: %s", c.Overflow)
+	}
+	return nil
+}
+
+// withDefaults returns the configuration with the defaults of the unset fields
+func (c ListenerQueueConf) withDefaults() ListenerQueueConf {
+	if c.Size == 0 {
+		c.Size = defaultListenerQueueSize
+	}
+	if c.Overflow == "" {
+		c.Overflow = OverflowDropOldest
+	}
+	return c
+}
+
+// ListenerQueueStats describes the queue of a listener
+type ListenerQueueStats struct {
+	// Listener is the type of the listener, e.g. *catalog.MQTTManager
+	Listener  string `json:"listener"`
+	Depth     int    `json:"depth"`
+	Capacity  int    `json:"capacity"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// ListenerQueueStatsList is the list of the queues of all listeners
+type ListenerQueueStatsList struct {
+	Overflow  string               `json:"overflow"`
+	Listeners []ListenerQueueStats `json:"listeners"`
+}
+
+// listenerEvent is a call of a Listener method, e.g. Listener.added
+type listenerEvent struct {
+	notify  func(Listener, Service)
+	service Service
+	// change is the change in the change feed, nil if the feed is disabled or the event is not a change
+	change *Change
+}
+
+// changeListener is a Listener which receives the changes of the change feed with their sequence numbers
+// It is called with changed instead of the Listener method for the events which are in the change feed.
+type changeListener interface {
+	changed(c Change, s Service)
+}
+
+// listenerQueue delivers the events to a listener in order from a bounded queue
+// Events are pushed in the order of the committed changes.
+type listenerQueue struct {
+	listener  Listener
+	overflow  string
+	events    chan listenerEvent
+	drained   chan struct{}
+	delivered uint64
+	dropped   uint64
+	// dropping is the number of events discarded since the queue is full, guarded by the dispatch lock
+	dropping uint64
+}
+
+func newListenerQueue(listener Listener, conf ListenerQueueConf) *listenerQueue {
+	q := &listenerQueue{
+		listener: listener,
+		overflow: conf.Overflow,
+		events:   make(chan listenerEvent, conf.Size),
+		drained:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *listenerQueue) run() {
+	for e := range q.events {
+		if l, ok := q.listener.(changeListener); ok && e.change != nil {
+			l.changed(*e.change, e.service)
+		} else {
+			e.notify(q.listener, e.service)
+		}
+		atomic.AddUint64(&q.delivered, 1)
+	}
+	close(q.drained)
+}
+
+// push queues an event according to the overflow policy
+// The caller must hold the dispatch lock.
+func (q *listenerQueue) push(e listenerEvent) {
+	switch q.overflow {
+	case OverflowDropNewest:
+		select {
+		case q.events <- e:
+			q.recovered()
+		default:
+			q.drop()
+		}
+	case OverflowDropOldest:
+		full := false
+		for {
+			select {
+			case q.events <- e:
+				if !full {
+					q.recovered()
+				}
+				return
+			default:
+			}
+			select {
+			case <-q.events:
+				full = true
+				q.drop()
+			default:
+			}
+		}
+	default:
+		q.events <- e
+	}
+}
+
+// drop counts a discarded event and logs the start of the overflow
+// The caller must hold the dispatch lock.
+func (q *listenerQueue) drop() {
+	atomic.AddUint64(&q.dropped, 1)
+	if q.dropping == 0 {
+		logger.Printf("Listener %T: Queue of %d events is full, discarding events (%s)", q.listener, cap(q.events), q.overflow)
+	}
+	q.dropping++
+}
+
+// recovered logs the end of an overflow with the number of discarded events
+// The caller must hold the dispatch lock.
+func (q *listenerQueue) recovered() {
+	if q.dropping > 0 {
+		logger.Printf("Listener %T: Discarded %d events while the queue was full", q.listener, q.dropping)
+		q.dropping = 0
+	}
+}
+
+// close stops accepting events and waits until the queued ones are delivered, or the drain timeout
+func (q *listenerQueue) close() {
+	close(q.events)
+	select {
+	case <-q.drained:
+	case <-time.After(listenerDrainTimeout):
+		logger.Printf("Listener %T did not process %d events before the timeout", q.listener, len(q.events))
+	}
+}
+
+func (q *listenerQueue) stats() ListenerQueueStats {
+	return ListenerQueueStats{
+		Listener:  fmt.Sprintf("%T", q.listener),
+		Depth:     len(q.events),
+		Capacity:  cap(q.events),
+		Delivered: atomic.LoadUint64(&q.delivered),
+		Dropped:   atomic.LoadUint64(&q.dropped),
+	}
+}
+
+// listenerMethods are the Listener methods notified with the types of the events
+var listenerMethods = map[string]func(Listener, Service){
+	EventAdded:         Listener.added,
+	EventUpdated:       Listener.updated,
+	eventRenewed:       Listener.renewed,
+	EventDeleted:       Listener.deleted,
+	EventExpired:       Listener.expired,
+	EventHealthChanged: Listener.healthChanged,
+}
+
+// dispatchEvents queues the events of a committed transaction for all listeners
+// It is called while holding the lock of the controller, or by the state machine of a cluster, which applies the
+// transactions in order without the lock.
+func (c *Controller) dispatchEvents(events []txnEvent) {
+	c.dispatchLock.Lock()
+	defer c.dispatchLock.Unlock()
+
+	for _, e := range events {
+		notify, found := listenerMethods[e.Type]
+		if !found {
+			logger.Printf("Unknown type of event for service %s: %s", e.Service.ID, e.Type)
+			continue
+		}
+		for _, q := range c.queues {
+			q.push(listenerEvent{notify: notify, service: e.Service, change: e.Change})
+		}
+	}
+}
+
+func (c *Controller) AddListener(listener Listener) {
+	c.Lock()
+	c.addListener(listener)
+	c.Unlock()
+}
+
+// addListener starts the queue of a listener
+// The caller must hold the lock.
+func (c *Controller) addListener(listener Listener) {
+	c.dispatchLock.Lock()
+	c.queuesLock.Lock()
+	c.queues = append(c.queues, newListenerQueue(listener, c.queueConf))
+	c.queuesLock.Unlock()
+	c.dispatchLock.Unlock()
+}
+
+// RemoveListener removes a listener after it has processed its queued events
+func (c *Controller) RemoveListener(listener Listener) {
+	var removed *listenerQueue
+	c.Lock()
+	c.dispatchLock.Lock()
+	c.queuesLock.Lock()
+	for i, q := range c.queues {
+		if q.listener == listener {
+			//delete the entry and break
+			removed = q
+			c.queues = append(c.queues[:i], c.queues[i+1:]...)
+			break
+		}
+	}
+	c.queuesLock.Unlock()
+	c.dispatchLock.Unlock()
+	c.Unlock()
+
+	if removed != nil {
+		removed.close()
+	}
+}
+
+// drainListeners removes all listeners after they have processed their queued events
+func (c *Controller) drainListeners() {
+	c.Lock()
+	c.dispatchLock.Lock()
+	c.queuesLock.Lock()
+	queues := c.queues
+	c.queues = nil
+	c.queuesLock.Unlock()
+	c.dispatchLock.Unlock()
+	c.Unlock()
+
+	var wg sync.WaitGroup
+	for _, q := range queues {
+		wg.Add(1)
+		go func(q *listenerQueue) {
+			defer wg.Done()
+			q.close()
+		}(q)
+	}
+	wg.Wait()
+}
+
+// listenerQueueStats returns the stats of the queues of all listeners
+// It takes neither the lock of the controller nor the dispatch lock, which are held while the changes wait for a full queue.
+// The stats describe the events of all services and are limited to the admins, and to the admin token if tokens are
+// enabled. These checks only read the configurations of ownership and tokens, which are set before the catalog is served.
+func (c *Controller) listenerQueueStats(by actor) (*ListenerQueueStatsList, error) {
+	if err := c.authorizeAdmin(by); err != nil {
+		return nil, err
+	}
+	if err := c.checkAdminToken(by); err != nil {
+		return nil, err
+	}
+
+	c.queuesLock.Lock()
+	defer c.queuesLock.Unlock()
+
+	list := &ListenerQueueStatsList{Overflow: c.queueConf.Overflow, Listeners: []ListenerQueueStats{}}
+	for _, q := range c.queues {
+		list.Listeners = append(list.Listeners, q.stats())
+	}
+	return list, nil
+}
+
+// ListenerQueues returns the depths and counters of the queues of the listeners
+func (a *HttpAPI) ListenerQueues(w http.ResponseWriter, req *http.Request) {
+	stats, err := a.controller.listenerQueueStats(requestActor(req))
+	if err != nil {
+		switch err.(type) {
+		case *ForbiddenError:
+			a.ErrorResponse(w, http.StatusForbidden, err.Error())
+		case *UnauthorizedError:
+			a.ErrorResponse(w, http.StatusUnauthorized, err.Error())
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(stats)
+}
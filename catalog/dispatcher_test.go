@@ -0,0 +1,159 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// gatedListener processes an event whenever the gate is opened
+type gatedListener struct {
+	gate   chan struct{}
+	events eventListener
+}
+
+func newGatedListener() *gatedListener {
+	return &gatedListener{gate: make(chan struct{}), events: make(eventListener, 100)}
+}
+
+func (l *gatedListener) added(s Service)         { <-l.gate; l.events.added(s) }
+func (l *gatedListener) updated(s Service)       { <-l.gate; l.events.updated(s) }
+func (l *gatedListener) renewed(s Service)       { <-l.gate; l.events.renewed(s) }
+func (l *gatedListener) deleted(s Service)       { <-l.gate; l.events.deleted(s) }
+func (l *gatedListener) expired(s Service)       { <-l.gate; l.events.expired(s) }
+func (l *gatedListener) healthChanged(s Service) { <-l.gate; l.events.healthChanged(s) }
+
+func queueStats(t *testing.T, controller *Controller) *ListenerQueueStatsList {
+	stats, err := controller.listenerQueueStats(actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return stats
+}
+
+func TestListenerOrder(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	listener := newGatedListener()
+	controller.AddListener(listener)
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		s, err := controller.add(Service{ID: fmt.Sprintf("service_%d", i), Type: "_test._tcp", TTL: 30}, actor{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = controller.delete(s.ID, actor{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		expected = append(expected, "added "+s.ID, "deleted "+s.ID)
+	}
+
+	stats := queueStats(t, controller)
+	if stats.Overflow != OverflowDropOldest || len(stats.Listeners) != 1 || stats.Listeners[0].Capacity != defaultListenerQueueSize {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	// one event may already be taken from the queue
+	if s := stats.Listeners[0]; s.Listener != "*catalog.gatedListener" || s.Depth < len(expected)-1 || s.Delivered != 0 {
+		t.Fatalf("Unexpected stats of the listener: %+v", s)
+	}
+
+	// the queued events are delivered in order when the controller is stopped
+	close(listener.gate)
+	shutdown()
+	if len(listener.events) != len(expected) {
+		t.Fatalf("Expected %d events after draining, got %d", len(expected), len(listener.events))
+	}
+	for _, e := range expected {
+		if received := <-listener.events; received != e {
+			t.Fatalf("Expected event %s, got %s", e, received)
+		}
+	}
+}
+
+func TestListenerStuck(t *testing.T) {
+	controller, shutdown, err := setupWithConf(ControllerConf{ListenerQueue: ListenerQueueConf{Size: 2}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	listener := newGatedListener()
+	controller.AddListener(listener)
+
+	// the changes do not wait for the listener by default
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 10; i++ {
+			_, err := controller.add(Service{ID: fmt.Sprintf("service_%d", i), Type: "_test._tcp", TTL: 30}, actor{})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Services are not added while a listener is stuck")
+	}
+	if stats := queueStats(t, controller).Listeners[0]; stats.Dropped == 0 {
+		t.Fatalf("Expected dropped events, got: %+v", stats)
+	}
+
+	close(listener.gate)
+	shutdown()
+}
+
+func TestListenerOverflow(t *testing.T) {
+	for _, overflow := range []string{OverflowDropNewest, OverflowDropOldest} {
+		controller, shutdown, err := setupWithConf(ControllerConf{ListenerQueue: ListenerQueueConf{Size: 2, Overflow: overflow}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		listener := newGatedListener()
+		controller.AddListener(listener)
+
+		add := func(id string) {
+			_, err := controller.add(Service{ID: id, Type: "_test._tcp", TTL: 30}, actor{})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		// the first event is taken from the queue and waits for the gate
+		add("service_0")
+		for queueStats(t, controller).Listeners[0].Depth != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for i := 1; i <= 4; i++ {
+			add(fmt.Sprintf("service_%d", i))
+		}
+
+		stats := queueStats(t, controller).Listeners[0]
+		if stats.Depth != 2 || stats.Dropped != 2 {
+			t.Fatalf("%s: Unexpected stats: %+v", overflow, stats)
+		}
+
+		close(listener.gate)
+		shutdown()
+		expected := []string{"added service_0", "added service_1", "added service_2"}
+		if overflow == OverflowDropOldest {
+			expected = []string{"added service_0", "added service_3", "added service_4"}
+		}
+		if len(listener.events) != len(expected) {
+			t.Fatalf("%s: Expected %d events, got %d", overflow, len(expected), len(listener.events))
+		}
+		for _, e := range expected {
+			if received := <-listener.events; received != e {
+				t.Fatalf("%s: Expected event %s, got %s", overflow, e, received)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Conflict policies for importing a service whose id already exists in the storage
+const (
+	ImportPolicySkip      = "skip"      // keep the stored service
+	ImportPolicyOverwrite = "overwrite" // replace the stored service
+	ImportPolicyFail      = "fail"      // abort the import without any changes
+)
+
+// maxDumpLineSize is the maximum size of a service in a dump
+const maxDumpLineSize = 16 * 1024 * 1024
+
+// ImportResult summarizes an import
+type ImportResult struct {
+	Added       int `json:"added"`
+	Overwritten int `json:"overwritten"`
+	Skipped     int `json:"skipped"`
+	Deleted     int `json:"deleted,omitempty"`
+}
+
+// Export writes all services in the storage to w as newline-delimited JSON (NDJSON)
+// It returns the number of exported services.
+func Export(storage Storage, w io.Writer) (int, error) {
+	snapshot, err := storage.snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.release()
+
+	return writeSnapshot(snapshot, w)
+}
+
+// writeSnapshot writes all services in the snapshot to w as newline-delimited JSON (NDJSON)
+func writeSnapshot(snapshot snapshot, w io.Writer) (int, error) {
+	encoder := json.NewEncoder(w)
+
+	n := 0
+	for after := ""; ; {
+		services, err := snapshot.listAfter(after, MaxPerPage)
+		if err != nil {
+			return n, err
+		}
+
+		for i := range services {
+			err = encoder.Encode(services[i])
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+
+		if len(services) < MaxPerPage {
+			return n, nil
+		}
+		after = services[len(services)-1].ID
+	}
+}
+
+// Import reads services as newline-delimited JSON (NDJSON) from r and stores them
+// The timestamps of the services are preserved. Missing timestamps are set based on the current time.
+// If validate is true, services are checked with the same rules as for registrations.
+// The whole input is parsed and checked before storing anything.
+func Import(storage Storage, r io.Reader, policy string, validate bool) (*ImportResult, error) {
+	switch policy {
+	case ImportPolicySkip, ImportPolicyOverwrite, ImportPolicyFail:
+	default:
+		return nil, fmt.Errorf("unknown import policy: %s", policy)
+	}
+
+	services, err := readDump(r, validate)
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == ImportPolicyFail {
+		for _, s := range services {
+			_, err := storage.get(s.ID)
+			if err == nil {
+				return nil, &ConflictError{fmt.Sprintf("Service id %s already exists", s.ID)}
+			} else if _, notFound := err.(*NotFoundError); !notFound {
+				return nil, err
+			}
+		}
+	}
+
+	var result ImportResult
+	for i := range services {
+		err := storage.add(&services[i])
+		if err == nil {
+			result.Added++
+			continue
+		} else if _, conflict := err.(*ConflictError); !conflict {
+			return &result, err
+		}
+
+		switch policy {
+		case ImportPolicyOverwrite:
+			err = storage.update(services[i].ID, &services[i])
+			if err != nil {
+				return &result, err
+			}
+			result.Overwritten++
+		case ImportPolicySkip:
+			result.Skipped++
+		default:
+			return &result, err
+		}
+	}
+
+	return &result, nil
+}
+
+func readDump(r io.Reader, validate bool) ([]Service, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxDumpLineSize)
+
+	var services []Service
+	ids := make(map[string]bool)
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+
+		var s Service
+		err := json.Unmarshal(b, &s)
+		if err != nil {
+			return nil, &BadRequestError{fmt.Sprintf("line %d: error parsing service: %s", line, err)}
+		}
+		if s.ID == "" {
+			return nil, &BadRequestError{fmt.Sprintf("line %d: service id is not defined", line)}
+		}
+		if ids[s.ID] {
+			return nil, &BadRequestError{fmt.Sprintf("line %d: service id %s is not unique", line, s.ID)}
+		}
+		ids[s.ID] = true
+		if validate {
+			if err := s.validate(); err != nil {
+				return nil, &BadRequestError{fmt.Sprintf("line %d: invalid service %s: %s", line, s.ID, err)}
+			}
+		}
+
+		if s.CreatedAt.IsZero() {
+			s.CreatedAt = time.Now().UTC()
+		}
+		if s.UpdatedAt.IsZero() {
+			s.UpdatedAt = s.CreatedAt
+		}
+		if s.ExpiresAt.IsZero() {
+			s.ExpiresAt = s.UpdatedAt.Add(time.Duration(s.TTL) * time.Second)
+		}
+		services = append(services, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
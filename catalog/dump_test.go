@@ -0,0 +1,113 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	t.Log(TestStorageType)
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+
+	for i := 0; i < 3; i++ {
+		_, err := controller.add(Service{
+			ID:   fmt.Sprintf("service_%d", i),
+			Type: "_test._tcp",
+			TTL:  30,
+		}, actor{})
+		if err != nil {
+			t.Fatal("Error adding a service:", err.Error())
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	var dump bytes.Buffer
+	n, err := Export(controller.storage, &dump)
+	if err != nil {
+		t.Fatal("Error exporting:", err.Error())
+	}
+	if n != 3 || strings.Count(dump.String(), "\n") != 3 {
+		t.Fatalf("Expected 3 lines in the dump, got %d:\n%s", n, dump.String())
+	}
+
+	controller2, shutdown2, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown2()
+
+	result, err := Import(controller2.storage, bytes.NewReader(dump.Bytes()), ImportPolicyFail, true)
+	if err != nil {
+		t.Fatal("Error importing:", err.Error())
+	}
+	if result.Added != 3 {
+		t.Fatalf("Expected 3 added services, got %+v", result)
+	}
+
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("service_%d", i)
+		s1, _ := controller.get(id)
+		s2, err := controller2.get(id)
+		if err != nil {
+			t.Fatalf("Imported service %s is not found: %s", id, err)
+		}
+		if !s1.CreatedAt.Equal(s2.CreatedAt) || !s1.UpdatedAt.Equal(s2.UpdatedAt) || !s1.ExpiresAt.Equal(s2.ExpiresAt) {
+			t.Fatalf("Timestamps are not preserved:\n Exported: %v\n Imported: %v", s1, s2)
+		}
+	}
+
+	// Conflicts
+	conflicting := `{"id":"service_0","type":"_changed._tcp","ttl":30}` + "\n" + `{"id":"service_9","type":"_test._tcp","ttl":30}`
+
+	_, err = Import(controller2.storage, strings.NewReader(conflicting), ImportPolicyFail, true)
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("Expected a conflict error with the fail policy, got: %v", err)
+	}
+	if _, err := controller2.get("service_9"); err == nil {
+		t.Fatal("Import with the fail policy stored services despite the conflict")
+	}
+
+	result, err = Import(controller2.storage, strings.NewReader(conflicting), ImportPolicySkip, true)
+	if err != nil {
+		t.Fatal("Error importing:", err.Error())
+	}
+	if result.Added != 1 || result.Skipped != 1 {
+		t.Fatalf("Expected 1 added and 1 skipped service, got %+v", result)
+	}
+	s, _ := controller2.get("service_0")
+	if s.Type != "_test._tcp" {
+		t.Fatalf("Import with the skip policy changed the stored service: %v", s)
+	}
+
+	result, err = Import(controller2.storage, strings.NewReader(conflicting), ImportPolicyOverwrite, true)
+	if err != nil {
+		t.Fatal("Error importing:", err.Error())
+	}
+	if result.Overwritten != 2 {
+		t.Fatalf("Expected 2 overwritten services, got %+v", result)
+	}
+	s, _ = controller2.get("service_0")
+	if s.Type != "_changed._tcp" {
+		t.Fatalf("Import with the overwrite policy did not change the stored service: %v", s)
+	}
+
+	// Validation
+	invalid := `{"id":"service_10","type":"_test._tcp","ttl":0}`
+	_, err = Import(controller2.storage, strings.NewReader(invalid), ImportPolicyFail, true)
+	if _, ok := err.(*BadRequestError); !ok {
+		t.Fatalf("Expected a bad request error for an invalid service, got: %v", err)
+	}
+	_, err = Import(controller2.storage, strings.NewReader(invalid), ImportPolicyFail, false)
+	if err != nil {
+		t.Fatal("Error importing without validation:", err.Error())
+	}
+}
@@ -16,3 +16,28 @@ func (e *ConflictError) Error() string { return e.Msg }
 type BadRequestError struct{ Msg string }
 
 func (e *BadRequestError) Error() string { return e.Msg }
+
+// Unauthorized (missing or invalid admin token)
+type UnauthorizedError struct{ Msg string }
+
+func (e *UnauthorizedError) Error() string { return e.Msg }
+
+// Forbidden (modification of a service owned by another user or without its token)
+type ForbiddenError struct{ Msg string }
+
+func (e *ForbiddenError) Error() string { return e.Msg }
+
+// Precondition Failed (mismatching revision)
+type PreconditionFailedError struct{ Msg string }
+
+func (e *PreconditionFailedError) Error() string { return e.Msg }
+
+// Gone (changes which are no longer kept)
+type GoneError struct{ Msg string }
+
+func (e *GoneError) Error() string { return e.Msg }
+
+// Stale transaction (read a service or a record modified concurrently on another node of the cluster)
+type staleError struct{ Msg string }
+
+func (e *staleError) Error() string { return e.Msg }
@@ -0,0 +1,124 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+	"time"
+)
+
+// States of the lifecycle of a service
+// A service is expired when it is not renewed within its TTL. It is removed after the grace period.
+const (
+	StateActive  = "active"
+	StateExpired = "expired"
+)
+
+// GetParamExcludeExpired is the query parameter for excluding expired services from listing and filtering
+const GetParamExcludeExpired = "excludeExpired"
+
+const (
+	defaultExpiryGraceFraction   = 0.5
+	defaultExpiryCleanupInterval = 60
+)
+
+// ExpiryConf is the configuration of the expiry of services
+type ExpiryConf struct {
+	// GraceFraction is the fraction of the TTL for which an expired service is kept before it is removed. Defaults to 0.5.
+	// Expired services are removed at the next cleanup if zero.
+	GraceFraction *float64 `json:"graceFraction"`
+	// CleanupInterval is the interval in seconds of flagging and removing expired services. Defaults to 60.
+	CleanupInterval uint `json:"cleanupInterval"`
+}
+
+func (c ExpiryConf) Validate() error {
+	if c.GraceFraction != nil && *c.GraceFraction < 0 {
+		return fmt.Errorf("expiry: graceFraction must not be negative")
+	}
+	return nil
+}
+
+// withDefaults returns the configuration with the defaults of the unset fields
+func (c ExpiryConf) withDefaults() ExpiryConf {
+	if c.GraceFraction == nil {
+		graceFraction := defaultExpiryGraceFraction
+		c.GraceFraction = &graceFraction
+	}
+	if c.CleanupInterval == 0 {
+		c.CleanupInterval = defaultExpiryCleanupInterval
+	}
+	return c
+}
+
+// gracePeriod returns the time for which a service is kept after its expiry
+func (c ExpiryConf) gracePeriod(s *Service) time.Duration {
+	return time.Duration(*c.GraceFraction * float64(s.TTL) * float64(time.Second))
+}
+
+// cleanExpired periodically flags the services whose expiry is overdue, and removes them after the grace period
+func (c *Controller) cleanExpired() {
+	clean := func(t time.Time) {
+		// in a cluster, only the leader flags and removes the expired services
+		if m, ok := c.storage.(clusterMember); ok && !m.isLeader() {
+			return
+		}
+
+		c.Lock()
+		defer c.Unlock()
+
+		var expiredServices, removedServices []*Service
+		for s := range c.storage.iterator() {
+			if t.After(s.ExpiresAt.Add(c.expiry.gracePeriod(s))) {
+				removedServices = append(removedServices, s)
+			} else if t.After(s.ExpiresAt) && s.State != StateExpired {
+				expiredServices = append(expiredServices, s)
+			}
+		}
+
+		for _, s := range expiredServices {
+			logger.Printf("cleanExpired() Flagging expired registration: %s", s.ID)
+			err := c.transact(func(tx *txn) error {
+				// the service may have been renewed on another node of the cluster
+				ss, err := tx.get(s.ID)
+				if err != nil || !t.After(ss.ExpiresAt) || ss.State == StateExpired {
+					return err
+				}
+				ss.State = StateExpired
+				err = tx.update(ss)
+				if err != nil {
+					return err
+				}
+				return c.notifyExpired(tx, *ss)
+			})
+			if err != nil {
+				logger.Printf("cleanExpired() Error flagging expired registration: %s: %s", s.ID, err)
+			}
+		}
+
+		for _, s := range removedServices {
+			logger.Printf("cleanExpired() Removing expired registration: %s", s.ID)
+			err := c.transact(func(tx *txn) error {
+				ss, err := tx.get(s.ID)
+				if err != nil || !t.After(ss.ExpiresAt.Add(c.expiry.gracePeriod(ss))) {
+					return err
+				}
+				err = tx.delete(ss.ID)
+				if err != nil {
+					return err
+				}
+				return c.notifyDeleted(tx, *ss, actor{origin: OriginExpiry})
+			})
+			if err != nil {
+				logger.Printf("cleanExpired() Error removing expired registration: %s: %s", s.ID, err)
+			}
+		}
+		if err := c.pruneHistory(t); err != nil {
+			logger.Printf("cleanExpired() Error removing the histories of deleted services: %s", err)
+		}
+	}
+
+	clean(time.Now())
+	for t := range time.Tick(time.Duration(c.expiry.CleanupInterval) * time.Second) {
+		clean(t)
+	}
+}
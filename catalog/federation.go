@@ -0,0 +1,275 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/linksmart/service-catalog/v3/utils"
+)
+
+// MetaKeyFederationOrigin is the meta key with the id of the catalog from which a service is imported
+// Imported services are read-only. The key cannot be set on local services.
+const MetaKeyFederationOrigin = "federationOrigin"
+
+// federationOriginPath is the indexed path of the origin of imported services
+const federationOriginPath = "meta." + MetaKeyFederationOrigin
+
+// Views of the catalog
+const (
+	ViewAll       = "all"       // local and imported services
+	ViewLocal     = "local"     // services registered in this catalog
+	ViewFederated = "federated" // services imported from peer catalogs
+)
+
+// GetParamView is the query parameter for selecting a view of the catalog
+const GetParamView = "view"
+
+// SyncResult summarizes a synchronization with a peer catalog
+type SyncResult struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+	// Skipped are the services which are invalid, expired, imported by the peer itself, or whose ids are taken
+	Skipped int `json:"skipped"`
+}
+
+// federationOrigin returns the id of the catalog from which the service is imported, or an empty string for local services
+func federationOrigin(s *Service) string {
+	origin, _ := s.Meta[MetaKeyFederationOrigin].(string)
+	return origin
+}
+
+// SyncFederated makes the services imported from the origin catalog identical to the given ones
+// Services keep their timestamps and expire based on their TTL if they are not synchronized again.
+// Services which are imported by the origin from other catalogs are not imported to avoid cycles.
+// Local services and services imported from other catalogs take precedence over imported ones with the same id.
+func (c *Controller) SyncFederated(origin string, services []Service) (*SyncResult, error) {
+	if origin == "" {
+		return nil, &BadRequestError{"origin is not defined"}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	ids, err := c.filterIDs(federationOriginPath, utils.FOpEquals, origin)
+	if err != nil {
+		return nil, err
+	}
+	var result SyncResult
+	now := time.Now().UTC()
+	synced := make(map[string]bool, len(services))
+	for i := range services {
+		s := services[i]
+		if federationOrigin(&s) != "" || s.validate() != nil || s.ExpiresAt.Before(now) || synced[s.ID] {
+			result.Skipped++
+			continue
+		}
+		synced[s.ID] = true
+
+		meta := make(map[string]interface{}, len(s.Meta)+1)
+		for k, v := range s.Meta {
+			meta[k] = v
+		}
+		meta[MetaKeyFederationOrigin] = origin
+		s.Meta = meta
+
+		// counter is the count of the result which the synchronization of the service adds to
+		var counter *int
+		err := c.transact(func(tx *txn) error {
+			counter = nil
+			stored, err := tx.get(s.ID)
+			if _, notFound := err.(*NotFoundError); notFound {
+				err = tx.add(&s)
+				if err != nil {
+					return err
+				}
+				if err := c.notifyAdded(tx, s, actor{origin: OriginFederation}); err != nil {
+					return err
+				}
+				counter = &result.Added
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if federationOrigin(stored) != origin {
+				// the id is taken by a local service or one of another catalog
+				counter = &result.Skipped
+				return nil
+			}
+			if reflect.DeepEqual(*stored, s) {
+				return nil
+			}
+			err = tx.update(&s)
+			if err != nil {
+				return err
+			}
+			if err := c.notifyUpdated(tx, s, actor{origin: OriginFederation}); err != nil {
+				return err
+			}
+			counter = &result.Updated
+			return nil
+		})
+		if err != nil {
+			return &result, err
+		}
+		if counter != nil {
+			*counter++
+		}
+	}
+
+	for _, id := range ids {
+		if synced[id] {
+			continue
+		}
+		err := c.transact(func(tx *txn) error {
+			old, err := tx.get(id)
+			if err != nil {
+				return err
+			}
+			err = tx.delete(id)
+			if err != nil {
+				return err
+			}
+			return c.notifyDeleted(tx, *old, actor{origin: OriginFederation})
+		})
+		if err != nil {
+			return &result, err
+		}
+		result.Removed++
+	}
+
+	return &result, nil
+}
+
+// viewIDs returns the sorted ids of the services in the view which match the filter and the selection
+// An empty path matches all services.
+func (c *Controller) viewIDs(view, path, op, value string, sel selection) ([]string, error) {
+	var (
+		ids []string
+		err error
+	)
+	switch view {
+	case "", ViewAll:
+		if path != "" {
+			ids, err = c.filterIDs(path, op, value)
+			path = ""
+		} else {
+			ids, err = c.scanIDs(func(s *Service) bool { return true })
+		}
+	case ViewFederated:
+		ids, err = c.filterIDs(federationOriginPath, utils.FOpPrefix, "")
+	case ViewLocal:
+		ids, err = c.scanIDs(func(s *Service) bool { return federationOrigin(s) == "" })
+	default:
+		return nil, &BadRequestError{fmt.Sprintf("Unknown view: %s", view)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		matched, err := c.filterIDs(path, op, value)
+		if err != nil {
+			return nil, err
+		}
+		ids = intersectSorted(ids, matched)
+	}
+	if sel.excludeExpired {
+		expired, err := c.scanIDs(func(s *Service) bool { return s.State == StateExpired })
+		if err != nil {
+			return nil, err
+		}
+		ids = subtractSorted(ids, expired)
+	}
+	if sel.healthyOnly {
+		if c.health == nil {
+			return nil, &BadRequestError{"Health checking is not enabled"}
+		}
+		healthy, err := c.scanIDs(func(s *Service) bool { return s.Health != nil && s.Health.Status == HealthHealthy })
+		if err != nil {
+			return nil, err
+		}
+		ids = intersectSorted(ids, healthy)
+	}
+	return ids, nil
+}
+
+// scanIDs returns the sorted ids of the services for which match returns true, scanning the whole catalog
+func (c *Controller) scanIDs(match func(s *Service) bool) ([]string, error) {
+	ids := []string{}
+	for after := ""; ; {
+		services, err := c.storage.listAfter(after, MaxPerPage)
+		if err != nil {
+			return nil, err
+		}
+		for i := range services {
+			if match(&services[i]) {
+				ids = append(ids, services[i].ID)
+			}
+		}
+		if len(services) < MaxPerPage {
+			break
+		}
+		after = services[len(services)-1].ID
+	}
+	return ids, nil
+}
+
+// view returns a page of the services in the view which match the filter, and the total
+func (c *Controller) view(view, path, op, value string, sel selection, page, perPage int) ([]Service, int, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	ids, err := c.viewIDs(view, path, op, value, sel)
+	if err != nil {
+		return nil, 0, err
+	}
+	return c.pageIDs(ids, page, perPage)
+}
+
+// viewAfter returns a page of the services in the view which match the filter with ids greater than after,
+// whether more services follow, and the total
+func (c *Controller) viewAfter(view, path, op, value string, sel selection, after string, perPage int) ([]Service, bool, int, error) {
+	err := utils.ValidatePagingParams(1, perPage, MaxPerPage)
+	if err != nil {
+		return nil, false, 0, &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+
+	ids, err := c.viewIDs(view, path, op, value, sel)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return c.pageIDsAfter(ids, after, perPage)
+}
+
+// intersectSorted returns the elements of the sorted slice a which are also in the sorted slice b
+func intersectSorted(a, b []string) []string {
+	result := []string{}
+	for _, s := range a {
+		i := sort.SearchStrings(b, s)
+		if i < len(b) && b[i] == s {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// subtractSorted returns the elements of the sorted slice a which are not in the sorted slice b
+func subtractSorted(a, b []string) []string {
+	result := []string{}
+	for _, s := range a {
+		i := sort.SearchStrings(b, s)
+		if i == len(b) || b[i] != s {
+			result = append(result, s)
+		}
+	}
+	return result
+}
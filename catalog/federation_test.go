@@ -0,0 +1,97 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyncFederated(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+
+	_, err = controller.add(Service{ID: "local_1", Type: "_test._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal("Error adding a local service:", err.Error())
+	}
+	_, err = controller.add(Service{ID: "local_2", Type: "_test._tcp", TTL: 30, Meta: map[string]interface{}{MetaKeyFederationOrigin: "peer"}}, actor{})
+	if _, ok := err.(*BadRequestError); !ok {
+		t.Fatalf("Expected a bad request error for a local service with the origin key, got: %v", err)
+	}
+
+	now := time.Now().UTC()
+	peerService := func(id string, ttl uint32) Service {
+		return Service{ID: id, Type: "_test._tcp", TTL: ttl, CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(time.Duration(ttl) * time.Second)}
+	}
+	expired := peerService("expired_1", 30)
+	expired.ExpiresAt = now.Add(-time.Second)
+	reimported := peerService("other_1", 30)
+	reimported.Meta = map[string]interface{}{MetaKeyFederationOrigin: "other"}
+
+	result, err := controller.SyncFederated("peer", []Service{peerService("peer_1", 30), peerService("local_1", 30), expired, reimported})
+	if err != nil {
+		t.Fatal("Error synchronizing:", err.Error())
+	}
+	if result.Added != 1 || result.Skipped != 3 {
+		t.Fatalf("Unexpected result of the first synchronization: %+v", result)
+	}
+	s, err := controller.get("peer_1")
+	if err != nil {
+		t.Fatal("Imported service is not found:", err.Error())
+	}
+	if federationOrigin(s) != "peer" || !s.ExpiresAt.Equal(now.Add(30*time.Second)) {
+		t.Fatalf("Imported service is not tagged or its expiry is not kept: %+v", s)
+	}
+	if s, _ := controller.get("local_1"); federationOrigin(s) != "" {
+		t.Fatal("Local service is overwritten by an imported one")
+	}
+
+	// Imported services are read-only
+	_, err = controller.update("peer_1", Service{Type: "_test._tcp", TTL: 30}, actor{})
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("Expected a conflict error for updating an imported service, got: %v", err)
+	}
+	err = controller.delete("peer_1", actor{})
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("Expected a conflict error for deleting an imported service, got: %v", err)
+	}
+
+	// Views
+	services, total, err := controller.view(ViewLocal, "", "", "", selection{}, 1, MaxPerPage)
+	if err != nil || total != 1 || services[0].ID != "local_1" {
+		t.Fatalf("Unexpected local view: %v, %v", services, err)
+	}
+	services, total, err = controller.view(ViewFederated, "type", "equals", "_test._tcp", selection{}, 1, MaxPerPage)
+	if err != nil || total != 1 || services[0].ID != "peer_1" {
+		t.Fatalf("Unexpected filtered federated view: %v, %v", services, err)
+	}
+	_, _, err = controller.view("unknown", "", "", "", selection{}, 1, MaxPerPage)
+	if _, ok := err.(*BadRequestError); !ok {
+		t.Fatalf("Expected a bad request error for an unknown view, got: %v", err)
+	}
+
+	// Changed services are updated and missing ones are removed
+	changed := peerService("peer_1", 60)
+	result, err = controller.SyncFederated("peer", []Service{changed})
+	if err != nil || result.Updated != 1 {
+		t.Fatalf("Unexpected result of the second synchronization: %+v, %v", result, err)
+	}
+	if s, _ := controller.get("peer_1"); s.TTL != 60 {
+		t.Fatal("Imported service is not updated")
+	}
+	result, err = controller.SyncFederated("peer", []Service{changed})
+	if err != nil || result.Updated != 0 {
+		t.Fatalf("Unchanged service is updated: %+v, %v", result, err)
+	}
+	result, err = controller.SyncFederated("peer", nil)
+	if err != nil || result.Removed != 1 {
+		t.Fatalf("Unexpected result of the third synchronization: %+v, %v", result, err)
+	}
+	if total, _ := controller.total(); total != 1 {
+		t.Fatalf("Expected only the local service after the removal, got %d services", total)
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Health statuses of services and their APIs
+const (
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+const (
+	// APIMetaKeyHealthPath is the API meta key with the path requested to check the health of an HTTP API, e.g. /health
+	// HTTP APIs without a health path are checked by connecting to their port.
+	APIMetaKeyHealthPath = "healthPath"
+	// GetParamHealthyOnly is the query parameter for listing and filtering only the healthy services
+	GetParamHealthyOnly = "healthyOnly"
+
+	defaultHealthTimeout = 5
+	// number of services checked concurrently
+	healthCheckConcurrency = 10
+)
+
+// default ports of the URL schemes of APIs which are checked with a TCP connect
+var healthDefaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+	"tcp":   "1883",
+	"mqtt":  "1883",
+	"ssl":   "8883",
+	"tls":   "8883",
+	"mqtts": "8883",
+}
+
+// HealthConf is the configuration of the health checks of the APIs of services
+type HealthConf struct {
+	// Interval is the interval in seconds of checking all services. Health checking is disabled if zero.
+	Interval uint `json:"interval"`
+	// Timeout is the timeout in seconds of checking an API. Defaults to 5.
+	Timeout uint `json:"timeout"`
+}
+
+// Health is the result of the latest check of the APIs of a service
+type Health struct {
+	// Status is healthy if all checked APIs are healthy
+	Status string `json:"status"`
+	// CheckedAt is the time of the latest check
+	CheckedAt time.Time `json:"checkedAt"`
+	// Latency is the longest latency of the checked APIs in milliseconds
+	Latency int64       `json:"latency"`
+	APIs    []APIHealth `json:"apis"`
+}
+
+// APIHealth is the result of checking an API
+type APIHealth struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Latency is the time in milliseconds until the API responded or the check failed
+	Latency int64  `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// healthChecker periodically checks the APIs of all services
+type healthChecker struct {
+	conf   HealthConf
+	client *http.Client
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newHealthChecker(conf HealthConf) *healthChecker {
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultHealthTimeout
+	}
+	return &healthChecker{
+		conf:   conf,
+		client: &http.Client{Timeout: time.Duration(conf.Timeout) * time.Second},
+		done:   make(chan struct{}),
+	}
+}
+
+func (h *healthChecker) timeout() time.Duration {
+	return time.Duration(h.conf.Timeout) * time.Second
+}
+
+// check probes the APIs of a service
+// It returns nil if none of the APIs can be checked.
+func (h *healthChecker) check(s Service) *Health {
+	health := Health{
+		Status:    HealthHealthy,
+		CheckedAt: time.Now().UTC(),
+		APIs:      []APIHealth{},
+	}
+	for _, api := range s.APIs {
+		start := time.Now()
+		checked, err := h.probe(api)
+		if !checked {
+			continue
+		}
+		result := APIHealth{
+			ID:      api.ID,
+			Status:  HealthHealthy,
+			Latency: int64(time.Since(start) / time.Millisecond),
+		}
+		if err != nil {
+			result.Status = HealthUnhealthy
+			result.Error = err.Error()
+			health.Status = HealthUnhealthy
+		}
+		if result.Latency > health.Latency {
+			health.Latency = result.Latency
+		}
+		health.APIs = append(health.APIs, result)
+	}
+	if len(health.APIs) == 0 {
+		return nil
+	}
+	return &health
+}
+
+// probe checks an API based on its protocol
+// It returns false if the API has no URL with a host to be checked.
+func (h *healthChecker) probe(api API) (bool, error) {
+	u, err := url.Parse(api.URL)
+	if err != nil || u.Host == "" {
+		return false, nil
+	}
+	switch strings.ToUpper(api.Protocol) {
+	case APITypeHTTP, "HTTPS":
+		if path, _ := api.Meta[APIMetaKeyHealthPath].(string); path != "" {
+			return true, h.probeHTTP(u, path)
+		}
+	case APITypeMQTT:
+		return true, h.probeMQTT(u)
+	}
+	return true, h.probeTCP(u)
+}
+
+// probeHTTP requests the health path relative to the URL of the API and expects a successful response
+func (h *healthChecker) probeHTTP(u *url.URL, path string) error {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return fmt.Errorf("invalid health path: %s", path)
+	}
+	res, err := h.client.Get(u.ResolveReference(ref).String())
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("health path responded with %s", res.Status)
+	}
+	return nil
+}
+
+// hostPort returns the host of the URL with the default port of its scheme if it has no port
+func hostPort(u *url.URL) (string, error) {
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	port, found := healthDefaultPorts[u.Scheme]
+	if !found {
+		return "", fmt.Errorf("no port in %s", u.Host)
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// mqttSchemes are the schemes of the MQTT client for the schemes of the broker URLs which it does not support
+var mqttSchemes = map[string]string{
+	"mqtt":  "tcp",
+	"mqtts": "ssl",
+}
+
+// mqttBrokerURL returns the URL of a broker with a scheme supported by the MQTT client and with a port
+func mqttBrokerURL(u *url.URL) (string, error) {
+	host, err := hostPort(u)
+	if err != nil {
+		return "", err
+	}
+	broker := *u
+	broker.Host = host
+	if scheme, found := mqttSchemes[u.Scheme]; found {
+		broker.Scheme = scheme
+	}
+	return broker.String(), nil
+}
+
+// probeTCP connects to the host of the URL
+func (h *healthChecker) probeTCP(u *url.URL) error {
+	host, err := hostPort(u)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", host, h.timeout())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeMQTT connects to the broker of the URL
+func (h *healthChecker) probeMQTT(u *url.URL) error {
+	// the client does not report refused connections before the timeout
+	if err := h.probeTCP(u); err != nil {
+		return err
+	}
+	broker, err := mqttBrokerURL(u)
+	if err != nil {
+		return err
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID("sc-health-" + uuid.NewV4().String()).
+		SetConnectTimeout(h.timeout()).
+		SetAutoReconnect(false)
+	client := paho.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(h.timeout()) {
+		return fmt.Errorf("timeout connecting to %s", u.Host)
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	client.Disconnect(0)
+	return nil
+}
+
+func (h *healthChecker) stop() {
+	close(h.done)
+	h.wg.Wait()
+}
+
+// EnableHealthChecks starts checking the APIs of the services periodically
+func (c *Controller) EnableHealthChecks(conf HealthConf) {
+	if conf.Interval == 0 {
+		return
+	}
+	h := newHealthChecker(conf)
+	c.Lock()
+	c.health = h
+	c.Unlock()
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		ticker := time.NewTicker(time.Duration(conf.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			c.checkHealth(h)
+			select {
+			case <-ticker.C:
+			case <-h.done:
+				return
+			}
+		}
+	}()
+}
+
+// checkHealth checks the APIs of all services
+func (c *Controller) checkHealth(h *healthChecker) {
+	// in a cluster, only the leader checks the services
+	if m, ok := c.storage.(clusterMember); ok && !m.isLeader() {
+		return
+	}
+
+	// imported services are checked by the catalogs from which they are imported
+	c.RLock()
+	var services []Service
+	for s := range c.storage.iterator() {
+		if federationOrigin(s) == "" {
+			services = append(services, *s)
+		}
+	}
+	c.RUnlock()
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, healthCheckConcurrency)
+	for i := range services {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(s Service) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if health := h.check(s); health != nil {
+				c.setHealth(s, health)
+			}
+		}(services[i])
+	}
+	wg.Wait()
+}
+
+// setHealth stores the health of a checked service and notifies the listeners if its status changed
+// The health does not change the revision of the service, so that it does not fail the conditional updates of clients.
+// It is discarded if the service is modified or removed during the check.
+func (c *Controller) setHealth(checked Service, health *Health) {
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.transact(func(tx *txn) error {
+		ss, err := tx.get(checked.ID)
+		if err != nil || ss.Revision != checked.Revision {
+			return nil
+		}
+		changed := ss.Health == nil || ss.Health.Status != health.Status
+		ss.Health = health
+
+		err = tx.update(ss)
+		if err != nil || !changed {
+			return err
+		}
+		return c.notifyHealthChanged(tx, *ss)
+	})
+	if err != nil {
+		logger.Printf("Error storing the health of service %s: %s", checked.ID, err)
+	}
+}
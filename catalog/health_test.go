@@ -0,0 +1,208 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthChecks(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	events := make(eventListener, 10)
+	controller.AddListener(events)
+
+	var down int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/health" || atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	// a closed port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	closedURL := "tcp://" + listener.Addr().String()
+	listener.Close()
+
+	_, _, err = controller.view(ViewAll, "", "", "", selection{healthyOnly: true}, 1, MaxPerPage)
+	if _, ok := err.(*BadRequestError); !ok {
+		t.Fatalf("Expected BadRequestError when health checking is disabled, got: %v", err)
+	}
+	controller.EnableHealthChecks(HealthConf{Interval: 3600, Timeout: 1})
+
+	checked, err := controller.add(Service{ID: "checked", Type: "_test._tcp", TTL: 30, APIs: []API{
+		{ID: "http", Protocol: APITypeHTTP, URL: server.URL + "/api/", Meta: map[string]interface{}{APIMetaKeyHealthPath: "health"}},
+		{ID: "tcp", Protocol: "TCP", URL: server.URL},
+	}}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	unreachable, err := controller.add(Service{ID: "unreachable", Type: "_test._tcp", TTL: 30, APIs: []API{
+		{ID: "mqtt", Protocol: APITypeMQTT, URL: closedURL},
+	}}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = controller.add(Service{ID: "unchecked", Type: "_test._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expectEvents := func(expected map[string]bool) {
+		for range expected {
+			e := <-events
+			if !expected[e] {
+				t.Fatalf("Unexpected event: %s", e)
+			}
+		}
+		select {
+		case e := <-events:
+			t.Fatalf("Unexpected event: %s", e)
+		default:
+		}
+	}
+
+	// the first check may also be started in the background before the services are added
+	controller.checkHealth(controller.health)
+	expectEvents(map[string]bool{
+		"added " + checked.ID: true, "added " + unreachable.ID: true, "added unchecked": true,
+		"health " + checked.ID: true, "health " + unreachable.ID: true,
+	})
+
+	s, _ := controller.get(checked.ID)
+	if s.Health == nil || s.Health.Status != HealthHealthy || len(s.Health.APIs) != 2 || s.Revision != checked.Revision {
+		t.Fatalf("Unexpected health of %s: %+v", s.ID, s.Health)
+	}
+	s, _ = controller.get(unreachable.ID)
+	if s.Health == nil || s.Health.Status != HealthUnhealthy || s.Health.APIs[0].Error == "" {
+		t.Fatalf("Unexpected health of %s: %+v", s.ID, s.Health)
+	}
+	s, _ = controller.get("unchecked")
+	if s.Health != nil {
+		t.Fatalf("Service without APIs should not be checked: %+v", s.Health)
+	}
+
+	services, total, err := controller.view(ViewAll, "type", "equals", "_test._tcp", selection{healthyOnly: true}, 1, MaxPerPage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total != 1 || services[0].ID != checked.ID {
+		t.Fatalf("Expected only the healthy service, got: %v", services)
+	}
+
+	// every check is stored with a new entity tag, but only transitions are notified
+	healthy, _ := controller.get(checked.ID)
+	controller.checkHealth(controller.health)
+	expectEvents(map[string]bool{})
+	s, _ = controller.get(checked.ID)
+	if !s.Health.CheckedAt.After(healthy.Health.CheckedAt) || s.ETag() == healthy.ETag() {
+		t.Fatalf("Expected the time of the latest check, got: %+v", s.Health)
+	}
+	if s.Revision != healthy.Revision {
+		t.Fatalf("Health check should not change the revision: %d", s.Revision)
+	}
+	atomic.StoreInt32(&down, 1)
+	controller.checkHealth(controller.health)
+	expectEvents(map[string]bool{"health " + checked.ID: true})
+	s, _ = controller.get(checked.ID)
+	if s.Health.Status != HealthUnhealthy || s.Health.APIs[0].Status != HealthUnhealthy || s.Health.APIs[1].Status != HealthHealthy {
+		t.Fatalf("Unexpected health of %s: %+v", s.ID, s.Health)
+	}
+	if s.ETag() == healthy.ETag() {
+		t.Fatalf("Expected a new ETag after the change of the health status, got %s", s.ETag())
+	}
+	// a conditional update with the entity tag before the checks succeeds
+	_, err = controller.updateIf(checked.ID, Service{ID: checked.ID, Type: "_test._tcp", TTL: 30}, healthy.ETag(), actor{})
+	if err != nil {
+		t.Fatalf("Health checks should not fail a conditional update: %s", err)
+	}
+	expectEvents(map[string]bool{"updated " + checked.ID: true})
+
+	// imported services are not checked
+	imported := &Service{ID: "imported", Type: "_test._tcp", TTL: 30, Revision: 1,
+		Meta: map[string]interface{}{MetaKeyFederationOrigin: "other"},
+		APIs: []API{{ID: "mqtt", Protocol: APITypeMQTT, URL: closedURL}}}
+	err = controller.storage.add(imported)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	controller.checkHealth(controller.health)
+	expectEvents(map[string]bool{})
+	s, _ = controller.get(imported.ID)
+	if s.Health != nil || s.Revision != imported.Revision {
+		t.Fatalf("Imported service should not be checked: %+v", s.Health)
+	}
+}
+
+func TestMQTTBrokerURL(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"mqtt://broker":       "tcp://broker:1883",
+		"mqtts://broker":      "ssl://broker:8883",
+		"mqtt://broker:1884":  "tcp://broker:1884",
+		"tcp://broker":        "tcp://broker:1883",
+		"wss://broker/mqtt":   "wss://broker:443/mqtt",
+		"ssl://10.0.0.1:8884": "ssl://10.0.0.1:8884",
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		broker, err := mqttBrokerURL(u)
+		if err != nil || broker != expected {
+			t.Errorf("Expected %s for %s, got: %s %v", expected, raw, broker, err)
+		}
+	}
+}
+
+func TestProbeMQTT(t *testing.T) {
+	// a broker which accepts the connection of the client
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				// the fixed header and the remaining length of CONNECT
+				header := make([]byte, 2)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+					return
+				}
+				// CONNACK with return code accepted
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+				io.Copy(ioutil.Discard, conn)
+			}(conn)
+		}
+	}()
+
+	h := newHealthChecker(HealthConf{Interval: 3600, Timeout: 2})
+	u, err := url.Parse("mqtt://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := h.probeMQTT(u); err != nil {
+		t.Fatalf("Error probing the broker at %s: %s", u, err)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Operations in the history
+const (
+	HistoryCreated = "created"
+	HistoryUpdated = "updated"
+	HistoryDeleted = "deleted"
+	HistoryExpired = "expired"
+)
+
+// Origins of the changes in the history
+// Changes made through MQTT have the id of the broker as origin.
+const (
+	OriginHTTP       = "http"
+	OriginExpiry     = "expiry"
+	OriginFederation = "federation"
+	OriginRestore    = "restore"
+)
+
+const (
+	// recordKindHistory is the kind of the records with the history of a service, by service id
+	recordKindHistory = "history"
+	// recordKindHistoryDeleted is the kind of the records with the deletion time of a service, by service id
+	// The histories of deleted services are pruned by these records, without reading the histories of the other services.
+	recordKindHistoryDeleted = "historyDeleted"
+
+	defaultHistoryRetention = 86400
+)
+
+// HistoryConf is the configuration of the revision history of services
+type HistoryConf struct {
+	// Size is the number of revisions kept per service. The history is disabled if zero.
+	Size int `json:"size"`
+	// Retention is the time in seconds for which the history of a deleted service is kept. Defaults to 86400.
+	Retention uint `json:"retention"`
+}
+
+func (c HistoryConf) Validate() error {
+	if c.Size < 0 {
+		return fmt.Errorf("history: size must not be negative")
+	}
+	return nil
+}
+
+// withDefaults returns the configuration with the defaults of the unset fields
+func (c HistoryConf) withDefaults() HistoryConf {
+	if c.Retention == 0 {
+		c.Retention = defaultHistoryRetention
+	}
+	return c
+}
+
+// HistoryEntry is a change of a service
+type HistoryEntry struct {
+	Operation string    `json:"operation"`
+	Time      time.Time `json:"time"`
+	// Origin is http, the id of an MQTT broker, expiry, federation, or restore
+	Origin string `json:"origin"`
+	// User is the authenticated user who made the change
+	User string `json:"user,omitempty"`
+	// Service is the document after the change, or before the deletion
+	Service Service `json:"service"`
+}
+
+// History is the list of changes of a service, from the oldest to the latest
+type History struct {
+	ID      string         `json:"id"`
+	Entries []HistoryEntry `json:"entries"`
+}
+
+// actor describes who made a change
+type actor struct {
+	origin string
+	user   string
+	groups []string
+	// token is the registration token sent with the request
+	token string
+}
+
+// requestActor returns the actor of an HTTP request
+func requestActor(req *http.Request) actor {
+	a := actor{origin: OriginHTTP, token: req.Header.Get(RegistrationTokenHeader)}
+	if p := requestPrincipal(req); p != nil {
+		a.user = p.User
+		a.groups = p.Groups
+	}
+	return a
+}
+
+// history keeps the latest changes of each service as a record in the storage
+// The records are written together with the changes, which persists and replicates them with the services.
+// It is guarded by the lock of the controller.
+type history struct {
+	conf    HistoryConf
+	storage Storage
+	// indexed is set once the deletions of the histories written before the deletion records are indexed
+	indexed bool
+}
+
+// get returns the entries of the history of a service
+func (h *history) get(records recordReader, id string) ([]HistoryEntry, error) {
+	r, err := records.getRecord(recordKindHistory, id)
+	if err != nil {
+		return nil, err
+	}
+	var entries []HistoryEntry
+	err = json.Unmarshal(r.Value, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the history of %s: %s", id, err)
+	}
+	return entries, nil
+}
+
+// record writes a change in the history of the service in the transaction
+func (h *history) record(tx *txn, operation string, s Service, by actor) error {
+	entries, err := h.get(tx, s.ID)
+	if _, notFound := err.(*NotFoundError); err != nil && !notFound {
+		return err
+	}
+	entries = append(entries, HistoryEntry{
+		Operation: operation,
+		Time:      time.Now().UTC(),
+		Origin:    by.origin,
+		User:      by.user,
+		Service:   s,
+	})
+	if len(entries) > h.conf.Size {
+		entries = entries[len(entries)-h.conf.Size:]
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tx.putRecord(&record{Kind: recordKindHistory, ID: s.ID, Value: b})
+
+	switch operation {
+	case HistoryDeleted:
+		return h.putDeleted(tx, s.ID, entries[len(entries)-1].Time)
+	case HistoryCreated:
+		// the id may be reused after a deletion
+		tx.deleteRecord(recordKindHistoryDeleted, s.ID)
+	}
+	return nil
+}
+
+// putDeleted writes the deletion time of a service in the transaction
+func (h *history) putDeleted(tx *txn, id string, t time.Time) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tx.putRecord(&record{Kind: recordKindHistoryDeleted, ID: id, Value: b})
+	return nil
+}
+
+// indexDeleted writes the deletion times of the deleted services whose histories have none in the transaction
+// It reads all histories, and is only needed once for the histories written before the deletion records.
+func (h *history) indexDeleted(tx *txn) error {
+	records, err := h.storage.listRecords(recordKindHistory)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		var entries []HistoryEntry
+		err = json.Unmarshal(r.Value, &entries)
+		if err != nil {
+			return fmt.Errorf("error decoding the history of %s: %s", r.ID, err)
+		}
+		if len(entries) == 0 || entries[len(entries)-1].Operation != HistoryDeleted {
+			continue
+		}
+		_, err = tx.getRecord(recordKindHistoryDeleted, r.ID)
+		if _, notFound := err.(*NotFoundError); !notFound {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = h.putDeleted(tx, r.ID, entries[len(entries)-1].Time)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune removes the histories of services deleted before the retention period in the transaction
+// Only the deletion records are read, so that the cost does not depend on the services in the catalog.
+func (h *history) prune(tx *txn, t time.Time) error {
+	records, err := h.storage.listRecords(recordKindHistoryDeleted)
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		// the deletion is read through the transaction, which is checked for concurrent changes in a cluster
+		current, err := tx.getRecord(recordKindHistoryDeleted, r.ID)
+		if _, notFound := err.(*NotFoundError); notFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		var deleted time.Time
+		err = json.Unmarshal(current.Value, &deleted)
+		if err != nil {
+			return fmt.Errorf("error decoding the deletion time of %s: %s", r.ID, err)
+		}
+		if t.After(deleted.Add(time.Duration(h.conf.Retention) * time.Second)) {
+			tx.deleteRecord(recordKindHistory, r.ID)
+			tx.deleteRecord(recordKindHistoryDeleted, r.ID)
+		}
+	}
+	return nil
+}
+
+// EnableHistory starts recording the changes of services
+func (c *Controller) EnableHistory(conf HistoryConf) {
+	if conf.Size == 0 {
+		return
+	}
+	c.Lock()
+	c.history = &history{conf: conf.withDefaults(), storage: c.storage}
+	c.Unlock()
+}
+
+// record adds a change to the history in the transaction if the history is enabled
+// The caller must hold the lock.
+func (c *Controller) record(tx *txn, operation string, s Service, by actor) {
+	if c.history == nil {
+		return
+	}
+	err := c.history.record(tx, operation, s, by)
+	if err != nil {
+		logger.Printf("Error recording the history of service %s: %s", s.ID, err)
+	}
+}
+
+// pruneHistory removes the histories of services deleted before the retention period
+// The caller must hold the lock.
+func (c *Controller) pruneHistory(t time.Time) error {
+	if c.history == nil {
+		return nil
+	}
+	err := c.transact(func(tx *txn) error {
+		if !c.history.indexed {
+			err := c.history.indexDeleted(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return c.history.prune(tx, t)
+	})
+	if err != nil {
+		return err
+	}
+	c.history.indexed = true
+	return nil
+}
+
+// getHistory returns the history of a service, which may have been deleted
+func (c *Controller) getHistory(id string) (*History, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.history == nil {
+		return nil, &NotFoundError{"History is not enabled"}
+	}
+	entries, err := c.history.get(c.storage, id)
+	if _, notFound := err.(*NotFoundError); notFound {
+		return nil, &NotFoundError{fmt.Sprintf("No history for service %s", id)}
+	} else if err != nil {
+		return nil, err
+	}
+	return &History{ID: id, Entries: entries}, nil
+}
+
+// History returns the latest changes of a service
+func (a *HttpAPI) History(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	h, err := a.controller.getHistory(params["id"])
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			a.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error retrieving the history:", err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(h)
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
@@ -17,26 +19,37 @@ type HttpAPI struct {
 	id          string
 	description string
 	version     string
+	// namespace is empty for the default namespace
+	namespace string
+	stream    *stream
 }
 
 // NewHTTPAPI creates a RESTful HTTP API
 func NewHTTPAPI(controller *Controller, id, description, version string) *HttpAPI {
-	return &HttpAPI{
+	api := &HttpAPI{
 		controller:  controller,
 		id:          id,
 		description: description,
 		version:     version,
+		stream:      newStream(controller),
 	}
+	controller.AddListener(api.stream)
+	return api
 }
 
 // Collection is the paginated list of services
 type Collection struct {
 	ID          string    `json:"id"`
 	Description string    `json:"description"`
+	Namespace   string    `json:"namespace,omitempty"`
 	Services    []Service `json:"services"`
 	Page        int       `json:"page"`
 	PerPage     int       `json:"per_page"`
 	Total       int       `json:"total"`
+	// Next is the cursor for retrieving the services after this page. It is empty for the last page.
+	// Traversing the collection with cursors neither skips nor repeats services,
+	// even if other services are added or removed in between.
+	Next string `json:"next,omitempty"`
 }
 
 // API Index: Lists services
@@ -52,24 +65,45 @@ func (a *HttpAPI) List(w http.ResponseWriter, req *http.Request) {
 		a.ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
 		return
 	}
-
-	services, total, err := a.controller.list(page, perPage)
+	after, cursor, err := parseCursor(req.Form)
 	if err != nil {
-		a.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		a.ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
+		return
+	}
+	sel, err := parseSelection(req.Form)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
 		return
 	}
 
-	coll := &Collection{
-		ID:          a.id,
-		Description: a.description,
-		Services:    services,
-		Page:        page,
-		PerPage:     perPage,
-		Total:       total,
+	var (
+		services []Service
+		total    int
+		more     bool
+	)
+	view := req.Form.Get(GetParamView)
+	// the services are selected like in a view if expired or unhealthy ones are excluded
+	all := sel == selection{} && (view == "" || view == ViewAll)
+	switch {
+	case cursor && all:
+		page = 0
+		services, more, total, err = a.controller.listAfter(after, perPage)
+	case cursor:
+		page = 0
+		services, more, total, err = a.controller.viewAfter(view, "", "", "", sel, after, perPage)
+	case all:
+		services, total, err = a.controller.list(page, perPage)
+		more = (page-1)*perPage+len(services) < total
+	default:
+		services, total, err = a.controller.view(view, "", "", "", sel, page, perPage)
+		more = (page-1)*perPage+len(services) < total
+	}
+	if err != nil {
+		a.collectionErrorResponse(w, err)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json;version="+a.version)
-	json.NewEncoder(w).Encode(coll)
+	a.writeCollection(w, services, page, perPage, total, more)
 }
 
 // Filters services
@@ -90,26 +124,113 @@ func (a *HttpAPI) Filter(w http.ResponseWriter, req *http.Request) {
 		a.ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
 		return
 	}
+	after, cursor, err := parseCursor(req.Form)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
+		return
+	}
+	sel, err := parseSelection(req.Form)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error parsing query parameters:", err.Error())
+		return
+	}
 
-	services, total, err := a.controller.filter(path, op, value, page, perPage)
+	var (
+		services []Service
+		total    int
+		more     bool
+	)
+	view := req.Form.Get(GetParamView)
+	// the services are selected like in a view if expired or unhealthy ones are excluded
+	all := sel == selection{} && (view == "" || view == ViewAll)
+	switch {
+	case cursor && all:
+		page = 0
+		services, more, total, err = a.controller.filterAfter(path, op, value, after, perPage)
+	case cursor:
+		page = 0
+		services, more, total, err = a.controller.viewAfter(view, path, op, value, sel, after, perPage)
+	case all:
+		services, total, err = a.controller.filter(path, op, value, page, perPage)
+		more = (page-1)*perPage+len(services) < total
+	default:
+		services, total, err = a.controller.view(view, path, op, value, sel, page, perPage)
+		more = (page-1)*perPage+len(services) < total
+	}
 	if err != nil {
-		a.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		a.collectionErrorResponse(w, err)
 		return
 	}
 
+	a.writeCollection(w, services, page, perPage, total, more)
+}
+
+// parseCursor returns the position encoded in the cursor query parameter and whether the parameter is set
+// An empty cursor refers to the beginning of the collection
+func parseCursor(form url.Values) (string, bool, error) {
+	cursors, found := form[utils.GetParamCursor]
+	if !found {
+		return "", false, nil
+	}
+	if form.Get(utils.GetParamPage) != "" {
+		return "", true, fmt.Errorf("%s and %s parameters cannot be used together", utils.GetParamPage, utils.GetParamCursor)
+	}
+	if cursors[0] == "" {
+		return "", true, nil
+	}
+	after, err := utils.DecodeCursor(cursors[0])
+	if err != nil {
+		return "", true, err
+	}
+	return after, true, nil
+}
+
+// parseSelection parses the query parameters which exclude services by their state
+func parseSelection(form url.Values) (selection, error) {
+	var sel selection
+	for param, value := range map[string]*bool{
+		GetParamExcludeExpired: &sel.excludeExpired,
+		GetParamHealthyOnly:    &sel.healthyOnly,
+	} {
+		if form.Get(param) == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(form.Get(param))
+		if err != nil {
+			return sel, fmt.Errorf("Invalid value for parameter %s: %s", param, form.Get(param))
+		}
+		*value = b
+	}
+	return sel, nil
+}
+
+func (a *HttpAPI) writeCollection(w http.ResponseWriter, services []Service, page, perPage, total int, more bool) {
 	coll := &Collection{
 		ID:          a.id,
 		Description: a.description,
+		Namespace:   a.namespace,
 		Services:    services,
 		Page:        page,
 		PerPage:     perPage,
 		Total:       total,
 	}
+	if more && len(services) > 0 {
+		coll.Next = utils.EncodeCursor(services[len(services)-1].ID)
+	}
 
 	w.Header().Set("Content-Type", "application/json;version="+a.version)
 	json.NewEncoder(w).Encode(coll)
 }
 
+func (a *HttpAPI) collectionErrorResponse(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *BadRequestError:
+		a.ErrorResponse(w, http.StatusBadRequest, err.Error())
+	default:
+		a.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
 // Retrieves a service
 func (a *HttpAPI) Get(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
@@ -126,12 +247,18 @@ func (a *HttpAPI) Get(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	w.Header().Set("ETag", s.ETag())
+	if inm := req.Header.Get("If-None-Match"); inm != "" && s.matchETag(inm) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json;version="+a.version)
 	json.NewEncoder(w).Encode(s)
 }
 
-func (a *HttpAPI) createService(w http.ResponseWriter, s *Service) {
-	addedS, err := a.controller.add(*s)
+func (a *HttpAPI) createService(w http.ResponseWriter, s *Service, by actor) {
+	addedS, err := a.controller.add(*s, by)
 	if err != nil {
 		switch err.(type) {
 		case *ConflictError:
@@ -147,7 +274,8 @@ func (a *HttpAPI) createService(w http.ResponseWriter, s *Service) {
 	}
 
 	w.Header().Set("Content-Type", "application/json;version="+a.version)
-	w.Header().Set("Location", fmt.Sprintf("/%s", addedS.ID))
+	w.Header().Set("Location", fmt.Sprintf("%s/%s", NamespacePath(a.namespace), addedS.ID))
+	w.Header().Set("ETag", addedS.ETag())
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(addedS)
 }
@@ -166,7 +294,7 @@ func (a *HttpAPI) Post(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	a.createService(w, &s)
+	a.createService(w, &s, requestActor(req))
 	return
 }
 
@@ -186,17 +314,23 @@ func (a *HttpAPI) Put(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	updatedS, err := a.controller.update(params["id"], s)
+	updatedS, err := a.controller.updateIf(params["id"], s, req.Header.Get("If-Match"), requestActor(req))
 	if err != nil {
 		switch err.(type) {
 		case *NotFoundError:
 			// Create a new service with the given id
 			s.ID = params["id"]
-			a.createService(w, &s)
+			a.createService(w, &s, requestActor(req))
 			return
 		case *ConflictError:
 			a.ErrorResponse(w, http.StatusConflict, "Error updating the service:", err.Error())
 			return
+		case *PreconditionFailedError:
+			a.ErrorResponse(w, http.StatusPreconditionFailed, "Error updating the service:", err.Error())
+			return
+		case *ForbiddenError:
+			a.ErrorResponse(w, http.StatusForbidden, "Error updating the service:", err.Error())
+			return
 		case *BadRequestError:
 			a.ErrorResponse(w, http.StatusBadRequest, "Invalid service registration:", err.Error())
 			return
@@ -207,6 +341,7 @@ func (a *HttpAPI) Put(w http.ResponseWriter, req *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	w.Header().Set("ETag", updatedS.ETag())
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(updatedS)
 }
@@ -215,12 +350,21 @@ func (a *HttpAPI) Put(w http.ResponseWriter, req *http.Request) {
 func (a *HttpAPI) Delete(w http.ResponseWriter, req *http.Request) {
 	params := mux.Vars(req)
 
-	err := a.controller.delete(params["id"])
+	err := a.controller.deleteIf(params["id"], req.Header.Get("If-Match"), requestActor(req))
 	if err != nil {
 		switch err.(type) {
 		case *NotFoundError:
 			a.ErrorResponse(w, http.StatusNotFound, err.Error())
 			return
+		case *ConflictError:
+			a.ErrorResponse(w, http.StatusConflict, "Error deleting the service:", err.Error())
+			return
+		case *PreconditionFailedError:
+			a.ErrorResponse(w, http.StatusPreconditionFailed, "Error deleting the service:", err.Error())
+			return
+		case *ForbiddenError:
+			a.ErrorResponse(w, http.StatusForbidden, "Error deleting the service:", err.Error())
+			return
 		default:
 			a.ErrorResponse(w, http.StatusInternalServerError, "Error deleting the service:", err.Error())
 			return
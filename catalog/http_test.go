@@ -3,6 +3,7 @@
 package catalog
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -11,10 +12,12 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/linksmart/service-catalog/v3/utils"
 	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/websocket"
 )
 
 func setupRouter() (*mux.Router, func(), error) {
@@ -32,13 +35,24 @@ func setupRouter() (*mux.Router, func(), error) {
 		if err != nil {
 			return nil, nil, err
 		}
+	case CatalogBackendBolt:
+		storage, err = NewBoltStorage(tempDir, nil)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	controller, err := NewController(storage)
+	controller, err := NewController(storage, ControllerConf{})
 	if err != nil {
 		storage.Close()
 		return nil, nil, fmt.Errorf("Failed to start the controller: %v", err.Error())
 	}
+	controller.EnableWebhooks(WebhookConf{})
+	err = controller.EnableChanges(ChangesConf{Size: 100})
+	if err != nil {
+		controller.Stop()
+		return nil, nil, err
+	}
 
 	api := NewHTTPAPI(
 		controller,
@@ -48,11 +62,28 @@ func setupRouter() (*mux.Router, func(), error) {
 	)
 
 	r := mux.NewRouter().StrictSlash(true)
+	// Backup, Restore
+	r.Methods("GET").Path("/admin/backup").HandlerFunc(api.Backup)
+	r.Methods("POST").Path("/admin/restore").HandlerFunc(api.Restore)
+	// Events
+	r.Methods("GET").Path("/events").HandlerFunc(api.Events)
+	r.Methods("GET").Path("/events/{path}/{op}/{value:.*}").HandlerFunc(api.Events)
+	// Subscriptions
+	r.Methods("GET").Path("/subscriptions").HandlerFunc(api.ListSubscriptions)
+	r.Methods("POST").Path("/subscriptions").HandlerFunc(api.PostSubscription)
+	r.Methods("GET").Path("/subscriptions/{sid}").HandlerFunc(api.GetSubscription)
+	r.Methods("DELETE").Path("/subscriptions/{sid}").HandlerFunc(api.DeleteSubscription)
+	r.Methods("GET").Path("/subscriptions/{sid}/deadletters").HandlerFunc(api.DeadLetters)
+	r.Methods("DELETE").Path("/subscriptions/{sid}/deadletters").HandlerFunc(api.ClearDeadLetters)
 	// CRUD
 	r.Methods("POST").Path("/").HandlerFunc(api.Post)
+	r.Methods("GET").Path("/{path}/{op:equals|prefix|suffix|contains}/{value:.*}").HandlerFunc(api.Filter)
+	r.Methods("GET").Path("/{id:[^/]+/?[^/]*}/history").HandlerFunc(api.History)
 	r.Methods("GET").Path("/{id:[^/]+/?[^/]*}").HandlerFunc(api.Get)
 	r.Methods("PUT").Path("/{id:[^/]+/?[^/]*}").HandlerFunc(api.Put)
+	r.Methods("PATCH").Path("/{id:[^/]+/?[^/]*}").HandlerFunc(api.Patch)
 	r.Methods("DELETE").Path("/{id:[^/]+/?[^/]*}").HandlerFunc(api.Delete)
+	r.Methods("POST").Path("/{id:[^/]+/?[^/]*}/renew").HandlerFunc(api.Renew)
 	// List, Filter
 	r.Methods("GET").Path("/").HandlerFunc(api.List)
 	r.Methods("GET").Path("/{path}/{op}/{value:.*}").HandlerFunc(api.Filter)
@@ -340,6 +371,209 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestConditionalRequests(t *testing.T) {
+	router, shutdown, err := setupRouter()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	defer shutdown()
+
+	service := MockedService("1")
+	b, _ := json.Marshal(service)
+	url := ts.URL + "/" + service.ID
+
+	do := func(method, etagHeader, etag string, body []byte) *http.Response {
+		t.Logf("Calling %s %s with %s: %s", method, url, etagHeader, etag)
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if etag != "" {
+			req.Header.Set(etagHeader, etag)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// Conditional update of a missing service
+	res := do("PUT", "If-Match", "*", b)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusPreconditionFailed, res.StatusCode, res.Status)
+	}
+
+	// Create
+	res = do("PUT", "", "", b)
+	if res.StatusCode != http.StatusCreated || res.Header.Get("ETag") != `"1"` {
+		t.Fatalf("Server should return %v with ETag \"1\", got instead: %v with %s", http.StatusCreated, res.StatusCode, res.Header.Get("ETag"))
+	}
+
+	// Conditional retrieval
+	res = do("GET", "If-None-Match", `"1"`, nil)
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusNotModified, res.StatusCode, res.Status)
+	}
+
+	// Update with the current revision
+	res = do("PUT", "If-Match", `"1"`, b)
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") != `"2"` {
+		t.Fatalf("Server should return %v with ETag \"2\", got instead: %v with %s", http.StatusOK, res.StatusCode, res.Header.Get("ETag"))
+	}
+	res = do("GET", "If-None-Match", `"1"`, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+	}
+
+	// Update and deletion with a stale revision
+	res = do("PUT", "If-Match", `"1"`, b)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusPreconditionFailed, res.StatusCode, res.Status)
+	}
+	res = do("DELETE", "If-Match", `"1"`, nil)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusPreconditionFailed, res.StatusCode, res.Status)
+	}
+
+	// Deletion with the current revision
+	res = do("DELETE", "If-Match", `W/"0", "2"`, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	router, shutdown, err := setupRouter()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	defer shutdown()
+
+	service := MockedService("1")
+	b, _ := json.Marshal(service)
+	url := ts.URL + "/" + service.ID
+	t.Log("Calling PUT", url)
+	res, err := httpPut(url, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+
+	patch := func(url, contentType, body string) (*http.Response, *Service) {
+		t.Logf("Calling PATCH %s with %s: %s", url, contentType, body)
+		req, err := http.NewRequest("PATCH", url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		req.Header.Set("Content-Type", contentType)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		var s Service
+		if res.StatusCode == http.StatusOK {
+			err = json.NewDecoder(res.Body).Decode(&s)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		return res, &s
+	}
+
+	// Merge Patch
+	res, patched := patch(url, MergePatchMediaType, `{"meta": {"location": "lab"}}`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+	}
+	if patched.Meta["location"] != "lab" || patched.Description != service.Description || patched.Revision != 2 {
+		t.Fatalf("Service is not merged with the patch: %+v", patched)
+	}
+
+	// JSON Patch
+	res, patched = patch(url, JSONPatchMediaType, `[{"op": "replace", "path": "/ttl", "value": 60}, {"op": "remove", "path": "/meta/location"}]`)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+	}
+	if patched.TTL != 60 || len(patched.Meta) != 0 || !patched.ExpiresAt.Equal(patched.UpdatedAt.Add(60*time.Second)) {
+		t.Fatalf("JSON Patch is not applied: %+v", patched)
+	}
+
+	// Invalid results and requests
+	for _, c := range []struct {
+		url, contentType, body string
+		code                   int
+	}{
+		{url, JSONPatchMediaType, `[{"op": "replace", "path": "/type", "value": ""}]`, http.StatusBadRequest},
+		{url, JSONPatchMediaType, `[{"op": "test", "path": "/ttl", "value": 30}]`, http.StatusBadRequest},
+		{url, MergePatchMediaType, `{"id": "other"}`, http.StatusConflict},
+		{url, "application/json", `{"ttl": 90}`, http.StatusUnsupportedMediaType},
+		{ts.URL + "/missing", MergePatchMediaType, `{"ttl": 90}`, http.StatusNotFound},
+	} {
+		res, _ = patch(c.url, c.contentType, c.body)
+		if res.StatusCode != c.code {
+			t.Fatalf("Server should return %v, got instead: %v (%s)", c.code, res.StatusCode, res.Status)
+		}
+	}
+}
+
+func TestRenew(t *testing.T) {
+	router, shutdown, err := setupRouter()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	defer shutdown()
+
+	service := MockedService("1")
+	b, _ := json.Marshal(service)
+	url := ts.URL + "/" + service.ID
+	t.Log("Calling PUT", url)
+	res, err := httpPut(url, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var added Service
+	json.NewDecoder(res.Body).Decode(&added)
+	res.Body.Close()
+
+	// Renew
+	t.Log("Calling POST", url+"/renew")
+	res, err = http.Post(url+"/renew", "", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+	}
+	var renewal Renewal
+	err = json.NewDecoder(res.Body).Decode(&renewal)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if renewal.ID != service.ID || renewal.ExpiresAt.Before(added.ExpiresAt) {
+		t.Fatalf("Unexpected renewal: %+v", renewal)
+	}
+
+	// Renew a missing service
+	res, err = http.Post(ts.URL+"/missing/renew", "", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusNotFound, res.StatusCode, res.Status)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	router, shutdown, err := setupRouter()
 	if err != nil {
@@ -466,6 +700,445 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+func TestListCursor(t *testing.T) {
+	router, shutdown, err := setupRouter()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	defer shutdown()
+
+	// Add 5 services
+	for i := 0; i < 5; i++ {
+		service := MockedService(fmt.Sprint(i))
+		b, _ := json.Marshal(service)
+		_, err := httpPut(ts.URL+"/"+service.ID, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	getCollection := func(url string) *Collection {
+		t.Log("Calling GET", url)
+		res, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+		}
+
+		var collection *Collection
+		err = json.NewDecoder(res.Body).Decode(&collection)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return collection
+	}
+
+	for _, base := range []string{ts.URL + "/?", ts.URL + "/description/" + utils.FOpPrefix + "/Test?"} {
+		// Traverse with cursors while modifying the catalog
+		seen := make(map[string]bool)
+		url := base + utils.GetParamCursor + "=&" + utils.GetParamPerPage + "=2"
+		for i := 0; ; i++ {
+			collection := getCollection(url)
+			for _, s := range collection.Services {
+				if seen[s.ID] {
+					t.Fatalf("Service %s is returned twice during the traversal", s.ID)
+				}
+				seen[s.ID] = true
+			}
+			if collection.Next == "" {
+				break
+			}
+
+			if i == 0 {
+				// remove a service which is already traversed and add one before the cursor
+				req, _ := http.NewRequest("DELETE", ts.URL+"/"+collection.Services[0].ID, nil)
+				_, err = http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				service := MockedService("0")
+				b, _ := json.Marshal(service)
+				_, err := httpPut(ts.URL+"/"+service.ID, bytes.NewReader(b))
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+			}
+			url = base + utils.GetParamCursor + "=" + collection.Next + "&" + utils.GetParamPerPage + "=2"
+		}
+		for i := 1; i < 5; i++ {
+			if !seen[MockedService(fmt.Sprint(i)).ID] {
+				t.Fatalf("Service %d is skipped during the traversal. Got: %v", i, seen)
+			}
+		}
+	}
+
+	// Page-based responses link to the next page too
+	collection := getCollection(ts.URL + "/?" + utils.GetParamPage + "=1&" + utils.GetParamPerPage + "=3")
+	if collection.Next == "" {
+		t.Fatal("First page does not include a cursor to the next page")
+	}
+	collection = getCollection(ts.URL + "/?" + utils.GetParamCursor + "=" + collection.Next + "&" + utils.GetParamPerPage + "=3")
+	if len(collection.Services) != 2 || collection.Next != "" {
+		t.Fatalf("Expected the last 2 services without a next cursor, got %d services and cursor %q", len(collection.Services), collection.Next)
+	}
+
+	// Invalid cursor
+	res, err := http.Get(ts.URL + "/?" + utils.GetParamCursor + "=%25%25")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Server should return %v for an invalid cursor, got instead: %v (%s)", http.StatusBadRequest, res.StatusCode, res.Status)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	router, shutdown, err := setupRouter()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	defer shutdown()
+
+	for i := 0; i < 3; i++ {
+		service := MockedService(fmt.Sprint(i))
+		b, _ := json.Marshal(service)
+		res, err := httpPut(ts.URL+"/"+service.ID, bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+	}
+
+	// Backup
+	t.Log("Calling GET", ts.URL+"/admin/backup")
+	res, err := http.Get(ts.URL + "/admin/backup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var backup bytes.Buffer
+	backup.ReadFrom(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+	}
+	if lines := strings.Count(backup.String(), "\n"); lines != 3 {
+		t.Fatalf("Expected 3 services in the backup, got %d:\n%s", lines, backup.String())
+	}
+
+	// Changes after the backup
+	service := MockedService("9")
+	b, _ := json.Marshal(service)
+	res, err = httpPut(ts.URL+"/"+service.ID, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	req, _ := http.NewRequest("DELETE", ts.URL+"/"+MockedService("0").ID, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+
+	// Restore
+	url := ts.URL + "/admin/restore?mode=" + RestoreModeReplace
+	t.Log("Calling POST", url)
+	res, err = http.Post(url, backupContentType, bytes.NewReader(backup.Bytes()))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var result ImportResult
+	err = json.NewDecoder(res.Body).Decode(&result)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+	}
+	if result.Added != 1 || result.Overwritten != 2 || result.Deleted != 1 {
+		t.Fatalf("Expected 1 added, 2 overwritten and 1 deleted service, got %+v", result)
+	}
+
+	res, err = http.Get(ts.URL + "/" + MockedService("9").ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Service added after the backup should be removed, got: %v (%s)", res.StatusCode, res.Status)
+	}
+	res, err = http.Get(ts.URL + "/" + MockedService("0").ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Service deleted after the backup should be restored, got: %v (%s)", res.StatusCode, res.Status)
+	}
+
+	// Invalid backup
+	res, err = http.Post(ts.URL+"/admin/restore", backupContentType, strings.NewReader("{invalid"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Server should return %v for an invalid backup, got instead: %v (%s)", http.StatusBadRequest, res.StatusCode, res.Status)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	router, shutdown, err := setupRouter()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	defer shutdown()
+
+	readEvent := func(r *bufio.Reader) (id string, e Event) {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading event: %s", err)
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "":
+				return id, e
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+				if err != nil {
+					t.Fatalf("Error decoding event: %s", err)
+				}
+			}
+		}
+	}
+
+	// Subscribe with a filter
+	res, err := http.Get(ts.URL + "/events/type/equals/_stream._tcp")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response: %v %s", res.Status, res.Header.Get("Content-Type"))
+	}
+
+	other := MockedService("1")
+	other.Type = "_other._tcp"
+	b, _ := json.Marshal(other)
+	res2, err := httpPut(ts.URL+"/"+other.ID, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res2.Body.Close()
+	service := MockedService("2")
+	service.Type = "_stream._tcp"
+	b, _ = json.Marshal(service)
+	res2, err = httpPut(ts.URL+"/"+service.ID, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res2.Body.Close()
+
+	id, e := readEvent(bufio.NewReader(res.Body))
+	res.Body.Close()
+	if e.Type != EventAdded || e.Service.ID != service.ID || id != fmt.Sprint(e.ID) {
+		t.Fatalf("Unexpected event %s: %+v", id, e)
+	}
+
+	// Resume after a disconnection
+	req, _ := http.NewRequest("DELETE", ts.URL+"/"+service.ID, nil)
+	res2, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res2.Body.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/events/type/equals/_stream._tcp", nil)
+	req.Header.Set("Last-Event-ID", id)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, e = readEvent(bufio.NewReader(res.Body))
+	res.Body.Close()
+	if e.Type != EventDeleted || e.Service.ID != service.ID {
+		t.Fatalf("Unexpected event after resuming: %+v", e)
+	}
+
+	// Replay all events over WebSocket
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/events?lastEventID=0", "", ts.URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ws.Close()
+	var types []string
+	for i := 0; i < 3; i++ {
+		err = websocket.JSON.Receive(ws, &e)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		types = append(types, e.Type)
+	}
+	if strings.Join(types, ",") != "added,added,deleted" {
+		t.Fatalf("Unexpected events: %v", types)
+	}
+
+	// Cross-origin WebSocket handshake
+	_, err = websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/events", "", "http://example.com")
+	if err == nil {
+		t.Fatal("Expected an error for a cross-origin WebSocket handshake")
+	}
+
+	// Invalid filter
+	res, err = http.Get(ts.URL + "/events/type/like/_stream._tcp")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusBadRequest, res.StatusCode, res.Status)
+	}
+}
+
+func TestEventsReset(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	err = controller.EnableChanges(ChangesConf{Size: 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	api := NewHTTPAPI(controller, "test", "Test catalog", "MAJOR.MINOR.PATCH")
+	ts := httptest.NewServer(http.HandlerFunc(api.Events))
+	defer ts.Close()
+
+	for i := 0; i < 4; i++ {
+		_, err := controller.add(Service{ID: fmt.Sprintf("service_%d", i), Type: "_test._tcp", TTL: 30}, actor{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	receive := func(lastEventID string, n int) []Event {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/events?lastEventID="+lastEventID, "", ts.URL)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer ws.Close()
+		events := make([]Event, n)
+		for i := range events {
+			err = websocket.JSON.Receive(ws, &events[i])
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		return events
+	}
+
+	// the ids are the sequence numbers of the change feed
+	events := receive("2", 2)
+	if events[0].ID != 3 || events[0].Service.ID != "service_2" || events[1].ID != 4 {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+
+	// the events after 1 are no longer kept
+	events = receive("1", 1)
+	if events[0].Type != EventReset || events[0].ID != 4 || events[0].Service != nil {
+		t.Fatalf("Expected a reset event with the latest id, got: %+v", events[0])
+	}
+	// unknown ids, e.g. from before a restore
+	events = receive("10", 1)
+	if events[0].Type != EventReset || events[0].ID != 4 {
+		t.Fatalf("Expected a reset event with the latest id, got: %+v", events[0])
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	router, shutdown, err := setupRouter()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	defer shutdown()
+
+	res, err := http.Post(ts.URL+"/subscriptions", "application/json", strings.NewReader(`{"url":"http://localhost:9999/hook","events":["added"]}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusCreated, res.StatusCode, res.Status)
+	}
+	var added Subscription
+	json.NewDecoder(res.Body).Decode(&added)
+	if added.ID == "" || added.Secret == "" || res.Header.Get("Location") != "/subscriptions/"+added.ID {
+		t.Fatalf("Unexpected subscription: %+v at %s", added, res.Header.Get("Location"))
+	}
+
+	res, err = http.Post(ts.URL+"/subscriptions", "application/json", strings.NewReader(`{"url":"http://localhost:9999/hook","events":["renewed"]}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusBadRequest, res.StatusCode, res.Status)
+	}
+
+	res, err = http.Get(ts.URL + "/subscriptions")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var list SubscriptionList
+	json.NewDecoder(res.Body).Decode(&list)
+	res.Body.Close()
+	if len(list.Subscriptions) != 1 || list.Subscriptions[0].ID != added.ID || list.Subscriptions[0].Secret != "" {
+		t.Fatalf("Unexpected subscriptions: %+v", list)
+	}
+
+	res, err = http.Get(ts.URL + "/subscriptions/" + added.ID + "/deadletters")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+	}
+
+	req, _ := http.NewRequest("DELETE", ts.URL+"/subscriptions/"+added.ID, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusOK, res.StatusCode, res.Status)
+	}
+	res, err = http.Get(ts.URL + "/subscriptions/" + added.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Server should return %v, got instead: %v (%s)", http.StatusNotFound, res.StatusCode, res.Status)
+	}
+}
+
 func httpPut(url string, r *bytes.Reader) (*http.Response, error) {
 	req, err := http.NewRequest("PUT", url, r)
 	if err != nil {
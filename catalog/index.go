@@ -0,0 +1,145 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/linksmart/service-catalog/v3/utils"
+)
+
+// DefaultIndexes are the paths indexed by all storage backends
+// Additional paths (e.g. meta.* keys) can be passed to the storage constructors
+var DefaultIndexes = []string{"type", "apis.protocol", "apis.url", federationOriginPath}
+
+// indexSeparator separates the value and the id in an index key
+// Service ids cannot contain control characters
+const indexSeparator = "\x00"
+
+// indexPaths returns the default indexes followed by the unique extra ones
+func indexPaths(extra []string) []string {
+	paths := append([]string{}, DefaultIndexes...)
+	for _, path := range extra {
+		if path == "" || containsString(paths, path) {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// indexValues returns the normalized values of the service for each indexed path
+// Paths which do not exist in the service are omitted
+func indexValues(s *Service, paths []string) map[string]string {
+	values := make(map[string]string, len(paths))
+	for _, path := range paths {
+		v, err := utils.ObjectValue(s, strings.Split(path, "."))
+		if err != nil || v == nil {
+			continue
+		}
+		values[path] = utils.NormalizeValue(v)
+	}
+	return values
+}
+
+// indexKey encodes an index entry of a service id under a normalized value
+func indexKey(value, id string) []byte {
+	return []byte(value + indexSeparator + id)
+}
+
+// splitIndexKey decodes an index key into the normalized value and the service id
+func splitIndexKey(key []byte) (string, string) {
+	k := string(key)
+	i := strings.LastIndex(k, indexSeparator)
+	if i == -1 {
+		return k, ""
+	}
+	return k[:i], k[i+1:]
+}
+
+// indexScanPrefix returns the prefix of the index keys that may match the filter
+func indexScanPrefix(op, value string) []byte {
+	value = strings.ToLower(value)
+	switch op {
+	case utils.FOpEquals:
+		return []byte(value + indexSeparator)
+	case utils.FOpPrefix:
+		return []byte(value)
+	}
+	return nil
+}
+
+// In-memory index
+type memIndex struct {
+	paths []string
+	// path -> normalized value -> set of ids
+	entries map[string]map[string]map[string]struct{}
+}
+
+func newMemIndex(paths []string) *memIndex {
+	idx := &memIndex{
+		paths:   paths,
+		entries: make(map[string]map[string]map[string]struct{}),
+	}
+	for _, path := range paths {
+		idx.entries[path] = make(map[string]map[string]struct{})
+	}
+	return idx
+}
+
+func (idx *memIndex) add(s *Service) {
+	for path, value := range indexValues(s, idx.paths) {
+		ids, found := idx.entries[path][value]
+		if !found {
+			ids = make(map[string]struct{})
+			idx.entries[path][value] = ids
+		}
+		ids[s.ID] = struct{}{}
+	}
+}
+
+func (idx *memIndex) remove(s *Service) {
+	for path, value := range indexValues(s, idx.paths) {
+		ids := idx.entries[path][value]
+		delete(ids, s.ID)
+		if len(ids) == 0 {
+			delete(idx.entries[path], value)
+		}
+	}
+}
+
+func (idx *memIndex) lookup(path, op, value string) ([]string, bool, error) {
+	values, found := idx.entries[path]
+	if !found {
+		return nil, false, nil
+	}
+	if err := utils.ValidateFilterOp(op); err != nil {
+		return nil, true, err
+	}
+
+	ids := []string{}
+	for v, set := range values {
+		matched, err := utils.MatchValue(v, op, value)
+		if err != nil {
+			return nil, true, err
+		}
+		if matched {
+			for id := range set {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+
+	return ids, true, nil
+}
+
+func containsString(slice []string, s string) bool {
+	for i := range slice {
+		if slice[i] == s {
+			return true
+		}
+	}
+	return false
+}
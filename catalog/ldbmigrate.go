@@ -0,0 +1,241 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Format versions of LevelDB databases
+// Databases created before the versioning have no version record. Their version is detected from the services.
+const (
+	ldbFormatV2 = 1 // services in the layout of Service Catalog v2
+	ldbFormatV3 = 2 // services in the layout of Service Catalog v3
+
+	// ldbFormatVersion is the format written by this version
+	ldbFormatVersion = ldbFormatV3
+)
+
+// ldbMigration upgrades a database from the previous format version
+type ldbMigration struct {
+	// version is the format version after the migration
+	version     int
+	description string
+	// migrate adds the changes to the batch
+	migrate func(db *leveldb.DB, batch *leveldb.Batch) error
+}
+
+// ldbMigrations are applied in order to databases of older versions
+var ldbMigrations = []ldbMigration{
+	{version: ldbFormatV3, description: "convert services from the v2 layout", migrate: ldbMigrateV2Services},
+}
+
+// migrate upgrades the database to the current format version
+// Each migration is written in a single batch together with the new version.
+// Databases of newer versions are refused as they cannot be read correctly.
+func (ls *LevelDBStorage) migrate() error {
+	version, err := ls.formatVersion()
+	if err != nil {
+		return err
+	}
+	if version > ldbFormatVersion {
+		return fmt.Errorf("database format version %d is newer than the supported version %d. Upgrade the service catalog.", version, ldbFormatVersion)
+	}
+
+	for _, m := range ldbMigrations {
+		if m.version <= version {
+			continue
+		}
+		logger.Printf("LevelDB: Migrating the database to format version %d: %s", m.version, m.description)
+
+		batch := new(leveldb.Batch)
+		err := m.migrate(ls.db, batch)
+		if err != nil {
+			return fmt.Errorf("error migrating to format version %d: %s", m.version, err)
+		}
+		// the indexes are rebuilt from the migrated services
+		batch.Delete(ldbIndexesKey)
+		batch.Put(ldbFormatKey, []byte(strconv.Itoa(m.version)))
+		err = ls.db.Write(batch, nil)
+		if err != nil {
+			return fmt.Errorf("error migrating to format version %d: %s", m.version, err)
+		}
+		version = m.version
+	}
+
+	if version < ldbFormatVersion {
+		return ls.db.Put(ldbFormatKey, []byte(strconv.Itoa(ldbFormatVersion)), nil)
+	}
+	return nil
+}
+
+// formatVersion returns the format version of the database
+// The version of an unversioned database is detected from its first service.
+func (ls *LevelDBStorage) formatVersion() (int, error) {
+	b, err := ls.db.Get(ldbFormatKey, nil)
+	if err == nil {
+		version, err := strconv.Atoi(string(b))
+		if err != nil {
+			return 0, fmt.Errorf("invalid database format version: %q", b)
+		}
+		return version, nil
+	} else if err != leveldb.ErrNotFound {
+		return 0, err
+	}
+
+	iter := ls.db.NewIterator(ldbServicesRange, nil)
+	defer iter.Release()
+	if !iter.Next() {
+		return ldbFormatVersion, iter.Error()
+	}
+	if isServiceV2(iter.Value()) {
+		return ldbFormatV2, nil
+	}
+	return ldbFormatV3, nil
+}
+
+// serviceV2 is a service in the layout of Service Catalog v2
+type serviceV2 struct {
+	ID          string                 `json:"id"`
+	Type        string                 `json:"type"`
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Meta        map[string]interface{} `json:"meta"`
+	APIs        map[string]string      `json:"apis"`
+	Docs        []docV2                `json:"docs"`
+	TTL         uint                   `json:"ttl,omitempty"`
+	Created     time.Time              `json:"created"`
+	Updated     time.Time              `json:"updated"`
+	Expires     *time.Time             `json:"expires,omitempty"`
+}
+
+// docV2 is a documentation of the APIs of a v2 service
+type docV2 struct {
+	Description string   `json:"description"`
+	URL         string   `json:"url"`
+	Type        string   `json:"type"`
+	APIs        []string `json:"apis"`
+}
+
+// isServiceV2 reports whether the encoded service is in the v2 layout
+// v2 services have a map of APIs and no createdAt timestamp
+func isServiceV2(b []byte) bool {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(b, &fields) != nil {
+		return false
+	}
+	if _, found := fields["createdAt"]; found {
+		return false
+	}
+	if apis, found := fields["apis"]; found {
+		return bytes.HasPrefix(bytes.TrimSpace(apis), []byte("{"))
+	}
+	_, found := fields["created"]
+	return found
+}
+
+func ldbMigrateV2Services(db *leveldb.DB, batch *leveldb.Batch) error {
+	iter := db.NewIterator(ldbServicesRange, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if !isServiceV2(iter.Value()) {
+			continue
+		}
+		var old serviceV2
+		err := json.Unmarshal(iter.Value(), &old)
+		if err != nil {
+			return fmt.Errorf("error parsing service %s: %s", iter.Key(), err)
+		}
+
+		b, err := json.Marshal(old.convert())
+		if err != nil {
+			return err
+		}
+		batch.Put(append([]byte{}, iter.Key()...), b)
+	}
+	return iter.Error()
+}
+
+// convert converts a v2 service to the current layout
+// The name (e.g. _linksmart-sc._tcp) becomes the type, each named API URL becomes an API with the name as id,
+// and typed docs become the specs of the referenced APIs. Services without TTL get the maximum TTL.
+func (old serviceV2) convert() Service {
+	s := Service{
+		ID:          old.ID,
+		Type:        old.Name,
+		Description: old.Description,
+		Meta:        old.Meta,
+		APIs:        []API{},
+		TTL:         uint32(old.TTL),
+		CreatedAt:   old.Created.UTC(),
+		UpdatedAt:   old.Updated.UTC(),
+	}
+	if s.Type == "" {
+		s.Type = old.Type
+	}
+	if s.Meta == nil {
+		s.Meta = make(map[string]interface{})
+	}
+	if old.TTL == 0 || old.TTL > MaxServiceTTL {
+		s.TTL = MaxServiceTTL
+	}
+	if old.Expires != nil {
+		s.ExpiresAt = old.Expires.UTC()
+	} else {
+		s.ExpiresAt = s.UpdatedAt.Add(time.Duration(s.TTL) * time.Second)
+	}
+
+	// sort by name for a deterministic order
+	names := make([]string, 0, len(old.APIs))
+	for name := range old.APIs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.APIs = append(s.APIs, API{
+			ID:       name,
+			Title:    name,
+			Protocol: protocolOfURL(old.APIs[name]),
+			URL:      old.APIs[name],
+			Meta:     make(map[string]interface{}),
+		})
+	}
+
+	for _, doc := range old.Docs {
+		if s.Doc == "" {
+			s.Doc = doc.URL
+		}
+		for i := range s.APIs {
+			if containsString(doc.APIs, s.APIs[i].ID) && s.APIs[i].Spec.URL == "" {
+				s.APIs[i].Spec = Spec{MediaType: doc.Type, URL: doc.URL}
+			}
+		}
+	}
+
+	return s
+}
+
+// protocolOfURL returns the API protocol based on the scheme of the URL
+func protocolOfURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" {
+		return ""
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return APITypeHTTP
+	case "mqtt", "mqtts", "tcp", "ssl", "tls", "ws", "wss":
+		return APITypeMQTT
+	}
+	return strings.ToUpper(u.Scheme)
+}
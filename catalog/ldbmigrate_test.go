@@ -0,0 +1,85 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestLevelDBMigration(t *testing.T) {
+	if TestStorageType != CatalogBackendLevelDB {
+		t.Skip("Only for the LevelDB storage")
+	}
+	dir := fmt.Sprintf("%s/lslc/test-%s.ldb", strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4().String())
+	defer os.RemoveAll(dir)
+
+	// Database written by Service Catalog v2
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = db.Put([]byte("gc1"), []byte(`{
+		"id": "gc1",
+		"type": "Service",
+		"name": "_linksmart-gc._tcp",
+		"description": "Gateway",
+		"meta": {"location": "lab"},
+		"apis": {"Data": "mqtt://localhost:1883", "REST": "http://localhost:8080/rest"},
+		"docs": [{"description": "REST API", "url": "http://localhost:8080/openapi.json", "type": "application/openapi+json", "apis": ["REST"]}],
+		"ttl": 60,
+		"created": "2018-01-01T10:00:00Z",
+		"updated": "2018-01-01T11:00:00Z",
+		"expires": "2018-01-01T11:01:00Z"
+	}`), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	db.Close()
+
+	storage, err := NewLevelDBStorage(dir, nil)
+	if err != nil {
+		t.Fatal("Error opening the v2 database:", err.Error())
+	}
+	s, err := storage.get("gc1")
+	if err != nil {
+		t.Fatal("Migrated service is not found:", err.Error())
+	}
+	if s.Type != "_linksmart-gc._tcp" || s.Meta["location"] != "lab" || s.TTL != 60 || s.UpdatedAt.Hour() != 11 || s.ExpiresAt.Minute() != 1 {
+		t.Fatalf("Service is not migrated correctly: %+v", s)
+	}
+	if len(s.APIs) != 2 || s.APIs[0].ID != "Data" || s.APIs[0].Protocol != APITypeMQTT ||
+		s.APIs[1].Protocol != APITypeHTTP || s.APIs[1].Spec.URL != "http://localhost:8080/openapi.json" {
+		t.Fatalf("APIs are not migrated correctly: %+v", s.APIs)
+	}
+	if err := s.validate(); err != nil {
+		t.Fatal("Migrated service is invalid:", err)
+	}
+	ids, _, _ := storage.lookup("type", "equals", "_linksmart-gc._tcp")
+	if len(ids) != 1 {
+		t.Fatal("Migrated service is not indexed")
+	}
+	storage.Close()
+
+	// Database written by a newer version
+	db, err = leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	version, _ := db.Get(ldbFormatKey, nil)
+	if string(version) != fmt.Sprint(ldbFormatVersion) {
+		t.Fatalf("Expected format version %d after the migration, got %s", ldbFormatVersion, version)
+	}
+	db.Put(ldbFormatKey, []byte(fmt.Sprint(ldbFormatVersion+1)), nil)
+	db.Close()
+
+	_, err = NewLevelDBStorage(dir, nil)
+	if err == nil {
+		t.Fatal("Database of a newer format version is not refused")
+	}
+}
@@ -3,23 +3,56 @@
 package catalog
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/linksmart/service-catalog/v3/utils"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// Keys of internal records start with ldbInternalPrefix
+// Service ids cannot contain control characters, so they never collide with internal keys
+var (
+	ldbInternalPrefix = "\x00"
+	ldbIndexPrefix    = ldbInternalPrefix + "i" + ldbInternalPrefix
+	ldbRecordPrefix   = ldbInternalPrefix + "r" + ldbInternalPrefix
+	ldbOffsetPrefix   = ldbInternalPrefix + "o" + ldbInternalPrefix
+	ldbIndexesKey     = []byte(ldbInternalPrefix + "m" + ldbInternalPrefix + "indexes")
+	ldbTotalKey       = []byte(ldbInternalPrefix + "m" + ldbInternalPrefix + "total")
+	ldbFormatKey      = []byte(ldbInternalPrefix + "m" + ldbInternalPrefix + "format")
+	ldbServicesRange  = &util.Range{Start: []byte{0x01}}
+)
+
+// ldbOffsetBucket is the number of services per entry of the offset index
+const ldbOffsetBucket = 1000
+
 // LevelDB storage
+// The offset index has an entry for every bucket of about offsetBucket consecutive services, under the id of its first
+// service, with the number of services in the bucket. A page is listed by summing the entries up to its offset and
+// seeking to the bucket which contains it.
 type LevelDBStorage struct {
-	db *leveldb.DB
-	wg sync.WaitGroup
+	db      *leveldb.DB
+	wg      sync.WaitGroup
+	indexes []string
+	// writes serializes the mutations and protects count
+	writes sync.Mutex
+	// count is the number of services, persisted under ldbTotalKey
+	count int
+	// offsetBucket is the number of services per entry of the offset index. Buckets of twice the size are split.
+	offsetBucket int
 }
 
-func NewLevelDBStorage(dsn string, opts *opt.Options) (Storage, error) {
+// NewLevelDBStorage opens or creates a LevelDB storage
+// indexes are the paths to be indexed in addition to the DefaultIndexes
+func NewLevelDBStorage(dsn string, opts *opt.Options, indexes ...string) (Storage, error) {
 	url, err := url.Parse(dsn)
 	if err != nil {
 		return &LevelDBStorage{}, err
@@ -31,33 +64,41 @@ func NewLevelDBStorage(dsn string, opts *opt.Options) (Storage, error) {
 		return &LevelDBStorage{}, err
 	}
 
-	return &LevelDBStorage{db: db}, nil
-}
-
-// CRUD
-func (ls *LevelDBStorage) add(s *Service) error {
-
-	bytes, err := json.Marshal(s)
+	ls := &LevelDBStorage{db: db, indexes: indexPaths(indexes), offsetBucket: ldbOffsetBucket}
+	err = ls.migrate()
 	if err != nil {
-		return err
+		db.Close()
+		return &LevelDBStorage{}, err
 	}
-
-	_, err = ls.db.Get([]byte(s.ID), nil)
-	if err == nil {
-		return &ConflictError{"Service id is not unique."}
-	} else if err != leveldb.ErrNotFound {
-		return err
+	err = ls.ensureIndexes()
+	if err != nil {
+		db.Close()
+		return &LevelDBStorage{}, err
 	}
-
-	err = ls.db.Put([]byte(s.ID), bytes, nil)
+	err = ls.loadCount()
 	if err != nil {
-		return err
+		db.Close()
+		return &LevelDBStorage{}, err
+	}
+	err = ls.ensureOffsetIndex()
+	if err != nil {
+		db.Close()
+		return &LevelDBStorage{}, err
 	}
 
-	return nil
+	return ls, nil
+}
+
+// CRUD
+func (ls *LevelDBStorage) add(s *Service) error {
+	return ls.commit([]write{{Op: writeAdd, ID: s.ID, Service: s}})
 }
 
 func (ls *LevelDBStorage) get(id string) (*Service, error) {
+	if strings.HasPrefix(id, ldbInternalPrefix) {
+		// not a service id, see validateID
+		return nil, &NotFoundError{fmt.Sprintf("Service with id %q is not found", id)}
+	}
 
 	bytes, err := ls.db.Get([]byte(id), nil)
 	if err == leveldb.ErrNotFound {
@@ -76,69 +117,267 @@ func (ls *LevelDBStorage) get(id string) (*Service, error) {
 }
 
 func (ls *LevelDBStorage) update(id string, s *Service) error {
+	return ls.commit([]write{{Op: writeUpdate, ID: id, Service: s}})
+}
+
+func (ls *LevelDBStorage) delete(id string) error {
+	return ls.commit([]write{{Op: writeDelete, ID: id}})
+}
+
+// commit applies the writes in one batch
+func (ls *LevelDBStorage) commit(writes []write) error {
+	ls.writes.Lock()
+	defer ls.writes.Unlock()
 
-	bytes, err := json.Marshal(s)
+	err := checkWrites(writes, func(id string) (bool, error) {
+		return ls.db.Has([]byte(id), nil)
+	})
 	if err != nil {
 		return err
 	}
-	err = ls.db.Put([]byte(id), bytes, nil)
-	if err == leveldb.ErrNotFound {
-		return &NotFoundError{fmt.Sprintf("Service with id %s is not found", id)}
-	} else if err != nil {
+
+	// the services written by the commit, nil if deleted, whose index entries are replaced by later writes
+	pending := make(map[string]*Service)
+	stored := func(id string) (*Service, error) {
+		if s, found := pending[id]; found {
+			return s, nil
+		}
+		return ls.get(id)
+	}
+
+	// the sizes of the buckets of the offset index changed by the commit
+	buckets := make(map[string]int)
+	resize := func(id string, delta int) error {
+		key, size, err := ls.findBucket(id)
+		if err != nil {
+			return err
+		}
+		if _, found := buckets[key]; !found {
+			buckets[key] = size
+		}
+		buckets[key] += delta
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	count := ls.count
+	for _, w := range writes {
+		switch w.Op {
+		case writeAdd, writeUpdate:
+			bytes, err := json.Marshal(w.Service)
+			if err != nil {
+				return err
+			}
+			if w.Op == writeUpdate {
+				old, err := stored(w.ID)
+				if err != nil {
+					return err
+				}
+				ls.deleteIndexEntries(batch, old)
+			} else {
+				count++
+				if err := resize(w.ID, 1); err != nil {
+					return err
+				}
+			}
+			batch.Put([]byte(w.ID), bytes)
+			ls.putIndexEntries(batch, w.Service)
+			pending[w.ID] = w.Service
+		case writeDelete:
+			old, err := stored(w.ID)
+			if err != nil {
+				return err
+			}
+			batch.Delete([]byte(w.ID))
+			ls.deleteIndexEntries(batch, old)
+			pending[w.ID] = nil
+			count--
+			if err := resize(w.ID, -1); err != nil {
+				return err
+			}
+		case writePutRecord:
+			bytes, err := json.Marshal(w.Record)
+			if err != nil {
+				return err
+			}
+			batch.Put([]byte(ldbRecordPrefix+recordKey(w.Record.Kind, w.Record.ID)), bytes)
+		case writeDeleteRecord:
+			batch.Delete([]byte(ldbRecordPrefix + recordKey(w.Kind, w.ID)))
+		}
+	}
+	if count != ls.count {
+		batch.Put(ldbTotalKey, ldbEncodeCount(count))
+	}
+	for key, size := range buckets {
+		if size == 0 && key != ldbOffsetPrefix {
+			// the services of an empty bucket are counted by the previous one
+			batch.Delete([]byte(key))
+		} else {
+			batch.Put([]byte(key), ldbEncodeCount(size))
+		}
+	}
+
+	err = ls.db.Write(batch, nil)
+	if err != nil {
 		return err
 	}
+	ls.count = count
 
+	// a bucket which has grown too large is split after the commit, which is consistent without the split
+	for key, size := range buckets {
+		if size > 2*ls.offsetBucket {
+			err = ls.splitBucket(key, size)
+			if err != nil {
+				logger.Printf("LevelDB: Error splitting the offset index: %s", err)
+			}
+		}
+	}
 	return nil
 }
 
-func (ls *LevelDBStorage) delete(id string) error {
+func (ls *LevelDBStorage) putRecord(r *record) error {
+	bytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	ls.writes.Lock()
+	defer ls.writes.Unlock()
+
+	return ls.db.Put([]byte(ldbRecordPrefix+recordKey(r.Kind, r.ID)), bytes, nil)
+}
+
+func (ls *LevelDBStorage) deleteRecord(kind, id string) error {
+	ls.writes.Lock()
+	defer ls.writes.Unlock()
 
-	err := ls.db.Delete([]byte(id), nil)
+	key := []byte(ldbRecordPrefix + recordKey(kind, id))
+	_, err := ls.db.Get(key, nil)
 	if err == leveldb.ErrNotFound {
-		return &NotFoundError{fmt.Sprintf("Service with id %s is not found", id)}
+		return &NotFoundError{fmt.Sprintf("Record %s with id %s is not found", kind, id)}
 	} else if err != nil {
 		return err
 	}
+	return ls.db.Delete(key, nil)
+}
 
-	return nil
+func (ls *LevelDBStorage) getRecord(kind, id string) (*record, error) {
+	bytes, err := ls.db.Get([]byte(ldbRecordPrefix+recordKey(kind, id)), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, &NotFoundError{fmt.Sprintf("Record %s with id %s is not found", kind, id)}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var r record
+	err = json.Unmarshal(bytes, &r)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (ls *LevelDBStorage) listRecords(kind string) ([]record, error) {
+	prefix := ldbRecordPrefix
+	if kind != "" {
+		prefix += recordKey(kind, "")
+	}
+
+	records := make([]record, 0)
+	iter := ls.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var r record
+		err := json.Unmarshal(iter.Value(), &r)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, iter.Error()
+}
+
+func (ls *LevelDBStorage) listRecordsAfter(kind, after string, limit int) ([]record, error) {
+	prefix := util.BytesPrefix([]byte(ldbRecordPrefix + recordKey(kind, "")))
+	// the smallest key greater than after
+	start := []byte(ldbRecordPrefix + recordKey(kind, after) + "\x00")
+
+	records := make([]record, 0)
+	iter := ls.db.NewIterator(&util.Range{Start: start, Limit: prefix.Limit}, nil)
+	defer iter.Release()
+	for len(records) < limit && iter.Next() {
+		var r record
+		err := json.Unmarshal(iter.Value(), &r)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, iter.Error()
 }
 
 // Utilities
 
 func (ls *LevelDBStorage) list(page int, perPage int) ([]Service, int, error) {
 
-	total, err := ls.total()
+	ls.wg.Add(1)
+	defer ls.wg.Done()
+
+	// Read the total, the offset index, and the services from the same state
+	snapshot, err := ls.db.GetSnapshot()
 	if err != nil {
 		return nil, 0, err
 	}
+	defer snapshot.Release()
+
+	total := 0
+	bytes, err := snapshot.Get(ldbTotalKey, nil)
+	if err == nil {
+		total = ldbDecodeCount(bytes)
+	} else if err != leveldb.ErrNotFound {
+		return nil, 0, err
+	}
 	offset, limit, err := utils.GetPagingAttr(total, page, perPage, MaxPerPage)
 	if err != nil {
 		return nil, 0, &BadRequestError{fmt.Sprintf("Unable to paginate: %s", err)}
 	}
+	// page/registry is empty
+	if limit == 0 {
+		return []Service{}, total, nil
+	}
 
-	// TODO: is there a better way to do this?
-	// github.com/syndtr/goleveldb/leveldb/iterator
-	services := make([]Service, limit)
+	// find the bucket of the first service of the page
+	start := ldbServicesRange.Start
+	skip := offset
+	buckets := snapshot.NewIterator(util.BytesPrefix([]byte(ldbOffsetPrefix)), nil)
+	for buckets.Next() {
+		size := ldbDecodeCount(buckets.Value())
+		if skip < size {
+			if id := buckets.Key()[len(ldbOffsetPrefix):]; len(id) > 0 {
+				start = append([]byte{}, id...)
+			}
+			break
+		}
+		skip -= size
+	}
+	buckets.Release()
+	if err := buckets.Error(); err != nil {
+		return nil, 0, err
+	}
 
-	ls.wg.Add(1)
-	defer ls.wg.Done()
-	iter := ls.db.NewIterator(nil, nil)
+	// seek to the bucket and skip the services before the page without decoding them
+	services := make([]Service, 0, limit)
+	iter := snapshot.NewIterator(&util.Range{Start: start}, nil)
 	defer iter.Release()
-
-	i := 0
-	for iter.Next() {
+	for i := 0; i < skip && iter.Next(); i++ {
+	}
+	for len(services) < limit && iter.Next() {
 		var s Service
 		err = json.Unmarshal(iter.Value(), &s)
 		if err != nil {
 			return nil, 0, err
 		}
-
-		if i >= offset && i < offset+limit {
-			services[i-offset] = s
-		} else if i >= offset+limit {
-			break
-		}
-		i++
+		services = append(services, s)
 	}
 
 	err = iter.Error()
@@ -149,21 +388,82 @@ func (ls *LevelDBStorage) list(page int, perPage int) ([]Service, int, error) {
 	return services, total, nil
 }
 
-func (s *LevelDBStorage) total() (int, error) {
-	c := 0
-	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
+func (ls *LevelDBStorage) listAfter(after string, limit int) ([]Service, error) {
+
+	ls.wg.Add(1)
+	defer ls.wg.Done()
+
+	return ldbListAfter(ls.db, after, limit)
+}
+
+// ldbListAfter returns up to limit services with ids greater than after from a database or snapshot
+func ldbListAfter(reader ldbReader, after string, limit int) ([]Service, error) {
+	r := ldbServicesRange
+	if after != "" {
+		// the smallest key greater than after
+		r = &util.Range{Start: []byte(after + "\x00")}
+	}
+	iter := reader.NewIterator(r, nil)
+	defer iter.Release()
+
+	services := make([]Service, 0, limit)
+	for len(services) < limit && iter.Next() {
+		var s Service
+		err := json.Unmarshal(iter.Value(), &s)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+
+	err := iter.Error()
+	if err != nil {
+		return nil, err
+	}
+
+	return services, nil
+}
+
+func (ls *LevelDBStorage) total() (int, error) {
+	ls.writes.Lock()
+	defer ls.writes.Unlock()
+
+	return ls.count, nil
+}
+
+func (ls *LevelDBStorage) lookup(path, op, value string) ([]string, bool, error) {
+	if !containsString(ls.indexes, path) {
+		return nil, false, nil
+	}
+	if err := utils.ValidateFilterOp(op); err != nil {
+		return nil, true, err
+	}
+
+	ls.wg.Add(1)
+	defer ls.wg.Done()
+	pathPrefix := ldbIndexPrefix + path + indexSeparator
+	iter := ls.db.NewIterator(util.BytesPrefix(append([]byte(pathPrefix), indexScanPrefix(op, value)...)), nil)
+	defer iter.Release()
+
+	ids := []string{}
 	for iter.Next() {
-		c++
+		v, id := splitIndexKey(iter.Key()[len(pathPrefix):])
+		matched, err := utils.MatchValue(v, op, value)
+		if err != nil {
+			return nil, true, err
+		}
+		if matched {
+			ids = append(ids, id)
+		}
 	}
-	iter.Release()
-	s.wg.Done()
+
 	err := iter.Error()
 	if err != nil {
-		return 0, err
+		return nil, true, err
 	}
+	sort.Strings(ids)
 
-	return c, nil
+	return ids, true, nil
 }
 
 func (s *LevelDBStorage) iterator() <-chan *Service {
@@ -174,7 +474,7 @@ func (s *LevelDBStorage) iterator() <-chan *Service {
 
 		s.wg.Add(1)
 		defer s.wg.Done()
-		iter := s.db.NewIterator(nil, nil)
+		iter := s.db.NewIterator(ldbServicesRange, nil)
 		defer iter.Release()
 
 		for iter.Next() {
@@ -196,7 +496,207 @@ func (s *LevelDBStorage) iterator() <-chan *Service {
 	return serviceIter
 }
 
+func (ls *LevelDBStorage) snapshot() (snapshot, error) {
+	ls.wg.Add(1)
+	snapshot, err := ls.db.GetSnapshot()
+	if err != nil {
+		ls.wg.Done()
+		return nil, err
+	}
+
+	// Close waits for the release of the snapshot
+	return &ldbSnapshot{snapshot: snapshot, wg: &ls.wg}, nil
+}
+
 func (s *LevelDBStorage) Close() error {
 	s.wg.Wait()
 	return s.db.Close()
 }
+
+// ldbReader is implemented by both leveldb.DB and leveldb.Snapshot
+type ldbReader interface {
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+type ldbSnapshot struct {
+	snapshot *leveldb.Snapshot
+	wg       *sync.WaitGroup
+}
+
+func (s *ldbSnapshot) listAfter(after string, limit int) ([]Service, error) {
+	return ldbListAfter(s.snapshot, after, limit)
+}
+
+func (s *ldbSnapshot) release() {
+	s.snapshot.Release()
+	s.wg.Done()
+}
+
+// loadCount reads the number of services from the database
+// The counter is initialized by counting the services if it does not exist
+func (ls *LevelDBStorage) loadCount() error {
+	bytes, err := ls.db.Get(ldbTotalKey, nil)
+	if err == nil {
+		ls.count = ldbDecodeCount(bytes)
+		return nil
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	c := 0
+	iter := ls.db.NewIterator(ldbServicesRange, nil)
+	for iter.Next() {
+		c++
+	}
+	iter.Release()
+	err = iter.Error()
+	if err != nil {
+		return err
+	}
+
+	err = ls.db.Put(ldbTotalKey, ldbEncodeCount(c), nil)
+	if err != nil {
+		return err
+	}
+	ls.count = c
+	return nil
+}
+
+// findBucket returns the key of the entry of the offset index whose bucket contains the id, and the size of the bucket
+func (ls *LevelDBStorage) findBucket(id string) (string, int, error) {
+	iter := ls.db.NewIterator(util.BytesPrefix([]byte(ldbOffsetPrefix)), nil)
+	defer iter.Release()
+
+	// the bucket starts at the id, or is the previous one. The first bucket starts at the empty id.
+	key := []byte(ldbOffsetPrefix + id)
+	if !iter.Seek(key) || string(iter.Key()) != string(key) {
+		if !iter.Prev() {
+			if err := iter.Error(); err != nil {
+				return "", 0, err
+			}
+			return "", 0, fmt.Errorf("offset index has no entry for %s", id)
+		}
+	}
+	return string(iter.Key()), ldbDecodeCount(iter.Value()), nil
+}
+
+// splitBucket splits a bucket of the offset index into buckets of offsetBucket services
+// The caller must hold the writes lock.
+func (ls *LevelDBStorage) splitBucket(key string, size int) error {
+	start := ldbServicesRange.Start
+	if id := key[len(ldbOffsetPrefix):]; id != "" {
+		start = []byte(id)
+	}
+
+	batch := new(leveldb.Batch)
+	iter := ls.db.NewIterator(&util.Range{Start: start}, nil)
+	defer iter.Release()
+	for i := 0; i < size && iter.Next(); i++ {
+		if i%ls.offsetBucket != 0 {
+			continue
+		}
+		n := size - i
+		if n > ls.offsetBucket {
+			n = ls.offsetBucket
+		}
+		if i == 0 {
+			batch.Put([]byte(key), ldbEncodeCount(n))
+		} else {
+			batch.Put(append([]byte(ldbOffsetPrefix), iter.Key()...), ldbEncodeCount(n))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return ls.db.Write(batch, nil)
+}
+
+// ensureOffsetIndex builds the offset index if the database has none
+func (ls *LevelDBStorage) ensureOffsetIndex() error {
+	_, err := ls.db.Get([]byte(ldbOffsetPrefix), nil)
+	if err == nil {
+		return nil
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	logger.Printf("LevelDB: Building the offset index of %d services", ls.count)
+
+	// the first bucket counts all services, and is split into buckets of offsetBucket
+	err = ls.db.Put([]byte(ldbOffsetPrefix), ldbEncodeCount(ls.count), nil)
+	if err != nil {
+		return err
+	}
+	return ls.splitBucket(ldbOffsetPrefix, ls.count)
+}
+
+func ldbEncodeCount(c int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(c))
+	return b
+}
+
+func ldbDecodeCount(b []byte) int {
+	if len(b) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(b))
+}
+
+// Indexing
+
+func (ls *LevelDBStorage) putIndexEntries(batch *leveldb.Batch, s *Service) {
+	for path, value := range indexValues(s, ls.indexes) {
+		batch.Put(append([]byte(ldbIndexPrefix+path+indexSeparator), indexKey(value, s.ID)...), nil)
+	}
+}
+
+func (ls *LevelDBStorage) deleteIndexEntries(batch *leveldb.Batch, s *Service) {
+	for path, value := range indexValues(s, ls.indexes) {
+		batch.Delete(append([]byte(ldbIndexPrefix+path+indexSeparator), indexKey(value, s.ID)...))
+	}
+}
+
+// ensureIndexes rebuilds the indexes if the indexed paths differ from the ones stored in the database
+func (ls *LevelDBStorage) ensureIndexes() error {
+	indexes, err := json.Marshal(ls.indexes)
+	if err != nil {
+		return err
+	}
+
+	stored, err := ls.db.Get(ldbIndexesKey, nil)
+	if err == nil && string(stored) == string(indexes) {
+		return nil
+	} else if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	logger.Printf("LevelDB: Building indexes for %s", indexes)
+
+	batch := new(leveldb.Batch)
+	// remove all existing entries
+	iter := ls.db.NewIterator(util.BytesPrefix([]byte(ldbIndexPrefix)), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	iter = ls.db.NewIterator(ldbServicesRange, nil)
+	for iter.Next() {
+		var s Service
+		err = json.Unmarshal(iter.Value(), &s)
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		ls.putIndexEntries(batch, &s)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	batch.Put(ldbIndexesKey, indexes)
+	return ls.db.Write(batch, nil)
+}
@@ -0,0 +1,215 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestLevelDBStorageTotal(t *testing.T) {
+	if TestStorageType != CatalogBackendLevelDB {
+		t.Skip("Only for the LevelDB storage")
+	}
+	dir := fmt.Sprintf("%s/lslc/test-%s.ldb", strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4().String())
+	defer os.RemoveAll(dir)
+
+	storage, err := NewLevelDBStorage(dir, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 5; i++ {
+		err := storage.add(&Service{ID: fmt.Sprintf("service_%d", i), Type: "_test._tcp", TTL: 30})
+		if err != nil {
+			t.Fatal("Error adding a service:", err.Error())
+		}
+	}
+	err = storage.delete("service_2")
+	if err != nil {
+		t.Fatal("Error deleting a service:", err.Error())
+	}
+	err = storage.Close()
+	if err != nil {
+		t.Fatal("Error closing:", err.Error())
+	}
+
+	storage, err = NewLevelDBStorage(dir, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if total, _ := storage.total(); total != 4 {
+		t.Fatalf("Expected the persisted total of 4 after reopening, got %d", total)
+	}
+	_, total, err := storage.list(1, 10)
+	if err != nil || total != 4 {
+		t.Fatalf("Expected the total of 4 in the list after reopening, got %d: %v", total, err)
+	}
+
+	err = storage.delete("service_0")
+	if err != nil {
+		t.Fatal("Error deleting a service:", err.Error())
+	}
+	if err := storage.delete("service_0"); err == nil {
+		t.Fatal("Expected an error deleting a deleted service")
+	}
+	err = storage.Close()
+	if err != nil {
+		t.Fatal("Error closing:", err.Error())
+	}
+
+	storage, err = NewLevelDBStorage(dir, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer storage.Close()
+	if total, _ := storage.total(); total != 3 {
+		t.Fatalf("Expected the persisted total of 3 after the deletion and reopening, got %d", total)
+	}
+
+	// internal keys are not services
+	_, err = storage.get(string(ldbTotalKey))
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError for an internal key, got: %v", err)
+	}
+}
+
+func TestLevelDBStorageListLargeOffset(t *testing.T) {
+	if TestStorageType != CatalogBackendLevelDB {
+		t.Skip("Only for the LevelDB storage")
+	}
+	dir := fmt.Sprintf("%s/lslc/test-%s.ldb", strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4().String())
+	defer os.RemoveAll(dir)
+
+	storage, err := NewLevelDBStorage(dir, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer storage.Close()
+	// small buckets of the offset index, which are split while adding
+	storage.(*LevelDBStorage).offsetBucket = 16
+
+	const n = 2500
+	for i := 0; i < n; i++ {
+		err := storage.add(&Service{ID: fmt.Sprintf("service_%05d", i), Type: "_test._tcp", TTL: 30})
+		if err != nil {
+			t.Fatal("Error adding a service:", err.Error())
+		}
+	}
+
+	check := func(page, perPage, total int, first string, size int) {
+		services, gotTotal, err := storage.list(page, perPage)
+		if err != nil {
+			t.Fatalf("Error listing page %d: %s", page, err)
+		}
+		if gotTotal != total || len(services) != size {
+			t.Fatalf("Expected %d of %d services on page %d, got %d of %d", size, total, page, len(services), gotTotal)
+		}
+		if size > 0 && services[0].ID != first {
+			t.Fatalf("Expected page %d to start with %s, got %s", page, first, services[0].ID)
+		}
+		for i := 1; i < len(services); i++ {
+			if services[i-1].ID >= services[i].ID {
+				t.Fatalf("Services on page %d are not sorted: %s %s", page, services[i-1].ID, services[i].ID)
+			}
+		}
+	}
+	check(1, 100, n, "service_00000", 100)
+	check(24, 100, n, "service_02300", 100)
+	check(25, 100, n, "service_02400", 100)
+	check(26, 100, n, "", 0)
+	check(49, 50, n, "service_02400", 50)
+
+	// the offset index is kept up to date
+	for _, id := range []string{"service_00000", "service_02300", "service_02450"} {
+		err := storage.delete(id)
+		if err != nil {
+			t.Fatal("Error deleting a service:", err.Error())
+		}
+	}
+	err = storage.add(&Service{ID: "service_02400a", Type: "_test._tcp", TTL: 30})
+	if err != nil {
+		t.Fatal("Error adding a service:", err.Error())
+	}
+	check(1, 100, n-2, "service_00001", 100)
+	check(24, 100, n-2, "service_02302", 100)
+	check(25, 100, n-2, "service_02401", 98)
+
+	if sum := ldbOffsetIndexTotal(t, storage.(*LevelDBStorage)); sum != n-2 {
+		t.Fatalf("Expected the offset index to count %d services, got %d", n-2, sum)
+	}
+
+	// the offset index is built for databases which have none
+	ls := storage.(*LevelDBStorage)
+	iter := ls.db.NewIterator(util.BytesPrefix([]byte(ldbOffsetPrefix)), nil)
+	for iter.Next() {
+		ls.db.Delete(iter.Key(), nil)
+	}
+	iter.Release()
+	err = ls.ensureOffsetIndex()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	check(24, 100, n-2, "service_02302", 100)
+	check(25, 100, n-2, "service_02401", 98)
+}
+
+// ldbOffsetIndexTotal returns the sum of the sizes of the buckets of the offset index
+func ldbOffsetIndexTotal(t *testing.T, ls *LevelDBStorage) int {
+	sum := 0
+	iter := ls.db.NewIterator(util.BytesPrefix([]byte(ldbOffsetPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		sum += ldbDecodeCount(iter.Value())
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return sum
+}
+
+func BenchmarkLevelDBStorageList(b *testing.B) {
+	if TestStorageType != CatalogBackendLevelDB {
+		b.Skip("Only for the LevelDB storage")
+	}
+	dir := fmt.Sprintf("%s/lslc/test-%s.ldb", strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4().String())
+	defer os.RemoveAll(dir)
+
+	storage, err := NewLevelDBStorage(dir, nil)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer storage.Close()
+
+	const n = 20000
+	for i := 0; i < n; i++ {
+		err := storage.add(&Service{ID: fmt.Sprintf("service_%05d", i), Type: "_test._tcp", TTL: 30})
+		if err != nil {
+			b.Fatal("Error adding a service:", err.Error())
+		}
+	}
+
+	added := 0
+	b.Run("add", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			added++
+			err := storage.add(&Service{ID: fmt.Sprintf("bench_%d", added), Type: "_test._tcp", TTL: 30})
+			if err != nil {
+				b.Fatal(err.Error())
+			}
+		}
+	})
+	b.Run("last page", func(b *testing.B) {
+		total, _ := storage.total()
+		for i := 0; i < b.N; i++ {
+			_, _, err := storage.list(total/100, 100)
+			if err != nil {
+				b.Fatal(err.Error())
+			}
+		}
+	})
+}
@@ -11,6 +11,7 @@ var (
 	TestSupportedBackends = map[string]bool{
 		CatalogBackendMemory:  true,
 		CatalogBackendLevelDB: true,
+		CatalogBackendBolt:    true,
 	}
 	TestStorageType string
 )
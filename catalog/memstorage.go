@@ -4,6 +4,7 @@ package catalog
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	avl "github.com/ancientlore/go-avltree"
@@ -14,26 +15,27 @@ import (
 type MemoryStorage struct {
 	sync.RWMutex
 	services *avl.Tree
+	index    *memIndex
+	// records ordered by kind and id
+	records *avl.Tree
+	// wal is the write-ahead log of a durable storage, nil otherwise
+	wal *memWAL
 }
 
-func NewMemoryStorage() *MemoryStorage {
+// NewMemoryStorage creates an in-memory storage
+// indexes are the paths to be indexed in addition to the DefaultIndexes
+func NewMemoryStorage(indexes ...string) *MemoryStorage {
 	storage := &MemoryStorage{
 		services: avl.New(operator, 0),
+		index:    newMemIndex(indexPaths(indexes)),
+		records:  avl.New(recordOperator, 0),
 	}
 
 	return storage
 }
 
 func (ms *MemoryStorage) add(s *Service) error {
-	ms.Lock()
-	defer ms.Unlock()
-
-	_, duplicate := ms.services.Add(*s)
-	if duplicate {
-		return &ConflictError{fmt.Sprintf("Service id %s is not unique", s.ID)}
-	}
-
-	return nil
+	return ms.commit([]write{{Op: writeAdd, ID: s.ID, Service: s}})
 }
 
 func (ms *MemoryStorage) get(id string) (*Service, error) {
@@ -50,31 +52,162 @@ func (ms *MemoryStorage) get(id string) (*Service, error) {
 }
 
 func (ms *MemoryStorage) update(id string, s *Service) error {
+	return ms.commit([]write{{Op: writeUpdate, ID: id, Service: s}})
+}
+
+func (ms *MemoryStorage) delete(id string) error {
+	return ms.commit([]write{{Op: writeDelete, ID: id}})
+}
+
+func (ms *MemoryStorage) commit(writes []write) error {
 	ms.Lock()
 	defer ms.Unlock()
 
-	r := ms.services.Remove(Service{ID: id})
-	if r == nil {
-		return &NotFoundError{fmt.Sprintf("Service with id %s is not found", id)}
+	err := checkWrites(writes, func(id string) (bool, error) {
+		return ms.services.Find(Service{ID: id}) != nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	err = ms.log(memWALRecord{Op: memWALOpCommit, Writes: writes})
+	if err != nil {
+		return err
 	}
+	ms.apply(writes)
 
+	return nil
+}
+
+// apply applies checked writes
+func (ms *MemoryStorage) apply(writes []write) {
+	for _, w := range writes {
+		switch w.Op {
+		case writeAdd, writeUpdate:
+			ms.put(w.Service)
+		case writeDelete:
+			ms.remove(w.ID)
+		case writePutRecord:
+			ms.putRec(w.Record)
+		case writeDeleteRecord:
+			ms.removeRec(w.Kind, w.ID)
+		}
+	}
+}
+
+// put adds or replaces a service
+func (ms *MemoryStorage) put(s *Service) {
+	ms.remove(s.ID)
 	ms.services.Add(*s)
+	ms.index.add(s)
+}
+
+// remove removes a service if it exists
+func (ms *MemoryStorage) remove(id string) {
+	r := ms.services.Remove(Service{ID: id})
+	if r != nil {
+		old := r.(Service)
+		ms.index.remove(&old)
+	}
+}
+
+// putRec adds or replaces a record
+func (ms *MemoryStorage) putRec(r *record) {
+	ms.records.Remove(*r)
+	ms.records.Add(*r)
+}
+
+// removeRec removes a record if it exists
+func (ms *MemoryStorage) removeRec(kind, id string) {
+	ms.records.Remove(record{Kind: kind, ID: id})
+}
+
+func (ms *MemoryStorage) putRecord(r *record) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	err := ms.log(memWALRecord{Op: memWALOpPutRecord, Record: r})
+	if err != nil {
+		return err
+	}
+	ms.putRec(r)
 
 	return nil
 }
 
-func (ms *MemoryStorage) delete(id string) error {
+func (ms *MemoryStorage) deleteRecord(kind, id string) error {
 	ms.Lock()
 	defer ms.Unlock()
 
-	r := ms.services.Remove(Service{ID: id})
-	if r == nil {
-		return &NotFoundError{fmt.Sprintf("Service with id %s is not found", id)}
+	if ms.records.Find(record{Kind: kind, ID: id}) == nil {
+		return &NotFoundError{fmt.Sprintf("Record %s with id %s is not found", kind, id)}
+	}
+	err := ms.log(memWALRecord{Op: memWALOpDeleteRecord, Kind: kind, ID: id})
+	if err != nil {
+		return err
 	}
+	ms.removeRec(kind, id)
 
 	return nil
 }
 
+func (ms *MemoryStorage) getRecord(kind, id string) (*record, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	r := ms.records.Find(record{Kind: kind, ID: id})
+	if r == nil {
+		return nil, &NotFoundError{fmt.Sprintf("Record %s with id %s is not found", kind, id)}
+	}
+	rec := r.(record)
+	return &rec, nil
+}
+
+func (ms *MemoryStorage) listRecords(kind string) ([]record, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	if kind == "" {
+		return ms.copyRecords(), nil
+	}
+	return ms.recordsAfter(kind, "", ms.records.Len()), nil
+}
+
+func (ms *MemoryStorage) listRecordsAfter(kind, after string, limit int) ([]record, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return ms.recordsAfter(kind, after, limit), nil
+}
+
+// recordsAfter returns up to limit records of a kind with ids greater than after
+// The caller must hold the lock.
+func (ms *MemoryStorage) recordsAfter(kind, after string, limit int) []record {
+	key := recordKey(kind, after)
+	total := ms.records.Len()
+	start := sort.Search(total, func(i int) bool {
+		r := ms.records.At(i).(record)
+		return recordKey(r.Kind, r.ID) > key
+	})
+
+	records := make([]record, 0)
+	for i := start; i < total && len(records) < limit; i++ {
+		r := ms.records.At(i).(record)
+		if r.Kind != kind {
+			break
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// log appends a mutation to the write-ahead log of a durable storage
+func (ms *MemoryStorage) log(record memWALRecord) error {
+	if ms.wal == nil {
+		return nil
+	}
+	return ms.wal.append(record)
+}
+
 func (ms *MemoryStorage) list(page int, perPage int) ([]Service, int, error) {
 	ms.RLock()
 	defer ms.RUnlock()
@@ -99,6 +232,23 @@ func (ms *MemoryStorage) list(page int, perPage int) ([]Service, int, error) {
 	return services, total, nil
 }
 
+func (ms *MemoryStorage) listAfter(after string, limit int) ([]Service, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	total := ms.services.Len()
+	start := sort.Search(total, func(i int) bool {
+		return ms.services.At(i).(Service).ID > after
+	})
+
+	services := make([]Service, 0, limit)
+	for i := start; i < total && len(services) < limit; i++ {
+		services = append(services, ms.services.At(i).(Service))
+	}
+
+	return services, nil
+}
+
 func (ms *MemoryStorage) total() (int, error) {
 	ms.RLock()
 	defer ms.RUnlock()
@@ -106,6 +256,13 @@ func (ms *MemoryStorage) total() (int, error) {
 	return ms.services.Len(), nil
 }
 
+func (ms *MemoryStorage) lookup(path, op, value string) ([]string, bool, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return ms.index.lookup(path, op, value)
+}
+
 func (ms *MemoryStorage) iterator() <-chan *Service {
 	serviceIter := make(chan *Service)
 
@@ -122,7 +279,37 @@ func (ms *MemoryStorage) iterator() <-chan *Service {
 	return serviceIter
 }
 
+func (ms *MemoryStorage) snapshot() (snapshot, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return ms.copyServices(), nil
+}
+
+// copyServices returns a copy of the services. The caller must hold the lock.
+func (ms *MemoryStorage) copyServices() memSnapshot {
+	services := make(memSnapshot, 0, ms.services.Len())
+	ms.services.Do(func(s interface{}) bool {
+		services = append(services, s.(Service))
+		return true
+	})
+	return services
+}
+
+// copyRecords returns a copy of the records ordered by kind and id. The caller must hold the lock.
+func (ms *MemoryStorage) copyRecords() []record {
+	records := make([]record, 0, ms.records.Len())
+	ms.records.Do(func(r interface{}) bool {
+		records = append(records, r.(record))
+		return true
+	})
+	return records
+}
+
 func (ms *MemoryStorage) Close() error {
+	if ms.wal != nil {
+		return ms.closeWAL()
+	}
 	return nil
 }
 
@@ -135,3 +322,31 @@ func operator(a interface{}, b interface{}) int {
 	}
 	return 0
 }
+
+// Comparison operator of the records for AVL Tree
+func recordOperator(a interface{}, b interface{}) int {
+	ka, kb := recordKey(a.(record).Kind, a.(record).ID), recordKey(b.(record).Kind, b.(record).ID)
+	if ka < kb {
+		return -1
+	} else if ka > kb {
+		return 1
+	}
+	return 0
+}
+
+// memSnapshot is a copy of the services ordered by id
+type memSnapshot []Service
+
+func (snapshot memSnapshot) listAfter(after string, limit int) ([]Service, error) {
+	start := sort.Search(len(snapshot), func(i int) bool {
+		return snapshot[i].ID > after
+	})
+	end := start + limit
+	if end > len(snapshot) {
+		end = len(snapshot)
+	}
+
+	return snapshot[start:end], nil
+}
+
+func (snapshot memSnapshot) release() {}
@@ -0,0 +1,430 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files of the durable memory storage
+// The state is snapshot-<gen> followed by the mutations in wal-<gen> and the WAL files of later generations.
+const (
+	memSnapshotFilePrefix = "snapshot-"
+	memSnapshotFileSuffix = ".ndjson"
+	memWALFilePrefix      = "wal-"
+	memWALFileSuffix      = ".log"
+	memTempFilePrefix     = ".tmp-"
+
+	memWALOpPut          = "put"
+	memWALOpDelete       = "delete"
+	memWALOpPutRecord    = "putRecord"
+	memWALOpDeleteRecord = "deleteRecord"
+	memWALOpCommit       = "commit"
+
+	memDefaultCompactionInterval = 300 // seconds
+)
+
+// memWALRecord is a mutation in the write-ahead log
+type memWALRecord struct {
+	Op      string   `json:"op"`
+	ID      string   `json:"id,omitempty"`
+	Service *Service `json:"service,omitempty"`
+	// Kind and ID identify a deleted record
+	Kind   string  `json:"kind,omitempty"`
+	Record *record `json:"record,omitempty"`
+	// Writes are the writes of a commit, which is replayed as a whole
+	Writes []write `json:"writes,omitempty"`
+}
+
+// memWAL is the write-ahead log of the durable memory storage
+type memWAL struct {
+	dir  string
+	sync bool
+	gen  int
+	file *os.File
+	// size is the length of the file, to which it is truncated if an append fails
+	size int64
+	// records is the number of mutations since the last compaction
+	records int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewDurableMemoryStorage creates an in-memory storage which persists every mutation to a write-ahead log
+// The DSN is the path of the data directory with the optional query parameters sync, whether to flush
+// every mutation to disk (default true), and compaction, the interval in seconds between compactions
+// of the log into a snapshot (default 300). E.g. ./data?sync=false&compaction=60
+// On startup, the latest snapshot is loaded and the log is replayed.
+// indexes are the paths to be indexed in addition to the DefaultIndexes
+func NewDurableMemoryStorage(dsn string, indexes ...string) (*MemoryStorage, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		return nil, fmt.Errorf("data directory is not specified")
+	}
+
+	wal := &memWAL{
+		dir:  u.Path,
+		sync: true,
+		done: make(chan struct{}),
+	}
+	compaction := memDefaultCompactionInterval
+	query := u.Query()
+	if v := query.Get("sync"); v != "" {
+		wal.sync, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sync parameter: %s", err)
+		}
+	}
+	if v := query.Get("compaction"); v != "" {
+		compaction, err = strconv.Atoi(v)
+		if err != nil || compaction <= 0 {
+			return nil, fmt.Errorf("invalid compaction parameter: %s", v)
+		}
+	}
+
+	err = os.MkdirAll(wal.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := NewMemoryStorage(indexes...)
+	err = ms.recover(wal)
+	if err != nil {
+		return nil, err
+	}
+	ms.wal = wal
+
+	wal.wg.Add(1)
+	go ms.compactPeriodically(time.Duration(compaction) * time.Second)
+
+	return ms, nil
+}
+
+// recover loads the latest snapshot, replays the log and opens the log for appending
+func (ms *MemoryStorage) recover(wal *memWAL) error {
+	snapshots, logs, err := memListFiles(wal.dir)
+	if err != nil {
+		return err
+	}
+
+	// the latest complete snapshot
+	var snapshotGen int
+	if len(snapshots) > 0 {
+		snapshotGen = snapshots[len(snapshots)-1]
+		err = ms.loadSnapshot(memSnapshotPath(wal.dir, snapshotGen))
+		if err != nil {
+			return fmt.Errorf("error loading snapshot %d: %s", snapshotGen, err)
+		}
+	}
+	wal.gen = snapshotGen
+
+	// the logs written after the snapshot
+	var replayed int
+	for _, gen := range logs {
+		if gen < wal.gen {
+			continue
+		}
+		n, err := ms.replay(memWALPath(wal.dir, gen))
+		if err != nil {
+			return fmt.Errorf("error replaying log %d: %s", gen, err)
+		}
+		replayed += n
+		wal.gen = gen
+	}
+	wal.records = replayed
+	logger.Printf("Memory: Recovered %d services from %s (replayed %d mutations)", ms.services.Len(), wal.dir, replayed)
+
+	// The logs replayed after the snapshot are only removed by the next compaction, once their mutations are in a snapshot.
+	err = wal.removeBefore(snapshotGen)
+	if err != nil {
+		return err
+	}
+
+	wal.file, wal.size, err = openWALFile(memWALPath(wal.dir, wal.gen))
+	return err
+}
+
+// openWALFile opens a log file for appending and returns its size
+func openWALFile(path string) (*os.File, int64, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+func (ms *MemoryStorage) loadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	services, records, err := readSnapshot(f)
+	if err != nil {
+		return err
+	}
+	for i := range services {
+		ms.put(&services[i])
+	}
+	for i := range records {
+		ms.putRec(&records[i])
+	}
+	return nil
+}
+
+// replay applies the mutations in a log file
+// An incomplete record at the end of the file, e.g. after a crash, is discarded.
+func (ms *MemoryStorage) replay(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var n, offset int
+	for offset < len(b) {
+		end := bytes.IndexByte(b[offset:], '\n')
+		var record memWALRecord
+		if end == -1 || json.Unmarshal(b[offset:offset+end], &record) != nil {
+			if end != -1 && offset+end+1 < len(b) {
+				return n, fmt.Errorf("corrupted record at offset %d", offset)
+			}
+			logger.Printf("Memory: Discarding an incomplete record at the end of %s", path)
+			return n, os.Truncate(path, int64(offset))
+		}
+
+		switch record.Op {
+		case memWALOpPut:
+			if record.Service == nil {
+				return n, fmt.Errorf("record at offset %d has no service", offset)
+			}
+			ms.put(record.Service)
+		case memWALOpDelete:
+			ms.remove(record.ID)
+		case memWALOpPutRecord:
+			if record.Record == nil {
+				return n, fmt.Errorf("record at offset %d has no internal record", offset)
+			}
+			ms.putRec(record.Record)
+		case memWALOpDeleteRecord:
+			ms.removeRec(record.Kind, record.ID)
+		case memWALOpCommit:
+			ms.apply(record.Writes)
+		default:
+			return n, fmt.Errorf("record at offset %d has an unknown operation: %s", offset, record.Op)
+		}
+		offset += end + 1
+		n++
+	}
+	return n, nil
+}
+
+// append writes a mutation to the log
+func (wal *memWAL) append(record memWALRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	n, err := wal.file.Write(append(b, '\n'))
+	if err == nil && wal.sync {
+		err = wal.file.Sync()
+	}
+	if err != nil {
+		// a partial or unsynced record is removed, so that it is neither followed by the next records nor replayed
+		if n > 0 {
+			if truncErr := wal.file.Truncate(wal.size); truncErr != nil {
+				logger.Printf("Memory: Error truncating the log after a failed append: %s", truncErr)
+			}
+		}
+		return err
+	}
+	wal.size += int64(n)
+	wal.records++
+	return nil
+}
+
+// rotate continues the log in a new generation
+func (wal *memWAL) rotate() error {
+	file, size, err := openWALFile(memWALPath(wal.dir, wal.gen+1))
+	if err != nil {
+		return err
+	}
+	wal.file.Close()
+
+	wal.file = file
+	wal.size = size
+	wal.gen++
+	wal.records = 0
+	return nil
+}
+
+// removeBefore removes the snapshots and logs older than the given generation
+func (wal *memWAL) removeBefore(gen int) error {
+	snapshots, logs, err := memListFiles(wal.dir)
+	if err != nil {
+		return err
+	}
+	for _, g := range snapshots {
+		if g < gen {
+			if err := os.Remove(memSnapshotPath(wal.dir, g)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, g := range logs {
+		if g < gen {
+			if err := os.Remove(memWALPath(wal.dir, g)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStorage) compactPeriodically(interval time.Duration) {
+	defer ms.wal.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := ms.compact()
+			if err != nil {
+				logger.Printf("Memory: Error compacting the log: %s", err)
+			}
+		case <-ms.wal.done:
+			return
+		}
+	}
+}
+
+// compact writes the services to a snapshot and removes the log of the previous generation
+// The lock is only held while copying the services and switching to a new log.
+func (ms *MemoryStorage) compact() error {
+	ms.Lock()
+	if ms.wal.records == 0 {
+		ms.Unlock()
+		return nil
+	}
+	services := ms.copyServices()
+	records := ms.copyRecords()
+	err := ms.wal.rotate()
+	gen := ms.wal.gen
+	ms.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = writeMemSnapshot(ms.wal.dir, gen, services, records)
+	if err != nil {
+		return err
+	}
+	return ms.wal.removeBefore(gen)
+}
+
+// writeMemSnapshot writes the services and records to a new snapshot file
+// The file is written under a temporary name and renamed once complete.
+func writeMemSnapshot(dir string, gen int, services memSnapshot, records []record) error {
+	f, err := ioutil.TempFile(dir, memTempFilePrefix+memSnapshotFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	_, err = writeSnapshot(services, w)
+	if err == nil {
+		err = writeRecords(records, w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), memSnapshotPath(dir, gen))
+}
+
+// closeWAL stops the compactions, compacts the log and closes it
+func (ms *MemoryStorage) closeWAL() error {
+	close(ms.wal.done)
+	ms.wal.wg.Wait()
+
+	err := ms.compact()
+	if err != nil {
+		logger.Printf("Memory: Error compacting the log: %s", err)
+	}
+	return ms.wal.file.Close()
+}
+
+// memListFiles returns the generations of the snapshots and logs in dir in ascending order
+func memListFiles(dir string) ([]int, []int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var snapshots, logs []int
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if gen, ok := memParseGen(f.Name(), memSnapshotFilePrefix, memSnapshotFileSuffix); ok {
+			snapshots = append(snapshots, gen)
+		} else if gen, ok := memParseGen(f.Name(), memWALFilePrefix, memWALFileSuffix); ok {
+			logs = append(logs, gen)
+		}
+	}
+	sort.Ints(snapshots)
+	sort.Ints(logs)
+	return snapshots, logs, nil
+}
+
+func memParseGen(name, prefix, suffix string) (int, bool) {
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return 0, false
+	}
+	gen, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix))
+	if err != nil || gen < 0 {
+		return 0, false
+	}
+	return gen, true
+}
+
+func memSnapshotPath(dir string, gen int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d%s", memSnapshotFilePrefix, gen, memSnapshotFileSuffix))
+}
+
+func memWALPath(dir string, gen int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d%s", memWALFilePrefix, gen, memWALFileSuffix))
+}
@@ -0,0 +1,170 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestDurableMemoryStorage(t *testing.T) {
+	if TestStorageType != CatalogBackendMemory {
+		t.Skip("Only for the memory storage")
+	}
+	dir := fmt.Sprintf("%s/lslc/test-%s.mem", strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4().String())
+	defer os.RemoveAll(dir)
+
+	storage, err := NewDurableMemoryStorage(dir, testMetaIndex)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		err := storage.add(&Service{ID: fmt.Sprintf("service_%d", i), Type: "_test._tcp", TTL: 30})
+		if err != nil {
+			t.Fatal("Error adding a service:", err.Error())
+		}
+	}
+	err = storage.update("service_1", &Service{ID: "service_1", Type: "_updated._tcp", TTL: 30})
+	if err != nil {
+		t.Fatal("Error updating a service:", err.Error())
+	}
+	err = storage.delete("service_2")
+	if err != nil {
+		t.Fatal("Error deleting a service:", err.Error())
+	}
+
+	check := func(s Storage) {
+		if total, _ := s.total(); total != 2 {
+			t.Fatalf("Expected 2 recovered services, got %d", total)
+		}
+		updated, err := s.get("service_1")
+		if err != nil || updated.Type != "_updated._tcp" {
+			t.Fatalf("Update is not recovered: %v %v", updated, err)
+		}
+		if _, err := s.get("service_2"); err == nil {
+			t.Fatal("Deletion is not recovered")
+		}
+		ids, indexed, err := s.lookup("type", "equals", "_updated._tcp")
+		if err != nil || !indexed || len(ids) != 1 {
+			t.Fatalf("Index is not recovered: %v %v %v", ids, indexed, err)
+		}
+	}
+
+	// Replay the log without closing the storage, as after a crash
+	recovered, err := NewDurableMemoryStorage(dir, testMetaIndex)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	check(recovered)
+	recovered.wal.file.Close()
+
+	// Incomplete record at the end of the log
+	f, err := os.OpenFile(memWALPath(dir, storage.wal.gen), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	f.WriteString(`{"op":"put","service":{"id":"serv`)
+	f.Close()
+	recovered, err = NewDurableMemoryStorage(dir, testMetaIndex)
+	if err != nil {
+		t.Fatal("Error recovering a log with an incomplete record:", err.Error())
+	}
+	check(recovered)
+	recovered.wal.file.Close()
+
+	// Compaction
+	err = storage.compact()
+	if err != nil {
+		t.Fatal("Error compacting:", err.Error())
+	}
+	err = storage.add(&Service{ID: "service_3", Type: "_test._tcp", TTL: 30})
+	if err != nil {
+		t.Fatal("Error adding a service:", err.Error())
+	}
+	err = storage.delete("service_3")
+	if err != nil {
+		t.Fatal("Error deleting a service:", err.Error())
+	}
+	err = storage.Close()
+	if err != nil {
+		t.Fatal("Error closing:", err.Error())
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Fatalf("Expected a snapshot and a log after compaction, got: %v", files)
+	}
+
+	recovered, err = NewDurableMemoryStorage(dir, testMetaIndex)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer recovered.Close()
+	check(recovered)
+}
+
+func TestDurableMemoryStorageInterruptedRotation(t *testing.T) {
+	if TestStorageType != CatalogBackendMemory {
+		t.Skip("Only for the memory storage")
+	}
+	dir := fmt.Sprintf("%s/lslc/test-%s.mem", strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4().String())
+	defer os.RemoveAll(dir)
+
+	storage, err := NewDurableMemoryStorage(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = storage.add(&Service{ID: "a", Type: "_test._tcp", TTL: 30})
+	if err != nil {
+		t.Fatal("Error adding a service:", err.Error())
+	}
+	// crash after switching to a new log but before writing the snapshot
+	err = storage.wal.rotate()
+	if err != nil {
+		t.Fatal("Error rotating the log:", err.Error())
+	}
+	err = storage.add(&Service{ID: "b", Type: "_test._tcp", TTL: 30})
+	if err != nil {
+		t.Fatal("Error adding a service:", err.Error())
+	}
+	storage.wal.file.Close()
+
+	// reopen twice without closing, as after repeated crashes
+	for i := 0; i < 2; i++ {
+		recovered, err := NewDurableMemoryStorage(dir)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if total, _ := recovered.total(); total != 2 {
+			t.Fatalf("Expected 2 services after reopening %d times, got %d", i+1, total)
+		}
+		recovered.wal.file.Close()
+	}
+
+	// a compaction removes the replayed logs
+	recovered, err := NewDurableMemoryStorage(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = recovered.Close()
+	if err != nil {
+		t.Fatal("Error closing:", err.Error())
+	}
+	recovered, err = NewDurableMemoryStorage(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer recovered.Close()
+	if total, _ := recovered.total(); total != 2 {
+		t.Fatalf("Expected 2 services after compaction, got %d", total)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Fatalf("Expected a snapshot and a log after compaction, got: %v", files)
+	}
+}
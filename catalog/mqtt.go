@@ -31,10 +31,11 @@ type MQTTManager struct {
 
 type MQTTClient struct {
 	MQTTClientConf
-	paho       paho.Client
-	topics     []string
-	willTopics []string
-	manager    *MQTTManager
+	paho            paho.Client
+	topics          []string
+	willTopics      []string
+	heartbeatTopics []string
+	manager         *MQTTManager
 }
 
 func StartMQTTManager(controller *Controller, mqttConf MQTTConf, scID string) {
@@ -60,6 +61,7 @@ func StartMQTTManager(controller *Controller, mqttConf MQTTConf, scID string) {
 
 		client.topics = append(mqttConf.CommonRegTopics, client.RegTopics...)
 		client.willTopics = append(mqttConf.CommonWillTopics, client.WillTopics...)
+		client.heartbeatTopics = append(mqttConf.CommonHeartbeatTopics, client.HeartbeatTopics...)
 
 		logger.Printf("MQTT: Added client for %s", client.BrokerURI)
 		m.clients = append(m.clients, &client)
@@ -97,7 +99,7 @@ func (c *MQTTClient) connect() {
 func (c *MQTTClient) onConnect(pahoClient paho.Client) {
 	logger.Printf("MQTT: %s: Connected.", c.BrokerURI)
 
-	for _, topic := range append(c.topics, c.willTopics...) {
+	for _, topic := range append(append(c.topics, c.willTopics...), c.heartbeatTopics...) {
 		if token := pahoClient.Subscribe(topic, c.QoS, c.onMessage); token.WaitTimeout(mqttWaitTimout) && token.Error() != nil {
 			logger.Printf("MQTT: %s: Error subscribing to %s: %v", c.BrokerURI, topic, token.Error())
 			continue
@@ -119,7 +121,17 @@ func (c *MQTTClient) onMessage(_ paho.Client, msg paho.Message) {
 	for _, filter := range c.willTopics {
 		if mqtttopic.Match(filter, topic) {
 			parts := strings.Split(msg.Topic(), "/")
-			c.manager.removeService(Service{ID: parts[len(parts)-1]})
+			c.manager.removeService(Service{ID: parts[len(parts)-1]}, actor{origin: c.BrokerID})
+			return
+		}
+	}
+
+	// Heartbeat has ID in topic
+	// Get id from topic. Expects: <prefix as in heartbeatTopics or commonHeartbeatTopics>/<id>
+	for _, filter := range c.heartbeatTopics {
+		if mqtttopic.Match(filter, topic) {
+			parts := strings.Split(msg.Topic(), "/")
+			c.manager.renewService(parts[len(parts)-1], actor{origin: c.BrokerID})
 			return
 		}
 	}
@@ -144,7 +156,7 @@ func (c *MQTTClient) onMessage(_ paho.Client, msg paho.Message) {
 		service.ID = id
 	}
 
-	c.manager.addService(service)
+	c.manager.addService(service, actor{origin: c.BrokerID})
 }
 
 func (m *MQTTManager) registerAsService(client *MQTTClient) {
@@ -168,31 +180,52 @@ func (m *MQTTManager) registerAsService(client *MQTTClient) {
 	}
 	// keepalive starting from right now
 	for ; true; <-time.Tick(mqttServiceHeartbeatInterval) {
-		m.addService(service)
+		m.addService(service, actor{origin: client.BrokerID})
 	}
 }
 
-//Controller Listener interface implementation
+// Controller Listener interface implementation
 func (m *MQTTManager) added(s Service) {
 	if len(m.clients) > 0 {
 		m.publishAliveService(s)
 	}
 }
 
-//Controller Listener interface implementation
+// Controller Listener interface implementation
 func (m *MQTTManager) updated(s Service) {
 	if len(m.clients) > 0 {
 		m.publishAliveService(s)
 	}
 }
 
-//Controller Listener interface implementation
+// Controller Listener interface implementation
+func (m *MQTTManager) renewed(s Service) {
+	if len(m.clients) > 0 {
+		m.publishRenewedService(s)
+	}
+}
+
+// Controller Listener interface implementation
 func (m *MQTTManager) deleted(s Service) {
 	if len(m.clients) > 0 {
 		m.publishDeadService(s)
 	}
 }
 
+// Controller Listener interface implementation
+func (m *MQTTManager) expired(s Service) {
+	if len(m.clients) > 0 {
+		m.publishExpiredService(s)
+	}
+}
+
+// Controller Listener interface implementation
+func (m *MQTTManager) healthChanged(s Service) {
+	if len(m.clients) > 0 {
+		m.publishServiceHealth(s)
+	}
+}
+
 func (m *MQTTManager) publishAliveService(s Service) {
 	payload, err := json.Marshal(s)
 	if err != nil {
@@ -209,6 +242,57 @@ func (m *MQTTManager) publishAliveService(s Service) {
 	}
 }
 
+// publishRenewedService announces the new expiry without republishing the retained registration
+func (m *MQTTManager) publishRenewedService(s Service) {
+	payload, err := json.Marshal(Renewal{ID: s.ID, ExpiresAt: s.ExpiresAt})
+	if err != nil {
+		logger.Printf("MQTT: Error parsing json: %s ", err)
+		return
+	}
+	topic := m.topicPrefix + s.Type + "/" + s.ID + "/renewed"
+	for _, client := range m.clients {
+		if token := client.paho.Publish(topic, 1, false, payload); token.WaitTimeout(mqttWaitTimout) && token.Error() != nil {
+			logger.Printf("MQTT: %s: Error publishing renewal of service %s with topic %s: %v", client.BrokerURI, s.ID, topic, token.Error())
+			continue
+		}
+		logger.Debugf("MQTT: %s: Published renewal of service %s with topic %s", client.BrokerURI, s.ID, topic)
+	}
+}
+
+// publishExpiredService announces the expiry of a service, which is removed after the grace period
+func (m *MQTTManager) publishExpiredService(s Service) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		logger.Printf("MQTT: Error parsing json: %s ", err)
+		return
+	}
+	topic := m.topicPrefix + s.Type + "/" + s.ID + "/expired"
+	for _, client := range m.clients {
+		if token := client.paho.Publish(topic, 1, false, payload); token.WaitTimeout(mqttWaitTimout) && token.Error() != nil {
+			logger.Printf("MQTT: %s: Error publishing expiry of service %s with topic %s: %v", client.BrokerURI, s.ID, topic, token.Error())
+			continue
+		}
+		logger.Printf("MQTT: %s: Published expiry of service %s with topic %s", client.BrokerURI, s.ID, topic)
+	}
+}
+
+// publishServiceHealth announces the changed health status of a service
+func (m *MQTTManager) publishServiceHealth(s Service) {
+	payload, err := json.Marshal(s.Health)
+	if err != nil {
+		logger.Printf("MQTT: Error parsing json: %s ", err)
+		return
+	}
+	topic := m.topicPrefix + s.Type + "/" + s.ID + "/health"
+	for _, client := range m.clients {
+		if token := client.paho.Publish(topic, 1, false, payload); token.WaitTimeout(mqttWaitTimout) && token.Error() != nil {
+			logger.Printf("MQTT: %s: Error publishing health of service %s with topic %s: %v", client.BrokerURI, s.ID, topic, token.Error())
+			continue
+		}
+		logger.Printf("MQTT: %s: Published health of service %s with topic %s", client.BrokerURI, s.ID, topic)
+	}
+}
+
 func (m *MQTTManager) publishDeadService(s Service) {
 	// remove the retained message
 	topic := m.topicPrefix + s.Type + "/" + s.ID + "/alive"
@@ -237,8 +321,8 @@ func (m *MQTTManager) publishDeadService(s Service) {
 	}
 }
 
-func (m *MQTTManager) removeService(service Service) {
-	err := m.controller.delete(service.ID)
+func (m *MQTTManager) removeService(service Service, by actor) {
+	err := m.controller.delete(service.ID, by)
 	if err != nil {
 		logger.Printf("MQTT: Error removing service: %s: %s", service.ID, err)
 		return
@@ -246,13 +330,22 @@ func (m *MQTTManager) removeService(service Service) {
 	logger.Printf("MQTT: Removed service: %s", service.ID)
 }
 
-func (m *MQTTManager) addService(service Service) {
-	_, err := m.controller.update(service.ID, service)
+func (m *MQTTManager) renewService(id string, by actor) {
+	_, err := m.controller.renew(id, by)
+	if err != nil {
+		logger.Printf("MQTT: Error renewing service: %s: %s", id, err)
+		return
+	}
+	logger.Debugf("MQTT: Renewed service: %s", id)
+}
+
+func (m *MQTTManager) addService(service Service, by actor) {
+	_, err := m.controller.update(service.ID, service, by)
 	if err != nil {
 		switch err.(type) {
 		case *NotFoundError:
 			// Create a new service with the given id
-			_, err := m.controller.add(service)
+			_, err := m.controller.add(service, by)
 			if err != nil {
 				switch err.(type) {
 				case *BadRequestError:
@@ -17,25 +17,29 @@ const (
 )
 
 type MQTTConf struct {
-	Client            MQTTClientConf   `json:"client"`
-	AdditionalClients []MQTTClientConf `json:"additionalClients"`
-	CommonRegTopics   []string         `json:"commonRegTopics"`
-	CommonWillTopics  []string         `json:"commonWillTopics"`
-	TopicPrefix       string           `json:"topicPrefix"`
+	Client                MQTTClientConf   `json:"client"`
+	AdditionalClients     []MQTTClientConf `json:"additionalClients"`
+	CommonRegTopics       []string         `json:"commonRegTopics"`
+	CommonWillTopics      []string         `json:"commonWillTopics"`
+	CommonHeartbeatTopics []string         `json:"commonHeartbeatTopics"` // topics for renewing services with an empty payload: <topic>/<id>
+	TopicPrefix           string           `json:"topicPrefix"`
+	// NamespaceTopicPrefixes are the prefixes of all topics of each namespace. Defaults to <namespace>/.
+	NamespaceTopicPrefixes map[string]string `json:"namespaceTopicPrefixes"`
 }
 
 type MQTTClientConf struct {
-	Disabled   bool     `json:"disabled"`
-	BrokerID   string   `json:"brokerID"`
-	BrokerURI  string   `json:"brokerURI"`
-	RegTopics  []string `json:"regTopics"`
-	WillTopics []string `json:"willTopics"`
-	QoS        byte     `json:"qos"`
-	Username   string   `json:"username,omitempty"`
-	Password   string   `json:"password,omitempty"`
-	CaFile     string   `json:"caFile,omitempty"`   // trusted CA certificates file path
-	CertFile   string   `json:"certFile,omitempty"` // client certificate file path
-	KeyFile    string   `json:"keyFile,omitempty"`  // client private key file path
+	Disabled        bool     `json:"disabled"`
+	BrokerID        string   `json:"brokerID"`
+	BrokerURI       string   `json:"brokerURI"`
+	RegTopics       []string `json:"regTopics"`
+	WillTopics      []string `json:"willTopics"`
+	HeartbeatTopics []string `json:"heartbeatTopics"`
+	QoS             byte     `json:"qos"`
+	Username        string   `json:"username,omitempty"`
+	Password        string   `json:"password,omitempty"`
+	CaFile          string   `json:"caFile,omitempty"`   // trusted CA certificates file path
+	CertFile        string   `json:"certFile,omitempty"` // client certificate file path
+	KeyFile         string   `json:"keyFile,omitempty"`  // client private key file path
 }
 
 func (c MQTTConf) Validate() error {
@@ -58,6 +62,43 @@ func (c MQTTConf) Validate() error {
 	return nil
 }
 
+// ForNamespace returns the configuration of the MQTT API of a namespace
+// The registration, will, and heartbeat topics, as well as the announcements, are prefixed with the topic prefix of the namespace.
+// The configured brokers are registered as services in every namespace.
+func (c MQTTConf) ForNamespace(namespace string) MQTTConf {
+	prefix, found := c.NamespaceTopicPrefixes[namespace]
+	if !found {
+		prefix = namespace + "/"
+	}
+	prefixed := func(topics []string) []string {
+		var p []string
+		for _, topic := range topics {
+			p = append(p, prefix+topic)
+		}
+		return p
+	}
+
+	nc := c
+	nc.Client = c.Client.forNamespace(prefixed)
+	nc.AdditionalClients = nil
+	for _, client := range c.AdditionalClients {
+		nc.AdditionalClients = append(nc.AdditionalClients, client.forNamespace(prefixed))
+	}
+	nc.CommonRegTopics = prefixed(c.CommonRegTopics)
+	nc.CommonWillTopics = prefixed(c.CommonWillTopics)
+	nc.CommonHeartbeatTopics = prefixed(c.CommonHeartbeatTopics)
+	nc.TopicPrefix = prefix + c.TopicPrefix
+	nc.NamespaceTopicPrefixes = nil
+	return nc
+}
+
+func (client MQTTClientConf) forNamespace(prefixed func([]string) []string) MQTTClientConf {
+	client.RegTopics = prefixed(client.RegTopics)
+	client.WillTopics = prefixed(client.WillTopics)
+	client.HeartbeatTopics = prefixed(client.HeartbeatTopics)
+	return client
+}
+
 func (client MQTTClientConf) pahoOptions() (*paho.ClientOptions, error) {
 	opts := paho.NewClientOptions() // uses defaults: https://godoc.org/github.com/eclipse/paho.mqtt.golang#NewClientOptions
 	opts.AddBroker(client.BrokerURI)
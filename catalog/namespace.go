@@ -0,0 +1,54 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+)
+
+// NamespacePathPrefix is the prefix of the routes of the namespaces, e.g. /ns/team-a/{id}
+// The root routes are the default namespace.
+const NamespacePathPrefix = "/ns/"
+
+var namespacePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+// ValidateNamespace checks the name of a namespace, which is part of paths, topics and file names
+func ValidateNamespace(name string) error {
+	if !namespacePattern.MatchString(name) {
+		return fmt.Errorf("invalid namespace: %q: only letters, digits, _ and - are allowed", name)
+	}
+	return nil
+}
+
+// NamespacePath returns the prefix of the routes of a namespace, which is empty for the default namespace
+func NamespacePath(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return NamespacePathPrefix + namespace
+}
+
+// NamespaceDSN returns the DSN of the storage of a namespace, given the DSN of the default namespace
+// The services of each namespace are kept in a separate storage at namespaces/<namespace>/ next to the default one,
+// e.g. ./data/namespaces/team-a/sc.ldb for ./data/sc.ldb, so that their ids are scoped per namespace.
+func NamespaceDSN(dsn, namespace string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" {
+		return dsn, nil
+	}
+	u.Path = filepath.ToSlash(filepath.Join(filepath.Dir(u.Path), "namespaces", namespace, filepath.Base(u.Path)))
+	return u.String(), nil
+}
+
+// NewNamespaceHTTPAPI creates a RESTful HTTP API of a namespace, which is served under its prefix
+func NewNamespaceHTTPAPI(controller *Controller, namespace, id, description, version string) *HttpAPI {
+	api := NewHTTPAPI(controller, id, description, version)
+	api.namespace = namespace
+	return api
+}
@@ -0,0 +1,88 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNamespaceDSN(t *testing.T) {
+	for dsn, expected := range map[string]string{
+		"./data/sc.ldb":              "data/namespaces/team-a/sc.ldb",
+		"/var/lib/sc.db":             "/var/lib/namespaces/team-a/sc.db",
+		"./data?sync=false":          "namespaces/team-a/data?sync=false",
+		"":                           "",
+		"file:///var/lib/sc/bolt.db": "file:///var/lib/sc/namespaces/team-a/bolt.db",
+	} {
+		nsDSN, err := NamespaceDSN(dsn, "team-a")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if nsDSN != expected {
+			t.Fatalf("Expected %s for %s, got %s", expected, dsn, nsDSN)
+		}
+	}
+
+	for _, name := range []string{"", "a/b", "-a", "a b", ".."} {
+		if ValidateNamespace(name) == nil {
+			t.Fatalf("Expected namespace %q to be invalid", name)
+		}
+	}
+}
+
+func TestMQTTConfForNamespace(t *testing.T) {
+	conf := MQTTConf{
+		Client:            MQTTClientConf{RegTopics: []string{"gw/reg/+"}},
+		AdditionalClients: []MQTTClientConf{{WillTopics: []string{"gw/will/+"}}},
+		CommonRegTopics:   []string{"sc/reg/+"},
+		TopicPrefix:       "sc/announcement/",
+		NamespaceTopicPrefixes: map[string]string{
+			"team-b": "teams/b/",
+		},
+	}
+
+	a := conf.ForNamespace("team-a")
+	if a.Client.RegTopics[0] != "team-a/gw/reg/+" || a.AdditionalClients[0].WillTopics[0] != "team-a/gw/will/+" ||
+		a.CommonRegTopics[0] != "team-a/sc/reg/+" || a.TopicPrefix != "team-a/sc/announcement/" {
+		t.Fatalf("Unexpected configuration of the namespace: %+v", a)
+	}
+	b := conf.ForNamespace("team-b")
+	if b.CommonRegTopics[0] != "teams/b/sc/reg/+" || b.TopicPrefix != "teams/b/sc/announcement/" {
+		t.Fatalf("Unexpected configuration of the namespace: %+v", b)
+	}
+	// the configuration of the root is not modified
+	if conf.Client.RegTopics[0] != "gw/reg/+" || conf.AdditionalClients[0].WillTopics[0] != "gw/will/+" {
+		t.Fatalf("Configuration of the root was modified: %+v", conf)
+	}
+}
+
+func TestNamespaceHTTPAPI(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	api := NewNamespaceHTTPAPI(controller, "team-a", "test", "Test catalog", "MAJOR.MINOR.PATCH")
+
+	w := httptest.NewRecorder()
+	api.Post(w, httptest.NewRequest("POST", "/ns/team-a/", bytes.NewBufferString(`{"type":"_test._tcp","ttl":30}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+	if location[:len("/ns/team-a/")] != "/ns/team-a/" {
+		t.Fatalf("Expected the location in the namespace, got %s", location)
+	}
+
+	w = httptest.NewRecorder()
+	req := mux.SetURLVars(httptest.NewRequest("GET", location, nil), map[string]string{"id": location[len("/ns/team-a/"):]})
+	api.Get(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Owner is the user and groups who may modify a service
+type Owner struct {
+	User   string   `json:"user,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// OwnershipConf is the configuration of the ownership of services
+type OwnershipConf struct {
+	// AdminUsers may modify and transfer all services
+	AdminUsers []string `json:"adminUsers"`
+	// AdminGroups are the groups whose members may modify and transfer all services
+	AdminGroups []string `json:"adminGroups"`
+}
+
+func (o Owner) validate() error {
+	if o.User == "" && len(o.Groups) == 0 {
+		return fmt.Errorf("owner must have a user or groups")
+	}
+	return nil
+}
+
+// owner returns the owner of a service created by the actor, or nil for anonymous and internal actors
+func (a actor) owner() *Owner {
+	if a.origin != OriginHTTP || a.user == "" {
+		return nil
+	}
+	return &Owner{User: a.user, Groups: a.groups}
+}
+
+// external checks whether the actor is a client of the HTTP API or of an MQTT broker, whose changes are authorized
+// Internal changes, e.g. on expiry, federation, or restore, are not.
+func (a actor) external() bool {
+	switch a.origin {
+	case "", OriginExpiry, OriginFederation, OriginRestore:
+		return false
+	}
+	return true
+}
+
+// isAdmin checks whether the actor is an admin
+func (conf *OwnershipConf) isAdmin(by actor) bool {
+	if by.user != "" && containsString(conf.AdminUsers, by.user) {
+		return true
+	}
+	for _, g := range by.groups {
+		if containsString(conf.AdminGroups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableOwnership restricts the modification of owned services to their owners and the admins
+func (c *Controller) EnableOwnership(conf OwnershipConf) {
+	c.Lock()
+	c.ownership = &conf
+	c.Unlock()
+}
+
+// authorize checks whether the actor may modify the stored service
+// Services without an owner, e.g. registered anonymously or over MQTT, may be modified by anyone.
+// Owned services cannot be modified over MQTT, whose clients are not authenticated.
+// The caller must hold the lock.
+func (c *Controller) authorize(ss *Service, by actor) error {
+	if c.ownership == nil || !by.external() || ss.Owner == nil {
+		return nil
+	}
+	if by.origin != OriginHTTP {
+		return &ForbiddenError{fmt.Sprintf("Service %s is owned and cannot be modified over MQTT", ss.ID)}
+	}
+	if by.user != "" && by.user == ss.Owner.User {
+		return nil
+	}
+	for _, g := range by.groups {
+		if containsString(ss.Owner.Groups, g) {
+			return nil
+		}
+	}
+	if c.ownership.isAdmin(by) {
+		return nil
+	}
+	if by.user == "" {
+		return &ForbiddenError{fmt.Sprintf("Service %s is owned and cannot be modified anonymously", ss.ID)}
+	}
+	return &ForbiddenError{fmt.Sprintf("Service %s is not owned by %s or any of the groups %v", ss.ID, by.user, by.groups)}
+}
+
+// authorizeAdmin checks whether the actor is an admin, if ownership is enabled
+// The caller must hold the lock.
+func (c *Controller) authorizeAdmin(by actor) error {
+	if c.ownership == nil || !by.external() || c.ownership.isAdmin(by) {
+		return nil
+	}
+	return &ForbiddenError{fmt.Sprintf("User %s is not an admin", by.user)}
+}
+
+// transferOwnership sets the owner of a service
+// It is allowed to the current owner and the admins, and is notified as an update.
+func (c *Controller) transferOwnership(id string, owner Owner, ifMatch string, by actor) (*Service, error) {
+	if err := owner.validate(); err != nil {
+		return nil, &BadRequestError{err.Error()}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	var transferred *Service
+	err := c.transact(func(tx *txn) error {
+		ss, err := c.getModifiable(tx, id, ifMatch, by)
+		if err != nil {
+			return err
+		}
+		if ss.Owner == nil {
+			// unowned services can be claimed only by admins
+			if err := c.authorizeAdmin(by); err != nil {
+				return err
+			}
+		}
+		ss.Owner = &owner
+		ss.Revision++
+		ss.UpdatedAt = time.Now().UTC()
+
+		err = tx.update(ss)
+		if err != nil {
+			return err
+		}
+		if err := c.notifyUpdated(tx, *ss, by); err != nil {
+			return err
+		}
+		transferred = ss
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return transferred, nil
+}
+
+// TransferOwnership sets the owner of a service
+func (a *HttpAPI) TransferOwnership(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	var owner Owner
+	err := json.NewDecoder(req.Body).Decode(&owner)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
+		return
+	}
+
+	s, err := a.controller.transferOwnership(params["id"], owner, req.Header.Get("If-Match"), requestActor(req))
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			a.ErrorResponse(w, http.StatusNotFound, err.Error())
+		case *BadRequestError:
+			a.ErrorResponse(w, http.StatusBadRequest, "Invalid owner:", err.Error())
+		case *ConflictError:
+			a.ErrorResponse(w, http.StatusConflict, "Error transferring the service:", err.Error())
+		case *ForbiddenError:
+			a.ErrorResponse(w, http.StatusForbidden, "Error transferring the service:", err.Error())
+		case *PreconditionFailedError:
+			a.ErrorResponse(w, http.StatusPreconditionFailed, "Error transferring the service:", err.Error())
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error transferring the service:", err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	w.Header().Set("ETag", s.ETag())
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,203 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOwnership(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	controller.EnableOwnership(OwnershipConf{AdminUsers: []string{"root"}, AdminGroups: []string{"admins"}})
+
+	alice := actor{origin: OriginHTTP, user: "alice", groups: []string{"team"}}
+	bob := actor{origin: OriginHTTP, user: "bob", groups: []string{"others"}}
+	carol := actor{origin: OriginHTTP, user: "carol", groups: []string{"team"}}
+	admin := actor{origin: OriginHTTP, user: "dave", groups: []string{"admins"}}
+	anonymous := actor{origin: OriginHTTP}
+
+	s, err := controller.add(Service{ID: "owned", Type: "_test._tcp", TTL: 30, Owner: &Owner{User: "mallory"}}, alice)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.Owner == nil || s.Owner.User != "alice" || len(s.Owner.Groups) != 1 || s.Owner.Groups[0] != "team" {
+		t.Fatalf("Expected the owner to be the authenticated user, got: %+v", s.Owner)
+	}
+
+	// other users
+	for _, by := range []actor{bob, anonymous} {
+		if _, err := controller.updateIf("owned", Service{Type: "_test._tcp", TTL: 60}, "", by); !isForbidden(err) {
+			t.Fatalf("Expected ForbiddenError for the update by %+v, got: %v", by, err)
+		}
+		if _, err := controller.renew("owned", by); !isForbidden(err) {
+			t.Fatalf("Expected ForbiddenError for the renewal by %+v, got: %v", by, err)
+		}
+		if err := controller.deleteIf("owned", "", by); !isForbidden(err) {
+			t.Fatalf("Expected ForbiddenError for the deletion by %+v, got: %v", by, err)
+		}
+		if _, err := controller.transferOwnership("owned", Owner{User: "eve"}, "", by); !isForbidden(err) {
+			t.Fatalf("Expected ForbiddenError for the transfer by %+v, got: %v", by, err)
+		}
+	}
+
+	// owner group, admin, and internal actors
+	for _, by := range []actor{carol, admin, {}} {
+		if _, err := controller.updateIf("owned", Service{Type: "_test._tcp", TTL: 60}, "", by); err != nil {
+			t.Fatalf("Unexpected error for the update by %+v: %s", by, err)
+		}
+	}
+	updated, err := controller.get("owned")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if updated.Owner == nil || updated.Owner.User != "alice" {
+		t.Fatalf("Update changed the owner: %+v", updated.Owner)
+	}
+
+	// transfer
+	transferred, err := controller.transferOwnership("owned", Owner{User: "bob"}, "", alice)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if transferred.Owner.User != "bob" || transferred.Revision != updated.Revision+1 {
+		t.Fatalf("Unexpected transferred service: %+v", transferred)
+	}
+	if _, err := controller.updateIf("owned", Service{Type: "_test._tcp", TTL: 30}, "", alice); !isForbidden(err) {
+		t.Fatalf("Expected ForbiddenError for the previous owner, got: %v", err)
+	}
+	if _, err := controller.transferOwnership("owned", Owner{}, "", bob); err == nil {
+		t.Fatal("Expected an error for an empty owner")
+	} else if _, ok := err.(*BadRequestError); !ok {
+		t.Fatalf("Expected BadRequestError for an empty owner, got: %v", err)
+	}
+
+	// unowned services
+	if _, err := controller.add(Service{ID: "unowned", Type: "_test._tcp", TTL: 30}, anonymous); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := controller.updateIf("unowned", Service{Type: "_test._tcp", TTL: 60}, "", bob); err != nil {
+		t.Fatalf("Unexpected error for the update of an unowned service: %s", err)
+	}
+	if _, err := controller.transferOwnership("unowned", Owner{User: "bob"}, "", bob); !isForbidden(err) {
+		t.Fatalf("Expected ForbiddenError for claiming an unowned service, got: %v", err)
+	}
+	if _, err := controller.transferOwnership("unowned", Owner{User: "bob"}, "", admin); err != nil {
+		t.Fatalf("Unexpected error for the claim by an admin: %s", err)
+	}
+
+	// admin operations
+	confirm := 2
+	q := QueryOperation{Action: QueryActionSetTTL, Filter: SubscriptionFilter{Path: "type", Op: "equals", Value: "_test._tcp"}, TTL: 10, Confirm: &confirm}
+	if _, err := controller.applyQuery(q, alice); !isForbidden(err) {
+		t.Fatalf("Expected ForbiddenError for the query by a non-admin, got: %v", err)
+	}
+	if _, err := controller.applyQuery(q, actor{origin: OriginHTTP, user: "root"}); err != nil {
+		t.Fatalf("Unexpected error for the query by an admin: %s", err)
+	}
+
+	if _, err := controller.listenerQueueStats(alice); !isForbidden(err) {
+		t.Fatalf("Expected ForbiddenError for the listener stats of a non-admin, got: %v", err)
+	}
+	if _, err := controller.listenerQueueStats(admin); err != nil {
+		t.Fatalf("Unexpected error for the listener stats of an admin: %s", err)
+	}
+	if _, err := controller.backup(alice); !isForbidden(err) {
+		t.Fatalf("Expected ForbiddenError for the backup by a non-admin, got: %v", err)
+	}
+	snapshot, err := controller.backup(admin)
+	if err != nil {
+		t.Fatalf("Unexpected error for the backup by an admin: %s", err)
+	}
+	snapshot.release()
+	forged := Service{ID: "owned", Type: "_test._tcp", TTL: 30, Owner: &Owner{User: "alice"}}
+	for _, mode := range []string{RestoreModeMerge, RestoreModeReplace} {
+		if _, err := controller.restore([]Service{forged}, mode, alice); !isForbidden(err) {
+			t.Fatalf("Expected ForbiddenError for the %s restore by a non-admin, got: %v", mode, err)
+		}
+	}
+	if s, _ := controller.get("owned"); s.Owner.User != "bob" {
+		t.Fatalf("Restore by a non-admin changed the owner: %+v", s.Owner)
+	}
+	if total, _ := controller.total(); total != 2 {
+		t.Fatalf("Restore by a non-admin changed the catalog: %d services", total)
+	}
+
+	// MQTT clients are not authenticated
+	mqtt := actor{origin: "broker"}
+	if _, err := controller.updateIf("owned", Service{Type: "_test._tcp", TTL: 60}, "", mqtt); !isForbidden(err) {
+		t.Fatalf("Expected ForbiddenError for the update of an owned service over MQTT, got: %v", err)
+	}
+	if err := controller.deleteIf("owned", "", mqtt); !isForbidden(err) {
+		t.Fatalf("Expected ForbiddenError for the deletion of an owned service over MQTT, got: %v", err)
+	}
+	if _, err := controller.add(Service{ID: "mqtt", Type: "_test._tcp", TTL: 30}, mqtt); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := controller.deleteIf("mqtt", "", mqtt); err != nil {
+		t.Fatalf("Unexpected error for the deletion of an unowned service over MQTT: %s", err)
+	}
+
+	if err := controller.deleteIf("owned", "", bob); err != nil {
+		t.Fatalf("Unexpected error for the deletion by the new owner: %s", err)
+	}
+}
+
+func TestOwnershipHTTP(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	controller.EnableOwnership(OwnershipConf{})
+	api := NewHTTPAPI(controller, "test", "", "")
+
+	b, _ := json.Marshal(Service{Type: "_test._tcp", TTL: 30})
+	req := mux.SetURLVars(httptest.NewRequest("PUT", "/svc", bytes.NewReader(b)), map[string]string{"id": "svc"})
+	w := httptest.NewRecorder()
+	api.Put(w, WithPrincipal(req, &Principal{User: "alice"}))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var s Service
+	json.NewDecoder(w.Body).Decode(&s)
+	if s.Owner == nil || s.Owner.User != "alice" {
+		t.Fatalf("Expected the owner in the service document, got: %+v", s.Owner)
+	}
+
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/svc", nil), map[string]string{"id": "svc"})
+	w = httptest.NewRecorder()
+	api.Delete(w, WithPrincipal(req, &Principal{User: "bob"}))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+
+	b, _ = json.Marshal(Owner{User: "bob"})
+	req = mux.SetURLVars(httptest.NewRequest("PUT", "/svc/owner", bytes.NewReader(b)), map[string]string{"id": "svc"})
+	w = httptest.NewRecorder()
+	api.TransferOwnership(w, WithPrincipal(req, &Principal{User: "alice"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/svc", nil), map[string]string{"id": "svc"})
+	w = httptest.NewRecorder()
+	api.Delete(w, WithPrincipal(req, &Principal{User: "bob"}))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func isForbidden(err error) bool {
+	_, ok := err.(*ForbiddenError)
+	return ok
+}
@@ -0,0 +1,120 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/gorilla/mux"
+)
+
+// Media types of the patch documents
+const (
+	MergePatchMediaType = "application/merge-patch+json" // RFC 7396
+	JSONPatchMediaType  = "application/json-patch+json"  // RFC 6902
+)
+
+// patch applies a patch document of the given media type to the service
+// The patched service is validated and only its modifiable attributes are stored.
+func (c *Controller) patch(id, mediaType string, patch []byte, ifMatch string, by actor) (*Service, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var patched *Service
+	err := c.transact(func(tx *txn) error {
+		ss, err := c.getModifiable(tx, id, ifMatch, by)
+		if err != nil {
+			return err
+		}
+
+		doc, err := json.Marshal(ss)
+		if err != nil {
+			return err
+		}
+		switch mediaType {
+		case MergePatchMediaType:
+			doc, err = jsonpatch.MergePatch(doc, patch)
+		case JSONPatchMediaType:
+			var p jsonpatch.Patch
+			p, err = jsonpatch.DecodePatch(patch)
+			if err == nil {
+				doc, err = p.Apply(doc)
+			}
+		default:
+			return &BadRequestError{fmt.Sprintf("Unsupported patch media type: %s", mediaType)}
+		}
+		if err != nil {
+			return &BadRequestError{fmt.Sprintf("Error applying the patch: %s", err)}
+		}
+
+		var s Service
+		err = json.Unmarshal(doc, &s)
+		if err != nil {
+			return &BadRequestError{fmt.Sprintf("Patched service is invalid: %s", err)}
+		}
+		if s.ID != ss.ID {
+			return &ConflictError{"Service id cannot be patched"}
+		}
+		if err := validateRegistration(&s); err != nil {
+			return err
+		}
+
+		patched, err = c.replace(tx, ss, s, by)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
+
+// Patch modifies a service with a JSON Merge Patch or a JSON Patch, depending on the content type
+func (a *HttpAPI) Patch(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || (mediaType != MergePatchMediaType && mediaType != JSONPatchMediaType) {
+		a.ErrorResponse(w, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("Content-Type should be either %s or %s", MergePatchMediaType, JSONPatchMediaType))
+		return
+	}
+	patch, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
+		return
+	}
+
+	patchedS, err := a.controller.patch(params["id"], mediaType, patch, req.Header.Get("If-Match"), requestActor(req))
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			a.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		case *ConflictError:
+			a.ErrorResponse(w, http.StatusConflict, "Error patching the service:", err.Error())
+			return
+		case *PreconditionFailedError:
+			a.ErrorResponse(w, http.StatusPreconditionFailed, "Error patching the service:", err.Error())
+			return
+		case *ForbiddenError:
+			a.ErrorResponse(w, http.StatusForbidden, "Error patching the service:", err.Error())
+			return
+		case *BadRequestError:
+			a.ErrorResponse(w, http.StatusBadRequest, "Invalid patch:", err.Error())
+			return
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error patching the service:", err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	w.Header().Set("ETag", patchedS.ETag())
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(patchedS)
+}
@@ -0,0 +1,28 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"context"
+	"net/http"
+)
+
+// Principal is the authenticated user of a request
+type Principal struct {
+	User   string   `json:"user"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of the request carrying the authenticated user
+// It is used by the authentication middleware.
+func WithPrincipal(req *http.Request, p *Principal) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), principalKey{}, p))
+}
+
+// requestPrincipal returns the authenticated user of the request, or nil for anonymous requests
+func requestPrincipal(req *http.Request) *Principal {
+	p, _ := req.Context().Value(principalKey{}).(*Principal)
+	return p
+}
@@ -0,0 +1,204 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/linksmart/service-catalog/v3/utils"
+)
+
+// Actions applied to the services matching a query
+const (
+	QueryActionDelete    = "delete"
+	QueryActionSetTTL    = "setTTL"
+	QueryActionMergeMeta = "mergeMeta"
+)
+
+// QueryOperation applies an action to all services matching a filter
+// Imported services are read-only and never match.
+type QueryOperation struct {
+	// Action is delete, setTTL, or mergeMeta
+	Action string             `json:"action"`
+	Filter SubscriptionFilter `json:"filter"`
+	// TTL is the new TTL of the services for setTTL
+	TTL uint32 `json:"ttl,omitempty"`
+	// Meta is merged into the meta of the services for mergeMeta. Keys with null values are removed.
+	Meta map[string]interface{} `json:"meta,omitempty"`
+	// DryRun returns the matching services without applying the action
+	DryRun bool `json:"dryRun"`
+	// Confirm must be the number of matching services, e.g. as returned by a dry run, unless in dry run
+	Confirm *int `json:"confirm,omitempty"`
+}
+
+// QueryResult is the result of a query operation
+type QueryResult struct {
+	Action  string   `json:"action"`
+	DryRun  bool     `json:"dryRun"`
+	Matched int      `json:"matched"`
+	Applied int      `json:"applied"`
+	IDs     []string `json:"ids"`
+}
+
+func (q *QueryOperation) validate() error {
+	switch q.Action {
+	case QueryActionDelete, QueryActionSetTTL:
+	case QueryActionMergeMeta:
+		if len(q.Meta) == 0 {
+			return fmt.Errorf("meta must be defined for %s", q.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action: %s", q.Action)
+	}
+	if q.Filter.Path == "" {
+		return fmt.Errorf("filter path must be defined")
+	}
+	if err := utils.ValidateFilterOp(q.Filter.Op); err != nil {
+		return err
+	}
+	if !q.DryRun && q.Confirm == nil {
+		return fmt.Errorf("confirm must be the number of matching services")
+	}
+	return nil
+}
+
+// apply returns the service with the action applied, or nil for delete
+func (q *QueryOperation) apply(s Service) *Service {
+	switch q.Action {
+	case QueryActionSetTTL:
+		s.TTL = q.TTL
+	case QueryActionMergeMeta:
+		meta := make(map[string]interface{}, len(s.Meta)+len(q.Meta))
+		for k, v := range s.Meta {
+			meta[k] = v
+		}
+		for k, v := range q.Meta {
+			if v == nil {
+				delete(meta, k)
+			} else {
+				meta[k] = v
+			}
+		}
+		s.Meta = meta
+	default:
+		return nil
+	}
+	return &s
+}
+
+// applyQuery applies an action to all services matching the filter of the query
+// All matching services are changed in a single transaction, or none is. The listeners are notified of each change.
+func (c *Controller) applyQuery(q QueryOperation, by actor) (*QueryResult, error) {
+	if err := q.validate(); err != nil {
+		return nil, &BadRequestError{err.Error()}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// the services of all owners are affected
+	if err := c.authorizeAdmin(by); err != nil {
+		return nil, err
+	}
+	if err := c.checkAdminToken(by); err != nil {
+		return nil, err
+	}
+
+	ids, err := c.filterIDs(q.Filter.Path, q.Filter.Op, q.Filter.Value)
+	if err != nil {
+		return nil, err
+	}
+	services, err := c.getMany(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	result := QueryResult{Action: q.Action, DryRun: q.DryRun, IDs: []string{}}
+	var matched []Service
+	for _, s := range services {
+		if federationOrigin(&s) != "" {
+			continue
+		}
+		if m := q.apply(s); m != nil {
+			if err := validateRegistration(m); err != nil {
+				return nil, &BadRequestError{fmt.Sprintf("Service %s: %s", s.ID, err)}
+			}
+		}
+		matched = append(matched, s)
+		result.IDs = append(result.IDs, s.ID)
+	}
+	result.Matched = len(matched)
+
+	if q.DryRun {
+		return &result, nil
+	}
+	if *q.Confirm != result.Matched {
+		return nil, &PreconditionFailedError{fmt.Sprintf("%d services match the filter, not %d", result.Matched, *q.Confirm)}
+	}
+
+	// all services are changed in a single transaction, so that a failure changes none of them
+	err = c.transact(func(tx *txn) error {
+		result.Applied = 0
+		for i := range matched {
+			id := matched[i].ID
+			// the service is read again in the transaction, which is checked for concurrent changes in a cluster
+			ss, err := tx.get(id)
+			if err != nil {
+				return err
+			}
+			if q.Action == QueryActionDelete {
+				err = tx.delete(id)
+				if err == nil {
+					err = c.notifyDeleted(tx, *ss, by)
+				}
+			} else {
+				m := q.apply(*ss)
+				if err := validateRegistration(m); err != nil {
+					return &BadRequestError{fmt.Sprintf("Service %s: %s", id, err)}
+				}
+				_, err = c.replace(tx, ss, *m, by)
+			}
+			if err != nil {
+				return err
+			}
+			result.Applied++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Query applies a delete, TTL change, or meta merge to all services matching a filter
+func (a *HttpAPI) Query(w http.ResponseWriter, req *http.Request) {
+	var q QueryOperation
+	err := json.NewDecoder(req.Body).Decode(&q)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
+		return
+	}
+
+	result, err := a.controller.applyQuery(q, requestActor(req))
+	if err != nil {
+		switch err.(type) {
+		case *BadRequestError:
+			a.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		case *PreconditionFailedError:
+			a.ErrorResponse(w, http.StatusPreconditionFailed, err.Error())
+		case *ForbiddenError:
+			a.ErrorResponse(w, http.StatusForbidden, err.Error())
+		case *UnauthorizedError:
+			a.ErrorResponse(w, http.StatusUnauthorized, err.Error())
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error applying the operation:", err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,171 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestApplyQuery(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	events := make(eventListener, 10)
+	controller.AddListener(events)
+
+	for i := 0; i < 4; i++ {
+		gateway := "gw1"
+		if i == 3 {
+			gateway = "gw2"
+		}
+		_, err := controller.add(Service{ID: fmt.Sprintf("service_%d", i), Type: "_test._tcp", TTL: 30,
+			Meta: map[string]interface{}{"gateway": gateway, "room": "101"}}, actor{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		<-events
+	}
+	filter := SubscriptionFilter{Path: "meta.gateway", Op: "equals", Value: "gw1"}
+	confirm := func(n int) *int { return &n }
+
+	// dry run
+	result, err := controller.applyQuery(QueryOperation{Action: QueryActionDelete, Filter: filter, DryRun: true}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Matched != 3 || result.Applied != 0 || len(result.IDs) != 3 {
+		t.Fatalf("Unexpected result of the dry run: %+v", result)
+	}
+	if total, _ := controller.total(); total != 4 {
+		t.Fatalf("Dry run changed the catalog: %d services", total)
+	}
+
+	// invalid operations
+	for _, q := range []QueryOperation{
+		{Action: QueryActionDelete, Filter: filter},
+		{Action: QueryActionDelete, Filter: SubscriptionFilter{Path: "meta.gateway", Op: "like", Value: "gw1"}, DryRun: true},
+		{Action: QueryActionSetTTL, Filter: filter, Confirm: confirm(3)},
+		{Action: QueryActionMergeMeta, Filter: filter, Confirm: confirm(3)},
+		{Action: "renew", Filter: filter, Confirm: confirm(3)},
+	} {
+		_, err = controller.applyQuery(q, actor{})
+		if _, ok := err.(*BadRequestError); !ok {
+			t.Fatalf("Expected BadRequestError for %+v, got: %v", q, err)
+		}
+	}
+	_, err = controller.applyQuery(QueryOperation{Action: QueryActionDelete, Filter: filter, Confirm: confirm(2)}, actor{})
+	if _, ok := err.(*PreconditionFailedError); !ok {
+		t.Fatalf("Expected PreconditionFailedError for a wrong confirmation count, got: %v", err)
+	}
+
+	// TTL change and meta merge
+	result, err = controller.applyQuery(QueryOperation{Action: QueryActionSetTTL, Filter: filter, TTL: 60, Confirm: confirm(3)}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Applied != 3 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	result, err = controller.applyQuery(QueryOperation{Action: QueryActionMergeMeta, Filter: filter,
+		Meta: map[string]interface{}{"room": nil, "state": "offline"}, Confirm: confirm(3)}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 6; i++ {
+		if e := <-events; !strings.HasPrefix(e, "updated ") {
+			t.Fatalf("Expected an update event, got %s", e)
+		}
+	}
+	s, _ := controller.get("service_0")
+	if s.TTL != 60 || s.Revision != 3 || s.Meta["state"] != "offline" || s.Meta["gateway"] != "gw1" {
+		t.Fatalf("Unexpected service after the updates: %+v", s)
+	}
+	if _, found := s.Meta["room"]; found {
+		t.Fatalf("Meta key with a null value was not removed: %+v", s.Meta)
+	}
+
+	// delete
+	result, err = controller.applyQuery(QueryOperation{Action: QueryActionDelete, Filter: filter, Confirm: confirm(3)}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Applied != 3 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	for i := 0; i < 3; i++ {
+		if e := <-events; e != fmt.Sprintf("deleted service_%d", i) {
+			t.Fatalf("Expected deletion of service_%d, got %s", i, e)
+		}
+	}
+	if total, _ := controller.total(); total != 1 {
+		t.Fatalf("Expected 1 remaining service, got %d", total)
+	}
+}
+
+func TestApplyQueryAtomic(t *testing.T) {
+	controller, shutdown, err := setupWrapped(ControllerConf{}, failOn(writeUpdate, "service_1"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+
+	for _, id := range []string{"service_0", "service_1"} {
+		_, err := controller.add(Service{ID: id, Type: "_test._tcp", TTL: 30}, actor{})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// a failure changes none of the matching services
+	confirm := 2
+	q := QueryOperation{Action: QueryActionSetTTL, Filter: SubscriptionFilter{Path: "type", Op: "equals", Value: "_test._tcp"}, TTL: 60, Confirm: &confirm}
+	_, err = controller.applyQuery(q, actor{})
+	if err == nil {
+		t.Fatal("Expected an error for a query which cannot be stored")
+	}
+	for _, id := range []string{"service_0", "service_1"} {
+		if s, _ := controller.get(id); s.TTL != 30 {
+			t.Fatalf("Failed query changed %s: %+v", id, s)
+		}
+	}
+}
+
+func TestQueryHTTP(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	api := NewHTTPAPI(controller, "test", "Test catalog", "MAJOR.MINOR.PATCH")
+
+	_, err = controller.add(Service{ID: "service_0", Type: "_test._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{`{"action":"delete","filter":{"path":"type","op":"equals","value":"_test._tcp"},"dryRun":true}`, http.StatusOK},
+		{`{"action":"delete","filter":{"path":"type","op":"equals","value":"_test._tcp"},"confirm":2}`, http.StatusPreconditionFailed},
+		{`{"action":"delete","filter":{"path":"type","op":"equals","value":"_test._tcp"}}`, http.StatusBadRequest},
+		{`{"action":"delete","filter":{"path":"type","op":"equals","value":"_test._tcp"},"confirm":1}`, http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		api.Query(w, httptest.NewRequest("POST", "/admin/query", bytes.NewBufferString(c.body)))
+		if w.Code != c.code {
+			t.Fatalf("Expected %d for %s, got %d: %s", c.code, c.body, w.Code, w.Body.String())
+		}
+	}
+	if _, err := controller.get("service_0"); err == nil {
+		t.Fatal("Service was not deleted")
+	}
+}
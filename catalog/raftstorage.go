@@ -0,0 +1,517 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const (
+	raftApplyTimeout    = 10 * time.Second
+	raftTransportPool   = 3
+	raftSnapshotsRetain = 2
+	raftLogFile         = "raft.db"
+	raftApplyPollPeriod = 10 * time.Millisecond
+
+	raftOpCommit = "commit"
+)
+
+// raftCommand is a transaction of the controller replicated through the Raft log
+type raftCommand struct {
+	Op string `json:"op"`
+	// Reads are the versions of the services and records read by the transaction
+	Reads []read `json:"reads,omitempty"`
+	// Writes are committed if the reads are current
+	Writes []write `json:"writes,omitempty"`
+	// Events notify the listeners of every node after the commit
+	Events []txnEvent `json:"events,omitempty"`
+}
+
+// raftApplyResult is the response of the leader to a forwarded command
+type raftApplyResult struct {
+	// Index is the index of the command in the Raft log
+	Index uint64 `json:"index"`
+	// Stale is the error of a transaction whose reads were not current, which is not committed
+	Stale string `json:"stale,omitempty"`
+}
+
+// Raft storage
+// A storage replicated through a Raft log among the nodes of a cluster. The wrapped storage is the state machine.
+// The transactions of the controller are forwarded to the leader and applied by the state machine of every node, which
+// rejects the ones which read stale services or records and notifies the listeners of the node about the others.
+// Reads are served by the local storage.
+type RaftStorage struct {
+	Storage
+	raft      *raft.Raft
+	fsm       *raftFSM
+	transport *raft.NetworkTransport
+	logs      *raftboltdb.BoltStore
+	conf      ClusterConf
+	client    *http.Client
+}
+
+// NewRaftStorage starts a cluster node which replicates the mutations of the given storage
+// The cluster is bootstrapped with the configured nodes when the node has no Raft state.
+func NewRaftStorage(storage Storage, conf ClusterConf) (*RaftStorage, error) {
+	err := os.MkdirAll(conf.DataDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(conf.NodeID)
+	config.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Output: os.Stdout,
+		Level:  hclog.Info,
+	})
+	// the transport and snapshot store log with level prefixes such as [DEBUG]
+	stdLogger := config.Logger.StandardLogger(&hclog.StandardLoggerOptions{InferLevels: true})
+
+	bindAddr := conf.bindAddr()
+	addr, err := net.ResolveTCPAddr("tcp", bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address %s: %s", bindAddr, err)
+	}
+	transport, err := raft.NewTCPTransportWithLogger(bindAddr, addr, raftTransportPool, raftApplyTimeout, stdLogger)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(conf.DataDir, raftSnapshotsRetain, stdLogger)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(conf.DataDir, raftLogFile))
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+
+	exists, err := raft.HasExistingState(logs, logs, snapshots)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, err
+	}
+
+	// the commands in the log when the node starts were notified before it stopped
+	replayed, err := logs.LastIndex()
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, err
+	}
+	fsm := &raftFSM{storage: storage, snapshots: snapshots, replayed: replayed}
+
+	r, err := raft.NewRaft(config, fsm, logs, logs, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		logs.Close()
+		return nil, err
+	}
+
+	if !exists {
+		logger.Printf("Raft: Bootstrapping the cluster with %d nodes", len(conf.Nodes))
+		var servers []raft.Server
+		for _, node := range conf.Nodes {
+			servers = append(servers, raft.Server{
+				ID:      raft.ServerID(node.ID),
+				Address: raft.ServerAddress(node.Address),
+			})
+		}
+		err = r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err != nil && err != raft.ErrCantBootstrap {
+			r.Shutdown()
+			logs.Close()
+			return nil, err
+		}
+	}
+
+	return &RaftStorage{
+		Storage:   storage,
+		raft:      r,
+		fsm:       fsm,
+		transport: transport,
+		logs:      logs,
+		conf:      conf,
+		client:    &http.Client{Timeout: raftApplyTimeout},
+	}, nil
+}
+
+// replicate applies a transaction through the state machine of every node
+// It returns a staleError if the transaction read services or records which were modified since.
+func (rs *RaftStorage) replicate(reads []read, writes []write, events []txnEvent) error {
+	return rs.apply(raftCommand{Op: raftOpCommit, Reads: reads, Writes: writes, Events: events})
+}
+
+// setDispatcher sets the function which notifies the listeners of this node
+func (rs *RaftStorage) setDispatcher(dispatch func(events []txnEvent)) {
+	rs.fsm.Lock()
+	rs.fsm.dispatch = dispatch
+	rs.fsm.Unlock()
+}
+
+// CRUD
+// Mutations outside the transactions of the controller are replicated unconditionally and without events.
+func (rs *RaftStorage) add(s *Service) error {
+	return rs.commit([]write{{Op: writeAdd, ID: s.ID, Service: s}})
+}
+
+func (rs *RaftStorage) update(id string, s *Service) error {
+	return rs.commit([]write{{Op: writeUpdate, ID: id, Service: s}})
+}
+
+func (rs *RaftStorage) delete(id string) error {
+	return rs.commit([]write{{Op: writeDelete, ID: id}})
+}
+
+func (rs *RaftStorage) putRecord(r *record) error {
+	return rs.commit([]write{{Op: writePutRecord, Record: r}})
+}
+
+func (rs *RaftStorage) deleteRecord(kind, id string) error {
+	return rs.commit([]write{{Op: writeDeleteRecord, Kind: kind, ID: id}})
+}
+
+func (rs *RaftStorage) commit(writes []write) error {
+	return rs.replicate(nil, writes, nil)
+}
+
+func (rs *RaftStorage) Close() error {
+	err := rs.raft.Shutdown().Error()
+	if err != nil {
+		logger.Printf("Raft: Error shutting down: %s", err)
+	}
+	rs.transport.Close()
+	rs.logs.Close()
+	return rs.Storage.Close()
+}
+
+// isLeader reports whether this node is the leader of the cluster
+func (rs *RaftStorage) isLeader() bool {
+	return rs.raft.State() == raft.Leader
+}
+
+// apply replicates a command and waits until the local storage is up to date
+// Commands are forwarded to the leader if this node is a follower.
+func (rs *RaftStorage) apply(cmd raftCommand) error {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	if rs.isLeader() {
+		_, err = rs.applyLog(b)
+		if err != raft.ErrNotLeader && err != raft.ErrLeadershipLost {
+			return err
+		}
+	}
+
+	index, err := rs.forward(b)
+	if _, stale := err.(*staleError); err != nil && !stale {
+		return err
+	}
+	// a stale transaction is retried after the local storage has caught up
+	if werr := rs.waitApplied(index); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// applyLog appends a command to the log and returns the result of the state machine
+func (rs *RaftStorage) applyLog(b []byte) (uint64, error) {
+	f := rs.raft.Apply(b, raftApplyTimeout)
+	if err := f.Error(); err != nil {
+		return 0, err
+	}
+	if err, ok := f.Response().(error); ok {
+		return f.Index(), err
+	}
+	return f.Index(), nil
+}
+
+// leader returns the address of the leader, waiting for an election in progress
+func (rs *RaftStorage) leader() (raft.ServerAddress, error) {
+	deadline := time.Now().Add(raftApplyTimeout)
+	for {
+		if leader := rs.raft.Leader(); leader != "" {
+			return leader, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("cluster has no leader")
+		}
+		time.Sleep(raftApplyPollPeriod)
+	}
+}
+
+// forward sends a command to the leader
+// It returns the index of the command and a staleError if the command was not committed because of stale reads.
+func (rs *RaftStorage) forward(b []byte) (uint64, error) {
+	leader, err := rs.leader()
+	if err != nil {
+		return 0, err
+	}
+	node, found := rs.conf.node(string(leader))
+	if !found {
+		return 0, fmt.Errorf("leader %s is not a configured node", leader)
+	}
+
+	req, err := http.NewRequest("POST", node.APIURL+ClusterApplyPath, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ClusterSecretHeader, rs.conf.Secret)
+	res, err := rs.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error forwarding to the leader %s: %s", node.ID, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var e Error
+		json.NewDecoder(res.Body).Decode(&e)
+		switch res.StatusCode {
+		case http.StatusNotFound:
+			return 0, &NotFoundError{e.Message}
+		case http.StatusConflict:
+			return 0, &ConflictError{e.Message}
+		case http.StatusBadRequest:
+			return 0, &BadRequestError{e.Message}
+		default:
+			return 0, fmt.Errorf("error forwarding to the leader %s: (%d) %s", node.ID, res.StatusCode, e.Message)
+		}
+	}
+
+	var result raftApplyResult
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return 0, fmt.Errorf("error decoding the response of the leader %s: %s", node.ID, err)
+	}
+	if result.Stale != "" {
+		return result.Index, &staleError{result.Stale}
+	}
+	return result.Index, nil
+}
+
+// waitApplied waits until the local state machine has applied the log up to the given index
+// This makes the mutations forwarded by this node visible to its subsequent reads. The applied index of Raft is not
+// used, as it is updated before the state machine applies the commands.
+func (rs *RaftStorage) waitApplied(index uint64) error {
+	deadline := time.Now().Add(raftApplyTimeout)
+	for atomic.LoadUint64(&rs.fsm.applied) < index {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for the replication of log index %d", index)
+		}
+		time.Sleep(raftApplyPollPeriod)
+	}
+	return nil
+}
+
+// raftFSM applies the replicated transactions to the storage and notifies the listeners
+type raftFSM struct {
+	// applied is the index of the last command applied to the storage, accessed atomically
+	applied   uint64
+	storage   Storage
+	snapshots raft.SnapshotStore
+	// replayed is the last index of the log when the node started, up to which the listeners are not notified again
+	replayed uint64
+	// dispatch notifies the listeners, guarded by the mutex
+	sync.Mutex
+	dispatch func(events []txnEvent)
+}
+
+func (fsm *raftFSM) Apply(l *raft.Log) interface{} {
+	var cmd raftCommand
+	err := json.Unmarshal(l.Data, &cmd)
+	if err != nil {
+		logger.Printf("Raft: Error decoding log index %d: %s", l.Index, err)
+		return err
+	}
+
+	switch cmd.Op {
+	case raftOpCommit:
+		err = checkReads(fsm.storage, cmd.Reads)
+		if err == nil && len(cmd.Writes) > 0 {
+			err = fsm.storage.commit(cmd.Writes)
+		}
+		if err == nil && l.Index > fsm.replayed {
+			fsm.notify(cmd.Events)
+		}
+	default:
+		err = fmt.Errorf("unknown operation: %s", cmd.Op)
+	}
+	switch err.(type) {
+	case nil, *NotFoundError, *ConflictError, *staleError:
+		// these results are the same on all nodes
+	default:
+		logger.Printf("Raft: Error applying log index %d: %s", l.Index, err)
+	}
+	atomic.StoreUint64(&fsm.applied, l.Index)
+	return err
+}
+
+// notify queues the events of an applied transaction for the listeners
+// The log is applied in order, which keeps the events in the order of the changes on every node.
+func (fsm *raftFSM) notify(events []txnEvent) {
+	if len(events) == 0 {
+		return
+	}
+	fsm.Lock()
+	dispatch := fsm.dispatch
+	fsm.Unlock()
+	if dispatch != nil {
+		dispatch(events)
+	}
+}
+
+func (fsm *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	snapshot, err := fsm.storage.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	// Apply is not called concurrently, so the records are consistent with the services
+	records, err := fsm.storage.listRecords("")
+	if err != nil {
+		snapshot.release()
+		return nil, err
+	}
+	return &raftFSMSnapshot{snapshot, records}, nil
+}
+
+// Restore replaces the services and records in the storage with the ones in the snapshot
+func (fsm *raftFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	services, records, err := readSnapshot(rc)
+	if err != nil {
+		return err
+	}
+
+	restored := make(map[string]bool, len(services))
+	for i := range services {
+		restored[services[i].ID] = true
+	}
+	var removed []string
+	for s := range fsm.storage.iterator() {
+		if !restored[s.ID] {
+			removed = append(removed, s.ID)
+		}
+	}
+	for _, id := range removed {
+		err := fsm.storage.delete(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range services {
+		err := fsm.storage.add(&services[i])
+		if _, conflict := err.(*ConflictError); conflict {
+			err = fsm.storage.update(services[i].ID, &services[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	restoredRecords := make(map[string]bool, len(records))
+	for _, r := range records {
+		restoredRecords[recordKey(r.Kind, r.ID)] = true
+	}
+	existing, err := fsm.storage.listRecords("")
+	if err != nil {
+		return err
+	}
+	for _, r := range existing {
+		if !restoredRecords[recordKey(r.Kind, r.ID)] {
+			err := fsm.storage.deleteRecord(r.Kind, r.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i := range records {
+		err := fsm.storage.putRecord(&records[i])
+		if err != nil {
+			return err
+		}
+	}
+	// the restored snapshot is the latest one
+	if snapshots, err := fsm.snapshots.List(); err == nil && len(snapshots) > 0 {
+		atomic.StoreUint64(&fsm.applied, snapshots[0].Index)
+	}
+	logger.Printf("Raft: Restored %d services and %d records from a snapshot", len(services), len(records))
+	return nil
+}
+
+// raftFSMSnapshot writes a storage snapshot in the dump format, followed by the records
+type raftFSMSnapshot struct {
+	snapshot snapshot
+	records  []record
+}
+
+func (s *raftFSMSnapshot) Persist(sink raft.SnapshotSink) error {
+	_, err := writeSnapshot(s.snapshot, sink)
+	if err == nil {
+		err = writeRecords(s.records, sink)
+	}
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *raftFSMSnapshot) Release() {
+	s.snapshot.release()
+}
+
+// readClusterRequest reads a forwarded command
+func readClusterRequest(r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var cmd raftCommand
+	err = json.Unmarshal(b, &cmd)
+	if err != nil {
+		return nil, &BadRequestError{fmt.Sprintf("Error parsing the command: %s", err)}
+	}
+	switch cmd.Op {
+	case raftOpCommit:
+		if len(cmd.Writes) == 0 && len(cmd.Reads) == 0 {
+			return nil, &BadRequestError{"Neither reads nor writes are defined"}
+		}
+		for _, w := range cmd.Writes {
+			if err := w.validate(); err != nil {
+				return nil, &BadRequestError{err.Error()}
+			}
+		}
+		for _, e := range cmd.Events {
+			if _, found := listenerMethods[e.Type]; !found {
+				return nil, &BadRequestError{fmt.Sprintf("Unknown event type: %s", e.Type)}
+			}
+		}
+	default:
+		return nil, &BadRequestError{fmt.Sprintf("Unknown operation: %s", cmd.Op)}
+	}
+	return b, nil
+}
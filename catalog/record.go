@@ -0,0 +1,75 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// record is an internal document kept in the storage next to the services, e.g. a webhook subscription
+// Records are replicated and persisted like services but are neither indexed nor exported.
+type record struct {
+	Kind  string          `json:"kind"`
+	ID    string          `json:"id"`
+	Value json.RawMessage `json:"value"`
+}
+
+// recordKey is the key of a record which orders the records by kind and id
+func recordKey(kind, id string) string {
+	return kind + "\x00" + id
+}
+
+func (r *record) validate() error {
+	if r.Kind == "" || r.ID == "" {
+		return fmt.Errorf("record kind and id must be defined")
+	}
+	return nil
+}
+
+// writeRecords writes the records to w as newline-delimited JSON
+// The records are appended to the services of the snapshots of the durable memory storage and the Raft log.
+func writeRecords(records []record, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	for i := range records {
+		err := encoder.Encode(records[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSnapshot reads the services and records written by writeSnapshot and writeRecords
+// Records are told apart from services by their kind attribute.
+func readSnapshot(r io.Reader) ([]Service, []record, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxDumpLineSize)
+
+	var (
+		services bytes.Buffer
+		records  []record
+	)
+	for scanner.Scan() {
+		b := scanner.Bytes()
+		var rec record
+		if json.Unmarshal(b, &rec) == nil && rec.Kind != "" {
+			records = append(records, rec)
+			continue
+		}
+		services.Write(b)
+		services.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	dump, err := readDump(&services, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dump, records, nil
+}
@@ -0,0 +1,185 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestRecords(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	storage := controller.storage
+
+	for _, r := range []record{
+		{Kind: "b", ID: "1", Value: json.RawMessage(`{"n":1}`)},
+		{Kind: "a", ID: "2", Value: json.RawMessage(`{"n":2}`)},
+		{Kind: "a", ID: "1", Value: json.RawMessage(`{"n":3}`)},
+	} {
+		err := storage.putRecord(&r)
+		if err != nil {
+			t.Fatal("Error putting a record:", err.Error())
+		}
+	}
+	// replace
+	err = storage.putRecord(&record{Kind: "b", ID: "1", Value: json.RawMessage(`{"n":4}`)})
+	if err != nil {
+		t.Fatal("Error replacing a record:", err.Error())
+	}
+
+	records, err := storage.listRecords("a")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(records) != 2 || records[0].ID != "1" || records[1].ID != "2" {
+		t.Fatalf("Unexpected records of kind a: %v", records)
+	}
+	records, err = storage.listRecords("")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(records) != 3 || records[2].Kind != "b" || string(records[2].Value) != `{"n":4}` {
+		t.Fatalf("Unexpected records: %v", records)
+	}
+
+	// records are not services
+	if total, _ := storage.total(); total != 0 {
+		t.Fatalf("Records should not be counted as services: %d", total)
+	}
+
+	r, err := storage.getRecord("b", "1")
+	if err != nil {
+		t.Fatal("Error getting a record:", err.Error())
+	}
+	if string(r.Value) != `{"n":4}` {
+		t.Fatalf("Unexpected record: %v", r)
+	}
+	_, err = storage.getRecord("b", "2")
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError when getting a missing record, got: %v", err)
+	}
+
+	err = storage.deleteRecord("a", "1")
+	if err != nil {
+		t.Fatal("Error deleting a record:", err.Error())
+	}
+	err = storage.deleteRecord("a", "1")
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError when deleting a deleted record, got: %v", err)
+	}
+	records, _ = storage.listRecords("a")
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record of kind a after deletion, got %d", len(records))
+	}
+
+	// seek
+	for _, id := range []string{"3", "4", "5"} {
+		storage.putRecord(&record{Kind: "a", ID: id, Value: json.RawMessage(`{}`)})
+	}
+	storage.putRecord(&record{Kind: "ab", ID: "0", Value: json.RawMessage(`{}`)})
+	for _, c := range []struct {
+		after string
+		limit int
+		ids   string
+	}{
+		{"", 10, "2,3,4,5"},
+		{"", 1, "2"},
+		{"2", 2, "3,4"},
+		{"25", 10, "3,4,5"},
+		{"5", 10, ""},
+	} {
+		records, err := storage.listRecordsAfter("a", c.after, c.limit)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var ids []string
+		for _, r := range records {
+			ids = append(ids, r.ID)
+		}
+		if strings.Join(ids, ",") != c.ids {
+			t.Fatalf("Expected records %s after %s, got: %v", c.ids, c.after, records)
+		}
+	}
+}
+
+func TestDurableMemoryStorageRecords(t *testing.T) {
+	if TestStorageType != CatalogBackendMemory {
+		t.Skip("Only for the memory storage")
+	}
+	dir := fmt.Sprintf("%s/lslc/test-%s.mem", strings.Replace(os.TempDir(), "\\", "/", -1), uuid.NewV4().String())
+	defer os.RemoveAll(dir)
+
+	storage, err := NewDurableMemoryStorage(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storage.add(&Service{ID: "service_1", Type: "_test._tcp", TTL: 30})
+	storage.putRecord(&record{Kind: "a", ID: "1", Value: json.RawMessage(`{}`)})
+	storage.putRecord(&record{Kind: "a", ID: "2", Value: json.RawMessage(`{}`)})
+	storage.deleteRecord("a", "2")
+
+	check := func(s Storage) {
+		records, err := s.listRecords("")
+		if err != nil || len(records) != 1 || records[0].ID != "1" {
+			t.Fatalf("Records are not recovered: %v %v", records, err)
+		}
+		if total, _ := s.total(); total != 1 {
+			t.Fatalf("Expected 1 recovered service, got %d", total)
+		}
+	}
+
+	// Replay the log
+	recovered, err := NewDurableMemoryStorage(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	check(recovered)
+	recovered.wal.file.Close()
+
+	// Load the snapshot written on close
+	err = storage.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recovered, err = NewDurableMemoryStorage(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer recovered.Close()
+	check(recovered)
+}
+
+func TestReadSnapshot(t *testing.T) {
+	var b bytes.Buffer
+	services := memSnapshot{{ID: "service_1", Type: "_test._tcp", TTL: 30}}
+	records := []record{{Kind: "a", ID: "1", Value: json.RawMessage(`{"id":"x"}`)}}
+	_, err := writeSnapshot(services, &b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = writeRecords(records, &b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	readServices, readRecords, err := readSnapshot(&b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(readServices) != 1 || readServices[0].ID != "service_1" {
+		t.Fatalf("Unexpected services: %v", readServices)
+	}
+	if len(readRecords) != 1 || readRecords[0].Kind != "a" || string(readRecords[0].Value) != `{"id":"x"}` {
+		t.Fatalf("Unexpected records: %v", readRecords)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Renewal is the new expiry of a renewed service
+type Renewal struct {
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// renew extends the expiry of a service by its TTL from now
+// Other attributes, including the revision, are not modified.
+// Renewing an expired service makes it active again, which is notified as an update.
+func (c *Controller) renew(id string, by actor) (*Service, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	var renewed *Service
+	err := c.transact(func(tx *txn) error {
+		ss, err := c.getModifiable(tx, id, "", by)
+		if err != nil {
+			return err
+		}
+		ss.ExpiresAt = time.Now().UTC().Add(time.Duration(ss.TTL) * time.Second)
+		reactivated := ss.State == StateExpired
+		ss.State = StateActive
+
+		err = tx.update(ss)
+		if err != nil {
+			return err
+		}
+		if reactivated {
+			if err := c.notifyUpdated(tx, *ss, by); err != nil {
+				return err
+			}
+		} else {
+			c.notifyRenewed(tx, *ss)
+		}
+		renewed = ss
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return renewed, nil
+}
+
+// Renew extends the expiry of a service without sending the registration
+func (a *HttpAPI) Renew(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	s, err := a.controller.renew(params["id"], requestActor(req))
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			a.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		case *ConflictError:
+			a.ErrorResponse(w, http.StatusConflict, "Error renewing the service:", err.Error())
+			return
+		case *ForbiddenError:
+			a.ErrorResponse(w, http.StatusForbidden, "Error renewing the service:", err.Error())
+			return
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error renewing the service:", err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(Renewal{ID: s.ID, ExpiresAt: s.ExpiresAt})
+}
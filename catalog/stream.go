@@ -0,0 +1,371 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/service-catalog/v3/utils"
+	"golang.org/x/net/websocket"
+)
+
+// Types of the streamed events
+const (
+	EventAdded   = "added"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+	// EventExpired is the expiry of a service which is not renewed within its TTL
+	EventExpired = "expired"
+	// EventHealthChanged is the change of the health status of a service
+	EventHealthChanged = "health"
+	// EventReset tells a resuming subscriber that the events after its last event are no longer kept
+	// The subscriber should reload the services. The stream continues after the id of the reset event.
+	EventReset = "reset"
+)
+
+const (
+	// GetParamLastEventID is the query parameter for resuming a stream when the Last-Event-ID header can't be set, e.g. by WebSocket clients
+	GetParamLastEventID = "lastEventID"
+	// number of events buffered for each subscriber before it is disconnected
+	streamBuffer = 100
+	// interval of the pings which keep idle connections open
+	streamKeepaliveInterval = 20 * time.Second
+)
+
+// Event is a change of a service
+// The id is the sequence number of the change in the change feed, or zero if the change feed is disabled.
+type Event struct {
+	ID      uint64   `json:"id"`
+	Type    string   `json:"type"`
+	Service *Service `json:"service,omitempty"`
+}
+
+// stream is a Listener which pushes the changes of services to the subscribers
+// The subscribers which resume after a disconnection receive the missed events from the change feed.
+type stream struct {
+	sync.Mutex
+	controller  *Controller
+	subscribers map[*subscriber]bool
+}
+
+// subscriber receives the events which match its filter
+// The events channel is closed if the subscriber falls behind.
+type subscriber struct {
+	path   []string
+	op     string
+	value  string
+	events chan Event
+	// replayed is the id of the last event replayed from the change feed, after which the events are sent
+	replayed uint64
+}
+
+func newStream(controller *Controller) *stream {
+	return &stream{
+		controller:  controller,
+		subscribers: make(map[*subscriber]bool),
+	}
+}
+
+func (s *subscriber) match(e Event) bool {
+	if s.path == nil {
+		return true
+	}
+	matched, err := utils.MatchObject(e.Service, s.path, s.op, s.value)
+	if err != nil {
+		logger.Printf("Stream: Error matching event %d: %s", e.ID, err)
+		return false
+	}
+	return matched
+}
+
+// skip reports whether the event was already replayed from the change feed
+func (s *subscriber) skip(e Event) bool {
+	return e.ID != 0 && e.ID <= s.replayed
+}
+
+func (st *stream) publish(e Event) {
+	st.Lock()
+	defer st.Unlock()
+
+	for sub := range st.subscribers {
+		if !sub.match(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			// the subscriber may resume from its last received event
+			logger.Printf("Stream: Disconnecting a subscriber which fell behind at event %d", e.ID)
+			close(sub.events)
+			delete(st.subscribers, sub)
+		}
+	}
+}
+
+// subscribe registers a subscriber and returns the matching events after lastEventID, if given
+// The events are replayed from the change feed. If the change feed is disabled or no longer has the events after
+// lastEventID, a reset event with the id of the latest change is returned instead.
+func (st *stream) subscribe(sub *subscriber, lastEventID string) ([]Event, error) {
+	var after uint64
+	if lastEventID != "" {
+		var err error
+		after, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last event id: %s", lastEventID)
+		}
+	}
+
+	// registered before reading the change feed so that no change is missed in between
+	sub.events = make(chan Event, streamBuffer)
+	st.Lock()
+	st.subscribers[sub] = true
+	st.Unlock()
+	if lastEventID == "" {
+		return nil, nil
+	}
+
+	replay, err := st.replay(sub, after)
+	if err != nil {
+		st.unsubscribe(sub)
+		return nil, err
+	}
+	return replay, nil
+}
+
+// replay returns the matching events after the given id from the change feed
+// Deletions are tombstones in the change feed, which are replayed to all subscribers as they can't be filtered.
+func (st *stream) replay(sub *subscriber, after uint64) ([]Event, error) {
+	var replay []Event
+	for {
+		list, err := st.controller.getChanges(after, MaxPerPage)
+		switch err.(type) {
+		case nil:
+		case *NotFoundError, *GoneError, *BadRequestError:
+			last, err := st.controller.lastChange()
+			if err != nil {
+				return nil, err
+			}
+			sub.replayed = last
+			return []Event{{ID: last, Type: EventReset}}, nil
+		default:
+			return nil, err
+		}
+
+		for _, c := range list.Changes {
+			e := Event{ID: c.Seq, Type: c.Type, Service: c.Service}
+			if c.Type == EventDeleted {
+				e.Service = &Service{ID: c.ID}
+			} else if !sub.match(e) {
+				continue
+			}
+			replay = append(replay, e)
+		}
+		if len(list.Changes) > 0 {
+			after = list.Changes[len(list.Changes)-1].Seq
+		}
+		if !list.More {
+			break
+		}
+	}
+	sub.replayed = after
+	return replay, nil
+}
+
+func (st *stream) unsubscribe(sub *subscriber) {
+	st.Lock()
+	delete(st.subscribers, sub)
+	st.Unlock()
+}
+
+// changed publishes a change of the change feed with its sequence number as the id of the event
+func (st *stream) changed(c Change, s Service) {
+	st.publish(Event{ID: c.Seq, Type: c.Type, Service: &s})
+}
+
+// added and the other Listener methods publish the changes without ids if the change feed is disabled
+func (st *stream) added(s Service) {
+	st.publish(Event{Type: EventAdded, Service: &s})
+}
+
+func (st *stream) updated(s Service) {
+	st.publish(Event{Type: EventUpdated, Service: &s})
+}
+
+// renewed is not streamed as the service is not modified
+func (st *stream) renewed(s Service) {}
+
+func (st *stream) deleted(s Service) {
+	st.publish(Event{Type: EventDeleted, Service: &s})
+}
+
+func (st *stream) expired(s Service) {
+	st.publish(Event{Type: EventExpired, Service: &s})
+}
+
+func (st *stream) healthChanged(s Service) {
+	st.publish(Event{Type: EventHealthChanged, Service: &s})
+}
+
+// Events streams the changes of services as Server-Sent Events, or as WebSocket messages if the connection is upgraded
+// The changes may be filtered similar to the Filter API.
+// Clients resume after a disconnection by giving the id of the last received event.
+func (a *HttpAPI) Events(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+
+	var sub subscriber
+	if params["path"] != "" {
+		if err := utils.ValidateFilterOp(params["op"]); err != nil {
+			a.ErrorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sub.path, sub.op, sub.value = strings.Split(params["path"], "."), params["op"], params["value"]
+	}
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get(GetParamLastEventID)
+	}
+	replay, err := a.stream.subscribe(&sub, lastEventID)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer a.stream.unsubscribe(&sub)
+
+	if strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{Handshake: checkWebSocketOrigin, Handler: func(ws *websocket.Conn) {
+			streamWebSocket(ws, &sub, replay)
+		}}.ServeHTTP(w, req)
+		return
+	}
+	a.streamSSE(w, req, &sub, replay)
+}
+
+func (a *HttpAPI) streamSSE(w http.ResponseWriter, req *http.Request, sub *subscriber, replay []Event) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		a.ErrorResponse(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(e Event) error {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if e.ID != 0 {
+			_, err = fmt.Fprintf(w, "id: %d\n", e.ID)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+		return err
+	}
+
+	for _, e := range replay {
+		if err := write(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if sub.skip(e) {
+				continue
+			}
+			if err := write(e); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			// comment lines are ignored by clients
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// checkWebSocketOrigin accepts the handshakes of pages of the same origin, and of clients which send no origin
+// Unlike the requests of the other handlers, WebSocket handshakes are not subject to CORS in browsers.
+func checkWebSocketOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin: %s", origin)
+	}
+	if !strings.EqualFold(u.Host, req.Host) {
+		return fmt.Errorf("cross-origin handshake from %s", origin)
+	}
+	config.Origin = u
+	return nil
+}
+
+func streamWebSocket(ws *websocket.Conn, sub *subscriber, replay []Event) {
+	defer ws.Close()
+
+	// read until the client closes the connection, which also answers its pings
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(closed)
+	}()
+
+	for _, e := range replay {
+		if err := websocket.JSON.Send(ws, e); err != nil {
+			return
+		}
+	}
+
+	keepalive := time.NewTicker(streamKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if sub.skip(e) {
+				continue
+			}
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			ws.PayloadType = websocket.PingFrame
+			_, err := ws.Write(nil)
+			ws.PayloadType = websocket.TextFrame
+			if err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// RegistrationTokenHeader is the header with the registration token of a service, or the admin token
+const RegistrationTokenHeader = "Registration-Token"
+
+// recordKindToken is the kind of the records with the hashes of the registration tokens, by service id
+const recordKindToken = "token"
+
+// minAdminTokenLength is the minimum length of the admin token
+const minAdminTokenLength = 16
+
+// TokenConf is the configuration of the registration tokens
+type TokenConf struct {
+	// Enabled issues a token for every service created over HTTP, which is required to modify the service
+	Enabled bool `json:"enabled"`
+	// AdminToken may be sent instead of the token of any service and is required for the requests which affect all services
+	AdminToken string `json:"adminToken"`
+}
+
+func (c TokenConf) Validate() error {
+	if c.AdminToken != "" && len(c.AdminToken) < minAdminTokenLength {
+		return fmt.Errorf("tokens: adminToken must have at least %d characters", minAdminTokenLength)
+	}
+	return nil
+}
+
+// isAdmin checks whether the actor sent the admin token
+func (c *TokenConf) isAdmin(by actor) bool {
+	return c.AdminToken != "" && subtle.ConstantTimeCompare([]byte(by.token), []byte(c.AdminToken)) == 1
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// EnableTokens requires the registration token for the modification of services created over HTTP
+// The tokens are only kept as hashes in the storage.
+func (c *Controller) EnableTokens(conf TokenConf) {
+	if !conf.Enabled {
+		return
+	}
+	c.Lock()
+	c.tokens = &conf
+	c.Unlock()
+}
+
+// issueToken creates and stores the token of a service created by the actor
+// It returns an empty token if tokens are disabled or the service is not created over HTTP.
+// The caller must hold the lock.
+func (c *Controller) issueToken(tx *txn, id string, by actor) (string, error) {
+	if c.tokens == nil || by.origin != OriginHTTP {
+		return "", nil
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("error generating the token: %s", err)
+	}
+	token := hex.EncodeToString(b)
+
+	value, _ := json.Marshal(hashToken(token))
+	tx.putRecord(&record{Kind: recordKindToken, ID: id, Value: value})
+	return token, nil
+}
+
+// revokeToken removes the token of a deleted service
+// The caller must hold the lock.
+func (c *Controller) revokeToken(tx *txn, id string) {
+	if c.tokens == nil {
+		return
+	}
+	tx.deleteRecord(recordKindToken, id)
+}
+
+// checkToken checks whether the actor sent the token of the service or the admin token
+// Services without a token, e.g. registered over MQTT or before tokens were enabled, may be modified without one.
+// Services with a token cannot be modified over MQTT, whose messages have no token.
+// The caller must hold the lock.
+func (c *Controller) checkToken(tx *txn, id string, by actor) error {
+	if c.tokens == nil || !by.external() || c.tokens.isAdmin(by) {
+		return nil
+	}
+	r, err := tx.getRecord(recordKindToken, id)
+	if _, notFound := err.(*NotFoundError); notFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if by.origin != OriginHTTP {
+		return &ForbiddenError{fmt.Sprintf("Service %s has a registration token and cannot be modified over MQTT", id)}
+	}
+	var hash string
+	err = json.Unmarshal(r.Value, &hash)
+	if err != nil {
+		return err
+	}
+
+	if by.token == "" {
+		return &ForbiddenError{fmt.Sprintf("Service %s can only be modified with its registration token in the %s header", id, RegistrationTokenHeader)}
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(by.token)), []byte(hash)) != 1 {
+		return &ForbiddenError{fmt.Sprintf("Invalid registration token for service %s", id)}
+	}
+	return nil
+}
+
+// checkAdminToken checks whether the actor sent the admin token, if tokens are enabled
+// The admin token is required for the requests which affect all services, e.g. updates by query, backups, and webhook subscriptions.
+// The caller must hold the lock.
+func (c *Controller) checkAdminToken(by actor) error {
+	if c.tokens == nil || !by.external() || c.tokens.isAdmin(by) {
+		return nil
+	}
+	return &UnauthorizedError{fmt.Sprintf("The admin token is required in the %s header", RegistrationTokenHeader)}
+}
+
+// authorizeAdminToken checks whether the actor sent the admin token, if tokens are enabled
+func (c *Controller) authorizeAdminToken(by actor) error {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.checkAdminToken(by)
+}
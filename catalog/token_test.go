@@ -0,0 +1,268 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTokens(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	adminToken := "0123456789abcdef-admin"
+	controller.EnableTokens(TokenConf{Enabled: true, AdminToken: adminToken})
+
+	withToken := func(token string) actor { return actor{origin: OriginHTTP, token: token} }
+
+	s, err := controller.add(Service{ID: "protected", Type: "_test._tcp", TTL: 30, Token: "chosen"}, withToken(""))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	token := s.Token
+	if token == "" || token == "chosen" {
+		t.Fatalf("Expected a generated token, got: %q", token)
+	}
+	stored, err := controller.get("protected")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if stored.Token != "" {
+		t.Fatalf("Token should not be stored in the service: %q", stored.Token)
+	}
+
+	// missing and invalid tokens
+	for _, by := range []actor{withToken(""), withToken("invalid")} {
+		if _, err := controller.updateIf("protected", Service{Type: "_test._tcp", TTL: 60}, "", by); !isForbidden(err) {
+			t.Fatalf("Expected ForbiddenError for the update with %q, got: %v", by.token, err)
+		}
+		if _, err := controller.renew("protected", by); !isForbidden(err) {
+			t.Fatalf("Expected ForbiddenError for the renewal with %q, got: %v", by.token, err)
+		}
+		if err := controller.deleteIf("protected", "", by); !isForbidden(err) {
+			t.Fatalf("Expected ForbiddenError for the deletion with %q, got: %v", by.token, err)
+		}
+	}
+
+	// service and admin tokens, and internal actors
+	for _, by := range []actor{withToken(token), withToken(adminToken), {}} {
+		updated, err := controller.updateIf("protected", Service{Type: "_test._tcp", TTL: 60}, "", by)
+		if err != nil {
+			t.Fatalf("Unexpected error for the update with %q: %s", by.token, err)
+		}
+		if updated.Token != "" {
+			t.Fatalf("Token should only be returned on creation: %q", updated.Token)
+		}
+	}
+	if _, err := controller.renew("protected", withToken(token)); err != nil {
+		t.Fatalf("Unexpected error for the renewal with the token: %s", err)
+	}
+
+	// updates by query need the admin token
+	confirm := 1
+	q := QueryOperation{Action: QueryActionSetTTL, Filter: SubscriptionFilter{Path: "id", Op: "equals", Value: "protected"}, TTL: 10, Confirm: &confirm}
+	if _, err := controller.applyQuery(q, withToken(token)); !isUnauthorized(err) {
+		t.Fatalf("Expected UnauthorizedError for the query without the admin token, got: %v", err)
+	}
+	if _, err := controller.applyQuery(q, withToken(adminToken)); err != nil {
+		t.Fatalf("Unexpected error for the query with the admin token: %s", err)
+	}
+
+	// deletion revokes the token
+	if err := controller.deleteIf("protected", "", withToken(token)); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := controller.storage.getRecord(recordKindToken, "protected"); err == nil {
+		t.Fatal("Expected the token to be removed with the service")
+	}
+	s, err = controller.add(Service{ID: "protected", Type: "_test._tcp", TTL: 30}, withToken(token))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.Token == "" || s.Token == token {
+		t.Fatalf("Expected a new token for the created service, got: %q", s.Token)
+	}
+
+	// MQTT messages have no token
+	if err := controller.deleteIf("protected", "", actor{origin: "broker"}); !isForbidden(err) {
+		t.Fatalf("Expected ForbiddenError for the deletion over MQTT, got: %v", err)
+	}
+
+	// services created without a token
+	if _, err := controller.add(Service{ID: "unprotected", Type: "_test._tcp", TTL: 30}, actor{origin: "broker"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := controller.deleteIf("unprotected", "", withToken("")); err != nil {
+		t.Fatalf("Unexpected error for the deletion of a service without a token: %s", err)
+	}
+}
+
+func TestTokensBatch(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	controller.EnableTokens(TokenConf{Enabled: true})
+	by := actor{origin: OriginHTTP}
+
+	result := controller.batch(Batch{Operations: []BatchOperation{
+		{Op: BatchCreate, ID: "a", Service: &Service{Type: "_test._tcp", TTL: 30}},
+		{Op: BatchCreate, ID: "b", Service: &Service{Type: "_test._tcp", TTL: 30}},
+	}}, by)
+	if result.Succeeded != 2 || result.Results[0].Service.Token == "" || result.Results[1].Service.Token == "" {
+		t.Fatalf("Expected the tokens of the created services: %+v", result)
+	}
+	tokenA := result.Results[0].Service.Token
+
+	result = controller.batch(Batch{Mode: BatchBestEffort, Operations: []BatchOperation{
+		{Op: BatchDelete, ID: "a", Token: tokenA},
+		{Op: BatchDelete, ID: "b", Token: tokenA},
+	}}, by)
+	if result.Results[0].Status != http.StatusOK || result.Results[1].Status != http.StatusForbidden {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+
+	// a reverted creation revokes the token
+	result = controller.batch(Batch{Operations: []BatchOperation{
+		{Op: BatchCreate, ID: "c", Service: &Service{Type: "_test._tcp", TTL: 30}},
+		{Op: BatchDelete, ID: "b"},
+	}}, by)
+	if result.Failed != 2 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	if _, err := controller.storage.getRecord(recordKindToken, "c"); err == nil {
+		t.Fatal("Expected the token of the reverted creation to be removed")
+	}
+}
+
+func TestTokensHTTP(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	controller.EnableTokens(TokenConf{Enabled: true})
+	api := NewHTTPAPI(controller, "test", "", "")
+
+	b, _ := json.Marshal(Service{Type: "_test._tcp", TTL: 30})
+	w := httptest.NewRecorder()
+	api.Post(w, httptest.NewRequest("POST", "/", bytes.NewReader(b)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	var s Service
+	json.NewDecoder(w.Body).Decode(&s)
+	if s.Token == "" {
+		t.Fatal("Expected the token in the created service")
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/"+s.ID, nil), map[string]string{"id": s.ID})
+	w = httptest.NewRecorder()
+	api.Get(w, req)
+	var got Service
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.Token != "" {
+		t.Fatalf("Token should not be retrievable: %q", got.Token)
+	}
+
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/"+s.ID, nil), map[string]string{"id": s.ID})
+	w = httptest.NewRecorder()
+	api.Delete(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+
+	req = mux.SetURLVars(httptest.NewRequest("DELETE", "/"+s.ID, nil), map[string]string{"id": s.ID})
+	req.Header.Set(RegistrationTokenHeader, s.Token)
+	w = httptest.NewRecorder()
+	api.Delete(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+func TestTokensAdminHTTP(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	adminToken := "0123456789abcdef-admin"
+	controller.EnableTokens(TokenConf{Enabled: true, AdminToken: adminToken})
+	controller.EnableWebhooks(WebhookConf{})
+	api := NewHTTPAPI(controller, "test", "", "")
+
+	s, err := controller.add(Service{ID: "protected", Type: "_test._tcp", TTL: 30}, actor{origin: OriginHTTP})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	subscription := func() io.Reader {
+		b, _ := json.Marshal(Subscription{URL: "http://localhost:1/hook"})
+		return bytes.NewReader(b)
+	}
+	requests := []struct {
+		name    string
+		handler http.HandlerFunc
+		request func() *http.Request
+	}{
+		{"backup", api.Backup, func() *http.Request { return httptest.NewRequest("GET", "/admin/backup", nil) }},
+		{"restore", api.Restore, func() *http.Request {
+			return httptest.NewRequest("POST", "/admin/restore?mode="+RestoreModeReplace, strings.NewReader(""))
+		}},
+		{"subscription", api.PostSubscription, func() *http.Request { return httptest.NewRequest("POST", "/subscriptions", subscription()) }},
+		{"subscriptions", api.ListSubscriptions, func() *http.Request { return httptest.NewRequest("GET", "/subscriptions", nil) }},
+		{"subscription deletion", api.DeleteSubscription, func() *http.Request {
+			return mux.SetURLVars(httptest.NewRequest("DELETE", "/subscriptions/x", nil), map[string]string{"sid": "x"})
+		}},
+		{"listener stats", api.ListenerQueues, func() *http.Request { return httptest.NewRequest("GET", "/admin/listeners", nil) }},
+	}
+
+	// without or with another token
+	for _, token := range []string{"", s.Token} {
+		for _, r := range requests {
+			req := r.request()
+			if token != "" {
+				req.Header.Set(RegistrationTokenHeader, token)
+			}
+			w := httptest.NewRecorder()
+			r.handler(w, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected %d for the %s without the admin token, got %d: %s", http.StatusUnauthorized, r.name, w.Code, w.Body.String())
+			}
+		}
+	}
+	if total, _ := controller.total(); total != 1 {
+		t.Fatalf("Restore without the admin token changed the catalog: %d services", total)
+	}
+
+	// with the admin token
+	for _, r := range requests {
+		req := r.request()
+		req.Header.Set(RegistrationTokenHeader, adminToken)
+		w := httptest.NewRecorder()
+		r.handler(w, req)
+		if w.Code == http.StatusUnauthorized {
+			t.Fatalf("Unexpected %d for the %s with the admin token: %s", w.Code, r.name, w.Body.String())
+		}
+	}
+	if total, _ := controller.total(); total != 0 {
+		t.Fatalf("Expected the empty restore with the admin token to remove all services, got %d", total)
+	}
+}
+
+func isUnauthorized(err error) bool {
+	_, ok := err.(*UnauthorizedError)
+	return ok
+}
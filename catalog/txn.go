@@ -0,0 +1,338 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Operations of the writes of a commit
+const (
+	writeAdd          = "add"
+	writeUpdate       = "update"
+	writeDelete       = "delete"
+	writePutRecord    = "putRecord"
+	writeDeleteRecord = "deleteRecord"
+)
+
+// write is a mutation of a service or a record in a commit
+type write struct {
+	Op      string   `json:"op"`
+	ID      string   `json:"id,omitempty"`
+	Service *Service `json:"service,omitempty"`
+	// Kind and ID identify a deleted record
+	Kind   string  `json:"kind,omitempty"`
+	Record *record `json:"record,omitempty"`
+}
+
+// validate checks whether the write is well-formed
+func (w *write) validate() error {
+	switch w.Op {
+	case writeAdd, writeUpdate:
+		if w.Service == nil || w.Service.ID != w.ID {
+			return fmt.Errorf("write of service %s has no matching service", w.ID)
+		}
+	case writeDelete, writeDeleteRecord:
+	case writePutRecord:
+		if w.Record == nil {
+			return fmt.Errorf("write has no record")
+		}
+		return w.Record.validate()
+	default:
+		return fmt.Errorf("unknown write operation: %s", w.Op)
+	}
+	return nil
+}
+
+// checkWrites checks whether the writes of a commit can be applied in order
+// exists reports whether a service is stored before the commit. Deleting a record which does not exist is not an error.
+func checkWrites(writes []write, exists func(id string) (bool, error)) error {
+	pending := make(map[string]bool)
+	for _, w := range writes {
+		if err := w.validate(); err != nil {
+			return err
+		}
+		switch w.Op {
+		case writeAdd, writeUpdate, writeDelete:
+			found, ok := pending[w.ID]
+			if !ok {
+				var err error
+				found, err = exists(w.ID)
+				if err != nil {
+					return err
+				}
+			}
+			if w.Op == writeAdd && found {
+				return &ConflictError{fmt.Sprintf("Service id %s is not unique", w.ID)}
+			}
+			if w.Op != writeAdd && !found {
+				return &NotFoundError{fmt.Sprintf("Service with id %s is not found", w.ID)}
+			}
+			pending[w.ID] = w.Op != writeDelete
+		}
+	}
+	return nil
+}
+
+// read is the version of a service or a record read by a transaction
+type read struct {
+	// Kind is the kind of a record, empty for a service
+	Kind string `json:"kind,omitempty"`
+	ID   string `json:"id"`
+	// Version is the hash of the value, empty if it did not exist
+	Version string `json:"version,omitempty"`
+}
+
+// version returns the hash of the JSON of a service or a record
+// The values are decoded from JSON, so they are encoded without errors.
+func version(v interface{}) string {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkReads returns a staleError if a service or a record read by a transaction has changed since
+func checkReads(storage Storage, reads []read) error {
+	for _, r := range reads {
+		var current string
+		var err error
+		if r.Kind == "" {
+			var s *Service
+			s, err = storage.get(r.ID)
+			if err == nil {
+				current = version(s)
+			}
+		} else {
+			var rec *record
+			rec, err = storage.getRecord(r.Kind, r.ID)
+			if err == nil {
+				current = version(rec)
+			}
+		}
+		if _, notFound := err.(*NotFoundError); err != nil && !notFound {
+			return err
+		}
+		if current != r.Version {
+			if r.Kind == "" {
+				return &staleError{fmt.Sprintf("Service %s was modified concurrently", r.ID)}
+			}
+			return &staleError{fmt.Sprintf("Record %s with id %s was modified concurrently", r.Kind, r.ID)}
+		}
+	}
+	return nil
+}
+
+// eventRenewed is the type of the events of renewals, which are not in the change feed
+const eventRenewed = "renewed"
+
+// txnEvent is a notification of the listeners by a committed transaction
+type txnEvent struct {
+	Type    string  `json:"type"`
+	Service Service `json:"service"`
+	// Change is the change in the change feed, nil if the feed is disabled or the event is not a change
+	Change *Change `json:"change,omitempty"`
+}
+
+// replicatedStorage is implemented by storages which replicate the transactions among the nodes of a cluster
+// The state machine of every node checks the reads of a transaction against its storage, commits the writes, and
+// notifies its listeners with the events. This serializes the transactions made on different nodes.
+type replicatedStorage interface {
+	replicate(reads []read, writes []write, events []txnEvent) error
+	// setDispatcher sets the function which notifies the listeners with the events of the applied transactions
+	setDispatcher(dispatch func(events []txnEvent))
+}
+
+// maxTxnAttempts is the number of attempts of a transaction which read stale services or records in a cluster
+const maxTxnAttempts = 10
+
+// txn is a change of the catalog made while holding the lock of the controller
+// The writes, including the records of the change feed, are committed atomically by the storage and the listeners are
+// notified after the commit. A transaction which is not committed has no effect. Reads through the transaction see
+// its pending writes.
+type txn struct {
+	storage Storage
+	writes  []write
+	// events notify the listeners in order after the commit
+	events []txnEvent
+	// pending services and records by id and key, nil if deleted
+	services map[string]*Service
+	records  map[string]*record
+	// reads are the versions first read from a replicated storage, whose keys are in readKeys
+	replicated bool
+	reads      []read
+	readKeys   map[string]bool
+}
+
+// begin starts a transaction
+// The caller must hold the lock.
+func (c *Controller) begin() *txn {
+	_, replicated := c.storage.(replicatedStorage)
+	return &txn{
+		storage:    c.storage,
+		services:   make(map[string]*Service),
+		records:    make(map[string]*record),
+		replicated: replicated,
+		readKeys:   make(map[string]bool),
+	}
+}
+
+// commit applies the writes of the transaction and notifies the listeners
+// A replicated transaction is committed by the state machine of each node instead, which may return a staleError.
+// The caller must hold the lock.
+func (c *Controller) commit(tx *txn) error {
+	if r, ok := c.storage.(replicatedStorage); ok {
+		if len(tx.writes) == 0 && len(tx.events) == 0 {
+			return nil
+		}
+		return r.replicate(tx.reads, tx.writes, tx.events)
+	}
+	if len(tx.writes) > 0 {
+		err := c.storage.commit(tx.writes)
+		if err != nil {
+			return err
+		}
+	}
+	c.dispatchEvents(tx.events)
+	return nil
+}
+
+// verify returns a staleError if a replicated transaction has read services or records which were modified since
+// It lets a failed transaction be retried, so that its error is not caused by stale reads.
+// The caller must hold the lock.
+func (c *Controller) verify(tx *txn) error {
+	if r, ok := c.storage.(replicatedStorage); ok && len(tx.reads) > 0 {
+		return r.replicate(tx.reads, nil, nil)
+	}
+	return nil
+}
+
+// transact runs f in a transaction and commits it
+// The transaction is run again if it read services or records which a transaction on another node of the cluster
+// modified concurrently. f must not have effects other than through the transaction.
+// The caller must hold the lock.
+func (c *Controller) transact(f func(tx *txn) error) error {
+	var err error
+	for attempt := 0; attempt < maxTxnAttempts; attempt++ {
+		tx := c.begin()
+		err = f(tx)
+		if err != nil {
+			if _, stale := c.verify(tx).(*staleError); stale {
+				continue
+			}
+			return err
+		}
+		err = c.commit(tx)
+		if _, stale := err.(*staleError); !stale {
+			return err
+		}
+	}
+	return err
+}
+
+// track keeps the version of a service or a record read from a replicated storage
+// Only the first read of each is kept, which the state machine checks.
+func (tx *txn) track(kind, id string, v interface{}) {
+	key := recordKey(kind, id)
+	if !tx.replicated || tx.readKeys[key] {
+		return
+	}
+	r := read{Kind: kind, ID: id}
+	if v != nil {
+		r.Version = version(v)
+	}
+	tx.readKeys[key] = true
+	tx.reads = append(tx.reads, r)
+}
+
+func (tx *txn) get(id string) (*Service, error) {
+	s, found := tx.services[id]
+	if !found {
+		stored, err := tx.storage.get(id)
+		if err == nil {
+			tx.track("", id, stored)
+		} else if _, notFound := err.(*NotFoundError); notFound {
+			tx.track("", id, nil)
+		}
+		return stored, err
+	}
+	if s == nil {
+		return nil, &NotFoundError{fmt.Sprintf("Service with id %s is not found", id)}
+	}
+	service := *s
+	return &service, nil
+}
+
+func (tx *txn) add(s *Service) error {
+	_, err := tx.get(s.ID)
+	if err == nil {
+		return &ConflictError{fmt.Sprintf("Service id %s is not unique", s.ID)}
+	} else if _, notFound := err.(*NotFoundError); !notFound {
+		return err
+	}
+	tx.put(writeAdd, s)
+	return nil
+}
+
+func (tx *txn) update(s *Service) error {
+	_, err := tx.get(s.ID)
+	if err != nil {
+		return err
+	}
+	tx.put(writeUpdate, s)
+	return nil
+}
+
+func (tx *txn) delete(id string) error {
+	_, err := tx.get(id)
+	if err != nil {
+		return err
+	}
+	tx.services[id] = nil
+	tx.writes = append(tx.writes, write{Op: writeDelete, ID: id})
+	return nil
+}
+
+// put adds a write of a copy of the service
+func (tx *txn) put(op string, s *Service) {
+	service := *s
+	tx.services[s.ID] = &service
+	tx.writes = append(tx.writes, write{Op: op, ID: s.ID, Service: &service})
+}
+
+func (tx *txn) getRecord(kind, id string) (*record, error) {
+	r, found := tx.records[recordKey(kind, id)]
+	if !found {
+		stored, err := tx.storage.getRecord(kind, id)
+		if err == nil {
+			tx.track(kind, id, stored)
+		} else if _, notFound := err.(*NotFoundError); notFound {
+			tx.track(kind, id, nil)
+		}
+		return stored, err
+	}
+	if r == nil {
+		return nil, &NotFoundError{fmt.Sprintf("Record %s with id %s is not found", kind, id)}
+	}
+	rec := *r
+	return &rec, nil
+}
+
+func (tx *txn) putRecord(r *record) {
+	rec := *r
+	tx.records[recordKey(r.Kind, r.ID)] = &rec
+	tx.writes = append(tx.writes, write{Op: writePutRecord, Record: &rec})
+}
+
+// deleteRecord removes a record if it exists
+func (tx *txn) deleteRecord(kind, id string) {
+	tx.records[recordKey(kind, id)] = nil
+	tx.writes = append(tx.writes, write{Op: writeDeleteRecord, Kind: kind, ID: id})
+}
+
+// notify adds an event which notifies the listeners after the commit
+func (tx *txn) notify(eventType string, s Service, change *Change) {
+	tx.events = append(tx.events, txnEvent{Type: eventType, Service: s, Change: change})
+}
@@ -0,0 +1,155 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/linksmart/service-catalog/v3/utils"
+)
+
+func TestStorageCommit(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	storage := controller.storage
+
+	s1 := &Service{ID: "service_1", Type: "_test._tcp", TTL: 30}
+	s2 := &Service{ID: "service_2", Type: "_test._tcp", TTL: 30}
+	r := &record{Kind: "a", ID: "1", Value: json.RawMessage(`{}`)}
+
+	// a failed write discards the previous writes of the commit
+	err = storage.commit([]write{
+		{Op: writeAdd, ID: s1.ID, Service: s1},
+		{Op: writePutRecord, Record: r},
+		{Op: writeUpdate, ID: s2.ID, Service: s2},
+	})
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError for the update of a missing service, got: %v", err)
+	}
+	if _, err := storage.get(s1.ID); err == nil {
+		t.Fatal("Service of a failed commit was stored")
+	}
+	if _, err := storage.getRecord(r.Kind, r.ID); err == nil {
+		t.Fatal("Record of a failed commit was stored")
+	}
+	if total, _ := storage.total(); total != 0 {
+		t.Fatalf("Expected no services after a failed commit, got %d", total)
+	}
+
+	// the writes see the previous writes of the commit
+	updated := *s1
+	updated.Type = "_updated._tcp"
+	err = storage.commit([]write{
+		{Op: writeAdd, ID: s1.ID, Service: s1},
+		{Op: writeUpdate, ID: s1.ID, Service: &updated},
+		{Op: writeAdd, ID: s2.ID, Service: s2},
+		{Op: writeDelete, ID: s2.ID},
+		{Op: writePutRecord, Record: r},
+		{Op: writeDeleteRecord, Kind: "a", ID: "missing"},
+	})
+	if err != nil {
+		t.Fatal("Error committing:", err.Error())
+	}
+	s, err := storage.get(s1.ID)
+	if err != nil || s.Type != updated.Type {
+		t.Fatalf("Expected the updated service, got: %v %v", s, err)
+	}
+	if _, err := storage.get(s2.ID); err == nil {
+		t.Fatal("Deleted service was stored")
+	}
+	if total, _ := storage.total(); total != 1 {
+		t.Fatalf("Expected 1 service, got %d", total)
+	}
+	if _, err := storage.getRecord(r.Kind, r.ID); err != nil {
+		t.Fatal("Record was not stored:", err.Error())
+	}
+	for typ, n := range map[string]int{"_test._tcp": 0, "_updated._tcp": 1} {
+		ids, indexed, err := storage.lookup("type", utils.FOpEquals, typ)
+		if err != nil || !indexed || len(ids) != n {
+			t.Fatalf("Expected %d indexed services of type %s, got: %v %v", n, typ, ids, err)
+		}
+	}
+
+	err = storage.commit([]write{{Op: writeAdd, ID: s1.ID, Service: s1}})
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("Expected ConflictError for the addition of an existing service, got: %v", err)
+	}
+}
+
+func TestChangesAtomicBatch(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	err = controller.EnableChanges(ChangesConf{Size: 10})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the changes of a failed batch are not kept and their sequence numbers are not used
+	result := controller.batch(Batch{Operations: []BatchOperation{
+		{Op: BatchCreate, Service: &Service{ID: "service_1", Type: "_test._tcp", TTL: 30}},
+		{Op: BatchDelete, ID: "missing"},
+	}}, actor{})
+	if result.Failed != 2 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	list, err := controller.getChanges(0, MaxPerPage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if list.Last != 0 || len(list.Changes) != 0 {
+		t.Fatalf("Unexpected changes of a failed batch: %+v", list)
+	}
+
+	result = controller.batch(Batch{Operations: []BatchOperation{
+		{Op: BatchCreate, Service: &Service{ID: "service_1", Type: "_test._tcp", TTL: 30}},
+		{Op: BatchDelete, ID: "service_1"},
+		{Op: BatchCreate, Service: &Service{ID: "service_1", Type: "_test._tcp", TTL: 30}},
+	}}, actor{})
+	if result.Succeeded != 3 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	list, err = controller.getChanges(0, MaxPerPage)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if list.Last != 3 || len(list.Changes) != 3 {
+		t.Fatalf("Expected 3 changes, got: %+v", list)
+	}
+	for i, expected := range []string{EventAdded, EventDeleted, EventAdded} {
+		if c := list.Changes[i]; c.Seq != uint64(i+1) || c.Type != expected {
+			t.Fatalf("Unexpected change %d: %+v", i, c)
+		}
+	}
+}
+
+func TestChangesAppendError(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	err = controller.EnableChanges(ChangesConf{Size: 10})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a mutation is not committed without its change
+	err = controller.storage.putRecord(&record{Kind: recordKindSequence, ID: sequenceRecordID, Value: json.RawMessage(`"invalid"`)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = controller.add(Service{ID: "service_1", Type: "_test._tcp", TTL: 30}, actor{})
+	if err == nil {
+		t.Fatal("Expected an error for a change which cannot be stored")
+	}
+	if _, err := controller.get("service_1"); err == nil {
+		t.Fatal("Service was stored without its change")
+	}
+}
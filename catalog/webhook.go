@@ -0,0 +1,786 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/service-catalog/v3/utils"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Headers of the webhook deliveries
+const (
+	HeaderWebhookEvent    = "X-Webhook-Event"
+	HeaderWebhookDelivery = "X-Webhook-Delivery"
+	// HeaderWebhookSignature is the HMAC-SHA256 of the body with the secret of the subscription, as sha256=<hex>
+	HeaderWebhookSignature = "X-Webhook-Signature"
+)
+
+const (
+	recordKindSubscription = "subscription"
+	// recordKindSubscriptions is the kind of the record with the version of the subscriptions, which is written with every
+	// change of a subscription. The cached subscriptions are read again from the storage when the version changes.
+	recordKindSubscriptions = "subscriptions"
+	subscriptionsVersionID  = "version"
+
+	webhookDefaultAttempts    = 5
+	webhookDefaultBackoff     = 1   // seconds
+	webhookDefaultMaxBackoff  = 300 // seconds
+	webhookDefaultTimeout     = 10  // seconds
+	webhookDefaultQueueSize   = 1000
+	webhookDefaultDeadLetters = 100
+)
+
+// WebhookConf is the configuration of the delivery of events to the webhook subscriptions
+// Zero values are replaced by the defaults.
+type WebhookConf struct {
+	// Attempts is the number of delivery attempts before an event is moved to the dead letters (default 5)
+	Attempts int `json:"attempts"`
+	// Backoff is the delay in seconds before the first retry, doubled after each attempt (default 1)
+	Backoff uint `json:"backoff"`
+	// MaxBackoff is the maximum delay in seconds between attempts (default 300)
+	MaxBackoff uint `json:"maxBackoff"`
+	// Timeout is the timeout of a delivery attempt in seconds (default 10)
+	Timeout uint `json:"timeout"`
+	// QueueSize is the number of pending events per subscription (default 1000)
+	QueueSize int `json:"queueSize"`
+	// DeadLetters is the number of failed events kept per subscription (default 100)
+	DeadLetters int `json:"deadLetters"`
+}
+
+func (c WebhookConf) Validate() error {
+	if c.Attempts < 0 || c.QueueSize < 0 || c.DeadLetters < 0 {
+		return fmt.Errorf("webhooks: attempts, queueSize, and deadLetters must not be negative")
+	}
+	if c.MaxBackoff != 0 && c.MaxBackoff < c.Backoff {
+		return fmt.Errorf("webhooks: maxBackoff must not be less than backoff")
+	}
+	return nil
+}
+
+// Subscription is a webhook which receives the events of the matching services
+type Subscription struct {
+	ID string `json:"id"`
+	// URL receives the events as POST requests with a Delivery
+	URL string `json:"url"`
+	// Events are the types of events to deliver: added, updated, deleted, expired, or health. All if empty.
+	Events []string `json:"events,omitempty"`
+	// Filter selects the services similar to the Filter API. All if nil.
+	Filter *SubscriptionFilter `json:"filter,omitempty"`
+	// Secret is the key of the signatures. It is generated if not given and only returned on creation.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SubscriptionFilter selects the services with a value at the path matching the operation
+type SubscriptionFilter struct {
+	Path  string `json:"path"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// Delivery is the body of the requests to the subscriptions
+type Delivery struct {
+	ID           string    `json:"id"`
+	Subscription string    `json:"subscription"`
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	Service      Service   `json:"service"`
+}
+
+// DeadLetter is a delivery which failed after all attempts
+type DeadLetter struct {
+	Delivery
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// SubscriptionList is the list of subscriptions
+type SubscriptionList struct {
+	Subscriptions []Subscription `json:"subscriptions"`
+}
+
+// DeadLetterList is the list of dead letters of a subscription, from the oldest to the latest
+type DeadLetterList struct {
+	ID          string       `json:"id"`
+	DeadLetters []DeadLetter `json:"deadLetters"`
+}
+
+func (s *Subscription) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	for _, e := range s.Events {
+		switch e {
+		case EventAdded, EventUpdated, EventDeleted, EventExpired, EventHealthChanged:
+		default:
+			return fmt.Errorf("unknown event type: %s", e)
+		}
+	}
+	if s.Filter != nil {
+		if s.Filter.Path == "" {
+			return fmt.Errorf("filter path must be defined")
+		}
+		if err := utils.ValidateFilterOp(s.Filter.Op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Subscription) match(eventType string, service Service) bool {
+	if len(s.Events) > 0 {
+		var found bool
+		for _, e := range s.Events {
+			found = found || e == eventType
+		}
+		if !found {
+			return false
+		}
+	}
+	if s.Filter == nil {
+		return true
+	}
+	matched, err := utils.MatchObject(service, strings.Split(s.Filter.Path, "."), s.Filter.Op, s.Filter.Value)
+	if err != nil {
+		logger.Printf("Webhook: Error matching service %s for subscription %s: %s", service.ID, s.ID, err)
+		return false
+	}
+	return matched
+}
+
+// webhooks is a Listener which delivers the events to the subscriptions
+// The subscriptions are kept in the storage, which replicates them in a cluster. All nodes of a cluster are notified of
+// every change, of which only the leader delivers the events.
+// Each subscription has a queue which is delivered in order, retrying with an exponential backoff. The queues and the
+// dead letters are kept in memory on the delivering node.
+type webhooks struct {
+	conf       WebhookConf
+	storage    Storage
+	client     *http.Client
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	cacheLock sync.Mutex
+	cache     *subscriptionCache
+
+	sync.Mutex
+	queues map[string]*webhookQueue
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// subscriptionCache is the list of subscriptions at a version
+type subscriptionCache struct {
+	version       string
+	subscriptions []Subscription
+}
+
+// webhookQueue is the queue of pending deliveries of a subscription
+// The subscription and the dead letters are guarded by the lock of webhooks.
+type webhookQueue struct {
+	subscription Subscription
+	deliveries   chan Delivery
+	stop         chan struct{}
+	deadLetters  []DeadLetter
+}
+
+func newWebhooks(storage Storage, conf WebhookConf) *webhooks {
+	if conf.Attempts == 0 {
+		conf.Attempts = webhookDefaultAttempts
+	}
+	if conf.Backoff == 0 {
+		conf.Backoff = webhookDefaultBackoff
+	}
+	if conf.MaxBackoff == 0 {
+		conf.MaxBackoff = webhookDefaultMaxBackoff
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = webhookDefaultTimeout
+	}
+	if conf.QueueSize == 0 {
+		conf.QueueSize = webhookDefaultQueueSize
+	}
+	if conf.DeadLetters == 0 {
+		conf.DeadLetters = webhookDefaultDeadLetters
+	}
+	return &webhooks{
+		conf:       conf,
+		storage:    storage,
+		client:     &http.Client{Timeout: time.Duration(conf.Timeout) * time.Second},
+		backoff:    time.Duration(conf.Backoff) * time.Second,
+		maxBackoff: time.Duration(conf.MaxBackoff) * time.Second,
+		queues:     make(map[string]*webhookQueue),
+		done:       make(chan struct{}),
+	}
+}
+
+func (w *webhooks) subscriptions() ([]Subscription, error) {
+	records, err := w.storage.listRecords(recordKindSubscription)
+	if err != nil {
+		return nil, err
+	}
+	subscriptions := make([]Subscription, 0, len(records))
+	for _, r := range records {
+		var s Subscription
+		err := json.Unmarshal(r.Value, &s)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding subscription %s: %s", r.ID, err)
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, nil
+}
+
+// subscriptionsVersion returns the version of the subscriptions, which is empty if none was changed yet
+func (w *webhooks) subscriptionsVersion() (string, error) {
+	r, err := w.storage.getRecord(recordKindSubscriptions, subscriptionsVersionID)
+	if _, notFound := err.(*NotFoundError); notFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return string(r.Value), nil
+}
+
+// cachedSubscriptions returns the subscriptions, which are only read from the storage again after a change
+// The changes are committed on any node of a cluster, together with a new version of the subscriptions.
+func (w *webhooks) cachedSubscriptions() ([]Subscription, error) {
+	// read before the subscriptions, so that a change in between reads them again next time
+	version, err := w.subscriptionsVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	w.cacheLock.Lock()
+	defer w.cacheLock.Unlock()
+
+	if w.cache != nil && w.cache.version == version {
+		return w.cache.subscriptions, nil
+	}
+	subscriptions, err := w.subscriptions()
+	if err != nil {
+		return nil, err
+	}
+	w.cache = &subscriptionCache{version: version, subscriptions: subscriptions}
+	return subscriptions, nil
+}
+
+// commitSubscription writes the change of a subscription together with a new version of the subscriptions
+func (w *webhooks) commitSubscription(change write) error {
+	version, err := json.Marshal(uuid.NewV4().String())
+	if err != nil {
+		return err
+	}
+	return w.storage.commit([]write{
+		change,
+		{Op: writePutRecord, Record: &record{Kind: recordKindSubscriptions, ID: subscriptionsVersionID, Value: version}},
+	})
+}
+
+// dispatch queues the event for the matching subscriptions
+func (w *webhooks) dispatch(eventType string, s Service) {
+	if m, ok := w.storage.(clusterMember); ok && !m.isLeader() {
+		return
+	}
+	subscriptions, err := w.cachedSubscriptions()
+	if err != nil {
+		logger.Printf("Webhook: Error listing subscriptions: %s", err)
+		return
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+
+	current := make(map[string]bool, len(subscriptions))
+	for _, sub := range subscriptions {
+		current[sub.ID] = true
+		q := w.queue(sub)
+		if !sub.match(eventType, s) {
+			continue
+		}
+		d := Delivery{
+			ID:           uuid.NewV4().String(),
+			Subscription: sub.ID,
+			Type:         eventType,
+			Time:         time.Now().UTC(),
+			Service:      s,
+		}
+		select {
+		case q.deliveries <- d:
+		default:
+			w.deadLetter(q, d, 0, "queue is full")
+		}
+	}
+
+	// subscriptions may have been deleted through another node of a cluster
+	for id := range w.queues {
+		if !current[id] {
+			w.removeQueue(id)
+		}
+	}
+}
+
+// queue returns the queue of the subscription, starting it if needed. The caller must hold the lock.
+func (w *webhooks) queue(sub Subscription) *webhookQueue {
+	q, found := w.queues[sub.ID]
+	if !found {
+		q = &webhookQueue{
+			deliveries: make(chan Delivery, w.conf.QueueSize),
+			stop:       make(chan struct{}),
+		}
+		w.queues[sub.ID] = q
+		w.wg.Add(1)
+		go w.run(q)
+	}
+	q.subscription = sub
+	return q
+}
+
+// removeQueue stops the queue of a subscription and drops the pending deliveries. The caller must hold the lock.
+func (w *webhooks) removeQueue(id string) {
+	if q, found := w.queues[id]; found {
+		close(q.stop)
+		delete(w.queues, id)
+	}
+}
+
+// deadLetter keeps a failed delivery. The caller must hold the lock.
+func (w *webhooks) deadLetter(q *webhookQueue, d Delivery, attempts int, reason string) {
+	logger.Printf("Webhook: Giving up delivery %s to subscription %s after %d attempts: %s", d.ID, d.Subscription, attempts, reason)
+	q.deadLetters = append(q.deadLetters, DeadLetter{
+		Delivery: d,
+		Attempts: attempts,
+		Error:    reason,
+		FailedAt: time.Now().UTC(),
+	})
+	if len(q.deadLetters) > w.conf.DeadLetters {
+		q.deadLetters = append([]DeadLetter(nil), q.deadLetters[len(q.deadLetters)-w.conf.DeadLetters:]...)
+	}
+}
+
+func (w *webhooks) run(q *webhookQueue) {
+	defer w.wg.Done()
+	for {
+		select {
+		case d := <-q.deliveries:
+			w.deliver(q, d)
+		case <-q.stop:
+			return
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// deliver sends a delivery until it succeeds or the attempts are exhausted
+func (w *webhooks) deliver(q *webhookQueue, d Delivery) {
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		w.Lock()
+		sub := q.subscription
+		w.Unlock()
+
+		err := w.post(sub, d)
+		if err == nil {
+			logger.Debugf("Webhook: Delivered %s of service %s to subscription %s", d.Type, d.Service.ID, sub.ID)
+			return
+		}
+		if attempt >= w.conf.Attempts {
+			w.Lock()
+			w.deadLetter(q, d, attempt, err.Error())
+			w.Unlock()
+			return
+		}
+		logger.Printf("Webhook: Error delivering %s to subscription %s (attempt %d): %s", d.ID, sub.ID, attempt, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-q.stop:
+			return
+		case <-w.done:
+			return
+		}
+		backoff *= 2
+		if backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+func (w *webhooks) post(sub Subscription, d Delivery) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookEvent, d.Type)
+	req.Header.Set(HeaderWebhookDelivery, d.ID)
+	req.Header.Set(HeaderWebhookSignature, signWebhook(sub.Secret, b))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("subscriber responded with %s", res.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the signature of a delivery body
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhooks) stop() {
+	w.Lock()
+	close(w.done)
+	w.Unlock()
+	w.wg.Wait()
+}
+
+func (w *webhooks) added(s Service) {
+	w.dispatch(EventAdded, s)
+}
+
+func (w *webhooks) updated(s Service) {
+	w.dispatch(EventUpdated, s)
+}
+
+// renewed is not delivered as the service is not modified
+func (w *webhooks) renewed(s Service) {}
+
+func (w *webhooks) deleted(s Service) {
+	w.dispatch(EventDeleted, s)
+}
+
+func (w *webhooks) expired(s Service) {
+	w.dispatch(EventExpired, s)
+}
+
+func (w *webhooks) healthChanged(s Service) {
+	w.dispatch(EventHealthChanged, s)
+}
+
+// EnableWebhooks starts delivering events to the subscriptions in the storage
+func (c *Controller) EnableWebhooks(conf WebhookConf) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.webhooks = newWebhooks(c.storage, conf)
+	c.addListener(c.webhooks)
+}
+
+func (c *Controller) getWebhooks() (*webhooks, error) {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.webhooks == nil {
+		return nil, &NotFoundError{"Webhooks are not enabled"}
+	}
+	return c.webhooks, nil
+}
+
+// addSubscription stores a new subscription and returns it with its secret
+func (c *Controller) addSubscription(s Subscription) (*Subscription, error) {
+	w, err := c.getWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.validate(); err != nil {
+		return nil, &BadRequestError{err.Error()}
+	}
+
+	s.ID = uuid.NewV4().String()
+	s.CreatedAt = time.Now().UTC()
+	if s.Secret == "" {
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+		s.Secret = hex.EncodeToString(secret)
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	err = w.commitSubscription(write{Op: writePutRecord, Record: &record{Kind: recordKindSubscription, ID: s.ID, Value: b}})
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// getSubscription returns a subscription without its secret
+func (c *Controller) getSubscription(id string) (*Subscription, error) {
+	subscriptions, err := c.listSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range subscriptions {
+		if s.ID == id {
+			return &s, nil
+		}
+	}
+	return nil, &NotFoundError{fmt.Sprintf("Subscription with id %s is not found", id)}
+}
+
+// listSubscriptions returns the subscriptions without their secrets
+func (c *Controller) listSubscriptions() ([]Subscription, error) {
+	w, err := c.getWebhooks()
+	if err != nil {
+		return nil, err
+	}
+	subscriptions, err := w.subscriptions()
+	if err != nil {
+		return nil, err
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	return subscriptions, nil
+}
+
+// deleteSubscription removes a subscription and drops its pending deliveries
+func (c *Controller) deleteSubscription(id string) error {
+	w, err := c.getWebhooks()
+	if err != nil {
+		return err
+	}
+	_, err = w.storage.getRecord(recordKindSubscription, id)
+	if err != nil {
+		if _, ok := err.(*NotFoundError); ok {
+			return &NotFoundError{fmt.Sprintf("Subscription with id %s is not found", id)}
+		}
+		return err
+	}
+	err = w.commitSubscription(write{Op: writeDeleteRecord, Kind: recordKindSubscription, ID: id})
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	w.removeQueue(id)
+	w.Unlock()
+	return nil
+}
+
+// getDeadLetters returns the failed deliveries of a subscription on this node
+func (c *Controller) getDeadLetters(id string) (*DeadLetterList, error) {
+	_, err := c.getSubscription(id)
+	if err != nil {
+		return nil, err
+	}
+	w, err := c.getWebhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	list := DeadLetterList{ID: id, DeadLetters: []DeadLetter{}}
+	if q, found := w.queues[id]; found {
+		list.DeadLetters = append(list.DeadLetters, q.deadLetters...)
+	}
+	return &list, nil
+}
+
+// clearDeadLetters removes the failed deliveries of a subscription on this node
+func (c *Controller) clearDeadLetters(id string) error {
+	_, err := c.getSubscription(id)
+	if err != nil {
+		return err
+	}
+	w, err := c.getWebhooks()
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	if q, found := w.queues[id]; found {
+		q.deadLetters = nil
+	}
+	w.Unlock()
+	return nil
+}
+
+// PostSubscription creates a webhook subscription
+func (a *HttpAPI) PostSubscription(w http.ResponseWriter, req *http.Request) {
+	if !a.authorizeSubscriptions(w, req) {
+		return
+	}
+
+	var s Subscription
+	err := json.NewDecoder(req.Body).Decode(&s)
+	if err != nil {
+		a.ErrorResponse(w, http.StatusBadRequest, "Error processing the request:", err.Error())
+		return
+	}
+	if s.ID != "" {
+		a.ErrorResponse(w, http.StatusBadRequest, "Creating a subscription with defined ID is not possible using a POST request.")
+		return
+	}
+
+	added, err := a.controller.addSubscription(s)
+	if err != nil {
+		switch err.(type) {
+		case *NotFoundError:
+			a.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		case *BadRequestError:
+			a.ErrorResponse(w, http.StatusBadRequest, "Invalid subscription:", err.Error())
+			return
+		default:
+			a.ErrorResponse(w, http.StatusInternalServerError, "Error creating the subscription:", err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	w.Header().Set("Location", fmt.Sprintf("%s/subscriptions/%s", NamespacePath(a.namespace), added.ID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(added)
+}
+
+// ListSubscriptions lists the webhook subscriptions
+func (a *HttpAPI) ListSubscriptions(w http.ResponseWriter, req *http.Request) {
+	if !a.authorizeSubscriptions(w, req) {
+		return
+	}
+
+	subscriptions, err := a.controller.listSubscriptions()
+	if err != nil {
+		a.subscriptionErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(SubscriptionList{Subscriptions: subscriptions})
+}
+
+// GetSubscription retrieves a webhook subscription
+func (a *HttpAPI) GetSubscription(w http.ResponseWriter, req *http.Request) {
+	if !a.authorizeSubscriptions(w, req) {
+		return
+	}
+
+	params := mux.Vars(req)
+
+	s, err := a.controller.getSubscription(params["sid"])
+	if err != nil {
+		a.subscriptionErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(s)
+}
+
+// DeleteSubscription removes a webhook subscription
+func (a *HttpAPI) DeleteSubscription(w http.ResponseWriter, req *http.Request) {
+	if !a.authorizeSubscriptions(w, req) {
+		return
+	}
+
+	params := mux.Vars(req)
+
+	err := a.controller.deleteSubscription(params["sid"])
+	if err != nil {
+		a.subscriptionErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeadLetters lists the failed deliveries of a webhook subscription
+func (a *HttpAPI) DeadLetters(w http.ResponseWriter, req *http.Request) {
+	if !a.authorizeSubscriptions(w, req) {
+		return
+	}
+
+	params := mux.Vars(req)
+
+	list, err := a.controller.getDeadLetters(params["sid"])
+	if err != nil {
+		a.subscriptionErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	json.NewEncoder(w).Encode(list)
+}
+
+// ClearDeadLetters removes the failed deliveries of a webhook subscription
+func (a *HttpAPI) ClearDeadLetters(w http.ResponseWriter, req *http.Request) {
+	if !a.authorizeSubscriptions(w, req) {
+		return
+	}
+
+	params := mux.Vars(req)
+
+	err := a.controller.clearDeadLetters(params["sid"])
+	if err != nil {
+		a.subscriptionErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;version="+a.version)
+	w.WriteHeader(http.StatusOK)
+}
+
+// authorizeSubscriptions responds with 401 Unauthorized unless the request has the admin token, if tokens are enabled
+// The subscriptions receive the events of all services.
+func (a *HttpAPI) authorizeSubscriptions(w http.ResponseWriter, req *http.Request) bool {
+	if err := a.controller.authorizeAdminToken(requestActor(req)); err != nil {
+		a.ErrorResponse(w, http.StatusUnauthorized, err.Error())
+		return false
+	}
+	return true
+}
+
+func (a *HttpAPI) subscriptionErrorResponse(w http.ResponseWriter, err error) {
+	switch err.(type) {
+	case *NotFoundError:
+		a.ErrorResponse(w, http.StatusNotFound, err.Error())
+	default:
+		a.ErrorResponse(w, http.StatusInternalServerError, "Error processing the subscription:", err.Error())
+	}
+}
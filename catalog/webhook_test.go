@@ -0,0 +1,203 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package catalog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	controller.EnableWebhooks(WebhookConf{Attempts: 2})
+	controller.webhooks.backoff = 10 * time.Millisecond
+
+	// the receiver fails the first attempt
+	type received struct {
+		delivery  Delivery
+		signature string
+	}
+	deliveries := make(chan received, 10)
+	var attempts int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := ioutil.ReadAll(req.Body)
+		var d Delivery
+		json.Unmarshal(b, &d)
+		if req.Header.Get(HeaderWebhookSignature) != signWebhook("secret", b) {
+			t.Errorf("Invalid signature: %s", req.Header.Get(HeaderWebhookSignature))
+		}
+		deliveries <- received{d, req.Header.Get(HeaderWebhookEvent)}
+	}))
+	defer receiver.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	_, err = controller.addSubscription(Subscription{URL: "ftp://host"})
+	if _, ok := err.(*BadRequestError); !ok {
+		t.Fatalf("Expected BadRequestError for an invalid URL, got: %v", err)
+	}
+	sub, err := controller.addSubscription(Subscription{
+		URL:    receiver.URL,
+		Events: []string{EventAdded, EventDeleted},
+		Filter: &SubscriptionFilter{Path: "type", Op: "equals", Value: "_hook._tcp"},
+		Secret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	deadSub, err := controller.addSubscription(Subscription{URL: failing.URL})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if deadSub.Secret == "" {
+		t.Fatal("Secret should be generated")
+	}
+
+	// subscriptions are stored without exposing the secrets
+	subscriptions, err := controller.listSubscriptions()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(subscriptions) != 2 || subscriptions[0].Secret != "" {
+		t.Fatalf("Unexpected subscriptions: %+v", subscriptions)
+	}
+	records, _ := controller.storage.listRecords(recordKindSubscription)
+	if len(records) != 2 {
+		t.Fatalf("Subscriptions are not stored: %v", records)
+	}
+
+	_, err = controller.add(Service{ID: "other", Type: "_other._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := controller.add(Service{ID: "hooked", Type: "_hook._tcp", TTL: 30}, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = controller.update(s.ID, *s, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	time.Sleep(10 * time.Millisecond)
+	err = controller.delete(s.ID, actor{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the added event is retried, the updated event and the other service are not subscribed
+	for _, expected := range []string{EventAdded, EventDeleted} {
+		select {
+		case r := <-deliveries:
+			if r.delivery.Type != expected || r.signature != expected || r.delivery.Service.ID != s.ID || r.delivery.Subscription != sub.ID {
+				t.Fatalf("Unexpected delivery: %+v", r)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for the %s delivery", expected)
+		}
+	}
+	select {
+	case r := <-deliveries:
+		t.Fatalf("Unexpected delivery: %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// all events of the failing subscription end up in the dead letters
+	var list *DeadLetterList
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		list, err = controller.getDeadLetters(deadSub.ID)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(list.DeadLetters) == 4 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if len(list.DeadLetters) != 4 || list.DeadLetters[0].Attempts != 2 || list.DeadLetters[0].Error == "" {
+		t.Fatalf("Unexpected dead letters: %+v", list.DeadLetters)
+	}
+	err = controller.clearDeadLetters(deadSub.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	list, _ = controller.getDeadLetters(deadSub.ID)
+	if len(list.DeadLetters) != 0 {
+		t.Fatalf("Dead letters are not cleared: %+v", list.DeadLetters)
+	}
+
+	err = controller.deleteSubscription(deadSub.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = controller.getSubscription(deadSub.ID)
+	if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError for a deleted subscription, got: %v", err)
+	}
+}
+
+func TestWebhookSubscriptionCache(t *testing.T) {
+	controller, shutdown, err := setup()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer shutdown()
+	controller.EnableWebhooks(WebhookConf{})
+	w := controller.webhooks
+
+	sub, err := controller.addSubscription(Subscription{URL: "http://localhost:1/hook"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	subscriptions, err := w.cachedSubscriptions()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(subscriptions) != 1 || subscriptions[0].ID != sub.ID {
+		t.Fatalf("Unexpected subscriptions: %+v", subscriptions)
+	}
+
+	// records written without a new version are not read again
+	b, _ := json.Marshal(Subscription{ID: "unversioned", URL: "http://localhost:1/hook"})
+	err = controller.storage.putRecord(&record{Kind: recordKindSubscription, ID: "unversioned", Value: b})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if subscriptions, _ := w.cachedSubscriptions(); len(subscriptions) != 1 {
+		t.Fatalf("Expected the cached subscriptions, got: %+v", subscriptions)
+	}
+
+	// changes committed elsewhere, e.g. on another node of a cluster, are read again
+	b, _ = json.Marshal(Subscription{ID: "other", URL: "http://localhost:1/hook"})
+	err = newWebhooks(controller.storage, WebhookConf{}).commitSubscription(write{Op: writePutRecord, Record: &record{Kind: recordKindSubscription, ID: "other", Value: b}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if subscriptions, _ := w.cachedSubscriptions(); len(subscriptions) != 3 {
+		t.Fatalf("Expected the changed subscriptions, got: %+v", subscriptions)
+	}
+
+	err = controller.deleteSubscription(sub.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if subscriptions, _ := w.cachedSubscriptions(); len(subscriptions) != 2 {
+		t.Fatalf("Expected the subscriptions after the deletion, got: %+v", subscriptions)
+	}
+	if err := controller.deleteSubscription(sub.ID); err == nil {
+		t.Fatal("Expected an error when deleting a missing subscription")
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 
 	"github.com/linksmart/go-sec/auth/obtainer"
 	"github.com/linksmart/service-catalog/v3/catalog"
@@ -15,9 +17,12 @@ import (
 )
 
 // HTTPClient is the http client struct
+// It keeps the registration tokens of the services it creates and sends them with later modifications.
 type HTTPClient struct {
 	serverEndpoint *url.URL
 	ticket         *obtainer.Client
+	tokens         map[string]string
+	tokensLock     sync.RWMutex
 }
 
 // FilterArgs are the filtering arguments
@@ -36,9 +41,41 @@ func NewHTTPClient(serverEndpoint string, ticket *obtainer.Client) (*HTTPClient,
 	return &HTTPClient{
 		serverEndpoint: endpointUrl,
 		ticket:         ticket,
+		tokens:         make(map[string]string),
 	}, nil
 }
 
+// SetToken sets the registration token which is sent with the modifications of a service, e.g. one returned to another client
+func (c *HTTPClient) SetToken(id, token string) {
+	c.tokensLock.Lock()
+	defer c.tokensLock.Unlock()
+	if token == "" {
+		delete(c.tokens, id)
+		return
+	}
+	c.tokens[id] = token
+}
+
+// Token returns the registration token of a service, or an empty string if the token is unknown
+func (c *HTTPClient) Token(id string) string {
+	c.tokensLock.RLock()
+	defer c.tokensLock.RUnlock()
+	return c.tokens[id]
+}
+
+// withToken adds the registration token of a service, if known, to the headers
+func (c *HTTPClient) withToken(id string, headers map[string][]string) map[string][]string {
+	token := c.Token(id)
+	if token == "" {
+		return headers
+	}
+	withToken := map[string][]string{catalog.RegistrationTokenHeader: {token}}
+	for k, v := range headers {
+		withToken[k] = v
+	}
+	return withToken
+}
+
 // Ping returns true if health endpoint responds OK
 func (c *HTTPClient) Ping() (bool, error) {
 	res, err := utils.HTTPRequest("GET",
@@ -59,29 +96,56 @@ func (c *HTTPClient) Ping() (bool, error) {
 	}
 }
 
+// CatalogID returns the id of the catalog
+func (c *HTTPClient) CatalogID() (string, error) {
+	query := url.Values{}
+	query.Set(utils.GetParamPage, "1")
+	query.Set(utils.GetParamPerPage, "1")
+
+	coll, err := c.getCollection(query, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return coll.ID, nil
+}
+
 // Get gets a service
 func (c *HTTPClient) Get(id string) (*catalog.Service, error) {
+	s, _, err := c.get(id, nil)
+	return s, err
+}
+
+// GetIfNoneMatch gets a service unless its entity tag matches the given one, e.g. of a cached service
+// It returns false and no service if the service is not modified.
+func (c *HTTPClient) GetIfNoneMatch(id, etag string) (*catalog.Service, bool, error) {
+	return c.get(id, map[string][]string{"If-None-Match": {etag}})
+}
+
+func (c *HTTPClient) get(id string, headers map[string][]string) (*catalog.Service, bool, error) {
 	res, err := utils.HTTPRequest("GET",
 		fmt.Sprintf("%v/%v", c.serverEndpoint, id),
-		nil,
+		headers,
 		nil,
 		c.ticket,
 	)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer res.Body.Close()
 
 	switch res.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
 	case http.StatusBadRequest:
-		return nil, &catalog.BadRequestError{ErrorMsg(res)}
+		return nil, false, &catalog.BadRequestError{Msg: ErrorMsg(res)}
 	case http.StatusConflict:
-		return nil, &catalog.ConflictError{ErrorMsg(res)}
+		return nil, false, &catalog.ConflictError{Msg: ErrorMsg(res)}
 	case http.StatusNotFound:
-		return nil, &catalog.NotFoundError{ErrorMsg(res)}
+		return nil, false, &catalog.NotFoundError{Msg: ErrorMsg(res)}
 	default:
 		if res.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf(ErrorMsg(res))
+			return nil, false, fmt.Errorf(ErrorMsg(res))
 		}
 	}
 
@@ -89,10 +153,10 @@ func (c *HTTPClient) Get(id string) (*catalog.Service, error) {
 	var s *catalog.Service
 	err = decoder.Decode(&s)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return s, nil
+	return s, true, nil
 }
 
 // Post posts a service
@@ -119,11 +183,11 @@ func (c *HTTPClient) Post(service *catalog.Service) (*catalog.Service, error) {
 
 	switch res.StatusCode {
 	case http.StatusBadRequest:
-		return nil, &catalog.BadRequestError{ErrorMsg(res)}
+		return nil, &catalog.BadRequestError{Msg: ErrorMsg(res)}
 	case http.StatusConflict:
-		return nil, &catalog.ConflictError{ErrorMsg(res)}
+		return nil, &catalog.ConflictError{Msg: ErrorMsg(res)}
 	case http.StatusNotFound:
-		return nil, &catalog.NotFoundError{ErrorMsg(res)}
+		return nil, &catalog.NotFoundError{Msg: ErrorMsg(res)}
 	default:
 		if res.StatusCode != http.StatusCreated {
 			return nil, fmt.Errorf(ErrorMsg(res))
@@ -136,12 +200,23 @@ func (c *HTTPClient) Post(service *catalog.Service) (*catalog.Service, error) {
 	if err != nil {
 		return nil, err
 	}
+	c.SetToken(s.ID, s.Token)
 
 	return s, nil
 }
 
 // Put puts a service
 func (c *HTTPClient) Put(service *catalog.Service) (*catalog.Service, error) {
+	return c.put(service, map[string][]string{"Content-Type": {"application/ld+json"}})
+}
+
+// PutIfMatch updates a service if its entity tag matches the given one, e.g. of a previously retrieved service
+// It returns a catalog.PreconditionFailedError if the service is modified or removed in between.
+func (c *HTTPClient) PutIfMatch(service *catalog.Service, etag string) (*catalog.Service, error) {
+	return c.put(service, map[string][]string{"Content-Type": {"application/ld+json"}, "If-Match": {etag}})
+}
+
+func (c *HTTPClient) put(service *catalog.Service, headers map[string][]string) (*catalog.Service, error) {
 	if service.ID == "" {
 		return nil, fmt.Errorf("cannot PUT a service without ID")
 	}
@@ -149,7 +224,7 @@ func (c *HTTPClient) Put(service *catalog.Service) (*catalog.Service, error) {
 	b, _ := json.Marshal(service)
 	res, err := utils.HTTPRequest("PUT",
 		fmt.Sprintf("%v/%v", c.serverEndpoint, service.ID),
-		map[string][]string{"Content-Type": {"application/ld+json"}},
+		c.withToken(service.ID, headers),
 		bytes.NewReader(b),
 		c.ticket,
 	)
@@ -160,17 +235,150 @@ func (c *HTTPClient) Put(service *catalog.Service) (*catalog.Service, error) {
 
 	switch res.StatusCode {
 	case http.StatusBadRequest:
-		return nil, &catalog.BadRequestError{ErrorMsg(res)}
+		return nil, &catalog.BadRequestError{Msg: ErrorMsg(res)}
 	case http.StatusConflict:
-		return nil, &catalog.ConflictError{ErrorMsg(res)}
+		return nil, &catalog.ConflictError{Msg: ErrorMsg(res)}
 	case http.StatusNotFound:
-		return nil, &catalog.NotFoundError{ErrorMsg(res)}
+		return nil, &catalog.NotFoundError{Msg: ErrorMsg(res)}
+	case http.StatusPreconditionFailed:
+		return nil, &catalog.PreconditionFailedError{Msg: ErrorMsg(res)}
+	case http.StatusForbidden:
+		return nil, &catalog.ForbiddenError{Msg: ErrorMsg(res)}
 	default:
 		if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
 			return nil, fmt.Errorf(ErrorMsg(res))
 		}
 	}
 
+	decoder := json.NewDecoder(res.Body)
+	var s *catalog.Service
+	err = decoder.Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusCreated {
+		// the service was created again, e.g. after expiry, with a new token
+		c.SetToken(s.ID, s.Token)
+	}
+
+	return s, nil
+}
+
+// Patch modifies a service with a patch document of the given media type
+// The media type is either catalog.MergePatchMediaType or catalog.JSONPatchMediaType.
+// The patch is encoded in JSON, e.g. a map for a merge patch or a slice of operations for a JSON Patch.
+// Pre-encoded documents can be passed as json.RawMessage.
+func (c *HTTPClient) Patch(id, mediaType string, patch interface{}) (*catalog.Service, error) {
+	b, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding the patch: %s", err)
+	}
+	res, err := utils.HTTPRequest("PATCH",
+		fmt.Sprintf("%v/%v", c.serverEndpoint, id),
+		c.withToken(id, map[string][]string{"Content-Type": {mediaType}}),
+		bytes.NewReader(b),
+		c.ticket,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusBadRequest:
+		return nil, &catalog.BadRequestError{Msg: ErrorMsg(res)}
+	case http.StatusConflict:
+		return nil, &catalog.ConflictError{Msg: ErrorMsg(res)}
+	case http.StatusNotFound:
+		return nil, &catalog.NotFoundError{Msg: ErrorMsg(res)}
+	case http.StatusPreconditionFailed:
+		return nil, &catalog.PreconditionFailedError{Msg: ErrorMsg(res)}
+	case http.StatusForbidden:
+		return nil, &catalog.ForbiddenError{Msg: ErrorMsg(res)}
+	default:
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf(ErrorMsg(res))
+		}
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	var s *catalog.Service
+	err = decoder.Decode(&s)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Renew extends the expiry of a service without sending the registration
+func (c *HTTPClient) Renew(id string) (*catalog.Renewal, error) {
+	res, err := utils.HTTPRequest("POST",
+		fmt.Sprintf("%v/%v/renew", c.serverEndpoint, id),
+		c.withToken(id, nil),
+		nil,
+		c.ticket,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusBadRequest:
+		return nil, &catalog.BadRequestError{Msg: ErrorMsg(res)}
+	case http.StatusConflict:
+		return nil, &catalog.ConflictError{Msg: ErrorMsg(res)}
+	case http.StatusNotFound:
+		return nil, &catalog.NotFoundError{Msg: ErrorMsg(res)}
+	case http.StatusForbidden:
+		return nil, &catalog.ForbiddenError{Msg: ErrorMsg(res)}
+	default:
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf(ErrorMsg(res))
+		}
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	var renewal *catalog.Renewal
+	err = decoder.Decode(&renewal)
+	if err != nil {
+		return nil, err
+	}
+
+	return renewal, nil
+}
+
+// TransferOwnership sets the owner of a service
+// It returns a catalog.ForbiddenError unless the client is authenticated as the current owner or an admin.
+func (c *HTTPClient) TransferOwnership(id string, owner catalog.Owner) (*catalog.Service, error) {
+	b, _ := json.Marshal(owner)
+	res, err := utils.HTTPRequest("PUT",
+		fmt.Sprintf("%v/%v/owner", c.serverEndpoint, id),
+		c.withToken(id, nil),
+		bytes.NewReader(b),
+		c.ticket,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusBadRequest:
+		return nil, &catalog.BadRequestError{Msg: ErrorMsg(res)}
+	case http.StatusConflict:
+		return nil, &catalog.ConflictError{Msg: ErrorMsg(res)}
+	case http.StatusNotFound:
+		return nil, &catalog.NotFoundError{Msg: ErrorMsg(res)}
+	case http.StatusForbidden:
+		return nil, &catalog.ForbiddenError{Msg: ErrorMsg(res)}
+	default:
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf(ErrorMsg(res))
+		}
+	}
+
 	decoder := json.NewDecoder(res.Body)
 	var s *catalog.Service
 	err = decoder.Decode(&s)
@@ -183,9 +391,19 @@ func (c *HTTPClient) Put(service *catalog.Service) (*catalog.Service, error) {
 
 // Delete deletes a service
 func (c *HTTPClient) Delete(id string) error {
+	return c.delete(id, nil)
+}
+
+// DeleteIfMatch deletes a service if its entity tag matches the given one, e.g. of a previously retrieved service
+// It returns a catalog.PreconditionFailedError if the service is modified or removed in between.
+func (c *HTTPClient) DeleteIfMatch(id, etag string) error {
+	return c.delete(id, map[string][]string{"If-Match": {etag}})
+}
+
+func (c *HTTPClient) delete(id string, headers map[string][]string) error {
 	res, err := utils.HTTPRequest("DELETE",
 		fmt.Sprintf("%v/%v", c.serverEndpoint, id),
-		nil,
+		c.withToken(id, headers),
 		bytes.NewReader([]byte{}),
 		c.ticket,
 	)
@@ -196,56 +414,159 @@ func (c *HTTPClient) Delete(id string) error {
 
 	switch res.StatusCode {
 	case http.StatusBadRequest:
-		return &catalog.BadRequestError{ErrorMsg(res)}
+		return &catalog.BadRequestError{Msg: ErrorMsg(res)}
 	case http.StatusConflict:
-		return &catalog.ConflictError{ErrorMsg(res)}
+		return &catalog.ConflictError{Msg: ErrorMsg(res)}
 	case http.StatusNotFound:
-		return &catalog.NotFoundError{ErrorMsg(res)}
+		return &catalog.NotFoundError{Msg: ErrorMsg(res)}
+	case http.StatusPreconditionFailed:
+		return &catalog.PreconditionFailedError{Msg: ErrorMsg(res)}
+	case http.StatusForbidden:
+		return &catalog.ForbiddenError{Msg: ErrorMsg(res)}
 	default:
 		if res.StatusCode != http.StatusOK {
 			return fmt.Errorf(ErrorMsg(res))
 		}
 	}
+	c.SetToken(id, "")
 
 	return nil
 }
 
-// GetMany retrieves a page from the service collection
-func (c *HTTPClient) GetMany(page, perPage int, filter *FilterArgs) ([]catalog.Service, int, error) {
-	var err error
-	var res *http.Response
-	if filter == nil {
-		res, err = utils.HTTPRequest("GET",
-			fmt.Sprintf("%v?%v=%v&%v=%v",
-				c.serverEndpoint, utils.GetParamPage, page, utils.GetParamPerPage, perPage),
-			nil,
-			nil,
-			c.ticket,
-		)
-	} else {
-		res, err = utils.HTTPRequest("GET",
-			fmt.Sprintf("%v/%v/%v/%v?%v=%v&%v=%v",
-				c.serverEndpoint, filter.Path, filter.Op, filter.Value, utils.GetParamPage, page, utils.GetParamPerPage, perPage),
-			nil,
-			nil,
-			c.ticket,
-		)
+// Batch applies a list of create, update, and delete operations
+// The result has the status of each operation. In atomic mode, none of the operations are applied if any of them fails.
+func (c *HTTPClient) Batch(batch catalog.Batch) (*catalog.BatchResult, error) {
+	// send the known registration tokens with the operations
+	operations := make([]catalog.BatchOperation, len(batch.Operations))
+	for i, op := range batch.Operations {
+		if op.Token == "" {
+			id := op.ID
+			if id == "" && op.Service != nil {
+				id = op.Service.ID
+			}
+			op.Token = c.Token(id)
+		}
+		operations[i] = op
+	}
+	batch.Operations = operations
+
+	b, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := utils.HTTPRequest("POST",
+		c.serverEndpoint.String()+"/batch",
+		map[string][]string{"Content-Type": {"application/json"}},
+		bytes.NewReader(b),
+		c.ticket,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusBadRequest:
+		return nil, &catalog.BadRequestError{Msg: ErrorMsg(res)}
+	default:
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf(ErrorMsg(res))
+		}
 	}
+
+	decoder := json.NewDecoder(res.Body)
+	var result *catalog.BatchResult
+	err = decoder.Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range result.Results {
+		switch {
+		case r.Status == http.StatusCreated && r.Service != nil:
+			c.SetToken(r.ID, r.Service.Token)
+		case r.Status == http.StatusOK && r.Op == catalog.BatchDelete:
+			c.SetToken(r.ID, "")
+		}
+	}
+
+	return result, nil
+}
+
+// GetMany retrieves a page from the service collection and the total number of services
+// Pages may skip or repeat services which are added or removed meanwhile. GetAll traverses the collection consistently.
+func (c *HTTPClient) GetMany(page, perPage int, filter *FilterArgs) ([]catalog.Service, int, error) {
+	query := url.Values{}
+	query.Set(utils.GetParamPage, strconv.Itoa(page))
+	query.Set(utils.GetParamPerPage, strconv.Itoa(perPage))
+
+	coll, err := c.getCollection(query, filter)
 	if err != nil {
 		return nil, 0, err
 	}
+
+	return coll.Services, coll.Total, nil
+}
+
+// GetManyCursor retrieves the page after the given cursor from the service collection
+// An empty cursor retrieves the first page. The returned cursor is empty after the last page.
+func (c *HTTPClient) GetManyCursor(cursor string, perPage int, filter *FilterArgs) ([]catalog.Service, string, error) {
+	query := url.Values{}
+	query.Set(utils.GetParamCursor, cursor)
+	query.Set(utils.GetParamPerPage, strconv.Itoa(perPage))
+
+	coll, err := c.getCollection(query, filter)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return coll.Services, coll.Next, nil
+}
+
+// GetAll retrieves the whole service collection by following the pagination cursors
+func (c *HTTPClient) GetAll(filter *FilterArgs) ([]catalog.Service, error) {
+	var services []catalog.Service
+	for cursor := ""; ; {
+		page, next, err := c.GetManyCursor(cursor, catalog.MaxPerPage, filter)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, page...)
+
+		if next == "" {
+			return services, nil
+		}
+		cursor = next
+	}
+}
+
+func (c *HTTPClient) getCollection(query url.Values, filter *FilterArgs) (*catalog.Collection, error) {
+	endpoint := c.serverEndpoint.String()
+	if filter != nil {
+		endpoint = fmt.Sprintf("%v/%v/%v/%v", c.serverEndpoint, filter.Path, filter.Op, filter.Value)
+	}
+
+	res, err := utils.HTTPRequest("GET",
+		fmt.Sprintf("%v?%v", endpoint, query.Encode()),
+		nil,
+		nil,
+		c.ticket,
+	)
+	if err != nil {
+		return nil, err
+	}
 	defer res.Body.Close()
 
 	switch res.StatusCode {
 	case http.StatusBadRequest:
-		return nil, 0, &catalog.BadRequestError{ErrorMsg(res)}
+		return nil, &catalog.BadRequestError{Msg: ErrorMsg(res)}
 	case http.StatusConflict:
-		return nil, 0, &catalog.ConflictError{ErrorMsg(res)}
+		return nil, &catalog.ConflictError{Msg: ErrorMsg(res)}
 	case http.StatusNotFound:
-		return nil, 0, &catalog.NotFoundError{ErrorMsg(res)}
+		return nil, &catalog.NotFoundError{Msg: ErrorMsg(res)}
 	default:
 		if res.StatusCode != http.StatusOK {
-			return nil, 0, fmt.Errorf(ErrorMsg(res))
+			return nil, fmt.Errorf(ErrorMsg(res))
 		}
 	}
 
@@ -253,10 +574,10 @@ func (c *HTTPClient) GetMany(page, perPage int, filter *FilterArgs) ([]catalog.S
 	var coll catalog.Collection
 	err = decoder.Decode(&coll)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	return coll.Services, len(coll.Services), nil
+	return &coll, nil
 }
 
 // ErrorMsg extracts the message field of a resource.Error response
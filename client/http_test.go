@@ -0,0 +1,91 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package client
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/service-catalog/v3/catalog"
+)
+
+func setupServer(t *testing.T) (*httptest.Server, func()) {
+	controller, err := catalog.NewController(catalog.NewMemoryStorage(), catalog.ControllerConf{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	api := catalog.NewHTTPAPI(controller, "test", "Test catalog", "MAJOR.MINOR.PATCH")
+
+	r := mux.NewRouter().StrictSlash(true)
+	r.Methods("GET").Path("/").HandlerFunc(api.List)
+	r.Methods("PUT").Path("/{id:[^/]+/?[^/]*}").HandlerFunc(api.Put)
+	r.Methods("GET").Path("/{path}/{op}/{value:.*}").HandlerFunc(api.Filter)
+	ts := httptest.NewServer(r)
+
+	return ts, func() {
+		ts.Close()
+		controller.Stop()
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	ts, shutdown := setupServer(t)
+	defer shutdown()
+
+	client, err := NewHTTPClient(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	const n = 5
+	for i := 0; i < n; i++ {
+		serviceType := "_test._tcp"
+		if i%2 == 1 {
+			serviceType = "_other._tcp"
+		}
+		_, err := client.Put(&catalog.Service{ID: fmt.Sprintf("service_%d", i), Type: serviceType, TTL: 30})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// the total is the number of services in the catalog, not in the page
+	services, total, err := client.GetMany(2, 2, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(services) != 2 || total != n {
+		t.Fatalf("Expected 2 of %d services, got %d of %d", n, len(services), total)
+	}
+	services, total, err = client.GetMany(1, 2, &FilterArgs{Path: "type", Op: "equals", Value: "_test._tcp"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(services) != 2 || total != 3 {
+		t.Fatalf("Expected 2 of 3 filtered services, got %d of %d", len(services), total)
+	}
+
+	// the cursors are followed until the last page
+	all, err := client.GetAll(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(all) != n {
+		t.Fatalf("Expected %d services, got %d", n, len(all))
+	}
+	page, next, err := client.GetManyCursor("", 3, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(page) != 3 || next == "" {
+		t.Fatalf("Expected 3 services and a cursor, got %d and %q", len(page), next)
+	}
+	page, next, err = client.GetManyCursor(next, 3, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(page) != 2 || next != "" || page[0].ID != "service_3" {
+		t.Fatalf("Expected the last 2 services without a cursor, got %+v and %q", page, next)
+	}
+}
@@ -12,6 +12,7 @@ import (
 )
 
 // RegisterService registers service into a catalog
+// The returned service has the registration token if it is created and the catalog issues tokens.
 func RegisterService(endpoint string, service catalog.Service, ticket *obtainer.Client) (*catalog.Service, error) {
 	// Configure client
 	client, err := NewHTTPClient(endpoint, ticket)
@@ -28,12 +29,14 @@ func RegisterService(endpoint string, service catalog.Service, ticket *obtainer.
 }
 
 // UnregisterService removes service from a catalog
+// The registration token of the service, e.g. as returned by RegisterService, is sent if set.
 func UnregisterService(endpoint string, service catalog.Service, ticket *obtainer.Client) error {
 	// Configure client
 	client, err := NewHTTPClient(endpoint, ticket)
 	if err != nil {
 		return fmt.Errorf("error creating HTTP client: %s", err)
 	}
+	client.SetToken(service.ID, service.Token)
 
 	err = client.Delete(service.ID)
 	if err != nil {
@@ -43,29 +46,46 @@ func UnregisterService(endpoint string, service catalog.Service, ticket *obtaine
 	return nil
 }
 
-// RegisterServiceAndKeepalive registers a service into a catalog and continuously updates it in order to avoid expiry
+// RegisterServiceAndKeepalive registers a service into a catalog and continuously renews it in order to avoid expiry
 // endpoint: catalog endpoint.
 // service: service registration
 // ticket: set to nil for no auth
+// The registration is sent again if it is updated or no longer exists in the catalog, e.g. after expiry.
+// The registration token of the service is kept and sent with the renewals, updates, and the removal.
+// A token set in the service is used for a service registered before, e.g. by a previous run of the program.
 // It returns a function for stopping the keepalive and another function for updating the service in keepalive routine
 func RegisterServiceAndKeepalive(endpoint string, service catalog.Service, ticket *obtainer.Client) (func() error, func(catalog.Service), error) {
 	mutex := sync.RWMutex{}
+	// registered is false when the registration has to be sent
+	registered := false
 
 	client, err := NewHTTPClient(endpoint, ticket)
 	if err != nil {
 		return nil, nil, err
 	}
+	client.SetToken(service.ID, service.Token)
 
 	ticker := time.NewTicker(time.Duration(service.TTL) * time.Second)
 	go func() {
 		for ; true; <-ticker.C {
-			mutex.RLock()
+			mutex.Lock()
+			if registered {
+				_, err := client.Renew(service.ID)
+				if err == nil {
+					mutex.Unlock()
+					logger.Debugf("Renewed service registration for %s", service.ID)
+					continue
+				}
+				logger.Printf("Error renewing service registration for %s: %s", service.ID, err)
+			}
 			_, err := client.Put(&service)
 			if err != nil {
+				mutex.Unlock()
 				logger.Printf("Error updating service registration for %s: %s", service.ID, err)
 				continue
 			}
-			mutex.RUnlock()
+			registered = true
+			mutex.Unlock()
 			logger.Printf("Updated service registration for %s", service.ID)
 		}
 	}()
@@ -73,7 +93,7 @@ func RegisterServiceAndKeepalive(endpoint string, service catalog.Service, ticke
 	stop := func() error {
 		ticker.Stop()
 		mutex.RLock()
-		client.Delete(service.ID)
+		err := client.Delete(service.ID)
 		if err != nil {
 			logger.Printf("Error removing service registration for %s: %s", service.ID, err)
 		}
@@ -85,6 +105,7 @@ func RegisterServiceAndKeepalive(endpoint string, service catalog.Service, ticke
 		logger.Printf("Service registration for %s will be updated in the next heartbeat.", service.ID)
 		mutex.Lock()
 		service = updatedService
+		registered = false
 		mutex.Unlock()
 	}
 
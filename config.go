@@ -8,20 +8,34 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/url"
+	"strings"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/linksmart/go-sec/authz"
 	"github.com/linksmart/service-catalog/v3/catalog"
+	"github.com/linksmart/service-catalog/v3/federation"
 )
 
 type Config struct {
-	ID           string           `json:"id"`
-	Description  string           `json:"description"`
-	DNSSDEnabled bool             `json:"dnssdEnabled"`
-	Storage      StorageConf      `json:"storage"`
-	HTTP         HTTPConf         `json:"http"`
-	MQTT         catalog.MQTTConf `json:"mqtt"`
-	Auth         ValidatorConf    `json:"auth"`
+	ID            string                    `json:"id"`
+	Description   string                    `json:"description"`
+	DNSSDEnabled  bool                      `json:"dnssdEnabled"`
+	Storage       StorageConf               `json:"storage"`
+	Expiry        catalog.ExpiryConf        `json:"expiry"`
+	ListenerQueue catalog.ListenerQueueConf `json:"listenerQueue"`
+	HTTP          HTTPConf                  `json:"http"`
+	MQTT          catalog.MQTTConf          `json:"mqtt"`
+	Auth          ValidatorConf             `json:"auth"`
+	Backup        catalog.BackupConf        `json:"backup"`
+	Cluster       catalog.ClusterConf       `json:"cluster"`
+	Federation    federation.Conf           `json:"federation"`
+	History       catalog.HistoryConf       `json:"history"`
+	Changes       catalog.ChangesConf       `json:"changes"`
+	Health        catalog.HealthConf        `json:"health"`
+	Webhooks      catalog.WebhookConf       `json:"webhooks"`
+	Tokens        catalog.TokenConf         `json:"tokens"`
+	// Namespaces are served under /ns/<namespace> in addition to the default namespace at the root
+	Namespaces []string `json:"namespaces"`
 }
 
 func (c *Config) validate() error {
@@ -41,6 +55,56 @@ func (c *Config) validate() error {
 		return err
 	}
 
+	err = c.Backup.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.Cluster.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.Expiry.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.ListenerQueue.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.Federation.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.History.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.Changes.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.Webhooks.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.Tokens.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = c.validateNamespaces()
+	if err != nil {
+		return err
+	}
+
 	if c.Auth.Enabled {
 		// Validate ticket validator config
 		err = c.Auth.validate()
@@ -52,6 +116,34 @@ func (c *Config) validate() error {
 	return nil
 }
 
+// validateNamespaces checks the namespaces and their settings in other sections
+func (c *Config) validateNamespaces() error {
+	namespaces := make(map[string]bool)
+	for _, ns := range c.Namespaces {
+		if err := catalog.ValidateNamespace(ns); err != nil {
+			return fmt.Errorf("namespaces: %s", err)
+		}
+		if namespaces[ns] {
+			return fmt.Errorf("namespaces: duplicate namespace: %s", ns)
+		}
+		namespaces[ns] = true
+	}
+	if len(namespaces) > 0 && c.Cluster.Enabled {
+		return fmt.Errorf("namespaces: not supported in a cluster")
+	}
+	for ns := range c.MQTT.NamespaceTopicPrefixes {
+		if !namespaces[ns] {
+			return fmt.Errorf("mqtt: topic prefix of unknown namespace: %s", ns)
+		}
+	}
+	for ns := range c.Auth.NamespaceAuthz {
+		if !namespaces[ns] {
+			return fmt.Errorf("auth: authorization of unknown namespace: %s", ns)
+		}
+	}
+	return nil
+}
+
 func loadConfig(confPath string) (*Config, error) {
 	file, err := ioutil.ReadFile(confPath)
 	if err != nil {
@@ -79,6 +171,18 @@ func loadConfig(confPath string) (*Config, error) {
 type StorageConf struct {
 	Type string `json:"type"`
 	DSN  string `json:"dsn"`
+	// Indexes are the paths indexed in addition to the default ones (e.g. meta.gateway)
+	Indexes []string `json:"indexes"`
+}
+
+// forNamespace returns the configuration of the storage of a namespace
+func (c StorageConf) forNamespace(namespace string) (StorageConf, error) {
+	dsn, err := catalog.NamespaceDSN(c.DSN, namespace)
+	if err != nil {
+		return c, err
+	}
+	c.DSN = dsn
+	return c, nil
 }
 
 func (c StorageConf) validate() error {
@@ -89,6 +193,11 @@ func (c StorageConf) validate() error {
 	if err != nil {
 		return fmt.Errorf("storage: DSN should be a valid URL: %v", err)
 	}
+	for _, index := range c.Indexes {
+		if index == "" || strings.ContainsAny(index, " ") {
+			return fmt.Errorf("storage: invalid index path: %q", index)
+		}
+	}
 	return nil
 }
 
@@ -121,6 +230,29 @@ type ValidatorConf struct {
 	BasicEnabled bool `json:"basicEnabled"`
 	// Authorization config
 	Authz *authz.Conf `json:"authorization"`
+	// Authorization config of each namespace, with resources relative to the namespace, e.g. / for /ns/<namespace>
+	// The authorization config of the root applies to the namespaces without one.
+	NamespaceAuthz map[string]*authz.Conf `json:"namespaceAuthorization"`
+	// Ownership restricts updates and deletions of services to the users who created them and the admins
+	Ownership catalog.OwnershipConf `json:"ownership"`
+}
+
+// namespaceAuthz returns the authorization config of a namespace with the resources prefixed by its path
+func (c ValidatorConf) namespaceAuthz(namespace string) *authz.Conf {
+	conf, found := c.NamespaceAuthz[namespace]
+	if !found || conf == nil {
+		return c.Authz
+	}
+	prefixed := &authz.Conf{}
+	for _, rule := range conf.Rules {
+		var resources []string
+		for _, res := range rule.Resources {
+			resources = append(resources, strings.TrimSuffix(catalog.NamespacePath(namespace)+res, "/"))
+		}
+		rule.Resources = resources
+		prefixed.Rules = append(prefixed.Rules, rule)
+	}
+	return prefixed
 }
 
 func (c ValidatorConf) validate() error {
@@ -150,6 +282,14 @@ func (c ValidatorConf) validate() error {
 			return err
 		}
 	}
+	for ns, conf := range c.NamespaceAuthz {
+		if conf == nil {
+			continue
+		}
+		if err := conf.Validate(); err != nil {
+			return fmt.Errorf("%s (namespace %s)", err, ns)
+		}
+	}
 
 	return nil
 }
@@ -0,0 +1,120 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package federation
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	_ "github.com/linksmart/go-sec/auth/keycloak/obtainer"
+	"github.com/linksmart/go-sec/auth/obtainer"
+	"github.com/linksmart/service-catalog/v3/catalog"
+	"github.com/linksmart/service-catalog/v3/client"
+)
+
+// Conf is the configuration of the federation with peer catalogs
+type Conf struct {
+	// Peers are the catalogs from which services are imported. Federation is disabled if empty.
+	Peers []PeerConf `json:"peers"`
+	// Interval is the time between synchronizations in seconds
+	Interval uint `json:"interval"`
+}
+
+// PeerConf is the configuration of a peer catalog
+type PeerConf struct {
+	// URL is the endpoint of the HTTP API of the peer
+	URL string `json:"url"`
+	// Auth is the configuration of the ticket obtainer. Requests are not authenticated if nil.
+	Auth *ObtainerConf `json:"auth"`
+}
+
+// ObtainerConf is the configuration of the ticket obtainer
+type ObtainerConf struct {
+	// Authentication provider name
+	Provider string `json:"provider"`
+	// Authentication provider URL
+	ProviderURL string `json:"providerURL"`
+	// Service ID of the peer catalog
+	ServiceID string `json:"serviceID"`
+	// User credentials
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (c Conf) Validate() error {
+	if len(c.Peers) == 0 {
+		return nil
+	}
+	if c.Interval == 0 {
+		return fmt.Errorf("federation: interval not defined")
+	}
+	for _, peer := range c.Peers {
+		u, err := url.Parse(peer.URL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("federation: invalid peer url: %q", peer.URL)
+		}
+		if peer.Auth != nil && (peer.Auth.Provider == "" || peer.Auth.ProviderURL == "" || peer.Auth.ServiceID == "") {
+			return fmt.Errorf("federation: provider, providerURL and serviceID of peer %s must be defined", peer.URL)
+		}
+	}
+	return nil
+}
+
+// Start periodically imports the services of the configured peers into the controller
+// Each imported service is tagged with the id of its peer in meta.federationOrigin and is read-only.
+// When a peer cannot be reached, its services are kept until they expire.
+func Start(controller *catalog.Controller, conf Conf, localID string) {
+	for _, peer := range conf.Peers {
+		go syncPeer(controller, peer, time.Duration(conf.Interval)*time.Second, localID)
+	}
+}
+
+func syncPeer(controller *catalog.Controller, conf PeerConf, interval time.Duration, localID string) {
+	var ticket *obtainer.Client
+	if conf.Auth != nil {
+		var err error
+		ticket, err = obtainer.NewClient(conf.Auth.Provider, conf.Auth.ProviderURL, conf.Auth.Username, conf.Auth.Password, conf.Auth.ServiceID)
+		if err != nil {
+			logger.Printf("Error creating the ticket obtainer for %s: %s", conf.URL, err)
+			return
+		}
+	}
+	c, err := client.NewHTTPClient(conf.URL, ticket)
+	if err != nil {
+		logger.Printf("Error creating the client for %s: %s", conf.URL, err)
+		return
+	}
+	logger.Printf("Importing services from %s every %s", conf.URL, interval)
+
+	sync := func() {
+		peerID, err := c.CatalogID()
+		if err != nil {
+			logger.Printf("Error retrieving the id of %s: %s", conf.URL, err)
+			return
+		}
+		if peerID == "" || peerID == localID {
+			logger.Printf("Peer %s has the id %q and is not imported", conf.URL, peerID)
+			return
+		}
+		services, err := c.GetAll(nil)
+		if err != nil {
+			logger.Printf("Error retrieving the services of %s: %s", conf.URL, err)
+			return
+		}
+		result, err := controller.SyncFederated(peerID, services)
+		if err != nil {
+			logger.Printf("Error importing the services of %s: %s", conf.URL, err)
+			return
+		}
+		if result.Added+result.Updated+result.Removed > 0 {
+			logger.Printf("Imported from %s (%s): %d added, %d updated, %d removed, %d skipped",
+				peerID, conf.URL, result.Added, result.Updated, result.Removed, result.Skipped)
+		}
+	}
+
+	sync()
+	for range time.Tick(interval) {
+		sync()
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+// Package federation imports the services of peer catalogs
+// into the local catalog
+package federation
+
+import (
+	"github.com/farshidtz/elog"
+)
+
+var logger *elog.Logger
+
+func init() {
+	logger = elog.New("[federation] ", &elog.Config{
+		DebugPrefix: "[federation-debug] ",
+		DebugTrace:  elog.NoTrace,
+	})
+}
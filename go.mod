@@ -5,10 +5,14 @@ go 1.13
 require (
 	github.com/ancientlore/go-avltree v1.0.1
 	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/evanphx/json-patch v4.12.0+incompatible
 	github.com/farshidtz/elog v1.0.1
 	github.com/farshidtz/mqtt-match v1.0.1
 	github.com/gorilla/context v1.1.1
 	github.com/gorilla/mux v1.7.3
+	github.com/hashicorp/go-hclog v0.9.1
+	github.com/hashicorp/raft v1.1.1
+	github.com/hashicorp/raft-boltdb/v2 v2.0.0-20210421194847-a7e34179d62c
 	github.com/justinas/alice v0.0.0-20160512134231-052b8b6c18ed
 	github.com/kelseyhightower/envconfig v1.3.0
 	github.com/linksmart/go-sec v1.0.1
@@ -19,4 +23,6 @@ require (
 	github.com/stretchr/testify v1.5.1 // indirect
 	github.com/syndtr/goleveldb v1.0.0
 	github.com/urfave/negroni v1.0.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
 )
@@ -16,7 +16,9 @@ import (
 	"github.com/justinas/alice"
 	_ "github.com/linksmart/go-sec/auth/keycloak/validator"
 	"github.com/linksmart/go-sec/auth/validator"
+	"github.com/linksmart/go-sec/authz"
 	"github.com/linksmart/service-catalog/v3/catalog"
+	"github.com/linksmart/service-catalog/v3/federation"
 	"github.com/oleksandr/bonjour"
 	"github.com/rs/cors"
 	uuid "github.com/satori/go.uuid"
@@ -24,11 +26,17 @@ import (
 )
 
 var (
-	confPath    = flag.String("conf", "conf/service-catalog.json", "Configuration file path")
-	profile     = flag.Int("profile", 0, "Activate runtime profiling HTTP server on the given port")
-	version     = flag.Bool("version", false, "Print the API version")
-	Version     string // set with build flag
-	BuildNumber string // set with build flag
+	confPath = flag.String("conf", "conf/service-catalog.json", "Configuration file path")
+	profile  = flag.Int("profile", 0, "Activate runtime profiling HTTP server on the given port")
+	version  = flag.Bool("version", false, "Print the API version")
+	// Export, import
+	exportPath     = flag.String("export", "", "Export the services of the configured storage to the given NDJSON file and exit")
+	exportURL      = flag.String("export-url", "", "Export from the catalog running at the given endpoint instead of the configured storage")
+	importPath     = flag.String("import", "", "Import services from the given NDJSON file into the configured storage and exit")
+	importPolicy   = flag.String("import-policy", catalog.ImportPolicyFail, "Policy for imported services with existing ids: skip, overwrite, or fail")
+	importValidate = flag.Bool("import-validate", true, "Validate the imported services")
+	Version        string // set with build flag
+	BuildNumber    string // set with build flag
 )
 
 const LINKSMART = `
@@ -43,6 +51,15 @@ func main() {
 		fmt.Println(Version)
 		return
 	}
+	// Export from a running catalog
+	if *exportPath != "" && *exportURL != "" {
+		err := exportFromEndpoint(*exportURL, *exportPath)
+		if err != nil {
+			logger.Fatalf("Error exporting from %s: %s", *exportURL, err)
+		}
+		return
+	}
+
 	fmt.Print(LINKSMART)
 	logger.Printf("Starting Service Catalog")
 
@@ -68,33 +85,83 @@ func main() {
 	}
 
 	// Setup storage
-	var storage catalog.Storage
+	storage, err := setupStorage(config.Storage)
+	if err != nil {
+		logger.Fatalln(err)
+	}
 
-	switch config.Storage.Type {
-	case catalog.CatalogBackendMemory:
-		storage = catalog.NewMemoryStorage()
-	case catalog.CatalogBackendLevelDB:
-		storage, err = catalog.NewLevelDBStorage(config.Storage.DSN, nil)
+	// Export or import offline
+	if *exportPath != "" || *importPath != "" {
+		if *exportPath != "" {
+			err = exportFromStorage(storage, *exportPath)
+		} else {
+			err = importToStorage(storage, *importPath, *importPolicy, *importValidate)
+		}
+		if closeErr := storage.Close(); closeErr != nil {
+			logger.Println(closeErr.Error())
+		}
 		if err != nil {
-			logger.Fatalf("Failed to start LevelDB storage: %s", err)
+			logger.Fatalf("Error: %s", err)
 		}
-	default:
-		logger.Fatalf("Could not create catalog API storage. Unsupported type: %v", config.Storage.Type)
+		return
 	}
 
-	var listeners []catalog.Listener
-	controller, err := catalog.NewController(storage, listeners...)
+	// Replicate the storage among the nodes of the cluster
+	if config.Cluster.Enabled {
+		raftStorage, err := catalog.NewRaftStorage(storage, config.Cluster)
+		if err != nil {
+			storage.Close()
+			logger.Fatalf("Failed to join the cluster: %s", err)
+		}
+		storage = raftStorage
+	}
+
+	controller, err := startController(storage, config)
 	if err != nil {
-		storage.Close()
-		logger.Fatalf("Failed to start the controller: %s", err)
+		logger.Fatalln(err)
+	}
+
+	// Start the catalog of each namespace with a separate storage
+	var namespaces []namespace
+	for _, name := range config.Namespaces {
+		storageConf, err := config.Storage.forNamespace(name)
+		if err != nil {
+			logger.Fatalf("Namespace %s: %s", name, err)
+		}
+		nsStorage, err := setupStorage(storageConf)
+		if err != nil {
+			logger.Fatalf("Namespace %s: %s", name, err)
+		}
+		nsController, err := startController(nsStorage, config)
+		if err != nil {
+			logger.Fatalf("Namespace %s: %s", name, err)
+		}
+		namespaces = append(namespaces, namespace{
+			name:       name,
+			controller: nsController,
+			httpAPI:    catalog.NewNamespaceHTTPAPI(nsController, name, config.ID, config.Description, Version),
+		})
+		logger.Printf("Started namespace %s at %s", name, catalog.NamespacePath(name))
 	}
 
 	// Create http api
 	httpAPI := catalog.NewHTTPAPI(controller, config.ID, config.Description, Version)
-	go serveHTTP(httpAPI, config)
+	go serveHTTP(httpAPI, namespaces, config)
 
 	// Create mqtt api
 	go catalog.StartMQTTManager(controller, config.MQTT, config.ID)
+	for _, ns := range namespaces {
+		go catalog.StartMQTTManager(ns.controller, config.MQTT.ForNamespace(ns.name), config.ID)
+	}
+
+	// Start periodic backups
+	go catalog.StartBackups(controller, config.Backup)
+	for _, ns := range namespaces {
+		go catalog.StartBackups(ns.controller, config.Backup.ForNamespace(ns.name))
+	}
+
+	// Import services from peer catalogs
+	federation.Start(controller, config.Federation, config.ID)
 
 	// Announce service using DNS-SD
 	var bonjourS *bonjour.Server
@@ -124,11 +191,86 @@ func main() {
 	if err != nil {
 		logger.Println(err.Error())
 	}
+	for _, ns := range namespaces {
+		err = ns.controller.Stop()
+		if err != nil {
+			logger.Printf("Namespace %s: %s", ns.name, err)
+		}
+	}
 
 	logger.Println("Stopped")
 }
 
-func serveHTTP(httpAPI *catalog.HttpAPI, config *Config) {
+// namespace is the catalog of a namespace
+type namespace struct {
+	name       string
+	controller *catalog.Controller
+	httpAPI    *catalog.HttpAPI
+}
+
+// startController starts a controller with the configured features on the storage
+func startController(storage catalog.Storage, config *Config) (*catalog.Controller, error) {
+	var listeners []catalog.Listener
+	controller, err := catalog.NewController(storage, catalog.ControllerConf{
+		Expiry:        config.Expiry,
+		ListenerQueue: config.ListenerQueue,
+	}, listeners...)
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("Failed to start the controller: %s", err)
+	}
+	// Record the changes of services
+	controller.EnableHistory(config.History)
+	// Keep the change feed for incremental sync
+	err = controller.EnableChanges(config.Changes)
+	if err != nil {
+		controller.Stop()
+		return nil, fmt.Errorf("Failed to enable the change feed: %s", err)
+	}
+	// Check the APIs of the services
+	controller.EnableHealthChecks(config.Health)
+	// Deliver the changes to the webhook subscriptions
+	controller.EnableWebhooks(config.Webhooks)
+	// Restrict the modification of services to their owners
+	if config.Auth.Enabled {
+		controller.EnableOwnership(config.Auth.Ownership)
+	}
+	// Require the registration tokens for the modification of services
+	controller.EnableTokens(config.Tokens)
+
+	return controller, nil
+}
+
+func setupStorage(conf StorageConf) (catalog.Storage, error) {
+	switch conf.Type {
+	case catalog.CatalogBackendMemory:
+		if conf.DSN == "" {
+			return catalog.NewMemoryStorage(conf.Indexes...), nil
+		}
+		// persist the mutations in the data directory given as DSN
+		storage, err := catalog.NewDurableMemoryStorage(conf.DSN, conf.Indexes...)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start durable memory storage: %s", err)
+		}
+		return storage, nil
+	case catalog.CatalogBackendLevelDB:
+		storage, err := catalog.NewLevelDBStorage(conf.DSN, nil, conf.Indexes...)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start LevelDB storage: %s", err)
+		}
+		return storage, nil
+	case catalog.CatalogBackendBolt:
+		storage, err := catalog.NewBoltStorage(conf.DSN, nil, conf.Indexes...)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start Bolt storage: %s", err)
+		}
+		return storage, nil
+	default:
+		return nil, fmt.Errorf("Could not create catalog API storage. Unsupported type: %v", conf.Type)
+	}
+}
+
+func serveHTTP(httpAPI *catalog.HttpAPI, namespaces []namespace, config *Config) {
 
 	commonHandlers := alice.New(
 		context.ClearHandler,
@@ -136,21 +278,31 @@ func serveHTTP(httpAPI *catalog.HttpAPI, config *Config) {
 		//commonHeaders,
 		cors.AllowAll().Handler,
 	)
+	// handlers of each namespace, which differ from the common ones by their authorization
+	namespaceHandlers := make(map[string]alice.Chain)
 
 	// Append auth handler if enabled
 	if config.Auth.Enabled {
 		// Setup ticket validator
-		v, err := validator.Setup(
-			config.Auth.Provider,
-			config.Auth.ProviderURL,
-			config.Auth.ServiceID,
-			config.Auth.BasicEnabled,
-			config.Auth.Authz)
-		if err != nil {
-			logger.Fatalln(err)
+		setupValidator := func(authzConf *authz.Conf) alice.Chain {
+			v, err := validator.Setup(
+				config.Auth.Provider,
+				config.Auth.ProviderURL,
+				config.Auth.ServiceID,
+				config.Auth.BasicEnabled,
+				authzConf)
+			if err != nil {
+				logger.Fatalln(err)
+			}
+			return commonHandlers.Append(newAuthHandler(config.Auth, v, authzConf).Handler)
 		}
 
-		commonHandlers = commonHandlers.Append(v.Handler)
+		for _, ns := range namespaces {
+			if _, found := config.Auth.NamespaceAuthz[ns.name]; found {
+				namespaceHandlers[ns.name] = setupValidator(config.Auth.namespaceAuthz(ns.name))
+			}
+		}
+		commonHandlers = setupValidator(config.Auth.Authz)
 	}
 
 	// Configure http router
@@ -159,15 +311,22 @@ func serveHTTP(httpAPI *catalog.HttpAPI, config *Config) {
 	r.get("/health", commonHandlers.ThenFunc(healthHandler))
 	r.options("/{path:.*}", commonHandlers.ThenFunc(optionsHandler))
 
-	// service handlers
-	r.get("/", commonHandlers.ThenFunc(httpAPI.List))
-	r.post("/", commonHandlers.ThenFunc(httpAPI.Post))
-	// Accept an id with zero or one slash: [^/]+/?[^/]*
-	// -> [^/]+ one or more of anything but slashes /? optional slash [^/]* zero or more of anything but slashes
-	r.get("/{id:[^/]+/?[^/]*}", commonHandlers.ThenFunc(httpAPI.Get))
-	r.put("/{id:[^/]+/?[^/]*}", commonHandlers.ThenFunc(httpAPI.Put))
-	r.delete("/{id:[^/]+/?[^/]*}", commonHandlers.ThenFunc(httpAPI.Delete))
-	r.get("/{path}/{op}/{value:.*}", commonHandlers.ThenFunc(httpAPI.Filter))
+	// cluster handlers
+	if config.Cluster.Enabled {
+		r.get(catalog.ClusterPath, commonHandlers.ThenFunc(httpAPI.ClusterStatus))
+		// forwarded mutations are authenticated with the cluster secret
+		r.post(catalog.ClusterApplyPath, alice.New(context.ClearHandler, loggingHandler).ThenFunc(httpAPI.ClusterApply))
+	}
+
+	// namespaces, registered before the root whose service ids would match the same paths
+	for _, ns := range namespaces {
+		handlers, found := namespaceHandlers[ns.name]
+		if !found {
+			handlers = commonHandlers
+		}
+		r.catalog(catalog.NamespacePath(ns.name), ns.httpAPI, handlers)
+	}
+	r.catalog("", httpAPI, commonHandlers)
 
 	// Configure the middleware
 	n := negroni.New(
@@ -0,0 +1,85 @@
+// Copyright 2014-2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"github.com/linksmart/service-catalog/v3/catalog"
+	"github.com/linksmart/service-catalog/v3/client"
+)
+
+// exportFromStorage writes the services of the storage to an NDJSON file
+func exportFromStorage(storage catalog.Storage, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	n, err := catalog.Export(storage, w)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	logger.Printf("Exported %d services to %s", n, path)
+	return f.Close()
+}
+
+// exportFromEndpoint writes the services of a running catalog to an NDJSON file
+func exportFromEndpoint(endpoint, path string) error {
+	c, err := client.NewHTTPClient(endpoint, nil)
+	if err != nil {
+		return err
+	}
+	services, err := c.GetAll(nil)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	encoder := json.NewEncoder(w)
+	for i := range services {
+		err = encoder.Encode(services[i])
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	logger.Printf("Exported %d services from %s to %s", len(services), endpoint, path)
+	return f.Close()
+}
+
+// importToStorage loads the services of an NDJSON file into the storage
+func importToStorage(storage catalog.Storage, path, policy string, validate bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	result, err := catalog.Import(storage, f, policy, validate)
+	if result != nil {
+		logger.Printf("Imported services from %s: %d added, %d overwritten, %d skipped", path, result.Added, result.Overwritten, result.Skipped)
+	}
+	return err
+}
@@ -5,12 +5,19 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/justinas/alice"
+	"github.com/linksmart/service-catalog/v3/catalog"
+	"github.com/linksmart/service-catalog/v3/utils"
 	"github.com/urfave/negroni"
 )
 
+// filterOps is the pattern of the operators in filter paths
+var filterOps = strings.Join([]string{utils.FOpEquals, utils.FOpPrefix, utils.FOpSuffix, utils.FOpContains}, "|")
+
 type router struct {
 	*mux.Router
 }
@@ -54,6 +61,54 @@ func (r *router) options(path string, handler http.Handler) {
 	r.Methods("OPTIONS").Path(fmt.Sprintf("%s/", path)).Handler(handler)
 }
 
+// catalog registers the routes of the catalog API under a path prefix, which is empty for the root
+func (r *router) catalog(prefix string, httpAPI *catalog.HttpAPI, handlers alice.Chain) {
+	path := func(p string) string {
+		if p == "/" && prefix != "" {
+			return prefix
+		}
+		return prefix + p
+	}
+
+	// admin handlers, registered before the service ids which would match the same paths
+	r.get(path("/admin/backup"), handlers.ThenFunc(httpAPI.Backup))
+	r.post(path("/admin/restore"), handlers.ThenFunc(httpAPI.Restore))
+	r.get(path("/admin/listeners"), handlers.ThenFunc(httpAPI.ListenerQueues))
+	r.post(path("/admin/query"), handlers.ThenFunc(httpAPI.Query))
+
+	// event streams, registered before the service ids which would match the same paths
+	r.get(path("/events"), handlers.ThenFunc(httpAPI.Events))
+	r.get(path("/events/{path}/{op}/{value:.*}"), handlers.ThenFunc(httpAPI.Events))
+
+	// change feed, registered before the service ids which would match the same path
+	r.get(path("/changes"), handlers.ThenFunc(httpAPI.Changes))
+
+	// webhook subscriptions, registered before the service ids which would match the same paths
+	r.get(path("/subscriptions"), handlers.ThenFunc(httpAPI.ListSubscriptions))
+	r.post(path("/subscriptions"), handlers.ThenFunc(httpAPI.PostSubscription))
+	r.get(path("/subscriptions/{sid}"), handlers.ThenFunc(httpAPI.GetSubscription))
+	r.delete(path("/subscriptions/{sid}"), handlers.ThenFunc(httpAPI.DeleteSubscription))
+	r.get(path("/subscriptions/{sid}/deadletters"), handlers.ThenFunc(httpAPI.DeadLetters))
+	r.delete(path("/subscriptions/{sid}/deadletters"), handlers.ThenFunc(httpAPI.ClearDeadLetters))
+
+	// service handlers
+	r.get(path("/"), handlers.ThenFunc(httpAPI.List))
+	r.post(path("/"), handlers.ThenFunc(httpAPI.Post))
+	r.post(path("/batch"), handlers.ThenFunc(httpAPI.Batch))
+	// Accept an id with zero or one slash: [^/]+/?[^/]*
+	// -> [^/]+ one or more of anything but slashes /? optional slash [^/]* zero or more of anything but slashes
+	// filters with a known operator would otherwise match the history of an id with one slash
+	r.get(path("/{path}/{op:"+filterOps+"}/{value:.*}"), handlers.ThenFunc(httpAPI.Filter))
+	r.get(path("/{id:[^/]+/?[^/]*}/history"), handlers.ThenFunc(httpAPI.History))
+	r.get(path("/{id:[^/]+/?[^/]*}"), handlers.ThenFunc(httpAPI.Get))
+	r.put(path("/{id:[^/]+/?[^/]*}/owner"), handlers.ThenFunc(httpAPI.TransferOwnership))
+	r.put(path("/{id:[^/]+/?[^/]*}"), handlers.ThenFunc(httpAPI.Put))
+	r.patch(path("/{id:[^/]+/?[^/]*}"), handlers.ThenFunc(httpAPI.Patch))
+	r.delete(path("/{id:[^/]+/?[^/]*}"), handlers.ThenFunc(httpAPI.Delete))
+	r.post(path("/{id:[^/]+/?[^/]*}/renew"), handlers.ThenFunc(httpAPI.Renew))
+	r.get(path("/{path}/{op}/{value:.*}"), handlers.ThenFunc(httpAPI.Filter))
+}
+
 // Add headers to handler's chain
 /*func commonHeaders(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
@@ -3,6 +3,7 @@
 package utils
 
 import (
+	"encoding/base64"
 	"fmt"
 	"strconv"
 )
@@ -10,6 +11,7 @@ import (
 const (
 	GetParamPage    = "page"
 	GetParamPerPage = "per_page"
+	GetParamCursor  = "cursor"
 )
 
 // Returns a 'slice' of the given slice based on the requested 'page'
@@ -106,3 +108,17 @@ func ParsePagingParams(page, perPage string, maxPerPage int) (int, int, error) {
 
 	return parsedPage, parsedPerPage, ValidatePagingParams(parsedPage, parsedPerPage, maxPerPage)
 }
+
+// Encodes a position (e.g. the last key of a page) into an opaque pagination cursor
+func EncodeCursor(position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// Decodes a pagination cursor into the position it was created from
+func DecodeCursor(cursor string) (string, error) {
+	position, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("Invalid value for parameter %s: %s", GetParamCursor, cursor)
+	}
+	return string(position), nil
+}
@@ -39,6 +39,8 @@ func recursiveMatch(data interface{}, path []string) interface{} {
 				return recursiveMatch(v, path)
 			}
 		}
+	case nil:
+		// path does not exist
 	default:
 		logger.Println("Unknown type for", data)
 	}
@@ -46,22 +48,44 @@ func recursiveMatch(data interface{}, path []string) interface{} {
 	return nil
 }
 
+// MatchObject checks whether the value at the given path of the object's JSON representation
+// matches the value based on the filter operation
 func MatchObject(object interface{}, path []string, op string, value string) (bool, error) {
-	var m interface{}
-	b, err := json.Marshal(object)
+	v, err := ObjectValue(object, path)
 	if err != nil {
-		return false, errors.New("unable to parse object into JSON")
+		return false, err
 	}
-	json.Unmarshal(b, &m)
 
 	// check if the path exists
-	v := recursiveMatch(m, path)
 	if v == nil {
 		return false, nil
 	}
 
+	return MatchValue(v, op, value)
+}
+
+// ObjectValue returns the value at the given path of the object's JSON representation
+// It returns nil if the path does not exist
+func ObjectValue(object interface{}, path []string) (interface{}, error) {
+	var m interface{}
+	b, err := json.Marshal(object)
+	if err != nil {
+		return nil, errors.New("unable to parse object into JSON")
+	}
+	json.Unmarshal(b, &m)
+
+	return recursiveMatch(m, path), nil
+}
+
+// NormalizeValue converts a value to the lower-case string which is used for filtering
+func NormalizeValue(v interface{}) string {
+	return strings.ToLower(fmt.Sprint(v))
+}
+
+// MatchValue checks whether the value matches the given value based on the filter operation
+func MatchValue(v interface{}, op string, value string) (bool, error) {
 	// convert everything to lower-case string
-	stringValue := strings.ToLower(fmt.Sprint(v))
+	stringValue := NormalizeValue(v)
 	value = strings.ToLower(value)
 
 	switch op {
@@ -90,6 +114,15 @@ func MatchObject(object interface{}, path []string, op string, value string) (bo
 			return false, nil
 		}
 	}
-	return false, fmt.Errorf("unknown filter operation: %s. Should be either of %v", op,
+	return false, ValidateFilterOp(op)
+}
+
+// ValidateFilterOp returns an error if the filter operation is not supported
+func ValidateFilterOp(op string) error {
+	switch op {
+	case FOpEquals, FOpPrefix, FOpSuffix, FOpContains:
+		return nil
+	}
+	return fmt.Errorf("unknown filter operation: %s. Should be either of %v", op,
 		strings.Join([]string{FOpEquals, FOpPrefix, FOpSuffix, FOpContains}, ", "))
 }